@@ -0,0 +1,299 @@
+// Mgmt
+// Copyright (C) 2013-2016+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package journal provides a persistent, append-only record of what the engine
+// did, stored as json lines on disk and rotated by size.
+package journal
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	errwrap "github.com/pkg/errors"
+)
+
+const (
+	// DefaultFileName is the name of the active journal file.
+	DefaultFileName = "journal.log"
+	// DefaultMaxSize is the size in bytes after which the journal rotates.
+	DefaultMaxSize = 10 * 1024 * 1024
+	// DefaultMaxFiles is the number of rotated journal files that we keep.
+	DefaultMaxFiles = 5
+)
+
+// The different types of entries that are stored in the journal.
+const (
+	EntryCheckApplyStart = "checkapply-start" // a CheckApply is about to run
+	EntryCheckApplyEnd   = "checkapply-end"   // a CheckApply has finished
+	EntrySendRecv        = "sendrecv"         // values were received
+	EntryRefresh         = "refresh"          // a refresh notification is acted on
+	EntryGraph           = "graph"            // a new graph was swapped in
+)
+
+// Entry is a single record in the journal.
+type Entry struct {
+	Time     time.Time `json:"time"`
+	Type     string    `json:"type"`
+	Kind     string    `json:"kind,omitempty"`
+	Name     string    `json:"name,omitempty"`
+	Apply    bool      `json:"apply,omitempty"`    // did CheckApply run with apply?
+	CheckOK  bool      `json:"checkok,omitempty"`  // was the state already okay?
+	Error    string    `json:"error,omitempty"`    // the error, if any
+	Duration float64   `json:"duration,omitempty"` // in seconds
+	Version  uint64    `json:"version,omitempty"`  // graph version
+	Message  string    `json:"message,omitempty"`  // additional information
+}
+
+// String returns a human readable, single line version of the entry.
+func (obj *Entry) String() string {
+	s := fmt.Sprintf("%s %s", obj.Time.Format(time.RFC3339Nano), obj.Type)
+	if obj.Kind != "" || obj.Name != "" {
+		s += fmt.Sprintf(" %s[%s]", obj.Kind, obj.Name)
+	}
+	switch obj.Type {
+	case EntryCheckApplyStart:
+		s += fmt.Sprintf(": apply: %t", obj.Apply)
+	case EntryCheckApplyEnd:
+		result := "changed"
+		if obj.Error != "" {
+			result = "error: " + obj.Error
+		} else if obj.CheckOK {
+			result = "ok"
+		} else if !obj.Apply {
+			result = "would change"
+		}
+		s += fmt.Sprintf(": %s (%.4fs)", result, obj.Duration)
+	case EntryGraph:
+		s += fmt.Sprintf(": version: %d", obj.Version)
+	}
+	if obj.Message != "" {
+		s += fmt.Sprintf(": %s", obj.Message)
+	}
+	return s
+}
+
+// Journal is an append-only json lines file which rotates when it gets too
+// big. Run Init() on it before use. All of its methods are safe to call on a
+// nil journal, in which case they do nothing, so that it can be disabled.
+type Journal struct {
+	Dir      string // directory where the journal files are stored
+	MaxSize  int64  // rotate after this many bytes, 0 for the default
+	MaxFiles int    // number of rotated files to keep, 0 for the default
+
+	mutex *sync.Mutex
+	file  *os.File
+	size  int64 // current size of the active file
+}
+
+// Init opens the journal for writing.
+func (obj *Journal) Init() error {
+	if obj.Dir == "" {
+		return fmt.Errorf("The journal Dir must not be empty!")
+	}
+	if obj.MaxSize <= 0 {
+		obj.MaxSize = DefaultMaxSize
+	}
+	if obj.MaxFiles <= 0 {
+		obj.MaxFiles = DefaultMaxFiles
+	}
+	obj.mutex = &sync.Mutex{}
+	if err := os.MkdirAll(obj.Dir, 0770); err != nil {
+		return errwrap.Wrapf(err, "can't create journal dir")
+	}
+	return obj.open()
+}
+
+// open opens the active journal file for appending.
+func (obj *Journal) open() error {
+	file, err := os.OpenFile(path.Join(obj.Dir, DefaultFileName), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0660)
+	if err != nil {
+		return errwrap.Wrapf(err, "can't open journal")
+	}
+	st, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return errwrap.Wrapf(err, "can't stat journal")
+	}
+	obj.file = file
+	obj.size = st.Size()
+	return nil
+}
+
+// rotate moves the active file to the first rotated slot, shifts all the older
+// ones down by one, drops the oldest, and then opens a new active file.
+func (obj *Journal) rotate() error {
+	if err := obj.file.Close(); err != nil {
+		return err
+	}
+	base := path.Join(obj.Dir, DefaultFileName)
+	os.Remove(fmt.Sprintf("%s.%d", base, obj.MaxFiles)) // drop the oldest
+	for i := obj.MaxFiles - 1; i >= 1; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", base, i), fmt.Sprintf("%s.%d", base, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(base, base+".1"); err != nil {
+		return err
+	}
+	return obj.open()
+}
+
+// Write appends an entry to the journal. If the entry has no time, it is set.
+func (obj *Journal) Write(entry *Entry) error {
+	if obj == nil {
+		return nil // disabled
+	}
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	obj.mutex.Lock()
+	defer obj.mutex.Unlock()
+	if obj.file == nil {
+		return fmt.Errorf("The journal is closed!")
+	}
+	if obj.size > 0 && obj.size+int64(len(data)) > obj.MaxSize {
+		if err := obj.rotate(); err != nil {
+			return errwrap.Wrapf(err, "can't rotate journal")
+		}
+	}
+	n, err := obj.file.Write(data)
+	obj.size += int64(n)
+	return err
+}
+
+// Close closes the journal.
+func (obj *Journal) Close() error {
+	if obj == nil {
+		return nil
+	}
+	obj.mutex.Lock()
+	defer obj.mutex.Unlock()
+	if obj.file == nil {
+		return nil
+	}
+	err := obj.file.Close()
+	obj.file = nil
+	return err
+}
+
+// Filter selects which entries are returned by Query. Empty fields match all.
+type Filter struct {
+	Kind  string
+	Name  string
+	Type  string
+	Since time.Time
+	Until time.Time
+}
+
+// Match returns true if the entry is selected by the filter.
+func (obj *Filter) Match(entry *Entry) bool {
+	if obj.Kind != "" && !strings.EqualFold(obj.Kind, entry.Kind) {
+		return false
+	}
+	if obj.Name != "" && obj.Name != entry.Name {
+		return false
+	}
+	if obj.Type != "" && obj.Type != entry.Type {
+		return false
+	}
+	if !obj.Since.IsZero() && entry.Time.Before(obj.Since) {
+		return false
+	}
+	if !obj.Until.IsZero() && entry.Time.After(obj.Until) {
+		return false
+	}
+	return true
+}
+
+// files returns the list of journal files in the dir, from oldest to newest.
+func files(dir string) ([]string, error) {
+	base := path.Join(dir, DefaultFileName)
+	matches, err := filepath.Glob(base + ".*")
+	if err != nil {
+		return nil, err
+	}
+	rotated := make(map[int]string)
+	keys := []int{}
+	for _, m := range matches {
+		i, err := strconv.Atoi(strings.TrimPrefix(m, base+"."))
+		if err != nil {
+			continue // not one of ours
+		}
+		rotated[i] = m
+		keys = append(keys, i)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(keys))) // the biggest is the oldest
+	result := []string{}
+	for _, i := range keys {
+		result = append(result, rotated[i])
+	}
+	return append(result, base), nil
+}
+
+// Query reads all the journal files in the dir, and returns the entries which
+// match the filter, from oldest to newest. Invalid lines are skipped.
+func Query(dir string, filter *Filter) ([]*Entry, error) {
+	if filter == nil {
+		filter = &Filter{}
+	}
+	names, err := files(dir)
+	if err != nil {
+		return nil, err
+	}
+	entries := []*Entry{}
+	for _, name := range names {
+		file, err := os.Open(name)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024) // allow long lines
+		for scanner.Scan() {
+			entry := &Entry{}
+			if err := json.Unmarshal(scanner.Bytes(), entry); err != nil {
+				continue // probably a partial write
+			}
+			if filter.Match(entry) {
+				entries = append(entries, entry)
+			}
+		}
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			return nil, errwrap.Wrapf(err, "can't read journal file: %s", name)
+		}
+	}
+	return entries, nil
+}
@@ -0,0 +1,186 @@
+// Mgmt
+// Copyright (C) 2013-2016+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package journal
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+// tempJournal returns an initialized journal in a temp dir, which is removed
+// by the returned function.
+func tempJournal(t *testing.T, maxSize int64, maxFiles int) (*Journal, func()) {
+	dir, err := ioutil.TempDir("", "mgmt-journal-")
+	if err != nil {
+		t.Fatalf("Can't create temp dir: %v", err)
+	}
+	j := &Journal{Dir: dir, MaxSize: maxSize, MaxFiles: maxFiles}
+	if err := j.Init(); err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("Init failed: %v", err)
+	}
+	return j, func() {
+		j.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestJournal1(t *testing.T) {
+	j, cleanup := tempJournal(t, 0, 0)
+	defer cleanup()
+
+	start := time.Date(2017, time.March, 1, 10, 0, 0, 0, time.UTC)
+	for i, entry := range []*Entry{
+		{Type: EntryGraph, Version: 1},
+		{Type: EntryCheckApplyStart, Kind: "File", Name: "f1", Apply: true},
+		{Type: EntryCheckApplyEnd, Kind: "File", Name: "f1", Apply: true, Duration: 0.5},
+		{Type: EntryCheckApplyEnd, Kind: "Svc", Name: "web", Error: "failed"},
+	} {
+		entry.Time = start.Add(time.Duration(i) * time.Minute)
+		if err := j.Write(entry); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	if err := j.Write(&Entry{Type: EntryRefresh}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	// a partial write, such as after a crash, is skipped
+	f, err := os.OpenFile(path.Join(j.Dir, DefaultFileName), os.O_WRONLY|os.O_APPEND, 0660)
+	if err != nil {
+		t.Fatalf("Can't open the journal: %v", err)
+	}
+	f.WriteString(`{"time":"2017-`)
+	f.Close()
+
+	for _, x := range []struct {
+		filter *Filter
+		n      int
+	}{
+		{nil, 5},
+		{&Filter{Kind: "file"}, 2},
+		{&Filter{Kind: "File", Type: EntryCheckApplyEnd}, 1},
+		{&Filter{Name: "web"}, 1},
+		{&Filter{Since: start.Add(time.Minute), Until: start.Add(2 * time.Minute)}, 2},
+		{&Filter{Until: start.Add(-time.Minute)}, 0},
+	} {
+		entries, err := Query(j.Dir, x.filter)
+		if err != nil {
+			t.Errorf("Query(%+v) failed: %v", x.filter, err)
+			continue
+		}
+		if len(entries) != x.n {
+			t.Errorf("Query(%+v) returned %d entries, expected: %d", x.filter, len(entries), x.n)
+		}
+	}
+
+	entries, _ := Query(j.Dir, nil)
+	if e := entries[len(entries)-1]; e.Time.IsZero() || e.Time.Before(start) {
+		t.Errorf("The time of the entry wasn't set: %v", e.Time)
+	}
+	if e := entries[3]; e.Error != "failed" || e.Kind != "Svc" || !e.Time.Equal(start.Add(3*time.Minute)) {
+		t.Errorf("Wrong entry: %+v", e)
+	}
+
+	if err := j.Close(); err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+	if err := j.Write(&Entry{Type: EntryRefresh}); err == nil {
+		t.Errorf("Write should fail once closed")
+	}
+}
+
+func TestJournalRotate1(t *testing.T) {
+	j, cleanup := tempJournal(t, 100, 2)
+	defer cleanup()
+
+	for i := 0; i < 10; i++ { // each entry is about 70 bytes, so one per file
+		if err := j.Write(&Entry{Type: EntryRefresh, Message: fmt.Sprintf("%d", i)}); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	names, err := files(j.Dir)
+	if err != nil {
+		t.Fatalf("Can't list the files: %v", err)
+	}
+	if len(names) != 3 { // the active file and the rotated ones
+		t.Errorf("Wrong files: %v", names)
+	}
+	entries, err := Query(j.Dir, nil)
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	messages := ""
+	for _, e := range entries {
+		messages += e.Message
+	}
+	if messages != "789" { // the oldest were dropped, and the order is kept
+		t.Errorf("Wrong entries: %s", messages)
+	}
+
+	// the journal appends to the active file when it's opened again
+	j.Close()
+	j2 := &Journal{Dir: j.Dir, MaxSize: 100, MaxFiles: 2}
+	if err := j2.Init(); err != nil {
+		t.Fatalf("Init failed: %v", err)
+	}
+	defer j2.Close()
+	if err := j2.Write(&Entry{Type: EntryRefresh, Message: "10"}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if entries, _ := Query(j.Dir, nil); len(entries) != 3 || entries[0].Message != "8" {
+		t.Errorf("The journal didn't rotate after it was opened again: %d entries", len(entries))
+	}
+}
+
+func TestJournalNil1(t *testing.T) {
+	var j *Journal // disabled
+	if err := j.Write(&Entry{Type: EntryRefresh}); err != nil {
+		t.Errorf("Write failed: %v", err)
+	}
+	if err := j.Close(); err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+	if err := (&Journal{}).Init(); err == nil {
+		t.Errorf("Init should fail without a dir")
+	}
+}
+
+func TestEntryString1(t *testing.T) {
+	now := time.Date(2017, time.March, 1, 10, 0, 0, 0, time.UTC)
+	for _, x := range []struct {
+		entry *Entry
+		s     string
+	}{
+		{&Entry{Type: EntryGraph, Version: 3}, "graph: version: 3"},
+		{&Entry{Type: EntryCheckApplyStart, Kind: "File", Name: "f1"}, "checkapply-start File[f1]: apply: false"},
+		{&Entry{Type: EntryCheckApplyEnd, Kind: "File", Name: "f1", Apply: true, Duration: 0.5}, "checkapply-end File[f1]: changed (0.5000s)"},
+		{&Entry{Type: EntryCheckApplyEnd, Kind: "File", Name: "f1", CheckOK: true}, "checkapply-end File[f1]: ok (0.0000s)"},
+		{&Entry{Type: EntryCheckApplyEnd, Kind: "File", Name: "f1"}, "checkapply-end File[f1]: would change (0.0000s)"},
+		{&Entry{Type: EntryCheckApplyEnd, Kind: "Svc", Name: "web", Apply: true, Error: "boom"}, "checkapply-end Svc[web]: error: boom (0.0000s)"},
+		{&Entry{Type: EntrySendRecv, Kind: "File", Name: "f1", Message: "Content"}, "sendrecv File[f1]: Content"},
+	} {
+		x.entry.Time = now
+		if s := x.entry.String(); s != "2017-03-01T10:00:00Z "+x.s {
+			t.Errorf("Wrong string: %s, expected: %s", s, x.s)
+		}
+	}
+}
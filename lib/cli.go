@@ -84,10 +84,12 @@ func run(c *cli.Context) error {
 
 	obj.NoWatch = c.Bool("no-watch")
 	obj.Noop = c.Bool("noop")
+	obj.Report = c.String("report")
 	obj.Graphviz = c.String("graphviz")
 	obj.GraphvizFilter = c.String("graphviz-filter")
 	obj.ConvergedTimeout = c.Int("converged-timeout")
 	obj.MaxRuntime = uint(c.Int("max-runtime"))
+	obj.MaxParallel = uint16(c.Int("max-parallel"))
 
 	obj.Seeds = c.StringSlice("seeds")
 	obj.ClientURLs = c.StringSlice("client-urls")
@@ -117,6 +119,11 @@ func run(c *cli.Context) error {
 
 	obj.Prometheus = c.Bool("prometheus")
 	obj.PrometheusListen = c.String("prometheus-listen")
+	obj.Dashboard = c.Bool("dashboard")
+
+	obj.NoJournal = c.Bool("no-journal")
+	obj.JournalMaxSize = int64(c.Int("journal-max-size")) * 1024 * 1024
+	obj.JournalMaxFiles = c.Int("journal-max-files")
 
 	// install the exit signal handler
 	exit := make(chan struct{})
@@ -228,6 +235,11 @@ func CLI(program, version string, flags Flags) error {
 					Name:  "noop",
 					Usage: "globally force all resources into no-op mode",
 				},
+				cli.StringFlag{
+					Name:  "report",
+					Value: "",
+					Usage: "print a report of the noop changes after converging (json or text)",
+				},
 				cli.StringFlag{
 					Name:  "graphviz, g",
 					Value: "",
@@ -250,6 +262,12 @@ func CLI(program, version string, flags Flags) error {
 					Usage:  "exit after a maximum of approximately this many seconds",
 					EnvVar: "MGMT_MAX_RUNTIME",
 				},
+				cli.IntFlag{
+					Name:   "max-parallel",
+					Value:  0,
+					Usage:  "maximum number of CheckApply's to run in parallel; 0 for unlimited",
+					EnvVar: "MGMT_MAX_PARALLEL",
+				},
 
 				// if empty, it will startup a new server
 				cli.StringSliceFlag{
@@ -332,6 +350,114 @@ func CLI(program, version string, flags Flags) error {
 					Value: "",
 					Usage: "specify prometheus instance binding",
 				},
+				cli.BoolFlag{
+					Name:  "dashboard",
+					Usage: "serve the status of the graph over http",
+				},
+				cli.BoolFlag{
+					Name:  "no-journal",
+					Usage: "don't record the engine events in the journal",
+				},
+				cli.IntFlag{
+					Name:  "journal-max-size",
+					Value: 0,
+					Usage: "rotate the journal after this many megabytes; 0 for the default",
+				},
+				cli.IntFlag{
+					Name:  "journal-max-files",
+					Value: 0,
+					Usage: "number of rotated journal files to keep; 0 for the default",
+				},
+			},
+		},
+		{
+			Name:   "journal",
+			Usage:  "query the engine journal",
+			Action: journalQuery,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:   "prefix",
+					Usage:  "specify a path to the working prefix directory",
+					EnvVar: "MGMT_PREFIX",
+				},
+				cli.StringFlag{
+					Name:  "kind",
+					Value: "",
+					Usage: "only show entries for this resource kind",
+				},
+				cli.StringFlag{
+					Name:  "name",
+					Value: "",
+					Usage: "only show entries for this resource name",
+				},
+				cli.StringFlag{
+					Name:  "type",
+					Value: "",
+					Usage: "only show entries of this type",
+				},
+				cli.StringFlag{
+					Name:  "since",
+					Value: "",
+					Usage: "only show entries after this time (RFC3339) or duration ago",
+				},
+				cli.StringFlag{
+					Name:  "until",
+					Value: "",
+					Usage: "only show entries before this time (RFC3339) or duration ago",
+				},
+				cli.BoolFlag{
+					Name:  "json",
+					Usage: "output the entries as json lines",
+				},
+			},
+		},
+		{
+			Name:  "ctl",
+			Usage: "control the resources of a running mgmt",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:   "prefix",
+					Usage:  "specify a path to the working prefix directory",
+					EnvVar: "MGMT_PREFIX",
+				},
+			},
+			Subcommands: []cli.Command{
+				{
+					Name:      ctlActionPause,
+					Usage:     "stop running CheckApply on a resource",
+					ArgsUsage: "kind[name]",
+					Action:    ctl(ctlActionPause),
+				},
+				{
+					Name:      ctlActionResume,
+					Usage:     "resume a paused resource",
+					ArgsUsage: "kind[name]",
+					Action:    ctl(ctlActionResume),
+				},
+				{
+					Name:      ctlActionApply,
+					Usage:     "run CheckApply once on a resource, ignoring its cached state",
+					ArgsUsage: "kind[name]",
+					Action:    ctl(ctlActionApply),
+				},
+			},
+		},
+		{
+			Name:  "graph",
+			Usage: "inspect the graph of a running mgmt",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:   "prefix",
+					Usage:  "specify a path to the working prefix directory",
+					EnvVar: "MGMT_PREFIX",
+				},
+			},
+			Subcommands: []cli.Command{
+				{
+					Name:   "dump",
+					Usage:  "print the running graph as json",
+					Action: graphDump,
+				},
 			},
 		},
 	}
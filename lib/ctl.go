@@ -0,0 +1,237 @@
+// Mgmt
+// Copyright (C) 2013-2016+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/purpleidea/mgmt/pgraph"
+
+	errwrap "github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+// ctlSocketName is the name of the control socket inside the working prefix.
+const ctlSocketName = "ctl.sock"
+
+// The actions which are supported by the control socket.
+const (
+	ctlActionPause  = "pause"
+	ctlActionResume = "resume"
+	ctlActionApply  = "apply"
+	ctlActionDump   = "dump" // returns the json of the whole graph
+)
+
+// ctlRequest is a single request sent to the control socket.
+type ctlRequest struct {
+	Action string `json:"action"`
+	Kind   string `json:"kind"`
+	Name   string `json:"name"`
+}
+
+// ctlResponse is the answer to a ctlRequest. An empty Error means success.
+type ctlResponse struct {
+	Error   string          `json:"error,omitempty"`
+	Message string          `json:"message,omitempty"`
+	Graph   json.RawMessage `json:"graph,omitempty"` // for the dump action
+}
+
+// ctlServer listens on a local unix socket for requests that act on single
+// vertices of the running graph.
+type ctlServer struct {
+	Path string // path to the unix socket
+	// Graph runs the function with the active graph, which is guaranteed to
+	// not be swapped out or paused until the function returns.
+	Graph func(func(*pgraph.Graph) error) error
+
+	listener net.Listener
+	wg       *sync.WaitGroup
+}
+
+// Start removes any stale socket, and starts listening for requests.
+func (obj *ctlServer) Start() error {
+	if err := os.Remove(obj.Path); err != nil && !os.IsNotExist(err) {
+		return errwrap.Wrapf(err, "can't remove stale socket")
+	}
+	listener, err := net.Listen("unix", obj.Path)
+	if err != nil {
+		return errwrap.Wrapf(err, "can't listen")
+	}
+	if err := os.Chmod(obj.Path, 0660); err != nil {
+		listener.Close()
+		return errwrap.Wrapf(err, "can't chmod socket")
+	}
+	obj.listener = listener
+	obj.wg = &sync.WaitGroup{}
+	obj.wg.Add(1)
+	go func() {
+		defer obj.wg.Done()
+		for {
+			conn, err := obj.listener.Accept()
+			if err != nil { // closed by Stop
+				return
+			}
+			obj.wg.Add(1)
+			go func() {
+				defer obj.wg.Done()
+				obj.handle(conn)
+			}()
+		}
+	}()
+	return nil
+}
+
+// Stop closes the socket, and waits for the running requests to finish. It can
+// be called more than once.
+func (obj *ctlServer) Stop() error {
+	if obj.listener == nil {
+		return nil
+	}
+	err := obj.listener.Close() // this also removes the socket file
+	obj.wg.Wait()
+	obj.listener = nil
+	return err
+}
+
+// handle serves a single request on the connection.
+func (obj *ctlServer) handle(conn net.Conn) {
+	defer conn.Close()
+	req := &ctlRequest{}
+	resp := &ctlResponse{}
+	if err := json.NewDecoder(conn).Decode(req); err != nil {
+		resp.Error = fmt.Sprintf("Invalid request: %v", err)
+	} else if err := obj.Graph(func(g *pgraph.Graph) error {
+		return ctlApply(g, req, resp)
+	}); err != nil {
+		resp.Error = err.Error()
+	}
+	if resp.Error != "" {
+		log.Printf("Ctl: %s", resp.Error)
+	}
+	if err := json.NewEncoder(conn).Encode(resp); err != nil {
+		log.Printf("Ctl: Can't send response: %v", err)
+	}
+}
+
+// ctlApply runs the requested action on the graph, and fills in the response.
+func ctlApply(g *pgraph.Graph, req *ctlRequest, resp *ctlResponse) error {
+	if g == nil {
+		return fmt.Errorf("No graph is running yet")
+	}
+	if req.Action == ctlActionDump {
+		data, err := json.Marshal(g)
+		resp.Graph = data
+		return err
+	}
+
+	v, err := g.FindVertex(req.Kind, req.Name)
+	if err != nil {
+		return err
+	}
+	switch req.Action {
+	case ctlActionPause:
+		err = g.PauseVertex(v)
+	case ctlActionResume:
+		err = g.ResumeVertex(v)
+	case ctlActionApply:
+		err = g.ApplyVertex(v)
+	default:
+		return fmt.Errorf("Unknown action: %s", req.Action)
+	}
+	if err == nil {
+		resp.Message = fmt.Sprintf("%s[%s]: %s: OK", req.Kind, req.Name, req.Action)
+	}
+	return err
+}
+
+// parseKindName parses a resource reference of the form: kind[name].
+func parseKindName(s string) (kind, name string, err error) {
+	i := strings.Index(s, "[")
+	if i < 1 || !strings.HasSuffix(s, "]") || len(s) < i+3 {
+		return "", "", fmt.Errorf("Invalid resource: %s, expected kind[name]", s)
+	}
+	return s[:i], s[i+1 : len(s)-1], nil
+}
+
+// ctlSend sends the request to the control socket of the running mgmt, and
+// returns its response. The prefix flag is looked up in the parent commands.
+func ctlSend(c *cli.Context, req *ctlRequest) (*ctlResponse, error) {
+	var prefix = fmt.Sprintf("/var/lib/%s/", c.App.Name) // default prefix
+	if s := c.GlobalString("prefix"); c.GlobalIsSet("prefix") && s != "" {
+		prefix = s
+	}
+	conn, err := net.Dial("unix", path.Join(prefix, ctlSocketName))
+	if err != nil {
+		return nil, errwrap.Wrapf(err, "Can't connect to mgmt, is it running?")
+	}
+	defer conn.Close()
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return nil, errwrap.Wrapf(err, "Can't send request")
+	}
+	resp := &ctlResponse{}
+	if err := json.NewDecoder(conn).Decode(resp); err != nil {
+		return nil, errwrap.Wrapf(err, "Can't read response")
+	}
+	if resp.Error != "" {
+		return nil, fmt.Errorf("%s", resp.Error)
+	}
+	return resp, nil
+}
+
+// ctl returns the cli action which sends the given request to the control
+// socket of the running mgmt instance.
+func ctl(action string) func(*cli.Context) error {
+	return func(c *cli.Context) error {
+		if c.NArg() != 1 {
+			return fmt.Errorf("Expected one argument: kind[name]")
+		}
+		kind, name, err := parseKindName(c.Args().First())
+		if err != nil {
+			return err
+		}
+		resp, err := ctlSend(c, &ctlRequest{Action: action, Kind: kind, Name: name})
+		if err != nil {
+			return err
+		}
+		fmt.Println(resp.Message)
+		return nil
+	}
+}
+
+// graphDump prints the json of the graph which the running mgmt is using.
+func graphDump(c *cli.Context) error {
+	resp, err := ctlSend(c, &ctlRequest{Action: ctlActionDump})
+	if err != nil {
+		return err
+	}
+	var out bytes.Buffer
+	if err := json.Indent(&out, resp.Graph, "", "\t"); err != nil {
+		return err
+	}
+	fmt.Println(out.String())
+	return nil
+}
@@ -0,0 +1,171 @@
+// Mgmt
+// Copyright (C) 2013-2016+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"os/exec"
+	"strings"
+
+	"github.com/purpleidea/mgmt/pgraph"
+	"github.com/purpleidea/mgmt/prometheus"
+
+	errwrap "github.com/pkg/errors"
+)
+
+// dashboardPath is the prefix of all the dashboard urls.
+const dashboardPath = "/graph/"
+
+// dashboardRefresh is the number of seconds between two page reloads.
+const dashboardRefresh = 5
+
+// dashboardTemplate is the html page of the dashboard. It shows the graph and a
+// table with the status of each resource, and it reloads itself periodically.
+var dashboardTemplate = template.Must(template.New("dashboard").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="{{.Refresh}}">
+<title>mgmt: {{.Status.Name}}</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; }
+td, th { border: 1px solid #ccc; padding: 2px 6px; text-align: left; }
+</style>
+</head>
+<body>
+<h1>{{.Status.Name}} ({{.Status.State}})</h1>
+<p><a href="svg">svg</a> | <a href="json">json</a> | <a href="dot">dot</a></p>
+<object data="svg" type="image/svg+xml"></object>
+<table>
+<tr><th>resource</th><th>state</th><th>last run</th><th>ok</th><th>retry</th><th>refresh</th><th>paused</th><th>deferred</th><th>error</th></tr>
+{{range .Status.Vertices}}<tr><td>{{.Kind}}[{{.Name}}]</td><td>{{.State}}</td><td>{{if not .LastRun.IsZero}}{{.LastRun.Format "2006-01-02 15:04:05"}}{{end}}</td><td>{{.CheckOK}}</td><td>{{.Retry}}</td><td>{{.Refresh}}</td><td>{{.Paused}}</td><td>{{if .Deferred}}{{.Deferred.Format "2006-01-02 15:04:05"}}{{end}}</td><td>{{.Error}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// dashboard serves the status of the running graph over http. It shares the
+// server of the prometheus instance if there is one, and otherwise it starts a
+// server of its own on the same listen address that prometheus would use.
+type dashboard struct {
+	Listen string // the listen specification if we run our own server
+	// Graph runs the function with the active graph, which is guaranteed to
+	// not be swapped out or paused until the function returns.
+	Graph func(func(*pgraph.Graph) error) error
+
+	listener net.Listener
+}
+
+// status returns the current status of the graph.
+func (obj *dashboard) status() (*pgraph.GraphStatus, error) {
+	var status *pgraph.GraphStatus
+	err := obj.Graph(func(g *pgraph.Graph) error {
+		if g == nil {
+			return fmt.Errorf("No graph is running yet")
+		}
+		status = g.Status()
+		return nil
+	})
+	return status, err
+}
+
+// ServeHTTP serves the dashboard page, and the status in the svg, json and dot
+// formats.
+func (obj *dashboard) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	status, err := obj.status()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	switch strings.TrimPrefix(r.URL.Path, dashboardPath) {
+	case "":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		data := struct {
+			Refresh int
+			Status  *pgraph.GraphStatus
+		}{dashboardRefresh, status}
+		if err := dashboardTemplate.Execute(w, data); err != nil {
+			log.Printf("Dashboard: Template error: %v", err)
+		}
+
+	case "json":
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(status); err != nil {
+			log.Printf("Dashboard: Encoding error: %v", err)
+		}
+
+	case "dot":
+		w.Header().Set("Content-Type", "text/vnd.graphviz; charset=utf-8")
+		fmt.Fprint(w, status.Graphviz())
+
+	case "svg":
+		path, err := exec.LookPath("dot")
+		if err != nil {
+			http.Error(w, "Graphviz is missing!", http.StatusNotImplemented)
+			return
+		}
+		cmd := exec.Command(path, "-Tsvg")
+		cmd.Stdin = strings.NewReader(status.Graphviz())
+		out, err := cmd.Output()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Graphviz failed: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "image/svg+xml")
+		w.Write(out)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// Start adds the dashboard to the prometheus server if shared is true, or it
+// starts a new server for it.
+func (obj *dashboard) Start(shared bool) error {
+	if shared {
+		http.Handle(dashboardPath, obj) // the prometheus server uses this mux
+		return nil
+	}
+	if obj.Listen == "" {
+		obj.Listen = prometheus.DefaultPrometheusListen
+	}
+	listener, err := net.Listen("tcp", obj.Listen)
+	if err != nil {
+		return errwrap.Wrapf(err, "can't listen")
+	}
+	obj.listener = listener
+	mux := http.NewServeMux()
+	mux.Handle(dashboardPath, obj)
+	go http.Serve(listener, mux) // returns when the listener is closed
+	return nil
+}
+
+// Stop stops the server of the dashboard, if it runs its own one.
+func (obj *dashboard) Stop() error {
+	if obj.listener == nil {
+		return nil
+	}
+	return obj.listener.Close()
+}
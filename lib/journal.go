@@ -0,0 +1,87 @@
+// Mgmt
+// Copyright (C) 2013-2016+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/purpleidea/mgmt/journal"
+
+	errwrap "github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+// parseTime parses a time which is either in RFC3339 format, or a duration
+// which is relative to now, eg: 2h30m means two and a half hours ago.
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil // zero value means unset
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Can't parse time: %s", s)
+	}
+	return time.Now().Add(-d), nil
+}
+
+// journalQuery is the query target for the engine journal.
+func journalQuery(c *cli.Context) error {
+	var prefix = fmt.Sprintf("/var/lib/%s/", c.App.Name) // default prefix
+	if s := c.String("prefix"); c.IsSet("prefix") && s != "" {
+		prefix = s
+	}
+
+	since, err := parseTime(c.String("since"))
+	if err != nil {
+		return err
+	}
+	until, err := parseTime(c.String("until"))
+	if err != nil {
+		return err
+	}
+	filter := &journal.Filter{
+		Kind:  c.String("kind"),
+		Name:  c.String("name"),
+		Type:  c.String("type"),
+		Since: since,
+		Until: until,
+	}
+
+	entries, err := journal.Query(path.Join(prefix, "journal"), filter)
+	if err != nil {
+		return errwrap.Wrapf(err, "Can't query the journal")
+	}
+	for _, entry := range entries {
+		if !c.Bool("json") {
+			fmt.Println(entry.String())
+			continue
+		}
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s\n", data)
+	}
+	return nil
+}
@@ -23,11 +23,13 @@ import (
 	"log"
 	"os"
 	"path"
+	"sync"
 	"time"
 
 	"github.com/purpleidea/mgmt/converger"
 	"github.com/purpleidea/mgmt/etcd"
 	"github.com/purpleidea/mgmt/gapi"
+	"github.com/purpleidea/mgmt/journal"
 	"github.com/purpleidea/mgmt/pgp"
 	"github.com/purpleidea/mgmt/pgraph"
 	"github.com/purpleidea/mgmt/prometheus"
@@ -67,10 +69,12 @@ type Main struct {
 
 	NoWatch          bool   // do not update graph on watched graph definition file changes
 	Noop             bool   // globally force all resources into no-op mode
+	Report           string // output format of the noop report, if one is wanted
 	Graphviz         string // output file for graphviz data
 	GraphvizFilter   string // graphviz filter to use
 	ConvergedTimeout int    // exit after approximately this many seconds in a converged state; -1 to disable
 	MaxRuntime       uint   // exit after a maximum of approximately this many seconds
+	MaxParallel      uint16 // maximum number of CheckApply's to run in parallel, 0 for unlimited
 
 	Seeds            []string // default etc client endpoint
 	ClientURLs       []string // list of URLs to listen on for client traffic
@@ -96,6 +100,11 @@ type Main struct {
 
 	Prometheus       bool   // enable prometheus metrics
 	PrometheusListen string // prometheus instance bind specification
+	Dashboard        bool   // serve the status of the graph over http
+
+	NoJournal       bool  // disable the persistent engine journal
+	JournalMaxSize  int64 // rotate the journal after this many bytes, 0 for the default
+	JournalMaxFiles int   // number of rotated journal files to keep, 0 for the default
 
 	exit chan error // exit signal
 }
@@ -140,6 +149,13 @@ func (obj *Main) Init() error {
 		return fmt.Errorf("Negative values for Depth are not permitted!")
 	}
 
+	if r := obj.Report; r != "" && r != "json" && r != "text" {
+		return fmt.Errorf("The Report format must be either json or text!")
+	}
+	if obj.Report != "" && obj.ConvergedTimeout < 0 {
+		obj.ConvergedTimeout = 0 // the report is printed once we've converged
+	}
+
 	// transform the url list inputs into etcd typed lists
 	var err error
 	obj.seeds, err = etcdtypes.NewURLs(
@@ -171,7 +187,7 @@ func (obj *Main) Exit(err error) {
 }
 
 // Run is the main execution entrypoint to run mgmt.
-func (obj *Main) Run() error {
+func (obj *Main) Run() (reterr error) {
 
 	var start = time.Now().UnixNano()
 
@@ -226,6 +242,7 @@ func (obj *Main) Run() error {
 	if err := os.MkdirAll(pgraphPrefix, 0770); err != nil {
 		return errwrap.Wrapf(err, "Can't create pgraph prefix")
 	}
+	reversePrefix := path.Join(prefix, "reverse") // pending reversals
 
 	var prom *prometheus.Prometheus
 	if obj.Prometheus {
@@ -240,6 +257,13 @@ func (obj *Main) Run() error {
 		if err := prom.Start(); err != nil {
 			return errwrap.Wrapf(err, "Can't start initiate Prometheus instance")
 		}
+		defer func() { // also on the early returns below
+			log.Printf("Main: Prometheus: Stopping instance")
+			if err := prom.Stop(); err != nil {
+				err = errwrap.Wrapf(err, "Prometheus instance exited poorly!")
+				reterr = multierr.Append(reterr, err)
+			}
+		}()
 	}
 
 	if !obj.NoPgp {
@@ -285,7 +309,63 @@ func (obj *Main) Run() error {
 		// TODO: Import admin key
 	}
 
+	var jrnl *journal.Journal // nil when disabled
+	if !obj.NoJournal {
+		jrnl = &journal.Journal{
+			Dir:      path.Join(prefix, "journal"),
+			MaxSize:  obj.JournalMaxSize,
+			MaxFiles: obj.JournalMaxFiles,
+		}
+		if err := jrnl.Init(); err != nil {
+			return errwrap.Wrapf(err, "Can't initialize the journal")
+		}
+		log.Printf("Main: Journal: Writing to %s", jrnl.Dir)
+		defer func() {
+			if err := jrnl.Close(); err != nil {
+				err = errwrap.Wrapf(err, "Journal closed poorly!")
+				reterr = multierr.Append(reterr, err)
+			}
+		}()
+	}
+
 	var G, oldGraph *pgraph.Graph
+	var graphVersion uint64 // incremented on each successful graph swap
+
+	graphMutex := &sync.Mutex{} // held while the active graph is swapped out
+
+	control := &ctlServer{
+		Path: path.Join(prefix, ctlSocketName),
+		Graph: func(fn func(*pgraph.Graph) error) error {
+			graphMutex.Lock()
+			defer graphMutex.Unlock()
+			return fn(G)
+		},
+	}
+	if err := control.Start(); err != nil {
+		return errwrap.Wrapf(err, "Can't start the control socket")
+	}
+	log.Printf("Main: Ctl: Listening on %s", control.Path)
+	defer func() { // also on the early returns below, it's a noop otherwise
+		if err := control.Stop(); err != nil {
+			err = errwrap.Wrapf(err, "Ctl exited poorly!")
+			reterr = multierr.Append(reterr, err)
+		}
+	}()
+
+	var dash *dashboard
+	if obj.Dashboard {
+		dash = &dashboard{
+			Listen: obj.PrometheusListen,
+			Graph:  control.Graph,
+		}
+		if prom != nil { // we share its server
+			dash.Listen = prom.Listen
+		}
+		if err := dash.Start(prom != nil); err != nil {
+			return errwrap.Wrapf(err, "Can't start the dashboard")
+		}
+		log.Printf("Main: Dashboard: Serving on http://%s%s", dash.Listen, dashboardPath)
+	}
 
 	// exit after `max-runtime` seconds for no reason at all...
 	if i := obj.MaxRuntime; i > 0 {
@@ -415,6 +495,7 @@ func (obj *Main) Run() error {
 				continue
 			}
 
+			graphMutex.Lock() // nobody else can touch G during the swap
 			// we need the vertices to be paused to work on them, so
 			// run graph vertex LOCK...
 			if !first { // TODO: we can flatten this check out I think
@@ -433,13 +514,22 @@ func (obj *Main) Run() error {
 					G.Start(first)    // sync
 					converger.Start() // after G.Start()
 				}
+				graphMutex.Unlock()
 				continue
 			}
-			newGraph.Flags = pgraph.Flags{Debug: obj.Flags.Debug}
+			// add the pending reversals of any removed resources
+			if err := newGraph.LoadReversals(reversePrefix); err != nil {
+				log.Printf("Config: Error loading reversals: %v", err)
+			}
+			newGraph.Flags = pgraph.Flags{
+				Debug:       obj.Flags.Debug,
+				MaxParallel: obj.MaxParallel,
+			}
 			// pass in the information we need
 			newGraph.AssociateData(&resources.Data{
 				Converger:  converger,
 				Prometheus: prom,
+				Journal:    jrnl,
 				Prefix:     pgraphPrefix,
 				Debug:      obj.Flags.Debug,
 			})
@@ -451,6 +541,30 @@ func (obj *Main) Run() error {
 				}
 			}
 
+			// verify all the send->recv relationships before we run
+			if err := newGraph.CheckSendRecv(); err != nil {
+				log.Printf("Config: Error checking send/recv: %v", err)
+				// unpause!
+				if !first {
+					G.Start(first)    // sync
+					converger.Start() // after G.Start()
+				}
+				graphMutex.Unlock()
+				continue
+			}
+
+			// reject the conflicting resources before we merge them
+			if err := newGraph.CheckConflicts(); err != nil {
+				log.Printf("Config: Error checking conflicts: %v", err)
+				// unpause!
+				if !first {
+					G.Start(first)    // sync
+					converger.Start() // after G.Start()
+				}
+				graphMutex.Unlock()
+				continue
+			}
+
 			// FIXME: make sure we "UnGroup()" any semi-destructive
 			// changes to the resources so our efficient GraphSync
 			// will be able to re-use and cmp to the old graph.
@@ -462,6 +576,7 @@ func (obj *Main) Run() error {
 					G.Start(first)    // sync
 					converger.Start() // after G.Start()
 				}
+				graphMutex.Unlock()
 				continue
 			}
 			oldGraph = newFullGraph // save old graph
@@ -470,9 +585,17 @@ func (obj *Main) Run() error {
 			G.AutoEdges() // add autoedges; modifies the graph
 			G.AutoGroup() // run autogroup; modifies the graph
 			// TODO: do we want to do a transitive reduction?
-			// FIXME: run a type checker that verifies all the send->recv relationships
 
 			log.Printf("Graph: %v", G) // show graph
+			graphVersion++
+			if err := jrnl.Write(&journal.Entry{
+				Type:    journal.EntryGraph,
+				Name:    G.GetName(),
+				Version: graphVersion,
+				Message: G.String(),
+			}); err != nil {
+				log.Printf("Main: Journal: Write failed: %v", err)
+			}
 			if obj.GraphvizFilter != "" {
 				if err := G.ExecGraphviz(obj.GraphvizFilter, obj.Graphviz); err != nil {
 					log.Printf("Graphviz: %v", err)
@@ -488,6 +611,7 @@ func (obj *Main) Run() error {
 			G.Start(first)    // sync
 			converger.Start() // after G.Start()
 			first = false
+			graphMutex.Unlock()
 		}
 	}()
 
@@ -544,7 +668,7 @@ func (obj *Main) Run() error {
 	}
 	log.Println("Main: Running...")
 
-	reterr := <-obj.exit // wait for exit signal
+	reterr = <-obj.exit // wait for exit signal
 
 	log.Println("Destroy...")
 
@@ -564,22 +688,32 @@ func (obj *Main) Run() error {
 	// tell inner main loop to exit
 	close(exitchan)
 
+	if err := control.Stop(); err != nil { // no more requests on the graph
+		err = errwrap.Wrapf(err, "Ctl exited poorly!")
+		reterr = multierr.Append(reterr, err) // list of errors
+	}
+	if dash != nil {
+		if err := dash.Stop(); err != nil {
+			err = errwrap.Wrapf(err, "Dashboard exited poorly!")
+			reterr = multierr.Append(reterr, err) // list of errors
+		}
+	}
+
 	G.Exit() // tell all the children to exit, and waits for them to do so
 
+	if obj.Report != "" && G != nil { // print what the noop resources would do
+		if err := obj.printReport(G.Report()); err != nil {
+			err = errwrap.Wrapf(err, "Report failed!")
+			reterr = multierr.Append(reterr, err) // list of errors
+		}
+	}
+
 	// cleanup etcd main loop last so it can process everything first
 	if err := EmbdEtcd.Destroy(); err != nil { // shutdown and cleanup etcd
 		err = errwrap.Wrapf(err, "Etcd exited poorly!")
 		reterr = multierr.Append(reterr, err) // list of errors
 	}
 
-	if obj.Prometheus {
-		log.Printf("Main: Prometheus: Stopping instance")
-		if err := prom.Stop(); err != nil {
-			err = errwrap.Wrapf(err, "Prometheus instance exited poorly!")
-			reterr = multierr.Append(reterr, err)
-		}
-	}
-
 	if obj.Flags.Debug {
 		log.Printf("Main: Graph: %v", G)
 	}
@@ -588,3 +722,18 @@ func (obj *Main) Run() error {
 	log.Println("Goodbye!")
 	return reterr
 }
+
+// printReport writes the noop report to stdout in the requested format.
+func (obj *Main) printReport(report *pgraph.Report) error {
+	switch obj.Report {
+	case "json":
+		data, err := report.JSON()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s\n", data)
+	case "text":
+		fmt.Print(report.Text())
+	}
+	return nil
+}
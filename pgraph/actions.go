@@ -21,10 +21,13 @@ import (
 	"fmt"
 	"log"
 	"math"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/purpleidea/mgmt/event"
+	"github.com/purpleidea/mgmt/journal"
 	"github.com/purpleidea/mgmt/resources"
 
 	multierr "github.com/hashicorp/go-multierror"
@@ -158,6 +161,47 @@ func (g *Graph) SetDownstreamRefresh(v *Vertex, b bool) {
 	}
 }
 
+// journalWrite records an entry about the vertex in the engine journal, if one
+// is enabled. Journal errors are logged, but they never stop the engine.
+func (g *Graph) journalWrite(v *Vertex, entry *journal.Entry) {
+	j := v.Res.GetJournal()
+	if j == nil {
+		return
+	}
+	entry.Kind, entry.Name = v.Kind(), v.GetName()
+	if err := j.Write(entry); err != nil {
+		log.Printf("%s[%s]: Journal: Write failed: %v", v.Kind(), v.GetName(), err)
+	}
+}
+
+// slotCheckApply runs the CheckApply of the vertex once it's its turn, and
+// journals it. The slots are released before we poke, so that we can't block
+// others, and the semaphores always come first, so that we can't deadlock. If
+// the CheckApply times out, the slots are kept until the stray run returns.
+func (g *Graph) slotCheckApply(v *Vertex, apply bool) (bool, error) {
+	semaRelease := g.SemaAcquire(v)
+	release := g.ParallelAcquire(v)
+	g.journalWrite(v, &journal.Entry{
+		Type:  journal.EntryCheckApplyStart,
+		Apply: apply,
+	})
+	start := time.Now()
+	checkOK, err := g.CheckApply(v, apply) // respects the timeout
+	v.setResult(checkOK, err)
+	end := &journal.Entry{
+		Type:     journal.EntryCheckApplyEnd,
+		Apply:    apply,
+		CheckOK:  checkOK,
+		Duration: time.Since(start).Seconds(),
+	}
+	if err != nil {
+		end.Error = err.Error()
+	}
+	g.journalWrite(v, end)
+	releaseSlots(v, release, semaRelease)
+	return checkOK, err
+}
+
 // Process is the primary function to execute for a particular vertex in the graph.
 func (g *Graph) Process(v *Vertex) error {
 	obj := v.Res
@@ -168,6 +212,15 @@ func (g *Graph) Process(v *Vertex) error {
 	obj.SetState(resources.ResStateProcess)
 	var ok = true
 	var applied = false // did we run an apply?
+	// has the user paused us, or asked for a forced run?
+	paused, force := v.control()
+	if paused && !force {
+		if g.Flags.Debug {
+			log.Printf("%s[%s]: Process(): Paused", obj.Kind(), obj.GetName())
+		}
+		return nil // we'll get poked when we're resumed
+	}
+
 	// is it okay to run dependency wise right now?
 	// if not, that's okay because when the dependency runs, it will poke
 	// us back and we will run if needed then!
@@ -181,19 +234,42 @@ func (g *Graph) Process(v *Vertex) error {
 		log.Printf("%s[%s]: OKTimestamp(%v)", obj.Kind(), obj.GetName(), v.GetTimestamp())
 	}
 
+	if force { // we're about to run, so this request is now handled
+		v.clearForce()
+		obj.StateOK(false) // ignore the cached state
+	}
+
 	// connect any senders to receivers and detect if values changed
 	if updated, err := obj.SendRecv(obj); err != nil {
 		return errwrap.Wrapf(err, "could not SendRecv in Process")
 	} else if len(updated) > 0 {
-		for _, changed := range updated {
-			if changed { // at least one was updated
-				obj.StateOK(false) // invalidate cache, mark as dirty
-				break
+		keys := []string{}
+		for key, changed := range updated {
+			if changed {
+				keys = append(keys, key)
 			}
 		}
+		if len(keys) > 0 { // at least one was updated
+			obj.StateOK(false) // invalidate cache, mark as dirty
+			sort.Strings(keys)
+			g.journalWrite(v, &journal.Entry{
+				Type:    journal.EntrySendRecv,
+				Message: strings.Join(keys, ", "),
+			})
+		}
 	}
 
 	var noop = obj.Meta().Noop // lookup the noop value
+	var deferred = false       // are we outside of the schedule window?
+	if !noop && !force {       // a forced run ignores the schedule
+		open, next := scheduleOpen(v, time.Now())
+		if !open { // only check what we would change, and try later
+			noop, deferred = true, true
+		}
+		g.setDeferred(v, next)
+	} else {
+		g.setDeferred(v, time.Time{})
+	}
 	var refresh bool
 	var checkOK bool
 	var err error
@@ -205,6 +281,9 @@ func (g *Graph) Process(v *Vertex) error {
 	// lookup the refresh (notification) variable
 	refresh = g.RefreshPending(v) // do i need to perform a refresh?
 	obj.SetRefresh(refresh)       // tell the resource
+	if refresh {
+		g.journalWrite(v, &journal.Entry{Type: journal.EntryRefresh})
+	}
 
 	// changes can occur after this...
 	obj.SetState(resources.ResStateCheckApply)
@@ -218,11 +297,26 @@ func (g *Graph) Process(v *Vertex) error {
 		// skip this, but it doesn't make a big difference under noop!
 	} else if noop && refresh { // had a refresh to do w/ noop!
 		checkOK, err = false, nil // therefore the state is wrong
+		// when deferred, the refresh stays pending until the window
+		if !deferred {
+			g.report.Set(obj.Kind(), obj.GetName(), []*resources.Change{
+				{Property: "refresh", New: "pending"},
+			})
+		}
 
 		// run the CheckApply!
 	} else {
 		// if this fails, don't UpdateTimestamp()
-		checkOK, err = obj.CheckApply(!noop)
+		checkOK, err = g.slotCheckApply(v, !noop)
+
+		// keep the noop report up to date with what we would change
+		if noop && !deferred && err == nil {
+			if checkOK {
+				g.report.Del(obj.Kind(), obj.GetName())
+			} else {
+				g.report.Set(obj.Kind(), obj.GetName(), obj.Changes())
+			}
+		}
 
 		if obj.Prometheus() != nil {
 			if promErr := obj.Prometheus().UpdateCheckApplyTotal(obj.Kind(), !noop, !checkOK, err != nil); promErr != nil {
@@ -233,7 +327,9 @@ func (g *Graph) Process(v *Vertex) error {
 		// TODO: Can the `Poll` converged timeout tracking be a
 		// more general method for all converged timeouts? this
 		// would simplify the resources by removing boilerplate
-		if v.Meta().Poll > 0 {
+		// a deferred resource can't change anything until the window
+		// opens, so it mustn't keep the graph from converging either
+		if v.Meta().Poll > 0 && !deferred {
 			if !checkOK { // something changed, restart timer
 				cuid := v.Res.ConvergerUID() // get the converger uid used to report status
 				cuid.ResetTimer()            // activity!
@@ -247,6 +343,12 @@ func (g *Graph) Process(v *Vertex) error {
 	if checkOK && err != nil { // should never return this way
 		log.Fatalf("%s[%s]: CheckApply(): %t, %+v", obj.Kind(), obj.GetName(), checkOK, err)
 	}
+	if e := v.snapshot(); e != nil { // for the graph dump
+		log.Printf("%s[%s]: Can't save the json: %v", obj.Kind(), obj.GetName(), e)
+	}
+	if deferred && checkOK { // nothing to change, so nothing to defer
+		g.setDeferred(v, time.Time{})
+	}
 	if g.Flags.Debug {
 		log.Printf("%s[%s]: CheckApply(): %t, %v", obj.Kind(), obj.GetName(), checkOK, err)
 	}
@@ -254,6 +356,7 @@ func (g *Graph) Process(v *Vertex) error {
 	// if CheckApply ran without noop and without error, state should be good
 	if !noop && err == nil { // aka !noop || checkOK
 		obj.StateOK(true) // reset
+		g.reversed(v)     // a pending reversal is now done
 		if refresh {
 			g.SetUpstreamRefresh(v, false) // refresh happened, clear the request
 			obj.SetRefresh(false)
@@ -272,6 +375,11 @@ func (g *Graph) Process(v *Vertex) error {
 	if noop && err == nil {
 		ok = true
 	}
+	// a deferred vertex still has its changes to make, so the vertices after
+	// it wait for them, instead of running against a state that will change
+	if deferred && !checkOK {
+		ok = false
+	}
 
 	if ok {
 		// did we actually do work?
@@ -344,7 +452,7 @@ func (g *Graph) Worker(v *Vertex) error {
 			<-timer.C // unnecessary, shouldn't happen
 		}
 
-		var delay = time.Duration(v.Meta().Delay) * time.Millisecond
+		var attempt int            // number of the current retry, 0 if none
 		var retry = v.Meta().Retry // number of tries left, -1 for infinite
 		var limiter = rate.NewLimiter(v.Meta().Limit, v.Meta().Burst)
 		limited := false
@@ -423,12 +531,19 @@ func (g *Graph) Worker(v *Vertex) error {
 						if retry > 0 { // don't decrement the -1
 							retry--
 						}
-						log.Printf("%s[%s]: CheckApply: Retrying after %.4f seconds (%d left)", v.Kind(), v.GetName(), delay.Seconds(), retry)
+						attempt++
+						delay := BackoffDelay(v.Meta(), attempt)
+						log.Printf("%s[%s]: CheckApply: Retrying after %.4f seconds (attempt %d, %d left)", v.Kind(), v.GetName(), delay.Seconds(), attempt, retry)
+						g.retryUpdate(v, "CheckApply", attempt, delay)
 						// start the timer...
 						timer.Reset(delay)
 						waiting = true // waiting for retry timer
 						return
 					}
+					if attempt > 0 {
+						attempt = 0 // reset on success
+						g.retryUpdate(v, "CheckApply", 0, 0)
+					}
 					retry = v.Meta().Retry // reset on success
 					close(done)            // trigger
 				}(ev)
@@ -485,7 +600,11 @@ func (g *Graph) Worker(v *Vertex) error {
 	// NOTE: we're using the same retry and delay metaparams that CheckApply
 	// uses. This is for practicality. We can separate them later if needed!
 	var watchDelay time.Duration
+	var watchAttempt int            // number of the current retry, 0 if none
 	var watchRetry = v.Meta().Retry // number of tries left, -1 for infinite
+	watchExit := make(chan struct{})
+	defer close(watchExit)
+	go g.watchTimeout(v, watchExit) // report a Watch that never starts up
 	// watch blocks until it ends, & errors to retry
 	for {
 		// TODO: do we have to stop the converged-timeout when in this block (perhaps we're in the delay block!)
@@ -547,7 +666,7 @@ func (g *Graph) Worker(v *Vertex) error {
 			//}
 		}
 
-		// TODO: reset the watch retry count after some amount of success
+		v.Res.SetRunning(false) // set by Running() once Watch is up
 		v.Res.RegisterConverger()
 		var e error
 		if v.Res.Meta().Poll > 0 { // poll instead of watching :(
@@ -568,6 +687,10 @@ func (g *Graph) Worker(v *Vertex) error {
 			break // sentinel means, perma-exit
 		}
 		log.Printf("%s[%s]: Watch errored: %v", v.Kind(), v.GetName(), e)
+		if v.Res.IsRunning() { // it started cleanly, so it's a new failure
+			watchAttempt = 0 // reset on success
+			watchRetry = v.Meta().Retry
+		}
 		if watchRetry == 0 {
 			err = fmt.Errorf("Permanent watch error: %v", e)
 			break
@@ -575,8 +698,10 @@ func (g *Graph) Worker(v *Vertex) error {
 		if watchRetry > 0 { // don't decrement the -1
 			watchRetry--
 		}
-		watchDelay = time.Duration(v.Meta().Delay) * time.Millisecond
-		log.Printf("%s[%s]: Watch: Retrying after %.4f seconds (%d left)", v.Kind(), v.GetName(), watchDelay.Seconds(), watchRetry)
+		watchAttempt++
+		watchDelay = BackoffDelay(v.Meta(), watchAttempt)
+		log.Printf("%s[%s]: Watch: Retrying after %.4f seconds (attempt %d, %d left)", v.Kind(), v.GetName(), watchDelay.Seconds(), watchAttempt, watchRetry)
+		g.retryUpdate(v, "Watch", watchAttempt, watchDelay)
 		// We need to trigger a CheckApply after Watch restarts, so that
 		// we catch any lost events that happened while down. We do this
 		// by getting the Watch resource to send one event once it's up!
@@ -601,6 +726,8 @@ func (g *Graph) Worker(v *Vertex) error {
 func (g *Graph) Start(first bool) { // start or continue
 	log.Printf("State: %v -> %v", g.setState(graphStateStarting), g.getState())
 	defer log.Printf("State: %v -> %v", g.setState(graphStateStarted), g.getState())
+	g.initPools() // build the parallel semaphores before anything runs
+	g.initSemas() // and the ones from the sema metaparam
 	var wg sync.WaitGroup
 	t, _ := g.TopologicalSort()
 	// TODO: only calculate indegree if `first` is true to save resources
@@ -623,6 +750,9 @@ func (g *Graph) Start(first bool) { // start or continue
 		v.Res.Starter((!first) || indegree[v] == 0)
 
 		if !v.Res.IsWorking() { // if Worker() is not running...
+			if err := v.snapshot(); err != nil { // before it can change
+				log.Printf("%s[%s]: Can't save the json: %v", v.Kind(), v.GetName(), err)
+			}
 			g.wg.Add(1)
 			// must pass in value to avoid races...
 			// see: https://ttboj.wordpress.com/2015/07/27/golang-parallelism-issues-causing-too-many-open-files-error/
@@ -658,6 +788,7 @@ func (g *Graph) Start(first bool) { // start or continue
 func (g *Graph) Pause() {
 	log.Printf("State: %v -> %v", g.setState(graphStatePausing), g.getState())
 	defer log.Printf("State: %v -> %v", g.setState(graphStatePaused), g.getState())
+	g.stopDeferred() // the start pokes them again
 	t, _ := g.TopologicalSort()
 	for _, v := range t { // squeeze out the events...
 		v.SendEvent(event.EventPause, nil)
@@ -669,6 +800,7 @@ func (g *Graph) Exit() {
 	if g == nil {
 		return
 	} // empty graph that wasn't populated yet
+	g.stopDeferred()
 	t, _ := g.TopologicalSort()
 	for _, v := range t { // squeeze out the events...
 		// turn off the taps...
@@ -0,0 +1,56 @@
+// Mgmt
+// Copyright (C) 2013-2016+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package pgraph
+
+import (
+	"testing"
+
+	"github.com/purpleidea/mgmt/resources"
+)
+
+// TestAutoEdgesMount1 checks that the files below a mountpoint come after the
+// mount, and that the mountpoint dir comes before it.
+func TestAutoEdgesMount1(t *testing.T) {
+	mount, _ := resources.NewMountRes("/mnt/data", "mounted", "tmpfs", "tmpfs", nil)
+	file, _ := resources.NewFileRes("file", "/mnt/data/www/index.html", "", "", nil, "", "exists", false, false)
+	dir, _ := resources.NewFileRes("dir", "/mnt/data/", "", "", nil, "", "exists", false, false)
+	other, _ := resources.NewFileRes("other", "/mnt/database/file", "", "", nil, "", "exists", false, false)
+
+	g := NewGraph("autoedges")
+	vm, vf, vd, vo := NewVertex(mount), NewVertex(file), NewVertex(dir), NewVertex(other)
+	g.AddVertex(vm, vf, vd, vo)
+	for v := range g.Adjacency {
+		v.Meta().AutoEdge = true
+	}
+	g.AutoEdges()
+
+	for _, x := range []struct {
+		from, to *Vertex
+		edge     bool
+	}{
+		{vm, vf, true},
+		{vd, vm, true},
+		{vm, vo, false}, // not below the mountpoint
+		{vf, vm, false},
+	} {
+		_, exists := g.Adjacency[x.from][x.to]
+		if exists != x.edge {
+			t.Errorf("Edge %s -> %s: %t, expected: %t", x.from.GetName(), x.to.GetName(), exists, x.edge)
+		}
+	}
+}
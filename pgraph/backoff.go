@@ -0,0 +1,66 @@
+// Mgmt
+// Copyright (C) 2013-2016+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package pgraph
+
+import (
+	"log"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/purpleidea/mgmt/resources"
+)
+
+// BackoffDelay returns how long to wait before the retry with the given attempt
+// number, which starts at one. It follows the backoff strategy from the meta
+// params, caps the result at the max delay, and then applies the jitter if any.
+func BackoffDelay(meta *resources.MetaParams, attempt int) time.Duration {
+	if attempt < 1 {
+		attempt = 1
+	}
+	delay := float64(meta.Delay) // in milliseconds
+	switch meta.Backoff {
+	case resources.BackoffLinear:
+		delay *= float64(attempt)
+	case resources.BackoffExponential:
+		delay *= math.Pow(2, float64(attempt-1))
+	}
+	if max := float64(meta.MaxDelay); max > 0 && delay > max {
+		delay = max
+	}
+	if delay > float64(math.MaxInt64/int64(time.Millisecond)) { // avoid overflow
+		delay = float64(math.MaxInt64 / int64(time.Millisecond))
+	}
+	d := time.Duration(delay) * time.Millisecond
+	if meta.Jitter && d > 0 { // pick somewhere between d/2 and d
+		d = d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+	}
+	return d
+}
+
+// retryUpdate exports the state of a retry to prometheus and to the status of
+// the vertex. An attempt of zero means that the operation succeeded, and that
+// we're no longer retrying.
+func (g *Graph) retryUpdate(v *Vertex, operation string, attempt int, delay time.Duration) {
+	v.setRetry(operation, attempt)
+	if p := v.Res.Prometheus(); p != nil {
+		if err := p.UpdateRetry(v.Kind(), v.GetName(), operation, attempt, delay); err != nil {
+			log.Printf("%s[%s]: Prometheus.UpdateRetry() errored: %v", v.Kind(), v.GetName(), err)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+// Mgmt
+// Copyright (C) 2013-2016+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package pgraph
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/purpleidea/mgmt/converger"
+	"github.com/purpleidea/mgmt/event"
+	"github.com/purpleidea/mgmt/resources"
+)
+
+func TestBackoffDelay1(t *testing.T) {
+	for _, x := range []struct {
+		backoff  string
+		delay    uint64
+		maxDelay uint64
+		attempt  int
+		expected time.Duration
+	}{
+		{"", 100, 0, 1, 100 * time.Millisecond},
+		{"", 100, 0, 5, 100 * time.Millisecond},
+		{resources.BackoffFixed, 100, 0, 3, 100 * time.Millisecond},
+		{resources.BackoffLinear, 100, 0, 1, 100 * time.Millisecond},
+		{resources.BackoffLinear, 100, 0, 3, 300 * time.Millisecond},
+		{resources.BackoffLinear, 100, 250, 3, 250 * time.Millisecond},
+		{resources.BackoffExponential, 100, 0, 1, 100 * time.Millisecond},
+		{resources.BackoffExponential, 100, 0, 4, 800 * time.Millisecond},
+		{resources.BackoffExponential, 100, 1000, 5, time.Second},
+		{resources.BackoffExponential, 100, 0, 0, 100 * time.Millisecond}, // the first attempt
+		{resources.BackoffExponential, 0, 0, 10, 0},
+	} {
+		meta := &resources.MetaParams{Backoff: x.backoff, Delay: x.delay, MaxDelay: x.maxDelay}
+		if d := BackoffDelay(meta, x.attempt); d != x.expected {
+			t.Errorf("%s backoff of %dms, max %dms, attempt %d: %v, expected: %v", x.backoff, x.delay, x.maxDelay, x.attempt, d, x.expected)
+		}
+	}
+
+	// a huge exponent is capped instead of overflowing
+	meta := &resources.MetaParams{Backoff: resources.BackoffExponential, Delay: 1000}
+	if d := BackoffDelay(meta, 1000); d <= 0 {
+		t.Errorf("The delay overflowed: %v", d)
+	}
+
+	meta = &resources.MetaParams{Delay: 1000, Jitter: true}
+	for i := 0; i < 100; i++ {
+		if d := BackoffDelay(meta, 1); d < 500*time.Millisecond || d > time.Second {
+			t.Errorf("The jitter is out of range: %v", d)
+		}
+	}
+}
+
+// flakyRes is a noop resource whose Watch fails a number of times. It gets to
+// Running before it fails if started is set.
+type flakyRes struct {
+	resources.NoopRes
+	started bool
+	fails   int
+	runs    int
+}
+
+func (obj *flakyRes) Watch(processChan chan *event.Event) error {
+	obj.runs++
+	if obj.started {
+		if err := obj.Running(processChan); err != nil {
+			return err
+		}
+	}
+	if obj.runs <= obj.fails {
+		return fmt.Errorf("failure %d", obj.runs)
+	}
+	return nil // exit
+}
+
+// TestWatchRetry1 checks that the retries of a Watch start over once it gets to
+// run, and that they run out when it keeps failing before it's running.
+func TestWatchRetry1(t *testing.T) {
+	for _, started := range []bool{true, false} {
+		obj := &flakyRes{started: started, fails: 3}
+		obj.SetName("flaky")
+		obj.MetaParams = resources.DefaultMetaParams
+		obj.MetaParams.Retry = 1
+		obj.MetaParams.Delay = 1
+		if err := obj.Init(); err != nil {
+			t.Fatalf("Init failed: %v", err)
+		}
+		obj.AssociateData(&resources.Data{Converger: converger.NewConverger(-1, nil)})
+		g := NewGraph("retry")
+		v := NewVertex(obj)
+		g.AddVertex(v)
+
+		err := g.Worker(v)
+		if started && (err != nil || obj.runs != 4) {
+			t.Errorf("A Watch which runs should keep retrying: %v, after %d runs", err, obj.runs)
+		}
+		if !started && (err == nil || obj.runs != 2) {
+			t.Errorf("A Watch which never runs should run out of retries: %v, after %d runs", err, obj.runs)
+		}
+	}
+}
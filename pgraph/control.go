@@ -0,0 +1,119 @@
+// Mgmt
+// Copyright (C) 2013-2016+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package pgraph
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/purpleidea/mgmt/event"
+)
+
+// FindVertex returns the vertex which has this kind and name. The kind match
+// isn't case sensitive. If the resource was grouped into another one, then the
+// vertex containing the group is returned, since that is the one that runs.
+func (g *Graph) FindVertex(kind, name string) (*Vertex, error) {
+	for v := range g.Adjacency {
+		if strings.EqualFold(v.Kind(), kind) && v.GetName() == name {
+			return v, nil
+		}
+		for _, res := range v.GetGroup() {
+			if strings.EqualFold(res.Kind(), kind) && res.GetName() == name {
+				return v, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("No vertex found for: %s[%s]", kind, name)
+}
+
+// IsPaused returns true if the vertex was paused with PauseVertex.
+func (v *Vertex) IsPaused() bool {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	return v.paused
+}
+
+// control returns whether the vertex is paused, and whether a forced apply was
+// requested.
+func (v *Vertex) control() (paused, force bool) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	return v.paused, v.force
+}
+
+// clearForce consumes the forced apply request, once it's about to happen.
+func (v *Vertex) clearForce() {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.force = false
+}
+
+// running returns an error if the graph isn't started. Sending events to a
+// vertex while the whole graph is paused isn't safe, so we refuse to do it.
+func (g *Graph) running() error {
+	if state := g.getState(); state != graphStateStarted {
+		return fmt.Errorf("The graph is not running (state: %v)", state)
+	}
+	return nil
+}
+
+// PauseVertex stops a single vertex from running its CheckApply, without any
+// effect on the rest of the graph. Its Watch keeps running, so events are not
+// lost, and a resume will catch up with any changes. Since the vertex doesn't
+// run, the vertices that depend on it won't run either until it is resumed.
+func (g *Graph) PauseVertex(v *Vertex) error {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if v.paused {
+		return fmt.Errorf("%s[%s]: Already paused", v.Kind(), v.GetName())
+	}
+	v.paused = true
+	log.Printf("%s[%s]: Paused", v.Kind(), v.GetName())
+	return nil
+}
+
+// ResumeVertex undoes a PauseVertex, and pokes the vertex so that it runs.
+func (g *Graph) ResumeVertex(v *Vertex) error {
+	if err := g.running(); err != nil {
+		return err
+	}
+	v.mutex.Lock()
+	if !v.paused {
+		v.mutex.Unlock()
+		return fmt.Errorf("%s[%s]: Not paused", v.Kind(), v.GetName())
+	}
+	v.paused = false
+	v.mutex.Unlock()
+	log.Printf("%s[%s]: Resumed", v.Kind(), v.GetName())
+	return v.SendEvent(event.EventPoke, nil)
+}
+
+// ApplyVertex forces a single run of CheckApply on the vertex, which ignores
+// the cached state. This works even if the vertex is paused, in which case it
+// stays paused afterwards.
+func (g *Graph) ApplyVertex(v *Vertex) error {
+	if err := g.running(); err != nil {
+		return err
+	}
+	v.mutex.Lock()
+	v.force = true
+	v.mutex.Unlock()
+	log.Printf("%s[%s]: Forcing CheckApply", v.Kind(), v.GetName())
+	return v.SendEvent(event.EventPoke, nil)
+}
@@ -0,0 +1,306 @@
+// Mgmt
+// Copyright (C) 2013-2016+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package pgraph
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/purpleidea/mgmt/resources"
+
+	errwrap "github.com/pkg/errors"
+)
+
+// GraphJSONVersion is the version of the json graph format. It is increased
+// each time that the format changes in an incompatible way.
+const GraphJSONVersion = 1
+
+// jsonGraph is the top level of the json graph format.
+type jsonGraph struct {
+	Version  int           `json:"version"`
+	Name     string        `json:"name"`
+	Vertices []*jsonVertex `json:"vertices"`
+	Edges    []*jsonEdge   `json:"edges"`
+}
+
+// jsonRef refers to a resource, or to one of its keys when used for send/recv.
+type jsonRef struct {
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+	Key  string `json:"key,omitempty"`
+	// Convert is the conversion requested by a send/recv key, if any.
+	Convert string `json:"convert,omitempty"`
+}
+
+// jsonVertex is a resource in the json graph format. The params contain all of
+// the public fields of the resource, including its name and its metaparams.
+type jsonVertex struct {
+	Kind   string              `json:"kind"`
+	Params json.RawMessage     `json:"params"`
+	Recv   map[string]*jsonRef `json:"recv,omitempty"`  // key -> sender
+	Group  []*jsonVertex       `json:"group,omitempty"` // autogrouped resources
+}
+
+// jsonEdge is an edge in the json graph format.
+type jsonEdge struct {
+	Name   string   `json:"name"`
+	From   *jsonRef `json:"from"`
+	To     *jsonRef `json:"to"`
+	Notify bool     `json:"notify,omitempty"`
+}
+
+// jsonEdges is a list of edges which can be sorted by their vertices.
+type jsonEdges []*jsonEdge
+
+func (es jsonEdges) Len() int      { return len(es) }
+func (es jsonEdges) Swap(i, j int) { es[i], es[j] = es[j], es[i] }
+func (es jsonEdges) Less(i, j int) bool {
+	if a, b := es[i].From.String(), es[j].From.String(); a != b {
+		return a < b
+	}
+	return es[i].To.String() < es[j].To.String()
+}
+
+// String returns the canonical form of the resource that this refers to.
+func (obj *jsonRef) String() string {
+	return fmt.Sprintf("%s[%s]", obj.Kind, obj.Name)
+}
+
+// marshalRes converts a resource into its json vertex. The secret params, such
+// as passwords and password hashes, are tagged to be left out of the json, and
+// so are the params which receive their value from a secret with send/recv.
+func marshalRes(res resources.Res) (*jsonVertex, error) {
+	value := reflect.ValueOf(res)
+	copied := false
+	for key := range res.GetRecv() {
+		if !secretKey(res, key, make(map[string]bool)) {
+			continue
+		}
+		if !copied { // redact a copy, and not the resource
+			value = reflect.New(value.Type().Elem())
+			value.Elem().Set(reflect.ValueOf(res).Elem())
+			copied = true
+		}
+		if field := value.Elem().FieldByName(key); field.CanSet() {
+			field.Set(reflect.Zero(field.Type()))
+		}
+	}
+	params, err := json.Marshal(value.Interface())
+	if err != nil {
+		return nil, errwrap.Wrapf(err, "can't marshal %s[%s]", res.Kind(), res.GetName())
+	}
+	vertex := &jsonVertex{
+		Kind:   res.Kind(),
+		Params: params,
+	}
+	if recv := res.GetRecv(); len(recv) > 0 {
+		vertex.Recv = make(map[string]*jsonRef)
+		for key, send := range recv {
+			vertex.Recv[key] = &jsonRef{
+				Kind:    send.Res.Kind(),
+				Name:    send.Res.GetName(),
+				Key:     send.Key,
+				Convert: send.Convert,
+			}
+		}
+	}
+	for _, r := range res.GetGroup() {
+		g, err := marshalRes(r)
+		if err != nil {
+			return nil, err
+		}
+		vertex.Group = append(vertex.Group, g)
+	}
+	return vertex, nil
+}
+
+// secretKey returns true if the key of the resource is left out of the json, or
+// if it receives its value from such a key, even through other receivers. The
+// seen keys are skipped, in case the send/recv keys have a cycle.
+func secretKey(res resources.Res, key string, seen map[string]bool) bool {
+	id := fmt.Sprintf("%s[%s].%s", res.Kind(), res.GetName(), key)
+	if seen[id] {
+		return false
+	}
+	seen[id] = true
+	t := reflect.Indirect(reflect.ValueOf(res)).Type()
+	if field, exists := t.FieldByName(key); exists && field.Tag.Get("json") == "-" {
+		return true
+	}
+	if send, exists := res.GetRecv()[key]; exists {
+		return secretKey(send.Res, send.Key, seen)
+	}
+	return false
+}
+
+// snapshot saves the json vertex of the resource, which is what MarshalJSON
+// returns for it from then on. The params are only read by the goroutine which
+// runs the vertex, so that the json is never read while CheckApply or SendRecv
+// are changing them.
+func (v *Vertex) snapshot() error {
+	vertex, err := marshalRes(v.Res)
+	if err != nil {
+		return err
+	}
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.json = vertex
+	return nil
+}
+
+// marshal returns the last snapshot of the json vertex, or the json of the
+// resource if the vertex never ran.
+func (v *Vertex) marshal() (*jsonVertex, error) {
+	v.mutex.Lock()
+	vertex := v.json
+	v.mutex.Unlock()
+	if vertex != nil {
+		return vertex, nil
+	}
+	return marshalRes(v.Res)
+}
+
+// MarshalJSON returns the versioned json representation of the graph. It has
+// all of the vertices with their params and metaparams, their send/recv keys,
+// any autogrouped resources, and all of the edges. Everything is sorted so that
+// two graphs can be compared with a simple diff. The params of the vertices are
+// the ones of their last run, once the graph was started.
+func (g *Graph) MarshalJSON() ([]byte, error) {
+	obj := &jsonGraph{
+		Version:  GraphJSONVersion,
+		Name:     g.GetName(),
+		Vertices: []*jsonVertex{},
+		Edges:    []*jsonEdge{},
+	}
+	vertices := g.GetVerticesSorted()
+	for _, v := range vertices {
+		vertex, err := v.marshal()
+		if err != nil {
+			return nil, err
+		}
+		obj.Vertices = append(obj.Vertices, vertex)
+	}
+	for _, v1 := range vertices {
+		for v2, e := range g.Adjacency[v1] {
+			obj.Edges = append(obj.Edges, &jsonEdge{
+				Name:   e.Name,
+				From:   &jsonRef{Kind: v1.Kind(), Name: v1.GetName()},
+				To:     &jsonRef{Kind: v2.Kind(), Name: v2.GetName()},
+				Notify: e.Notify,
+			})
+		}
+	}
+	sort.Sort(jsonEdges(obj.Edges))
+	return json.Marshal(obj)
+}
+
+// unmarshalRes builds a resource from its json vertex, using the registry of
+// resources. The send/recv keys are resolved later, once all of them exist.
+func unmarshalRes(vertex *jsonVertex) (resources.Res, error) {
+	res, err := resources.NewEmptyNamedResource(strings.ToLower(vertex.Kind))
+	if err != nil {
+		return nil, err
+	}
+	*res.Meta() = resources.DefaultMetaParams // in case they're absent
+	if err := json.Unmarshal(vertex.Params, res); err != nil {
+		return nil, errwrap.Wrapf(err, "can't unmarshal %s", vertex.Kind)
+	}
+	res.SetKind(vertex.Kind)
+	for _, g := range vertex.Group {
+		r, err := unmarshalRes(g)
+		if err != nil {
+			return nil, err
+		}
+		if err := res.GroupRes(r); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// UnmarshalGraph builds a new graph from the json produced by MarshalJSON. The
+// resources are neither validated nor initialized, which is what the engine
+// does with a new graph when it's synchronized with GraphSync.
+func UnmarshalGraph(data []byte) (*Graph, error) {
+	obj := &jsonGraph{}
+	if err := json.Unmarshal(data, obj); err != nil {
+		return nil, err
+	}
+	if obj.Version != GraphJSONVersion {
+		return nil, fmt.Errorf("Unsupported graph version: %d", obj.Version)
+	}
+
+	g := NewGraph(obj.Name)
+	lookup := make(map[string]*Vertex) // kind[name] -> vertex
+	all := make(map[string]resources.Res)
+	recvs := make(map[resources.Res]map[string]*jsonRef)
+	for _, vertex := range obj.Vertices {
+		res, err := unmarshalRes(vertex)
+		if err != nil {
+			return nil, err
+		}
+		v := NewVertex(res)
+		if _, exists := lookup[v.String()]; exists {
+			return nil, fmt.Errorf("Duplicate vertex: %s", v)
+		}
+		lookup[v.String()] = v
+		g.AddVertex(v)
+
+		// the grouped resources can send and receive values too
+		members := append([]resources.Res{res}, res.GetGroup()...)
+		for i, r := range members {
+			all[fmt.Sprintf("%s[%s]", r.Kind(), r.GetName())] = r
+			if i == 0 {
+				recvs[r] = vertex.Recv
+			} else {
+				recvs[r] = vertex.Group[i-1].Recv
+			}
+		}
+	}
+
+	for res, recv := range recvs {
+		if len(recv) == 0 {
+			continue
+		}
+		m := make(map[string]*resources.Send)
+		for key, ref := range recv {
+			send, exists := all[ref.String()]
+			if !exists {
+				return nil, fmt.Errorf("%s[%s]: Unknown sender for key %s: %s", res.Kind(), res.GetName(), key, ref)
+			}
+			m[key] = &resources.Send{Res: send, Key: ref.Key, Convert: ref.Convert}
+		}
+		res.SetRecv(m)
+	}
+
+	for _, edge := range obj.Edges {
+		if edge.From == nil || edge.To == nil {
+			return nil, fmt.Errorf("Edge %s is missing a vertex", edge.Name)
+		}
+		v1, exists1 := lookup[edge.From.String()]
+		v2, exists2 := lookup[edge.To.String()]
+		if !exists1 || !exists2 {
+			return nil, fmt.Errorf("Edge %s has an unknown vertex", edge.Name)
+		}
+		g.AddEdge(v1, v2, &Edge{Name: edge.Name, Notify: edge.Notify})
+	}
+	return g, nil
+}
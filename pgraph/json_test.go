@@ -0,0 +1,186 @@
+// Mgmt
+// Copyright (C) 2013-2016+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package pgraph
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/purpleidea/mgmt/resources"
+)
+
+// TestJSON1 marshals a graph and unmarshals it back, and checks that the same
+// json comes out of it, except for the secrets which are left out.
+func TestJSON1(t *testing.T) {
+	hash := "$6$salt$c2VjcmV0IGhhc2g"
+	secret := "hunter2"
+
+	user, _ := resources.NewUserRes("james", "exists", "")
+	user.HashedPassword = hash
+	password := &resources.PasswordRes{Length: 8, Password: &secret}
+	password.SetName("pass1")
+	password.SetKind("Password")
+	file := &resources.FileRes{Path: "/tmp/mgmt/f1", State: "exists"}
+	file.SetName("f1")
+	file.SetKind("File")
+	file.SetRecv(map[string]*resources.Send{
+		"Content": {Res: password, Key: "Password"},
+	})
+	noop1, _ := resources.NewNoopRes("noop1")
+	noop2, _ := resources.NewNoopRes("noop2")
+	if err := noop1.GroupRes(noop2); err != nil {
+		t.Fatalf("GroupRes failed: %v", err)
+	}
+
+	g := NewGraph("json")
+	v1, v2, v3, v4 := NewVertex(user), NewVertex(password), NewVertex(file), NewVertex(noop1)
+	for _, v := range []*Vertex{v1, v2, v3, v4} {
+		*v.Meta() = resources.DefaultMetaParams
+	}
+	g.AddEdge(v1, v3, NewEdge("e1"))
+	g.AddEdge(v2, v3, &Edge{Name: "e2", Notify: true})
+	g.AddVertex(v4)
+
+	data, err := g.MarshalJSON()
+	if err != nil {
+		t.Fatalf("MarshalJSON failed: %v", err)
+	}
+	for _, s := range []string{hash, secret} {
+		if bytes.Contains(data, []byte(s)) {
+			t.Errorf("The json contains the secret %q:\n%s", s, data)
+		}
+	}
+
+	g2, err := UnmarshalGraph(data)
+	if err != nil {
+		t.Fatalf("UnmarshalGraph failed: %v", err)
+	}
+	data2, err := g2.MarshalJSON()
+	if err != nil {
+		t.Fatalf("MarshalJSON failed: %v", err)
+	}
+	if !bytes.Equal(data, data2) {
+		t.Errorf("The json changed:\n%s\n%s", data, data2)
+	}
+
+	v, err := g2.FindVertex("User", "james")
+	if err != nil {
+		t.Fatalf("The user isn't in the graph: %v", err)
+	}
+	if u := v.Res.(*resources.UserRes); u.HashedPassword != "" {
+		t.Errorf("The password hash was loaded: %s", u.HashedPassword)
+	}
+	v, err = g2.FindVertex("File", "f1")
+	if err != nil {
+		t.Fatalf("The file isn't in the graph: %v", err)
+	}
+	if send := v.Res.GetRecv()["Content"]; send == nil || send.Res.GetName() != "pass1" || send.Key != "Password" {
+		t.Errorf("Wrong recv: %+v", send)
+	}
+	if n := g2.NumEdges(); n != 2 {
+		t.Errorf("Expected 2 edges, got: %d", n)
+	}
+	v, err = g2.FindVertex("Noop", "noop1")
+	if err != nil {
+		t.Fatalf("The noop isn't in the graph: %v", err)
+	}
+	if group := v.Res.GetGroup(); len(group) != 1 || group[0].GetName() != "noop2" {
+		t.Errorf("Wrong group: %v", group)
+	}
+}
+
+// TestJSONSendRecv1 sends a password to a file, which sends it on to another
+// one, and checks that the json of the receivers doesn't contain it either, but
+// that the values which aren't secret are still there.
+func TestJSONSendRecv1(t *testing.T) {
+	secret := "hunter2"
+	public := "hello world"
+
+	password := &resources.PasswordRes{Length: 8, Password: &secret}
+	password.SetName("pass1")
+	password.SetKind("Password")
+	newFile := func(name string, send resources.Res, key string) *resources.FileRes {
+		file := &resources.FileRes{Path: "/tmp/mgmt/" + name, State: "exists"}
+		file.SetName(name)
+		file.SetKind("File")
+		if send != nil {
+			file.SetRecv(map[string]*resources.Send{
+				"Content": {Res: send, Key: key},
+			})
+		}
+		return file
+	}
+	f1 := newFile("f1", password, "Password")
+	f2 := newFile("f2", f1, "Content")
+	f3 := newFile("f3", nil, "")
+	f3.Content = &public
+	f4 := newFile("f4", f3, "Content")
+
+	g := NewGraph("json")
+	for _, res := range []resources.Res{password, f1, f2, f3, f4} {
+		v := NewVertex(res)
+		*v.Meta() = resources.DefaultMetaParams
+		g.AddVertex(v)
+	}
+	for _, file := range []*resources.FileRes{f1, f2, f4} { // in order
+		if _, err := file.SendRecv(file); err != nil {
+			t.Fatalf("SendRecv failed: %v", err)
+		}
+	}
+	if f2.Content == nil || *f2.Content != secret {
+		t.Fatalf("The password wasn't sent")
+	}
+
+	data, err := g.MarshalJSON()
+	if err != nil {
+		t.Fatalf("MarshalJSON failed: %v", err)
+	}
+	if bytes.Contains(data, []byte(secret)) {
+		t.Errorf("The json contains the secret:\n%s", data)
+	}
+	if n := bytes.Count(data, []byte(public)); n != 2 {
+		t.Errorf("The json contains the public content %d times:\n%s", n, data)
+	}
+	if f1.Content == nil || *f1.Content != secret {
+		t.Errorf("The secret was removed from the resource")
+	}
+}
+
+// TestJSONSnapshot1 checks that the json of a vertex which ran is the snapshot
+// of its params, and not what the resource is changing at the moment.
+func TestJSONSnapshot1(t *testing.T) {
+	file := &resources.FileRes{Path: "/tmp/mgmt/f1", State: "exists"}
+	file.SetName("f1")
+	file.SetKind("File")
+	v := NewVertex(file)
+	*v.Meta() = resources.DefaultMetaParams
+	g := NewGraph("json")
+	g.AddVertex(v)
+
+	if err := v.snapshot(); err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	file.Path = "/tmp/mgmt/f2"
+	data, err := g.MarshalJSON()
+	if err != nil {
+		t.Fatalf("MarshalJSON failed: %v", err)
+	}
+	if !bytes.Contains(data, []byte("/tmp/mgmt/f1")) || bytes.Contains(data, []byte("/tmp/mgmt/f2")) {
+		t.Errorf("The json isn't the snapshot:\n%s", data)
+	}
+}
@@ -0,0 +1,129 @@
+// Mgmt
+// Copyright (C) 2013-2016+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package pgraph
+
+import (
+	"log"
+	"sync"
+
+	"github.com/purpleidea/mgmt/util"
+)
+
+// pools contains the semaphores that bound the number of CheckApply runs which
+// can happen simultaneously. It is shared between all copies of a graph, since
+// vertices that survive a graph switch keep running with their original graph.
+type pools struct {
+	mutex  *sync.Mutex                // used when modifying the semaphores
+	global *util.Semaphore            // global limit, nil for unlimited
+	named  map[string]*util.Semaphore // per pool limit, keyed by pool name
+	semas  map[string]*util.Semaphore // from the sema metaparam, keyed by name
+}
+
+// newPools returns a new empty pools struct.
+func newPools() *pools {
+	return &pools{
+		mutex: &sync.Mutex{},
+		named: make(map[string]*util.Semaphore),
+		semas: make(map[string]*util.Semaphore),
+	}
+}
+
+// PoolName returns the name of the parallel pool that a vertex belongs to. If
+// the vertex doesn't belong to any pool, then this returns the empty string. A
+// vertex which sets a parallel limit without naming a pool uses its own kind.
+func PoolName(v *Vertex) string {
+	meta := v.Meta()
+	if meta.Pool != "" {
+		return meta.Pool
+	}
+	if meta.Parallel > 0 {
+		return v.Kind()
+	}
+	return ""
+}
+
+// initPools builds the parallel semaphores for the graph. It is run each time
+// the graph is started so that a graph switch picks up the new limits. If more
+// than one vertex in a pool asks for a size, then the smallest one wins. Since
+// CheckApply might still be running on a previous semaphore, we only replace a
+// semaphore when its size changed, and the runner always releases its own one.
+func (g *Graph) initPools() {
+	g.pools.mutex.Lock()
+	defer g.pools.mutex.Unlock()
+
+	if n := int(g.Flags.MaxParallel); n == 0 {
+		g.pools.global = nil
+	} else if g.pools.global == nil || g.pools.global.Size() != n {
+		g.pools.global = util.NewSemaphore(n)
+	}
+
+	sizes := make(map[string]int)
+	for v := range g.Adjacency {
+		name := PoolName(v)
+		if name == "" {
+			continue
+		}
+		n := int(v.Meta().Parallel)
+		if size, exists := sizes[name]; !exists || (n > 0 && (size == 0 || n < size)) {
+			sizes[name] = n
+		}
+	}
+
+	named := make(map[string]*util.Semaphore)
+	for name, size := range sizes {
+		if size == 0 { // nobody set a limit, so this pool is unlimited
+			continue
+		}
+		if sema, exists := g.pools.named[name]; exists && sema.Size() == size {
+			named[name] = sema // keep it, it might be in use
+			continue
+		}
+		named[name] = util.NewSemaphore(size)
+	}
+	g.pools.named = named
+}
+
+// ParallelAcquire blocks until the vertex is allowed to run its CheckApply. It
+// returns a function which must be called to release the acquired slots. The
+// pool slot is always taken before the global one, which avoids a deadlock.
+func (g *Graph) ParallelAcquire(v *Vertex) func() {
+	var semas []*util.Semaphore
+	g.pools.mutex.Lock()
+	if name := PoolName(v); name != "" {
+		if sema, exists := g.pools.named[name]; exists {
+			semas = append(semas, sema)
+		}
+	}
+	if g.pools.global != nil {
+		semas = append(semas, g.pools.global)
+	}
+	g.pools.mutex.Unlock()
+
+	for _, sema := range semas {
+		if g.Flags.Debug && len(sema.C) == sema.Size() {
+			log.Printf("%s[%s]: Parallel: Waiting for a free slot...", v.Kind(), v.GetName())
+		}
+		sema.P(1) // lock!
+	}
+
+	return func() {
+		for i := len(semas) - 1; i >= 0; i-- { // release in reverse order
+			semas[i].V(1) // unlock!
+		}
+	}
+}
@@ -20,8 +20,10 @@ package pgraph
 
 import (
 	"fmt"
+	"log"
 	"sort"
 	"sync"
+	"time"
 
 	"github.com/purpleidea/mgmt/event"
 	"github.com/purpleidea/mgmt/resources"
@@ -42,7 +44,8 @@ const (
 
 // Flags contains specific constants used by the graph.
 type Flags struct {
-	Debug bool
+	Debug       bool
+	MaxParallel uint16 // maximum number of simultaneous CheckApply runs, 0 for unlimited
 }
 
 // Graph is the graph structure in this library.
@@ -58,12 +61,34 @@ type Graph struct {
 	state     graphState
 	mutex     *sync.Mutex // used when modifying graph State variable
 	wg        *sync.WaitGroup
+	pools     *pools  // semaphores that bound the CheckApply parallelism
+	report    *Report // changes that the noop resources would make
+	reversals *reversals
+	data      *resources.Data // what AssociateData gave the resources
 }
 
 // Vertex is the primary vertex struct in this library.
 type Vertex struct {
-	resources.Res       // anonymous field
-	timestamp     int64 // last updated timestamp ?
+	resources.Res               // anonymous field
+	timestamp     int64         // last updated timestamp ?
+	stray         chan struct{} // closes when a timed out CheckApply returns
+
+	mutex  *sync.Mutex // guards the runtime control fields below
+	paused bool        // is the vertex paused by the user?
+	force  bool        // should the next CheckApply ignore the cached state?
+
+	// the schedule metaparam can defer the changes until its window opens
+	deferred time.Time   // when the window opens, or zero if not deferred
+	window   *time.Timer // pokes the vertex once the window opens
+
+	// the status of the last runs, which is shown on the dashboard
+	lastRun     time.Time // when the last CheckApply finished
+	lastCheckOK bool      // the result of the last CheckApply
+	lastErr     error     // the error of the last CheckApply
+	retry       int       // current CheckApply retry attempt, 0 if none
+	watchRetry  int       // current Watch retry attempt, 0 if none
+
+	json *jsonVertex // the params of the resource when the vertex last ran
 }
 
 // Edge is the primary edge struct in this library.
@@ -81,15 +106,18 @@ func NewGraph(name string) *Graph {
 		Adjacency: make(map[*Vertex]map[*Vertex]*Edge),
 		state:     graphStateNil,
 		// ptr b/c: Mutex/WaitGroup must not be copied after first use
-		mutex: &sync.Mutex{},
-		wg:    &sync.WaitGroup{},
+		mutex:  &sync.Mutex{},
+		wg:     &sync.WaitGroup{},
+		pools:  newPools(),
+		report: NewReport(),
 	}
 }
 
 // NewVertex returns a new graph vertex struct with a contained resource.
 func NewVertex(r resources.Res) *Vertex {
 	return &Vertex{
-		Res: r,
+		Res:   r,
+		mutex: &sync.Mutex{},
 	}
 }
 
@@ -119,6 +147,10 @@ func (g *Graph) Copy() *Graph {
 		state:     g.state,
 		mutex:     g.mutex,
 		wg:        g.wg,
+		pools:     g.pools,
+		report:    g.report,
+		reversals: g.reversals,
+		data:      g.data,
 	}
 	for k, v := range g.Adjacency {
 		newGraph.Adjacency[k] = v // copy
@@ -131,6 +163,11 @@ func (g *Graph) GetName() string {
 	return g.Name
 }
 
+// Report returns the noop report which is shared by every copy of the graph.
+func (g *Graph) Report() *Report {
+	return g.report
+}
+
 // SetName sets the name of the graph.
 func (g *Graph) SetName(name string) {
 	g.Name = name
@@ -531,6 +568,32 @@ func (g *Graph) Reachability(a, b *Vertex) []*Vertex {
 	return result
 }
 
+// CheckConflicts returns an error if two resources of the graph conflict, such
+// as when they would keep undoing the changes of each other. It is meant to run
+// on a new graph, before it gets merged into the old one by GraphSync.
+func (g *Graph) CheckConflicts() error {
+	var all []resources.Res
+	for v := range g.Adjacency {
+		all = append(all, v.Res)
+		all = append(all, v.GetGroup()...)
+	}
+	for _, res := range all {
+		c, ok := res.(resources.Conflicter)
+		if !ok {
+			continue
+		}
+		for _, other := range all {
+			if other == res {
+				continue
+			}
+			if err := c.Conflicts(other); err != nil {
+				return errwrap.Wrapf(err, "%s[%s] conflicts with %s[%s]", res.Kind(), res.GetName(), other.Kind(), other.GetName())
+			}
+		}
+	}
+	return nil
+}
+
 // GraphSync updates the oldGraph so that it matches the newGraph receiver. It
 // leaves identical elements alone so that they don't need to be refreshed.
 // FIXME: add test cases
@@ -540,6 +603,13 @@ func (g *Graph) GraphSync(oldGraph *Graph) (*Graph, error) {
 		oldGraph = NewGraph(g.GetName()) // copy over the name
 	}
 	oldGraph.SetName(g.GetName()) // overwrite the name
+	oldGraph.Flags = g.Flags      // overwrite the flags
+	if g.reversals != nil {
+		oldGraph.reversals = g.reversals
+	}
+	if g.data != nil {
+		oldGraph.data = g.data
+	}
 
 	var lookup = make(map[*Vertex]*Vertex)
 	var vertexKeep []*Vertex // list of vertices which are the same in new graph
@@ -553,6 +623,9 @@ func (g *Graph) GraphSync(oldGraph *Graph) (*Graph, error) {
 			if err := res.Validate(); err != nil {
 				return nil, errwrap.Wrapf(err, "could not Validate() resource")
 			}
+			if _, ok := res.(resources.Reversible); res.Meta().Reverse && !ok {
+				return nil, fmt.Errorf("The %s resource doesn't support the reverse metaparam", res.Kind())
+			}
 			if err := res.Init(); err != nil {
 				return nil, errwrap.Wrapf(err, "could not Init() resource")
 			}
@@ -564,13 +637,35 @@ func (g *Graph) GraphSync(oldGraph *Graph) (*Graph, error) {
 	}
 
 	// get rid of any vertices we shouldn't keep (that aren't in new graph)
+	reversals := make(map[resources.Res]resources.Res) // removed -> reversal
 	for v := range oldGraph.Adjacency {
 		if !VertexContains(v, vertexKeep) {
 			// wait for exit before starting new graph!
 			v.SendEvent(event.EventExit, nil) // sync
+			// store the reversals of the resources that are gone, but
+			// not of the ones that were only changed in the new graph
+			for _, res := range append([]resources.Res{v.Res}, v.GetGroup()...) {
+				if _, err := g.FindVertex(res.Kind(), res.GetName()); err == nil {
+					continue
+				}
+				reversed, err := oldGraph.storeReversal(res)
+				if err != nil {
+					log.Printf("%s[%s]: Reverse: %v", res.Kind(), res.GetName(), err)
+				} else if reversed != nil {
+					reversals[res] = reversed
+				}
+			}
+			oldGraph.report.Del(v.Kind(), v.GetName())
 			oldGraph.DeleteVertex(v)
 		}
 	}
+	// the reversals run now, in place of the resources that they undo
+	for res, reversed := range reversals {
+		if err := oldGraph.addReversal(res, reversed); err != nil {
+			// it's stored, so the next graph swap will retry it
+			log.Printf("%s[%s]: Reverse: %v", res.Kind(), res.GetName(), err)
+		}
+	}
 
 	// compare edges
 	for v1 := range g.Adjacency { // loop through the vertices (resources)
@@ -624,6 +719,7 @@ func (g *Graph) GraphMetas() []*resources.MetaParams {
 
 // AssociateData associates some data with the object in the graph in question.
 func (g *Graph) AssociateData(data *resources.Data) {
+	g.data = data // for the resources which GraphSync adds later
 	for k := range g.Adjacency {
 		k.Res.AssociateData(data)
 	}
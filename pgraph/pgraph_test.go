@@ -24,11 +24,14 @@ import (
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/purpleidea/mgmt/resources"
+	"github.com/purpleidea/mgmt/util"
 )
 
 // NV is a helper function to make testing easier. It creates a new noop vertex.
 func NV(s string) *Vertex {
-	obj, err := NewNoopRes(s)
+	obj, err := resources.NewNoopRes(s)
 	if err != nil {
 		panic(err) // unlikely test failure!
 	}
@@ -623,10 +626,10 @@ func TestPgraphT11(t *testing.T) {
 }
 
 type NoopResTest struct {
-	NoopRes
+	resources.NoopRes
 }
 
-func (obj *NoopResTest) GroupCmp(r Res) bool {
+func (obj *NoopResTest) GroupCmp(r resources.Res) bool {
 	res, ok := r.(*NoopResTest)
 	if !ok {
 		return false
@@ -643,10 +646,10 @@ func (obj *NoopResTest) GroupCmp(r Res) bool {
 
 func NewNoopResTest(name string) *NoopResTest {
 	obj := &NoopResTest{
-		NoopRes: NoopRes{
-			BaseRes: BaseRes{
+		NoopRes: resources.NoopRes{
+			BaseRes: resources.BaseRes{
 				Name: name,
-				MetaParams: MetaParams{
+				MetaParams: resources.MetaParams{
 					AutoGroup: true, // always autogroup
 				},
 			},
@@ -695,7 +698,7 @@ Loop:
 		for _, x1 := range v1.GetGroup() {
 			l1 = append(l1, x1.GetName()) // add my contents
 		}
-		l1 = StrRemoveDuplicatesInList(l1) // remove duplicates
+		l1 = util.StrRemoveDuplicatesInList(l1) // remove duplicates
 		sort.Strings(l1)
 
 		// inner loop
@@ -705,7 +708,7 @@ Loop:
 			for _, x2 := range v2.GetGroup() {
 				l2 = append(l2, x2.GetName())
 			}
-			l2 = StrRemoveDuplicatesInList(l2) // remove duplicates
+			l2 = util.StrRemoveDuplicatesInList(l2) // remove duplicates
 			sort.Strings(l2)
 
 			// does l1 match l2 ?
@@ -738,14 +741,14 @@ Loop:
 			for _, x1 := range vv1.GetGroup() {
 				l1 = append(l1, x1.GetName()) // add my contents
 			}
-			l1 = StrRemoveDuplicatesInList(l1) // remove duplicates
+			l1 = util.StrRemoveDuplicatesInList(l1) // remove duplicates
 			sort.Strings(l1)
 
 			l2 := strings.Split(vv2.GetName(), ",")
 			for _, x2 := range vv2.GetGroup() {
 				l2 = append(l2, x2.GetName())
 			}
-			l2 = StrRemoveDuplicatesInList(l2) // remove duplicates
+			l2 = util.StrRemoveDuplicatesInList(l2) // remove duplicates
 			sort.Strings(l2)
 
 			// does l1 match l2 ?
@@ -782,7 +785,7 @@ func (ag *testGrouper) vertexMerge(v1, v2 *Vertex) (v *Vertex, err error) {
 	for _, n := range obj.GetGroup() {
 		names = append(names, n.GetName()) // add my contents
 	}
-	names = StrRemoveDuplicatesInList(names) // remove duplicates
+	names = util.StrRemoveDuplicatesInList(names) // remove duplicates
 	sort.Strings(names)
 	obj.SetName(strings.Join(names, ","))
 	return // success or fail, and no need to merge the actual vertices!
@@ -793,7 +796,7 @@ func (ag *testGrouper) edgeMerge(e1, e2 *Edge) *Edge {
 	n1 := strings.Split(e1.Name, ",") // load
 	n2 := strings.Split(e2.Name, ",") // load
 	names := append(n1, n2...)
-	names = StrRemoveDuplicatesInList(names) // remove duplicates
+	names = util.StrRemoveDuplicatesInList(names) // remove duplicates
 	sort.Strings(names)
 	return NewEdge(strings.Join(names, ","))
 }
@@ -1300,3 +1303,20 @@ func TestDurationAssumptions(t *testing.T) {
 		t.Errorf("Empty time.Duration is now greater than zero!")
 	}
 }
+
+func TestGraphConflicts1(t *testing.T) {
+	group, _ := resources.NewGroupRes("wheel", "exists")
+	group.Members = []string{"alice"}
+	user, _ := resources.NewUserRes("bob", "exists", "")
+	user.Groups = []string{"wheel"}
+	g := NewGraph("conflicts")
+	g.AddVertex(NewVertex(group), NewVertex(user))
+	if err := g.CheckConflicts(); err == nil {
+		t.Errorf("The conflicting resources were allowed")
+	}
+
+	group.Members = append(group.Members, "bob")
+	if err := g.CheckConflicts(); err != nil {
+		t.Errorf("CheckConflicts failed: %v", err)
+	}
+}
@@ -0,0 +1,126 @@
+// Mgmt
+// Copyright (C) 2013-2016+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package pgraph
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/purpleidea/mgmt/resources"
+)
+
+// ReportEntry is the noop report for a single resource that isn't in the
+// desired state.
+type ReportEntry struct {
+	Kind    string              `json:"kind"`
+	Name    string              `json:"name"`
+	Changes []*resources.Change `json:"changes"`
+}
+
+// Report aggregates the changes that every noop resource in the graph would
+// make. It is shared between all copies of a graph, and is kept up to date as
+// each resource runs its CheckApply, so that it is complete on convergence.
+type Report struct {
+	mutex   *sync.Mutex
+	entries map[string]*ReportEntry // keyed by kind[name]
+}
+
+// NewReport returns a new empty report.
+func NewReport() *Report {
+	return &Report{
+		mutex:   &sync.Mutex{},
+		entries: make(map[string]*ReportEntry),
+	}
+}
+
+// Set stores the list of changes for a resource, replacing any previous ones.
+func (obj *Report) Set(kind, name string, changes []*resources.Change) {
+	obj.mutex.Lock()
+	defer obj.mutex.Unlock()
+	if changes == nil {
+		changes = []*resources.Change{} // so the json output is a list
+	}
+	obj.entries[fmt.Sprintf("%s[%s]", kind, name)] = &ReportEntry{
+		Kind:    kind,
+		Name:    name,
+		Changes: changes,
+	}
+}
+
+// Del removes a resource from the report, because it is in the desired state.
+func (obj *Report) Del(kind, name string) {
+	obj.mutex.Lock()
+	defer obj.mutex.Unlock()
+	delete(obj.entries, fmt.Sprintf("%s[%s]", kind, name))
+}
+
+// Entries returns the list of report entries, sorted by kind and name.
+func (obj *Report) Entries() []*ReportEntry {
+	obj.mutex.Lock()
+	defer obj.mutex.Unlock()
+	keys := []string{}
+	for k := range obj.entries {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	entries := []*ReportEntry{}
+	for _, k := range keys {
+		entries = append(entries, obj.entries[k])
+	}
+	return entries
+}
+
+// JSON returns the report as a json document.
+func (obj *Report) JSON() ([]byte, error) {
+	return json.MarshalIndent(struct {
+		Resources []*ReportEntry `json:"resources"`
+	}{
+		Resources: obj.Entries(),
+	}, "", "\t")
+}
+
+// Text returns the report as human readable text.
+func (obj *Report) Text() string {
+	entries := obj.Entries()
+	if len(entries) == 0 {
+		return "No changes.\n"
+	}
+	buf := &bytes.Buffer{}
+	for _, entry := range entries {
+		fmt.Fprintf(buf, "%s[%s]:\n", entry.Kind, entry.Name)
+		if len(entry.Changes) == 0 {
+			fmt.Fprintf(buf, "\t(not in the desired state)\n")
+		}
+		for _, change := range entry.Changes {
+			fmt.Fprintf(buf, "\t%s\n", change.String())
+			if change.Diff == "" {
+				continue
+			}
+			for _, line := range strings.SplitAfter(strings.TrimSuffix(change.Diff, "\n"), "\n") {
+				fmt.Fprintf(buf, "\t\t%s", line)
+			}
+			fmt.Fprintf(buf, "\n")
+		}
+	}
+	fmt.Fprintf(buf, "%d resource(s) would change.\n", len(entries))
+	return buf.String()
+}
@@ -0,0 +1,183 @@
+// Mgmt
+// Copyright (C) 2013-2016+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package pgraph
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/purpleidea/mgmt/resources"
+
+	errwrap "github.com/pkg/errors"
+)
+
+// reverseExt is the file extension used for the stored reversals.
+const reverseExt = ".res"
+
+// reversals keeps track of the pending reversals. Each one is stored in its own
+// file in the dir, so that they survive a restart, until they've been applied.
+type reversals struct {
+	dir     string
+	mutex   *sync.Mutex
+	pending map[string]bool // paths of the reversals which are in the graph
+}
+
+// file returns the path of the file where the reversal of a resource is stored.
+// The name is hashed, since it could contain any character, such as a slash.
+func (obj *reversals) file(kind, name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return path.Join(obj.dir, fmt.Sprintf("%s-%x%s", strings.ToLower(kind), sum, reverseExt))
+}
+
+// LoadReversals adds the pending reversals which are stored in the dir to the
+// graph, so that they get applied. If the graph already contains a resource of
+// the same kind and name, it has come back, and the reversal is dropped. This
+// must run before the data is associated with the graph, and before GraphSync,
+// which stores the reversals of the removed resources in this same dir, and
+// adds them to the graph that it returns.
+func (g *Graph) LoadReversals(dir string) error {
+	if err := os.MkdirAll(dir, 0770); err != nil {
+		return errwrap.Wrapf(err, "can't create reverse dir")
+	}
+	g.reversals = &reversals{
+		dir:     dir,
+		mutex:   &sync.Mutex{},
+		pending: make(map[string]bool),
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return errwrap.Wrapf(err, "can't read reverse dir")
+	}
+
+	existing := make(map[string]bool) // the files of the resources we have
+	for v := range g.Adjacency {
+		existing[g.reversals.file(v.Kind(), v.GetName())] = true
+	}
+	for _, fi := range files {
+		if fi.IsDir() || !strings.HasSuffix(fi.Name(), reverseExt) {
+			continue
+		}
+		p := path.Join(dir, fi.Name())
+		if existing[p] { // it's back, so there's nothing to undo
+			log.Printf("Reverse: Dropping %s, the resource is back", p)
+			if err := os.Remove(p); err != nil {
+				return errwrap.Wrapf(err, "can't remove reversal: %s", p)
+			}
+			continue
+		}
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			return errwrap.Wrapf(err, "can't read reversal: %s", p)
+		}
+		res, err := resources.B64ToRes(strings.TrimSpace(string(data)))
+		if err != nil {
+			log.Printf("Reverse: Removing invalid reversal %s: %v", p, err)
+			os.Remove(p)
+			continue
+		}
+		log.Printf("Reverse: %s: Pending", res.GetName())
+		g.AddVertex(NewVertex(res))
+		g.reversals.pending[p] = true
+	}
+	return nil
+}
+
+// storeReversal stores the reversal of a resource which is being removed from
+// the graph, if the reverse metaparam asks for it. It returns the reversal, or
+// nil if there's nothing to undo.
+func (g *Graph) storeReversal(res resources.Res) (resources.Res, error) {
+	if g.reversals == nil || !res.Meta().Reverse {
+		return nil, nil
+	}
+	r, ok := res.(resources.Reversible)
+	if !ok {
+		return nil, fmt.Errorf("%s[%s]: The resource can't be reversed", res.Kind(), res.GetName())
+	}
+	reversed, err := r.Reversed()
+	if err != nil {
+		return nil, errwrap.Wrapf(err, "%s[%s]: Reversed() failed", res.Kind(), res.GetName())
+	}
+	if reversed == nil {
+		return nil, nil // nothing to undo
+	}
+	str, err := resources.ResToB64(reversed)
+	if err != nil {
+		return nil, err
+	}
+	g.reversals.mutex.Lock()
+	defer g.reversals.mutex.Unlock()
+	p := g.reversals.file(res.Kind(), res.GetName())
+	if err := ioutil.WriteFile(p, []byte(str+"\n"), 0600); err != nil {
+		return nil, errwrap.Wrapf(err, "can't store reversal")
+	}
+	log.Printf("%s[%s]: Reversal stored", res.Kind(), res.GetName())
+	return reversed, nil
+}
+
+// addReversal adds the reversal of a resource that was just removed to the
+// graph. This way it runs in the same graph swap which removed the resource,
+// instead of waiting for LoadReversals to find it during the next one, which
+// never comes with a static graph. The reversal keeps the noop metaparam of
+// the resource that it undoes, since it could be the global one.
+func (g *Graph) addReversal(res, reversed resources.Res) error {
+	reversed.Meta().Noop = res.Meta().Noop
+	if err := reversed.Validate(); err != nil {
+		return errwrap.Wrapf(err, "could not Validate() reversal")
+	}
+	if g.data != nil {
+		reversed.AssociateData(g.data)
+	}
+	if err := reversed.Init(); err != nil {
+		return errwrap.Wrapf(err, "could not Init() reversal")
+	}
+	g.AddVertex(NewVertex(reversed))
+
+	g.reversals.mutex.Lock()
+	defer g.reversals.mutex.Unlock()
+	g.reversals.pending[g.reversals.file(res.Kind(), res.GetName())] = true
+	log.Printf("%s[%s]: Reversal pending", res.Kind(), res.GetName())
+	return nil
+}
+
+// reversed is called when a vertex was applied successfully. If it contained a
+// pending reversal, that one is now done, and won't be loaded again.
+func (g *Graph) reversed(v *Vertex) {
+	if g.reversals == nil {
+		return
+	}
+	g.reversals.mutex.Lock()
+	defer g.reversals.mutex.Unlock()
+	for _, res := range append([]resources.Res{v.Res}, v.GetGroup()...) {
+		p := g.reversals.file(res.Kind(), res.GetName())
+		if !g.reversals.pending[p] {
+			continue
+		}
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			log.Printf("%s[%s]: Can't remove reversal: %v", res.Kind(), res.GetName(), err)
+			continue
+		}
+		delete(g.reversals.pending, p)
+		log.Printf("%s[%s]: Reversal applied", res.Kind(), res.GetName())
+	}
+}
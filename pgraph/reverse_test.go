@@ -0,0 +1,102 @@
+// Mgmt
+// Copyright (C) 2013-2016+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package pgraph
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/purpleidea/mgmt/resources"
+)
+
+// reverseGraph returns a graph with the reversals of the dir loaded, and the
+// resources added to it.
+func reverseGraph(t *testing.T, dir string, res ...resources.Res) *Graph {
+	g := NewGraph("reverse")
+	for _, r := range res {
+		g.AddVertex(NewVertex(r))
+	}
+	if err := g.LoadReversals(dir); err != nil {
+		t.Fatalf("LoadReversals failed: %v", err)
+	}
+	return g
+}
+
+// TestReverse1 removes a resource from the graph, and checks that its reversal
+// is in the graph that the same GraphSync returns, and that it's applied.
+func TestReverse1(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mgmt-reverse-")
+	if err != nil {
+		t.Fatalf("Can't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	p := path.Join(dir, "file1")
+	content := "hello\n"
+
+	file, err := resources.NewFileRes("file1", p, "", "", &content, "", "exists", false, false)
+	if err != nil {
+		t.Fatalf("NewFileRes failed: %v", err)
+	}
+	file.Meta().Reverse = true
+	oldGraph, err := reverseGraph(t, path.Join(dir, "reverse"), file).GraphSync(nil)
+	if err != nil {
+		t.Fatalf("GraphSync failed: %v", err)
+	}
+	if _, err := file.CheckApply(true); err != nil {
+		t.Fatalf("CheckApply failed: %v", err)
+	}
+
+	// the file is removed from the graph, so its reversal runs instead
+	newGraph, err := reverseGraph(t, path.Join(dir, "reverse")).GraphSync(oldGraph)
+	if err != nil {
+		t.Fatalf("GraphSync failed: %v", err)
+	}
+	v, err := newGraph.FindVertex("File", "file1")
+	if err != nil {
+		t.Fatalf("The reversal isn't in the graph: %v", err)
+	}
+	if v.Res == resources.Res(file) {
+		t.Fatalf("The removed resource is still in the graph")
+	}
+	files, _ := ioutil.ReadDir(path.Join(dir, "reverse"))
+	if len(files) != 1 {
+		t.Fatalf("Expected one stored reversal, got: %d", len(files))
+	}
+
+	if _, err := v.Res.CheckApply(true); err != nil {
+		t.Fatalf("CheckApply of the reversal failed: %v", err)
+	}
+	newGraph.reversed(v)
+	if _, err := os.Stat(p); !os.IsNotExist(err) {
+		t.Errorf("The reversal didn't remove the file: %v", err)
+	}
+	if files, _ := ioutil.ReadDir(path.Join(dir, "reverse")); len(files) != 0 {
+		t.Errorf("The applied reversal is still stored")
+	}
+
+	// once it's applied, the next graph doesn't contain it anymore
+	lastGraph, err := reverseGraph(t, path.Join(dir, "reverse")).GraphSync(newGraph)
+	if err != nil {
+		t.Fatalf("GraphSync failed: %v", err)
+	}
+	if n := lastGraph.NumVertices(); n != 0 {
+		t.Errorf("Expected an empty graph, got %d vertices", n)
+	}
+}
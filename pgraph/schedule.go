@@ -0,0 +1,104 @@
+// Mgmt
+// Copyright (C) 2013-2016+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package pgraph
+
+import (
+	"log"
+	"time"
+
+	"github.com/purpleidea/mgmt/event"
+	"github.com/purpleidea/mgmt/resources"
+)
+
+// scheduleOpen returns true if the schedule metaparam allows the vertex to make
+// changes right now. An autogrouped vertex needs the windows of all of its
+// members to be open. Otherwise it also returns when it should check again,
+// which is the zero time if that will never happen.
+func scheduleOpen(v *Vertex, t time.Time) (bool, time.Time) {
+	open := true
+	var next time.Time
+	for _, res := range append([]resources.Res{v.Res}, v.GetGroup()...) {
+		ok, x, err := resources.ScheduleOpen(res.Meta().Schedule, t)
+		if err != nil { // already rejected by Validate
+			log.Printf("%s[%s]: Schedule: %v", v.Kind(), v.GetName(), err)
+			continue
+		}
+		if ok {
+			continue
+		}
+		if x.IsZero() { // this one never opens, so neither does the group
+			return false, time.Time{}
+		}
+		open = false
+		if x.After(next) { // the last one to open is the earliest chance
+			next = x
+		}
+	}
+	return open, next
+}
+
+// Deferred returns when the schedule window of a deferred vertex opens, and the
+// zero time if the vertex isn't deferred.
+func (v *Vertex) Deferred() time.Time {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	return v.deferred
+}
+
+// setDeferred marks the vertex as deferred until the time, and pokes it then,
+// so that the changes which it skipped get applied once the window opens. The
+// zero time clears the deferral. The poke is dropped if the graph isn't running
+// at that point, since a start pokes every vertex anyways.
+func (g *Graph) setDeferred(v *Vertex, t time.Time) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if v.window != nil {
+		v.window.Stop()
+		v.window = nil
+	}
+	if t.IsZero() {
+		if !v.deferred.IsZero() {
+			log.Printf("%s[%s]: Schedule: Window is open", v.Kind(), v.GetName())
+		}
+		v.deferred = time.Time{}
+		return
+	}
+	if !t.Equal(v.deferred) {
+		log.Printf("%s[%s]: Schedule: Deferred until %s", v.Kind(), v.GetName(), t.Format(time.RFC3339))
+	}
+	v.deferred = t
+	v.window = time.AfterFunc(t.Sub(time.Now()), func() {
+		if err := g.running(); err != nil {
+			return
+		}
+		v.SendEvent(event.EventPoke, nil)
+	})
+}
+
+// stopDeferred stops the pending pokes of the deferred vertices, which is done
+// before the graph is paused or exits, since the vertices can't take them then.
+func (g *Graph) stopDeferred() {
+	for v := range g.Adjacency {
+		v.mutex.Lock()
+		if v.window != nil {
+			v.window.Stop()
+			v.window = nil
+		}
+		v.mutex.Unlock()
+	}
+}
@@ -0,0 +1,140 @@
+// Mgmt
+// Copyright (C) 2013-2016+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package pgraph
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/purpleidea/mgmt/resources"
+)
+
+func TestSchedule1(t *testing.T) {
+	now := time.Date(2017, time.March, 1, 10, 7, 30, 0, time.UTC) // a wednesday
+	tests := []struct {
+		windows []string
+		open    bool
+		next    string
+	}{
+		{[]string{}, true, ""},
+		{[]string{"TZ=UTC * 9-17 * * mon-fri"}, true, ""},
+		{[]string{"TZ=UTC * 22-23,0-5 * * *"}, false, "2017-03-01T22:00:00Z"},
+		{[]string{"TZ=UTC * * * * sat,sun", "TZ=UTC 0-29 12 * * *"}, false, "2017-03-01T12:00:00Z"},
+		{[]string{"TZ=UTC * 22-23,0-5 * * *", "TZ=UTC 0-9 10 * * *"}, true, ""},
+	}
+	for i, x := range tests {
+		open, next, err := resources.ScheduleOpen(x.windows, now)
+		if err != nil {
+			t.Errorf("Test %d failed: %v", i, err)
+			continue
+		}
+		if open != x.open {
+			t.Errorf("Test %d: open = %t, expected: %t", i, open, x.open)
+		}
+		s := ""
+		if !next.IsZero() {
+			s = next.UTC().Format(time.RFC3339)
+		}
+		if s != x.next {
+			t.Errorf("Test %d: next = %q, expected: %q", i, s, x.next)
+		}
+	}
+	for _, window := range []string{"TZ=Nowhere/Special * * * * *", "TZ=UTC", "* * *"} {
+		if _, err := resources.ParseSchedule(window); err == nil {
+			t.Errorf("ParseSchedule(%q) should have failed", window)
+		}
+	}
+}
+
+// dirtyRes is a noop resource whose state is never okay.
+type dirtyRes struct {
+	resources.NoopRes
+	applied int
+}
+
+func (obj *dirtyRes) CheckApply(apply bool) (bool, error) {
+	if apply {
+		obj.applied++
+	}
+	return false, nil
+}
+
+// newDirtyVertex returns a vertex which always has something to change.
+func newDirtyVertex(t *testing.T, name string) (*Vertex, *dirtyRes) {
+	obj := &dirtyRes{}
+	obj.Name = name
+	obj.MetaParams = resources.DefaultMetaParams
+	if err := obj.Init(); err != nil {
+		t.Fatalf("Init failed: %v", err)
+	}
+	return NewVertex(obj), obj
+}
+
+// TestScheduleDefer1 processes a vertex outside of its schedule window, and
+// checks that it doesn't change anything, and that the vertices after it keep
+// waiting for it until it runs in its window.
+func TestScheduleDefer1(t *testing.T) {
+	g := NewGraph("schedule")
+	v1, res1 := newDirtyVertex(t, "v1")
+	v2, _ := newDirtyVertex(t, "v2")
+	g.AddEdge(v1, v2, NewEdge("e1"))
+	defer g.stopDeferred()
+
+	hour := (time.Now().UTC().Hour() + 2) % 24 // the window isn't open now
+	v1.Meta().Schedule = []string{fmt.Sprintf("TZ=UTC * %d * * *", hour)}
+	if err := g.Process(v1); err != nil {
+		t.Fatalf("Process failed: %v", err)
+	}
+	if res1.applied != 0 {
+		t.Errorf("The deferred vertex changed something")
+	}
+	if v1.Deferred().IsZero() {
+		t.Errorf("The vertex isn't deferred")
+	}
+	if v1.GetTimestamp() != 0 {
+		t.Errorf("The deferred vertex updated its timestamp")
+	}
+	if g.OKTimestamp(v2) {
+		t.Errorf("The vertex after the deferred one can run")
+	}
+	status := g.vertexStatus(v1)
+	if status.Deferred == nil || !status.Deferred.Equal(v1.Deferred()) {
+		t.Errorf("Wrong deferral in the status: %v", status.Deferred)
+	}
+
+	v1.Meta().Schedule = []string{} // the window opens
+	if err := g.Process(v1); err != nil {
+		t.Fatalf("Process failed: %v", err)
+	}
+	if res1.applied != 1 {
+		t.Errorf("The vertex didn't apply in its window")
+	}
+	if !v1.Deferred().IsZero() || v1.GetTimestamp() == 0 || !g.OKTimestamp(v2) {
+		t.Errorf("The vertex is still deferred")
+	}
+	data, err := json.Marshal(g.vertexStatus(v1))
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	if strings.Contains(string(data), "deferred") {
+		t.Errorf("The status has a deferral: %s", data)
+	}
+}
@@ -0,0 +1,115 @@
+// Mgmt
+// Copyright (C) 2013-2016+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package pgraph
+
+import (
+	"log"
+	"sort"
+	"time"
+
+	"github.com/purpleidea/mgmt/resources"
+	"github.com/purpleidea/mgmt/util"
+)
+
+// SemaNames returns the sorted list of semaphore names that a vertex needs to
+// hold while it runs. This includes the semaphores of any grouped resources,
+// since they all run within the same CheckApply. Invalid entries are skipped,
+// since they were already rejected by Validate.
+func SemaNames(v *Vertex) []string {
+	names := []string{}
+	for _, res := range append([]resources.Res{v.Res}, v.GetGroup()...) {
+		for _, id := range res.Meta().Sema {
+			if name, _, err := resources.ParseSema(id); err == nil {
+				names = append(names, name)
+			}
+		}
+	}
+	names = util.StrRemoveDuplicatesInList(names)
+	sort.Strings(names) // a global order, so that we can never deadlock
+	return names
+}
+
+// initSemas builds the semaphores of the sema metaparam. Like initPools, it is
+// run each time the graph is started, and the smallest count of each semaphore
+// wins. A semaphore is only replaced when its size changed, since it might be
+// in use by a CheckApply that is still running.
+func (g *Graph) initSemas() {
+	g.pools.mutex.Lock()
+	defer g.pools.mutex.Unlock()
+
+	sizes := make(map[string]int)
+	for v := range g.Adjacency {
+		for _, res := range append([]resources.Res{v.Res}, v.GetGroup()...) {
+			for _, id := range res.Meta().Sema {
+				name, count, err := resources.ParseSema(id)
+				if err != nil {
+					continue
+				}
+				if size, exists := sizes[name]; !exists || count < size {
+					sizes[name] = count
+				}
+			}
+		}
+	}
+
+	semas := make(map[string]*util.Semaphore)
+	for name, size := range sizes {
+		if sema, exists := g.pools.semas[name]; exists && sema.Size() == size {
+			semas[name] = sema // keep it, it might be in use
+			continue
+		}
+		semas[name] = util.NewSemaphore(size)
+	}
+	g.pools.semas = semas
+}
+
+// SemaAcquire blocks until the vertex holds all of the semaphores it needs. It
+// returns a function which must be called to release them. The semaphores are
+// always taken in sorted order, which avoids a deadlock between two vertices
+// which need the same ones. The time spent waiting is exported to prometheus.
+func (g *Graph) SemaAcquire(v *Vertex) func() {
+	var names []string
+	var semas []*util.Semaphore
+	g.pools.mutex.Lock()
+	for _, name := range SemaNames(v) {
+		if sema, exists := g.pools.semas[name]; exists {
+			names = append(names, name)
+			semas = append(semas, sema)
+		}
+	}
+	g.pools.mutex.Unlock()
+
+	for i, sema := range semas {
+		if g.Flags.Debug && len(sema.C) == sema.Size() {
+			log.Printf("%s[%s]: Sema: Waiting for: %s", v.Kind(), v.GetName(), names[i])
+		}
+		start := time.Now()
+		sema.P(1) // lock!
+		if p := v.Res.Prometheus(); p != nil {
+			if err := p.UpdateSemaWait(v.Kind(), names[i], time.Since(start)); err != nil {
+				log.Printf("%s[%s]: Prometheus.UpdateSemaWait() errored: %v", v.Kind(), v.GetName(), err)
+			}
+		}
+	}
+
+	return func() {
+		for i := len(semas) - 1; i >= 0; i-- { // release in reverse order
+			semas[i].V(1) // unlock!
+		}
+	}
+}
@@ -0,0 +1,82 @@
+// Mgmt
+// Copyright (C) 2013-2016+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package pgraph
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/purpleidea/mgmt/resources"
+
+	multierr "github.com/hashicorp/go-multierror"
+)
+
+// CheckSendRecv is a type checker that verifies all the send->recv mappings in
+// the graph. Each field must pass resources.CheckRecv, and the sender must run
+// in a vertex which is an ancestor of the receiver, or it wouldn't be certain
+// to have run first. Since this is meant to run on a new graph, before the
+// autoedges are added, only the explicit edges count for this. It returns an
+// error listing every broken mapping, or nil if they're all fine.
+func (g *Graph) CheckSendRecv() error {
+	// Reachability would recurse forever if this wasn't a dag
+	if _, err := g.TopologicalSort(); err != nil {
+		return err
+	}
+
+	owner := make(map[resources.Res]*Vertex) // which vertex runs each res
+	for v := range g.Adjacency {
+		owner[v.Res] = v
+		for _, res := range v.GetGroup() {
+			owner[res] = v
+		}
+	}
+
+	var err error
+	for _, v := range g.GetVerticesSorted() { // sorted for a stable error
+		for _, res := range append([]resources.Res{v.Res}, v.GetGroup()...) {
+			recv := res.GetRecv()
+			keys := []string{}
+			for key := range recv {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+
+			for _, key := range keys {
+				send := recv[key]
+				if e := resources.CheckRecv(res, key, send); e != nil {
+					err = multierr.Append(err, e)
+					continue
+				}
+				str := fmt.Sprintf("%s[%s].%s -> %s[%s].%s", send.Res.Kind(), send.Res.GetName(), send.Key, res.Kind(), res.GetName(), key)
+				sender, exists := owner[send.Res]
+				if !exists {
+					err = multierr.Append(err, fmt.Errorf("%s: Sender is not in the graph", str))
+					continue
+				}
+				if sender == v {
+					err = multierr.Append(err, fmt.Errorf("%s: Sender and receiver are the same vertex", str))
+					continue
+				}
+				if len(g.Reachability(sender, v)) == 0 {
+					err = multierr.Append(err, fmt.Errorf("%s: Sender is not an ancestor of the receiver", str))
+				}
+			}
+		}
+	}
+	return err
+}
@@ -0,0 +1,183 @@
+// Mgmt
+// Copyright (C) 2013-2016+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package pgraph
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/purpleidea/mgmt/resources"
+)
+
+// The colours used for the vertices in the status graph.
+const (
+	statusColorNew      = "white"      // CheckApply never ran
+	statusColorOK       = "palegreen"  // the state was already okay
+	statusColorChanged  = "lightblue"  // the last run changed something
+	statusColorRunning  = "yellow"     // running right now
+	statusColorRetrying = "orange"     // failed, but will be retried
+	statusColorError    = "tomato"     // failed
+	statusColorPaused   = "lightgray"  // paused by the user
+	statusColorDeferred = "khaki"      // waiting for its schedule window
+	statusColorRefresh  = "darkviolet" // border colour for a pending refresh
+	statusColorBorder   = "black"      // border colour otherwise
+)
+
+// VertexStatus is a snapshot of the runtime state of a vertex.
+type VertexStatus struct {
+	Kind       string     `json:"kind"`
+	Name       string     `json:"name"`
+	State      string     `json:"state"`              // the current ResState
+	Paused     bool       `json:"paused,omitempty"`   // paused by the user?
+	Deferred   *time.Time `json:"deferred,omitempty"` // when the schedule window opens, if deferred
+	Refresh    bool       `json:"refresh,omitempty"`  // is a refresh pending?
+	LastRun    time.Time  `json:"lastrun"`            // end of the last CheckApply
+	CheckOK    bool       `json:"checkok"`            // result of the last CheckApply
+	Error      string     `json:"error,omitempty"`    // error of the last CheckApply
+	Retry      int        `json:"retry,omitempty"`    // current CheckApply retry
+	WatchRetry int        `json:"watchretry,omitempty"`
+}
+
+// GraphStatus is a snapshot of the runtime state of the whole graph.
+type GraphStatus struct {
+	Name     string          `json:"name"`
+	State    string          `json:"state"`
+	Vertices []*VertexStatus `json:"vertices"`
+	Edges    []*jsonEdge     `json:"edges"`
+}
+
+// setResult stores the result of a CheckApply run, for the status.
+func (v *Vertex) setResult(checkOK bool, err error) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.lastRun = time.Now()
+	v.lastCheckOK = checkOK
+	v.lastErr = err
+}
+
+// setRetry stores the current retry attempt of an operation, for the status.
+func (v *Vertex) setRetry(operation string, attempt int) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	switch operation {
+	case "CheckApply":
+		v.retry = attempt
+	case "Watch":
+		v.watchRetry = attempt
+	}
+}
+
+// vertexStatus returns a snapshot of the runtime state of the vertex.
+func (g *Graph) vertexStatus(v *Vertex) *VertexStatus {
+	paused, _ := v.control()
+	deferred := v.Deferred()
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	status := &VertexStatus{
+		Kind:       v.Kind(),
+		Name:       v.GetName(),
+		State:      fmt.Sprintf("%v", v.GetState()),
+		Paused:     paused,
+		Refresh:    g.RefreshPending(v),
+		LastRun:    v.lastRun,
+		CheckOK:    v.lastCheckOK,
+		Retry:      v.retry,
+		WatchRetry: v.watchRetry,
+	}
+	if !deferred.IsZero() {
+		status.Deferred = &deferred
+	}
+	if v.lastErr != nil {
+		status.Error = v.lastErr.Error()
+	}
+	return status
+}
+
+// Status returns a snapshot of the runtime state of every vertex in the graph,
+// along with its edges. The vertices and edges are sorted.
+func (g *Graph) Status() *GraphStatus {
+	status := &GraphStatus{
+		Name:     g.GetName(),
+		State:    fmt.Sprintf("%v", g.getState()),
+		Vertices: []*VertexStatus{},
+		Edges:    []*jsonEdge{},
+	}
+	vertices := g.GetVerticesSorted()
+	for _, v := range vertices {
+		status.Vertices = append(status.Vertices, g.vertexStatus(v))
+	}
+	for _, v1 := range vertices {
+		for v2, e := range g.Adjacency[v1] {
+			status.Edges = append(status.Edges, &jsonEdge{
+				Name:   e.Name,
+				From:   &jsonRef{Kind: v1.Kind(), Name: v1.GetName()},
+				To:     &jsonRef{Kind: v2.Kind(), Name: v2.GetName()},
+				Notify: e.Notify,
+			})
+		}
+	}
+	return status
+}
+
+// color returns the fill colour and the tooltip which describe the status.
+func (obj *VertexStatus) color() (string, string) {
+	last := obj.LastRun.Format(time.RFC3339)
+	switch {
+	case obj.Paused:
+		return statusColorPaused, "paused"
+	case obj.State == fmt.Sprintf("%v", resources.ResStateCheckApply):
+		return statusColorRunning, "running"
+	case obj.Error != "" && obj.Retry > 0:
+		return statusColorRetrying, fmt.Sprintf("retry %d: error: %s", obj.Retry, obj.Error)
+	case obj.Error != "":
+		return statusColorError, fmt.Sprintf("error: %s", obj.Error)
+	case obj.Deferred != nil:
+		return statusColorDeferred, fmt.Sprintf("deferred until %s", obj.Deferred.Format(time.RFC3339))
+	case obj.LastRun.IsZero():
+		return statusColorNew, "never ran"
+	case obj.CheckOK:
+		return statusColorOK, fmt.Sprintf("ok at %s", last)
+	}
+	return statusColorChanged, fmt.Sprintf("changed at %s", last)
+}
+
+// Graphviz outputs the status in graphviz format. The vertices are coloured by
+// their state, and the ones with a pending refresh have a coloured border.
+func (obj *GraphStatus) Graphviz() (out string) {
+	out += fmt.Sprintf("digraph %q {\n", obj.Name)
+	out += fmt.Sprintf("\tlabel=%q;\n", fmt.Sprintf("%s (%s)", obj.Name, obj.State))
+	out += "\tnode [style=filled];\n"
+	for _, v := range obj.Vertices {
+		id := fmt.Sprintf("%s[%s]", v.Kind, v.Name)
+		fill, tooltip := v.color()
+		border := statusColorBorder
+		if v.Refresh {
+			border = statusColorRefresh
+		}
+		out += fmt.Sprintf("\t%q [label=%q,fillcolor=%q,color=%q,tooltip=%q];\n", id, id, fill, border, tooltip)
+	}
+	for _, e := range obj.Edges {
+		style := ""
+		if e.Notify {
+			style = ",style=bold"
+		}
+		out += fmt.Sprintf("\t%q -> %q [label=%q%s];\n", e.From.String(), e.To.String(), e.Name, style)
+	}
+	out += "}\n"
+	return
+}
@@ -0,0 +1,146 @@
+// Mgmt
+// Copyright (C) 2013-2016+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package pgraph
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	context "golang.org/x/net/context"
+)
+
+// TimeoutErr is the error returned when a resource operation didn't finish
+// within the time allowed by the timeout metaparam.
+type TimeoutErr struct {
+	Operation string        // the operation that timed out, eg: CheckApply
+	Timeout   time.Duration // how long we waited
+}
+
+// Error returns the error message for the timeout.
+func (obj *TimeoutErr) Error() string {
+	return fmt.Sprintf("%s: Timeout after %v", obj.Operation, obj.Timeout)
+}
+
+// timedOut logs the timeout of an operation, and counts it in prometheus.
+func (g *Graph) timedOut(v *Vertex, err *TimeoutErr) {
+	log.Printf("%s[%s]: %v", v.Kind(), v.GetName(), err)
+	if p := v.Res.Prometheus(); p != nil {
+		if promErr := p.UpdateTimeoutTotal(v.Kind(), err.Operation); promErr != nil {
+			log.Printf("%s[%s]: Prometheus.UpdateTimeoutTotal() errored: %v", v.Kind(), v.GetName(), promErr)
+		}
+	}
+}
+
+// CheckApply runs the CheckApply method of the vertex, while enforcing the
+// timeout metaparam. The resource gets a context which is cancelled when the
+// timeout expires, so that it can abort cleanly. If it doesn't return in time,
+// we stop waiting for it and error, but the next run won't start until that
+// stray CheckApply has returned, since two should never run at the same time.
+func (g *Graph) CheckApply(v *Vertex, apply bool) (bool, error) {
+	obj := v.Res
+	ctx := context.Background()
+	timeout := time.Duration(obj.Meta().Timeout) * time.Second
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	if v.stray != nil { // wait for the previous one to finish first
+		select {
+		case <-v.stray:
+			v.stray = nil
+		case <-ctx.Done():
+			err := &TimeoutErr{Operation: "CheckApply", Timeout: timeout}
+			g.timedOut(v, err)
+			return false, err
+		}
+	}
+
+	obj.ResetChanges() // the resource reports what it found
+	obj.SetContext(ctx)
+	if timeout == 0 {
+		return obj.CheckApply(apply) // run it directly
+	}
+
+	type result struct {
+		checkOK bool
+		err     error
+	}
+	ch := make(chan result, 1) // buffered, so a stray run can always send
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		checkOK, err := obj.CheckApply(apply)
+		ch <- result{checkOK, err}
+	}()
+
+	select {
+	case r := <-ch:
+		return r.checkOK, r.err
+	case <-ctx.Done():
+	}
+	select {
+	case r := <-ch: // it might have finished at the same time
+		return r.checkOK, r.err
+	default:
+	}
+
+	v.stray = done // remember it so that we don't run two at once
+	err := &TimeoutErr{Operation: "CheckApply", Timeout: timeout}
+	g.timedOut(v, err)
+	return false, err
+}
+
+// releaseSlots runs the release functions of the slots that the vertex held
+// while it ran. If its CheckApply timed out and is still running, the slots are
+// kept until it returns, since it still counts against the limits.
+func releaseSlots(v *Vertex, release ...func()) {
+	f := func() {
+		for _, fn := range release {
+			fn()
+		}
+	}
+	if v.stray == nil {
+		f()
+		return
+	}
+	go func(stray <-chan struct{}) {
+		<-stray
+		f()
+	}(v.stray)
+}
+
+// watchTimeout watches the startup of the vertex Watch method, and reports if
+// it didn't start within the time allowed by the timeout metaparam. We can't
+// interrupt a stuck Watch, but at least the failure is visible to the user.
+func (g *Graph) watchTimeout(v *Vertex, exit <-chan struct{}) {
+	timeout := time.Duration(v.Meta().Timeout) * time.Second
+	if timeout == 0 {
+		return
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-v.Res.Started():
+	case <-exit:
+	case <-timer.C:
+		g.timedOut(v, &TimeoutErr{Operation: "Watch", Timeout: timeout})
+	}
+}
@@ -0,0 +1,100 @@
+// Mgmt
+// Copyright (C) 2013-2016+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package pgraph
+
+import (
+	"testing"
+	"time"
+
+	"github.com/purpleidea/mgmt/resources"
+)
+
+// blockRes is a noop resource whose CheckApply blocks until it's unblocked.
+type blockRes struct {
+	resources.NoopRes
+	unblock chan struct{}
+}
+
+func (obj *blockRes) CheckApply(apply bool) (bool, error) {
+	<-obj.unblock
+	return false, nil
+}
+
+// newBlockVertex returns a vertex whose CheckApply blocks and times out.
+func newBlockVertex(t *testing.T, name string) (*Vertex, chan struct{}) {
+	obj := &blockRes{unblock: make(chan struct{})}
+	obj.Name = name
+	obj.MetaParams = resources.DefaultMetaParams
+	obj.MetaParams.Timeout = 1
+	if err := obj.Init(); err != nil {
+		t.Fatalf("Init failed: %v", err)
+	}
+	return NewVertex(obj), obj.unblock
+}
+
+// testStraySlots times out the CheckApply of a vertex, and checks that the
+// slot which acquire takes is only given to another vertex once the stray
+// CheckApply has returned.
+func testStraySlots(t *testing.T, g *Graph, v1, v2 *Vertex, unblock chan struct{}, acquire func(*Vertex) func()) {
+	if _, err := g.slotCheckApply(v1, true); err == nil {
+		t.Fatalf("CheckApply didn't time out")
+	}
+
+	acquired := make(chan struct{})
+	go func() {
+		release := acquire(v2)
+		close(acquired)
+		release()
+	}()
+	select {
+	case <-acquired:
+		t.Fatalf("The slot was given away while the stray CheckApply runs")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(unblock) // the stray CheckApply returns
+	select {
+	case <-acquired:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("The slot wasn't released after the stray CheckApply")
+	}
+}
+
+func TestTimeoutParallel1(t *testing.T) {
+	g := NewGraph("timeout")
+	g.Flags.MaxParallel = 1
+	v1, unblock := newBlockVertex(t, "v1")
+	v2, _ := newBlockVertex(t, "v2")
+	g.AddVertex(v1, v2)
+	g.initPools()
+
+	testStraySlots(t, g, v1, v2, unblock, g.ParallelAcquire)
+}
+
+func TestTimeoutSema1(t *testing.T) {
+	g := NewGraph("timeout")
+	v1, unblock := newBlockVertex(t, "v1")
+	v2, _ := newBlockVertex(t, "v2")
+	for _, v := range []*Vertex{v1, v2} {
+		v.Meta().Sema = []string{"lock:1"}
+	}
+	g.AddVertex(v1, v2)
+	g.initSemas()
+
+	testStraySlots(t, g, v1, v2, unblock, g.SemaAcquire)
+}
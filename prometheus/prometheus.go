@@ -22,6 +22,7 @@ package prometheus
 import (
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -37,7 +38,11 @@ type Prometheus struct {
 	Listen string // the listen specification for the net/http server
 
 	checkApplyTotal *prometheus.CounterVec // total of CheckApplies that have been triggered
+	timeoutTotal    *prometheus.CounterVec // total of operations that have timed out
+	retryAttempt    *prometheus.GaugeVec   // current retry attempt of each resource
+	retryDelay      *prometheus.GaugeVec   // delay before the next retry of each resource
 
+	semaWait *prometheus.HistogramVec // time spent waiting for the semaphores
 }
 
 // Init some parameters - currently the Listen address.
@@ -59,6 +64,56 @@ func (obj *Prometheus) Init() error {
 	)
 	prometheus.MustRegister(obj.checkApplyTotal)
 
+	obj.timeoutTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mgmt_timeouts_total",
+			Help: "Number of resource operations that have timed out.",
+		},
+		// Labels for this metric.
+		// kind: resource type: Svc, File, ...
+		// operation: the operation that timed out: CheckApply or Watch
+		[]string{"kind", "operation"},
+	)
+	prometheus.MustRegister(obj.timeoutTotal)
+
+	obj.retryAttempt = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "mgmt_retry_attempt",
+			Help: "Current retry attempt of a resource operation, 0 if not retrying.",
+		},
+		// Labels for this metric.
+		// kind: resource type: Svc, File, ...
+		// name: resource name
+		// operation: the operation being retried: CheckApply or Watch
+		[]string{"kind", "name", "operation"},
+	)
+	prometheus.MustRegister(obj.retryAttempt)
+
+	obj.retryDelay = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "mgmt_retry_delay_seconds",
+			Help: "Delay before the next retry of a resource operation.",
+		},
+		// Labels for this metric.
+		// kind: resource type: Svc, File, ...
+		// name: resource name
+		// operation: the operation being retried: CheckApply or Watch
+		[]string{"kind", "name", "operation"},
+	)
+	prometheus.MustRegister(obj.retryDelay)
+
+	obj.semaWait = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name: "mgmt_sema_wait_seconds",
+			Help: "Time spent waiting to acquire a semaphore before a CheckApply.",
+		},
+		// Labels for this metric.
+		// kind: resource type: Svc, File, ...
+		// sema: name of the semaphore
+		[]string{"kind", "sema"},
+	)
+	prometheus.MustRegister(obj.semaWait)
+
 	return nil
 }
 
@@ -85,3 +140,27 @@ func (obj *Prometheus) UpdateCheckApplyTotal(kind string, apply, eventful, error
 	metric.Inc()
 	return nil
 }
+
+// UpdateTimeoutTotal increments the counter of operations which timed out.
+func (obj *Prometheus) UpdateTimeoutTotal(kind, operation string) error {
+	labels := prometheus.Labels{"kind": kind, "operation": operation}
+	metric := obj.timeoutTotal.With(labels)
+	metric.Inc()
+	return nil
+}
+
+// UpdateRetry sets the current retry attempt and the delay before the next one
+// for a resource operation. An attempt of zero means that we're not retrying.
+func (obj *Prometheus) UpdateRetry(kind, name, operation string, attempt int, delay time.Duration) error {
+	labels := prometheus.Labels{"kind": kind, "name": name, "operation": operation}
+	obj.retryAttempt.With(labels).Set(float64(attempt))
+	obj.retryDelay.With(labels).Set(delay.Seconds())
+	return nil
+}
+
+// UpdateSemaWait records how long a resource waited to acquire a semaphore.
+func (obj *Prometheus) UpdateSemaWait(kind, sema string, wait time.Duration) error {
+	labels := prometheus.Labels{"kind": kind, "sema": sema}
+	obj.semaWait.With(labels).Observe(wait.Seconds())
+	return nil
+}
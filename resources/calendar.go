@@ -0,0 +1,244 @@
+// Mgmt
+// Copyright (C) 2013-2016+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package resources
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// calendarMacros are the shorthands of the common calendar expressions.
+var calendarMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// calendarField describes one of the five fields of a calendar expression.
+type calendarField struct {
+	name  string
+	min   int
+	max   int
+	names []string // the names of the values, starting from min
+}
+
+var calendarFields = []calendarField{
+	{"minute", 0, 59, nil},
+	{"hour", 0, 23, nil},
+	{"day of month", 1, 31, nil},
+	{"month", 1, 12, []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}},
+	{"day of week", 0, 7, []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat", "sun"}},
+}
+
+// Calendar is a parsed calendar expression, in the format of crontab(5): the
+// minute, the hour, the day of the month, the month and the day of the week,
+// each of which is a list of values, ranges such as 1-5, and steps such as */15
+// or 0-30/10. The macros such as @daily work too. It matches the minutes that
+// all the fields match, except that if both days are restricted, then either
+// of them has to match, like with cron.
+type Calendar struct {
+	fields   [5]uint64 // a bit for each value which matches
+	anyDay   bool      // the day of the month is *
+	anyWeek  bool      // the day of the week is *
+	location *time.Location
+}
+
+// ParseCalendar parses the calendar expression. The times are computed in the
+// location, which is the local time if it's nil.
+func ParseCalendar(expr string, location *time.Location) (*Calendar, error) {
+	if location == nil {
+		location = time.Local
+	}
+	if x, exists := calendarMacros[strings.TrimSpace(expr)]; exists {
+		expr = x
+	}
+	parts := strings.Fields(expr)
+	if len(parts) != len(calendarFields) {
+		return nil, fmt.Errorf("Calendar expression %q must have %d fields", expr, len(calendarFields))
+	}
+	obj := &Calendar{
+		anyDay:   parts[2] == "*",
+		anyWeek:  parts[4] == "*",
+		location: location,
+	}
+	for i, field := range calendarFields {
+		bits, err := field.parse(parts[i])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s in %q: %v", field.name, expr, err)
+		}
+		obj.fields[i] = bits
+	}
+	if obj.fields[4]&(1<<7) != 0 { // sunday is both 0 and 7
+		obj.fields[4] |= 1
+	}
+	return obj, nil
+}
+
+// parse returns the bits of the values that the field matches.
+func (obj calendarField) parse(s string) (uint64, error) {
+	var bits uint64
+	for _, item := range strings.Split(s, ",") {
+		step := 1
+		if i := strings.Index(item, "/"); i >= 0 {
+			n, err := strconv.Atoi(item[i+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("bad step %q", item[i+1:])
+			}
+			step, item = n, item[:i]
+		}
+		lo, hi := obj.min, obj.max
+		if item != "*" {
+			var err error
+			bounds := strings.SplitN(item, "-", 2)
+			if lo, err = obj.value(bounds[0]); err != nil {
+				return 0, err
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = obj.value(bounds[1]); err != nil {
+					return 0, err
+				}
+			} else if step > 1 { // 5/10 means from 5 to the end
+				hi = obj.max
+			}
+			if hi < lo {
+				return 0, fmt.Errorf("bad range %q", item)
+			}
+		}
+		for x := lo; x <= hi; x += step {
+			bits |= 1 << uint(x)
+		}
+	}
+	return bits, nil
+}
+
+// value parses a number or a name of the field.
+func (obj calendarField) value(s string) (int, error) {
+	for i, name := range obj.names {
+		if strings.ToLower(s) == name {
+			return obj.min + i, nil
+		}
+	}
+	x, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("bad value %q", s)
+	}
+	if x < obj.min || x > obj.max {
+		return 0, fmt.Errorf("%d is out of range %d-%d", x, obj.min, obj.max)
+	}
+	return x, nil
+}
+
+// has returns true if the field matches the value.
+func (obj *Calendar) has(field, value int) bool {
+	return obj.fields[field]&(1<<uint(value)) != 0
+}
+
+// day returns true if the date matches the days of the month and of the week.
+func (obj *Calendar) day(t time.Time) bool {
+	dom := obj.has(2, t.Day())
+	dow := obj.has(4, int(t.Weekday()))
+	if !obj.anyDay && !obj.anyWeek {
+		return dom || dow
+	}
+	return dom && dow
+}
+
+// Match returns true if the minute of the time matches the expression.
+func (obj *Calendar) Match(t time.Time) bool {
+	t = t.In(obj.location)
+	return obj.has(0, t.Minute()) && obj.has(1, t.Hour()) && obj.has(3, int(t.Month())) && obj.day(t)
+}
+
+// Next returns the first minute after the time which matches the expression.
+// It returns the zero time if there is none, such as for the 30th of February.
+func (obj *Calendar) Next(t time.Time) time.Time {
+	t = t.In(obj.location).Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0) // the days of the week repeat after this
+	for t.Before(limit) {
+		y, m, d := t.Date()
+		var next time.Time
+		switch {
+		case !obj.has(3, int(m)):
+			next = time.Date(y, m+1, 1, 0, 0, 0, 0, obj.location)
+		case !obj.day(t):
+			next = time.Date(y, m, d+1, 0, 0, 0, 0, obj.location)
+		case !obj.has(1, t.Hour()):
+			next = time.Date(y, m, d, t.Hour()+1, 0, 0, 0, obj.location)
+		case !obj.has(0, t.Minute()):
+			next = t.Add(time.Minute)
+		default:
+			return t
+		}
+		if !next.After(t) { // a daylight saving time change went back
+			next = t.Add(time.Minute)
+		}
+		t = next
+	}
+	return time.Time{}
+}
+
+// ScheduleTZ is the prefix of a schedule window which sets its timezone.
+const ScheduleTZ = "TZ="
+
+// ParseSchedule parses a window of the schedule metaparam. This is a calendar
+// expression which matches every minute that is part of the window, and which
+// may start with a TZ=Zone prefix, such as "TZ=Europe/Paris * 9-17 * * 1-5".
+func ParseSchedule(window string) (*Calendar, error) {
+	window = strings.TrimSpace(window)
+	location := time.Local
+	if strings.HasPrefix(window, ScheduleTZ) {
+		parts := strings.SplitN(window, " ", 2)
+		var err error
+		if location, err = time.LoadLocation(strings.TrimPrefix(parts[0], ScheduleTZ)); err != nil {
+			return nil, fmt.Errorf("Invalid schedule timezone in %q: %v", window, err)
+		}
+		window = ""
+		if len(parts) == 2 {
+			window = parts[1]
+		}
+	}
+	return ParseCalendar(window, location)
+}
+
+// ScheduleOpen returns true if the time is inside one of the windows of the
+// schedule metaparam, which is always the case when there aren't any windows.
+// Otherwise it also returns when the next window opens, which is the zero time
+// if none of them ever do.
+func ScheduleOpen(windows []string, t time.Time) (bool, time.Time, error) {
+	var next time.Time
+	for _, window := range windows {
+		c, err := ParseSchedule(window)
+		if err != nil {
+			return false, time.Time{}, err
+		}
+		if c.Match(t) {
+			return true, time.Time{}, nil
+		}
+		if x := c.Next(t); !x.IsZero() && (next.IsZero() || x.Before(next)) {
+			next = x
+		}
+	}
+	return len(windows) == 0, next, nil
+}
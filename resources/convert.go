@@ -0,0 +1,203 @@
+// Mgmt
+// Copyright (C) 2013-2016+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package resources
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// The conversions which can be requested in the Convert field of a Send. Some
+// of them take an argument, which follows the name after a ConvertSep.
+const (
+	ConvertPtr    = "ptr"    // T -> *T or *T -> T, a nil pointer gives zero
+	ConvertParse  = "parse"  // string -> int, uint, float or bool
+	ConvertFormat = "format" // int, uint, float or bool -> string
+	ConvertJoin   = "join"   // []string -> string, the arg is the separator
+	ConvertSplit  = "split"  // string -> []string, the arg is the separator
+	ConvertKey    = "key"    // map[string]T -> T, the arg is the key to use
+)
+
+// ConvertSep separates the name of a conversion from its argument.
+const ConvertSep = ":"
+
+// DefaultConvertSep is the separator used by join and split if none is given.
+const DefaultConvertSep = ","
+
+// parseConvert splits a conversion into its name and its argument.
+func parseConvert(conv string) (name, arg string, hasArg bool) {
+	if i := strings.Index(conv, ConvertSep); i >= 0 {
+		return conv[:i], conv[i+len(ConvertSep):], true
+	}
+	return conv, "", false
+}
+
+// isScalar returns true for the kinds which parse and format can work with.
+func isScalar(kind reflect.Kind) bool {
+	switch kind {
+	case reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+// isStringSlice returns true if the type is a list of strings.
+func isStringSlice(t reflect.Type) bool {
+	return t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.String
+}
+
+// convertibleTo is like the ConvertibleTo of reflect, except that it refuses to
+// convert a number into a string, which in go gives the character of that code
+// point instead of the digits. The format conversion is what gives the digits.
+func convertibleTo(from, to reflect.Type) bool {
+	if isScalar(from.Kind()) && to.Kind() == reflect.String {
+		return false
+	}
+	return from.ConvertibleTo(to)
+}
+
+// ConvertCheck verifies that the conversion can turn a value of the from type
+// into one of the to type. It's the static counterpart of Convert.
+func ConvertCheck(conv string, from, to reflect.Type) error {
+	name, arg, hasArg := parseConvert(conv)
+	ok := false
+	switch name {
+	case ConvertPtr:
+		ok = (from.Kind() == reflect.Ptr && convertibleTo(from.Elem(), to)) ||
+			(to.Kind() == reflect.Ptr && convertibleTo(from, to.Elem()))
+	case ConvertParse:
+		ok = from.Kind() == reflect.String && isScalar(to.Kind())
+	case ConvertFormat:
+		ok = isScalar(from.Kind()) && to.Kind() == reflect.String
+	case ConvertJoin:
+		ok = isStringSlice(from) && to.Kind() == reflect.String
+	case ConvertSplit:
+		ok = from.Kind() == reflect.String && isStringSlice(to)
+	case ConvertKey:
+		if !hasArg || arg == "" {
+			return fmt.Errorf("Conversion %s needs a key", conv)
+		}
+		ok = from.Kind() == reflect.Map && from.Key().Kind() == reflect.String && convertibleTo(from.Elem(), to)
+	default:
+		return fmt.Errorf("Unknown conversion: %s", conv)
+	}
+	if !ok {
+		return fmt.Errorf("Conversion %s can't convert %s to %s", conv, from, to)
+	}
+	return nil
+}
+
+// Convert returns the value converted into the to type with the conversion. It
+// runs ConvertCheck first, but it can still fail if the contents of the value
+// can't be converted, such as when a string doesn't parse as a number.
+func Convert(conv string, value reflect.Value, to reflect.Type) (reflect.Value, error) {
+	if err := ConvertCheck(conv, value.Type(), to); err != nil {
+		return reflect.Value{}, err
+	}
+	name, arg, hasArg := parseConvert(conv)
+	switch name {
+	case ConvertPtr:
+		if value.Kind() == reflect.Ptr && to.Kind() != reflect.Ptr {
+			if value.IsNil() {
+				return reflect.Zero(to), nil
+			}
+			return value.Elem().Convert(to), nil
+		}
+		ptr := reflect.New(to.Elem())
+		ptr.Elem().Set(value.Convert(to.Elem()))
+		return ptr, nil
+
+	case ConvertParse:
+		return parseScalar(value.String(), to)
+
+	case ConvertFormat:
+		return reflect.ValueOf(fmt.Sprintf("%v", value.Interface())).Convert(to), nil
+
+	case ConvertJoin:
+		sep := DefaultConvertSep
+		if hasArg {
+			sep = arg
+		}
+		l := []string{}
+		for i := 0; i < value.Len(); i++ {
+			l = append(l, value.Index(i).String())
+		}
+		return reflect.ValueOf(strings.Join(l, sep)).Convert(to), nil
+
+	case ConvertSplit:
+		sep := DefaultConvertSep
+		if hasArg {
+			sep = arg
+		}
+		out := reflect.MakeSlice(to, 0, 0)
+		if s := value.String(); s != "" { // an empty string is an empty list
+			for _, x := range strings.Split(s, sep) {
+				out = reflect.Append(out, reflect.ValueOf(x).Convert(to.Elem()))
+			}
+		}
+		return out, nil
+
+	case ConvertKey:
+		x := value.MapIndex(reflect.ValueOf(arg).Convert(value.Type().Key()))
+		if !x.IsValid() {
+			return reflect.Value{}, fmt.Errorf("Key %s is missing", arg)
+		}
+		return x.Convert(to), nil
+	}
+	return reflect.Value{}, fmt.Errorf("Unknown conversion: %s", conv) // unreachable
+}
+
+// parseScalar parses the string into a value of the scalar type.
+func parseScalar(s string, to reflect.Type) (reflect.Value, error) {
+	s = strings.TrimSpace(s)
+	out := reflect.New(to).Elem()
+	switch to.Kind() {
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		out.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(s, 0, to.Bits())
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		out.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(s, 0, to.Bits())
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		out.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(s, to.Bits())
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		out.SetFloat(f)
+	default:
+		return reflect.Value{}, fmt.Errorf("Can't parse into %s", to)
+	}
+	return out, nil
+}
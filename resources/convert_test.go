@@ -0,0 +1,88 @@
+// Mgmt
+// Copyright (C) 2013-2016+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package resources
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestConvert1(t *testing.T) {
+	s := "hello"
+	var nilString *string
+	tests := []struct {
+		conv string
+		in   interface{}
+		out  interface{}
+	}{
+		{ConvertPtr, &s, "hello"},
+		{ConvertPtr, nilString, ""},
+		{ConvertPtr, "hello", &s},
+		{ConvertParse, " 42\n", int(42)},
+		{ConvertParse, "0x10", uint16(16)},
+		{ConvertParse, "1.5", float64(1.5)},
+		{ConvertParse, "true", true},
+		{ConvertFormat, int64(-3), "-3"},
+		{ConvertFormat, false, "false"},
+		{ConvertFormat, int(65), "65"},
+		{ConvertJoin, []string{"a", "b"}, "a,b"},
+		{"join: ", []string{"a", "b"}, "a b"},
+		{ConvertSplit, "a,b", []string{"a", "b"}},
+		{ConvertSplit, "", []string{}},
+		{"split:\n", "a\nb", []string{"a", "b"}},
+		{"key:foo", map[string]string{"foo": "bar"}, "bar"},
+	}
+	for _, x := range tests {
+		out, err := Convert(x.conv, reflect.ValueOf(x.in), reflect.TypeOf(x.out))
+		if err != nil {
+			t.Errorf("Convert(%q, %#v) failed: %v", x.conv, x.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(out.Interface(), x.out) {
+			t.Errorf("Convert(%q, %#v) = %#v, expected: %#v", x.conv, x.in, out.Interface(), x.out)
+		}
+	}
+}
+
+func TestConvert2(t *testing.T) {
+	tests := []struct {
+		conv string
+		in   interface{}
+		out  interface{}
+	}{
+		{"nope", "a", "b"},
+		{ConvertPtr, "a", 1},
+		{ConvertParse, "a", 1},         // not a number
+		{ConvertParse, "300", int8(0)}, // out of range
+		{ConvertParse, 1, 1},
+		{ConvertFormat, []int{1}, ""},
+		{ConvertJoin, []int{1}, ""},
+		{ConvertSplit, "a", []int{}},
+		{ConvertKey, map[string]string{}, ""}, // no key given
+		{"key:foo", map[string]string{}, ""},  // missing key
+		{"key:foo", map[int]string{}, ""},
+		{ConvertPtr, 65, new(string)}, // not "A", that's what format is for
+		{ConvertPtr, new(int), ""},
+		{"key:foo", map[string]int{"foo": 65}, ""},
+	}
+	for _, x := range tests {
+		if out, err := Convert(x.conv, reflect.ValueOf(x.in), reflect.TypeOf(x.out)); err == nil {
+			t.Errorf("Convert(%q, %#v) should have failed, got: %#v", x.conv, x.in, out.Interface())
+		}
+	}
+}
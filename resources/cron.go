@@ -0,0 +1,435 @@
+// Mgmt
+// Copyright (C) 2013-2016+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package resources
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/purpleidea/mgmt/event"
+	"github.com/purpleidea/mgmt/util"
+
+	systemd "github.com/coreos/go-systemd/dbus" // change namespace
+	systemdUtil "github.com/coreos/go-systemd/util"
+	errwrap "github.com/pkg/errors"
+)
+
+func init() {
+	RegisterResource("cron", func() Res { return &CronRes{} })
+	gob.Register(&CronRes{})
+}
+
+// cronUnitDir is where the unit files of the cron resource are generated.
+var cronUnitDir = "/etc/systemd/system"
+
+// cronNameRegexp matches the names that can be the prefix of a unit name.
+var cronNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9:_.@\\-]+$`)
+
+// The regexps of the parts of a calendar event, as in systemd.time(7), such as
+// "Mon..Fri *-*-01 09:00:00". A value can be a list, a range or a repetition.
+var (
+	cronWeekdayRegexp = regexp.MustCompile(`^(?i)(mon|tue|wed|thu|fri|sat|sun)[a-z]*((,|\.\.)(mon|tue|wed|thu|fri|sat|sun)[a-z]*)*$`)
+	cronDateRegexp    = regexp.MustCompile(`^([0-9*][0-9,.*/]*-)?[0-9*][0-9,.*/]*[-~][0-9*][0-9,.*/]*$`)
+	cronTimeRegexp    = regexp.MustCompile(`^[0-9*][0-9,.*/]*:[0-9*][0-9,.*/]*(:[0-9*][0-9,.*/]*)?$`)
+)
+
+// cronCalendarShorthands are the calendar events which are a single word.
+var cronCalendarShorthands = []string{"minutely", "hourly", "daily", "weekly", "monthly", "yearly", "annually", "quarterly", "semiannually"}
+
+// CronRes is a systemd timer resource. It generates a .timer unit, and the
+// .service unit which runs the command, and it keeps the timer enabled and
+// started. The name of the resource is the name of the units.
+type CronRes struct {
+	BaseRes            `yaml:",inline"`
+	State              string `yaml:"state"`              // state: exists, absent
+	OnCalendar         string `yaml:"oncalendar"`         // calendar event, as in systemd.time(7)
+	OnBootSec          uint64 `yaml:"onbootsec"`          // seconds after the boot
+	Persistent         bool   `yaml:"persistent"`         // catch up on the runs that were missed
+	RandomizedDelaySec uint64 `yaml:"randomizeddelaysec"` // random delay of up to this many seconds
+	Cmd                string `yaml:"cmd"`                // the ExecStart of the generated service
+	Unit               string `yaml:"unit"`               // an existing unit to activate instead
+
+	svc *SvcRes // the timer unit, which we enable and start
+}
+
+// NewCronRes is a constructor for this resource. It also calls Init() for you.
+func NewCronRes(name, state, onCalendar, cmd string) (*CronRes, error) {
+	obj := &CronRes{
+		BaseRes: BaseRes{
+			Name: name,
+		},
+		State:      state,
+		OnCalendar: onCalendar,
+		Cmd:        cmd,
+	}
+	return obj, obj.Init()
+}
+
+// Default returns some sensible defaults for this resource.
+func (obj *CronRes) Default() Res {
+	return &CronRes{
+		State: "exists",
+	}
+}
+
+// Validate if the params passed in are valid data.
+func (obj *CronRes) Validate() error {
+	if obj.State != "exists" && obj.State != "absent" {
+		return fmt.Errorf("State must be exists or absent.")
+	}
+	if !cronNameRegexp.MatchString(obj.GetName()) {
+		return fmt.Errorf("The name must be a valid unit name.")
+	}
+	if obj.State == "absent" {
+		return obj.BaseRes.Validate()
+	}
+	if obj.OnCalendar == "" && obj.OnBootSec == 0 {
+		return fmt.Errorf("One of OnCalendar or OnBootSec is required.")
+	}
+	if strings.ContainsAny(obj.OnCalendar, "\n") || strings.ContainsAny(obj.Cmd, "\n") {
+		return fmt.Errorf("The unit settings can't contain newlines.")
+	}
+	if obj.OnCalendar != "" {
+		if err := cronCheckCalendar(obj.OnCalendar); err != nil {
+			return err
+		}
+	}
+	if (obj.Cmd == "") == (obj.Unit == "") {
+		return fmt.Errorf("Exactly one of Cmd or Unit is required.")
+	}
+	if obj.Unit != "" && !cronNameRegexp.MatchString(obj.Unit) {
+		return fmt.Errorf("The unit must be a valid unit name.")
+	}
+	return obj.BaseRes.Validate()
+}
+
+// Init runs some startup code for this resource.
+func (obj *CronRes) Init() error {
+	obj.svc = &SvcRes{}
+	obj.svc.Name = obj.timer()
+	obj.svc.State = "running"
+	obj.svc.Startup = "enabled"
+	if obj.State == "absent" {
+		obj.svc.State = "stopped"
+		obj.svc.Startup = "disabled"
+	}
+	if err := obj.svc.Init(); err != nil {
+		return err
+	}
+	obj.BaseRes.kind = "Cron"
+	return obj.BaseRes.Init() // call base init, b/c we're overriding
+}
+
+// timer returns the name of the timer unit.
+func (obj *CronRes) timer() string {
+	return fmt.Sprintf("%s.timer", obj.GetName())
+}
+
+// service returns the name of the unit that the timer activates.
+func (obj *CronRes) service() string {
+	if obj.Unit != "" {
+		return obj.Unit
+	}
+	return fmt.Sprintf("%s.service", obj.GetName())
+}
+
+// files returns the content of the unit files that we generate, by path. The
+// content is empty for the files that must be absent.
+func (obj *CronRes) files() map[string]string {
+	timer := path.Join(cronUnitDir, obj.timer())
+	service := path.Join(cronUnitDir, fmt.Sprintf("%s.service", obj.GetName()))
+	result := map[string]string{timer: "", service: ""}
+	if obj.State == "absent" {
+		return result
+	}
+	result[timer] = obj.timerFile()
+	if obj.Cmd != "" {
+		result[service] = obj.serviceFile()
+	}
+	return result
+}
+
+// timerFile returns the content of the timer unit.
+func (obj *CronRes) timerFile() string {
+	var b bytes.Buffer
+	b.WriteString(unitHeader)
+	fmt.Fprintf(&b, "[Unit]\nDescription=mgmt cron %s\n\n", obj.GetName())
+	fmt.Fprintf(&b, "[Timer]\n")
+	if obj.OnCalendar != "" {
+		fmt.Fprintf(&b, "OnCalendar=%s\n", obj.OnCalendar)
+	}
+	if obj.OnBootSec > 0 {
+		fmt.Fprintf(&b, "OnBootSec=%d\n", obj.OnBootSec)
+	}
+	if obj.Persistent {
+		fmt.Fprintf(&b, "Persistent=true\n")
+	}
+	if obj.RandomizedDelaySec > 0 {
+		fmt.Fprintf(&b, "RandomizedDelaySec=%d\n", obj.RandomizedDelaySec)
+	}
+	fmt.Fprintf(&b, "Unit=%s\n\n", obj.service())
+	fmt.Fprintf(&b, "[Install]\nWantedBy=timers.target\n")
+	return b.String()
+}
+
+// serviceFile returns the content of the service unit which runs the command.
+func (obj *CronRes) serviceFile() string {
+	var b bytes.Buffer
+	b.WriteString(unitHeader)
+	fmt.Fprintf(&b, "[Unit]\nDescription=mgmt cron %s\n\n", obj.GetName())
+	// systemd expands the % specifiers in ExecStart, so we escape them
+	cmd := strings.Replace(obj.Cmd, "%", "%%", -1)
+	fmt.Fprintf(&b, "[Service]\nType=oneshot\nExecStart=%s\n", cmd)
+	return b.String()
+}
+
+// cronCheckCalendar checks the syntax of a calendar event, which is either a
+// shorthand such as daily, or the weekdays, the date, the time and the timezone,
+// each of which is optional, in that order.
+func cronCheckCalendar(calendar string) error {
+	fields := strings.Fields(calendar)
+	if len(fields) == 0 {
+		return fmt.Errorf("OnCalendar can't be blank.")
+	}
+	if len(fields) == 1 && util.StrInList(strings.ToLower(fields[0]), cronCalendarShorthands) {
+		return nil
+	}
+	parts := []*regexp.Regexp{cronWeekdayRegexp, cronDateRegexp, cronTimeRegexp}
+	for i, field := range fields {
+		for len(parts) > 0 && !parts[0].MatchString(field) {
+			parts = parts[1:] // this part was left out
+		}
+		if len(parts) > 0 {
+			parts = parts[1:]
+			continue
+		}
+		if i != len(fields)-1 || i == 0 { // the timezone comes last
+			return fmt.Errorf("Invalid OnCalendar field: %s", field)
+		}
+		if _, err := time.LoadLocation(field); err != nil {
+			return errwrap.Wrapf(err, "Invalid OnCalendar timezone: %s", field)
+		}
+	}
+	return nil
+}
+
+// Watch is the primary listener for this resource and it outputs events. It
+// watches the timer unit, and the unit files so that edits get reverted.
+func (obj *CronRes) Watch(processChan chan *event.Event) error {
+	files := []string{}
+	for p := range obj.files() {
+		files = append(files, p)
+	}
+	return watchUnit(obj, processChan, false, obj.timer(), files...)
+}
+
+// CheckApply checks the resource state and applies the resource if the bool
+// input is true. It returns error info and if the state check passed or not.
+func (obj *CronRes) CheckApply(apply bool) (checkOK bool, err error) {
+	if !systemdUtil.IsRunningSystemd() {
+		return false, fmt.Errorf("Systemd is not running.")
+	}
+
+	files := obj.files()
+	changed, err := unitFilesChanged(files) // the files which aren't right
+	if err != nil {
+		return false, err
+	}
+	exists := true // does the timer unit exist?
+	if _, err := os.Stat(path.Join(cronUnitDir, obj.timer())); os.IsNotExist(err) {
+		exists = false
+	}
+
+	// the timer is stopped and disabled before its files are removed, and
+	// it is started and enabled after they are written
+	var svcOK = true
+	if exists && (obj.State == "absent" || len(changed) == 0) {
+		obj.svc.ResetChanges()
+		if svcOK, err = obj.svc.CheckApply(apply); err != nil {
+			return false, errwrap.Wrapf(err, "Nested svc failed")
+		}
+		for _, x := range obj.svc.Changes() {
+			obj.AddChange(x)
+		}
+	}
+	if svcOK && len(changed) == 0 {
+		return true, nil // we are in the correct state
+	}
+
+	// state is not okay, no work done, exit, but without error
+	if !apply {
+		unitFileChanges(obj, files, changed)
+		if !exists && obj.State == "exists" {
+			obj.AddChange(&Change{Property: "state", Old: "absent", New: "running"})
+		}
+		return false, nil
+	}
+	if len(changed) == 0 {
+		return false, nil // the svc was applied
+	}
+
+	log.Printf("%s[%s]: Apply", obj.Kind(), obj.GetName())
+	if err := writeUnitFiles(files, changed); err != nil {
+		return false, err
+	}
+
+	conn, err := systemd.NewSystemdConnection() // needs root access
+	if err != nil {
+		return false, errwrap.Wrapf(err, "Failed to connect to systemd")
+	}
+	defer conn.Close()
+	if err := conn.Reload(); err != nil { // load the changed units
+		return false, errwrap.Wrapf(err, "Failed to reload systemd")
+	}
+	if obj.State == "absent" {
+		return false, nil
+	}
+
+	// the new schedule only applies once a running timer is restarted
+	result := make(chan string, 1) // catch result information
+	if _, err := conn.TryRestartUnit(obj.timer(), "fail", result); err != nil {
+		return false, errwrap.Wrapf(err, "Failed to restart unit")
+	}
+	if status := <-result; status != "done" {
+		return false, fmt.Errorf("Unknown systemd return string: %v", status)
+	}
+	if _, err := obj.svc.CheckApply(apply); err != nil {
+		return false, errwrap.Wrapf(err, "Nested svc failed")
+	}
+	return false, nil // success
+}
+
+// CronUID is the UID struct for CronRes.
+type CronUID struct {
+	BaseUID
+	name string // the name of the timer
+}
+
+// IFF aka if and only if they are equivalent, return true. If not, false.
+func (obj *CronUID) IFF(uid ResUID) bool {
+	res, ok := uid.(*CronUID)
+	if !ok {
+		return false
+	}
+	return obj.name == res.name
+}
+
+// AutoEdges returns the AutoEdge interface. The svc resource which manages the
+// generated service runs after us, since the service only exists once we made
+// it. The svc resource of an existing unit that we activate runs before us.
+func (obj *CronRes) AutoEdges() AutoEdge {
+	var reversed = obj.Unit != "" // an existing unit happens before us
+	data := []ResUID{
+		&SvcUID{
+			BaseUID: BaseUID{
+				name:     obj.GetName(),
+				kind:     obj.Kind(),
+				reversed: &reversed,
+			},
+			name: strings.TrimSuffix(obj.service(), ".service"), // the svc name
+		},
+	}
+	return &BatchAutoEdges{
+		data: data,
+	}
+}
+
+// UIDs includes all params to make a unique identification of this object.
+// Most resources only return one, although some resources can return multiple.
+func (obj *CronRes) UIDs() []ResUID {
+	x := &CronUID{
+		BaseUID: BaseUID{name: obj.GetName(), kind: obj.Kind()},
+		name:    obj.GetName(),
+	}
+	return append([]ResUID{x}, obj.svc.UIDs()...)
+}
+
+// GroupCmp returns whether two resources can be grouped together or not.
+func (obj *CronRes) GroupCmp(r Res) bool {
+	_, ok := r.(*CronRes)
+	if !ok {
+		return false
+	}
+	return false // not possible atm
+}
+
+// Compare two resources and return if they are equivalent.
+func (obj *CronRes) Compare(res Res) bool {
+	switch res.(type) {
+	case *CronRes:
+		res := res.(*CronRes)
+		if !obj.BaseRes.Compare(res) { // call base Compare
+			return false
+		}
+
+		if obj.Name != res.Name {
+			return false
+		}
+		if obj.State != res.State {
+			return false
+		}
+		if obj.OnCalendar != res.OnCalendar {
+			return false
+		}
+		if obj.OnBootSec != res.OnBootSec {
+			return false
+		}
+		if obj.Persistent != res.Persistent {
+			return false
+		}
+		if obj.RandomizedDelaySec != res.RandomizedDelaySec {
+			return false
+		}
+		if obj.Cmd != res.Cmd {
+			return false
+		}
+		if obj.Unit != res.Unit {
+			return false
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// UnmarshalYAML is the custom unmarshal handler for this struct.
+// It is primarily useful for setting the defaults.
+func (obj *CronRes) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type rawRes CronRes // indirection to avoid infinite recursion
+
+	def := obj.Default()      // get the default
+	res, ok := def.(*CronRes) // put in the right format
+	if !ok {
+		return fmt.Errorf("could not convert to CronRes")
+	}
+	raw := rawRes(*res) // convert; the defaults go here
+
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+
+	*obj = CronRes(raw) // restore from indirection with type conversion!
+	return nil
+}
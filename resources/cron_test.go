@@ -0,0 +1,138 @@
+// Mgmt
+// Copyright (C) 2013-2016+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package resources
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCronFiles1(t *testing.T) {
+	cron, _ := NewCronRes("backup", "exists", "daily", "/usr/bin/backup --all")
+	cron.Persistent = true
+	cron.RandomizedDelaySec = 600
+	if err := cron.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	files := cron.files()
+	timer := unitHeader + `[Unit]
+Description=mgmt cron backup
+
+[Timer]
+OnCalendar=daily
+Persistent=true
+RandomizedDelaySec=600
+Unit=backup.service
+
+[Install]
+WantedBy=timers.target
+`
+	if s := files[cronUnitDir+"/backup.timer"]; s != timer {
+		t.Errorf("Wrong timer unit:\n%s", s)
+	}
+	service := unitHeader + `[Unit]
+Description=mgmt cron backup
+
+[Service]
+Type=oneshot
+ExecStart=/usr/bin/backup --all
+`
+	if s := files[cronUnitDir+"/backup.service"]; s != service {
+		t.Errorf("Wrong service unit:\n%s", s)
+	}
+
+	cron, _ = NewCronRes("backup", "exists", "", "")
+	cron.OnBootSec = 300
+	cron.Unit = "other.service"
+	if err := cron.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	if s := cron.files()[cronUnitDir+"/backup.service"]; s != "" {
+		t.Errorf("The service unit shouldn't be generated:\n%s", s)
+	}
+	cron.Cmd = "/bin/true"
+	if err := cron.Validate(); err == nil {
+		t.Errorf("Both Cmd and Unit were allowed")
+	}
+
+	gone, _ := NewCronRes("backup", "absent", "", "")
+	if err := gone.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	files = gone.files()
+	if len(files) != 2 || files[cronUnitDir+"/backup.timer"] != "" || files[cronUnitDir+"/backup.service"] != "" {
+		t.Errorf("The units should be removed: %v", files)
+	}
+}
+
+func TestCronValidate1(t *testing.T) {
+	for _, f := range []func(*CronRes){
+		func(obj *CronRes) { obj.State = "running" },
+		func(obj *CronRes) { obj.Name = "back/up" },
+		func(obj *CronRes) { obj.OnCalendar = "" },
+		func(obj *CronRes) { obj.OnCalendar = "every day" },
+		func(obj *CronRes) { obj.Cmd = "/bin/true\nExecStart=/bin/false" },
+		func(obj *CronRes) { obj.Cmd = "" },
+		func(obj *CronRes) { obj.Cmd = ""; obj.Unit = "other service" },
+	} {
+		obj, _ := NewCronRes("backup", "exists", "daily", "/usr/bin/backup")
+		f(obj)
+		if err := obj.Validate(); err == nil {
+			t.Errorf("Validate should fail: %+v", obj)
+		}
+	}
+}
+
+func TestCronCalendar1(t *testing.T) {
+	for _, x := range []struct {
+		calendar string
+		valid    bool
+	}{
+		{"daily", true},
+		{"Weekly", true},
+		{"Mon..Fri 09:00", true},
+		{"Sat,Sun *-*-* 10:00:00", true},
+		{"*-*-01 00:00:00 UTC", true},
+		{"2017-03-01", true},
+		{"*-02~03", true},
+		{"*:0/15", true},
+		{"Fri 18:00:30.5 Europe/Paris", true},
+		{"every day", false},
+		{"10:00 Mon", false},
+		{"Mon nope 10:00", false},
+		{"10:00 10:00", false},
+		{"Mon 10:00 Nowhere/Special", false},
+		{"UTC", false},
+		{" ", false},
+	} {
+		if err := cronCheckCalendar(x.calendar); (err == nil) != x.valid {
+			t.Errorf("Calendar %q: valid: %t, error: %v", x.calendar, x.valid, err)
+		}
+	}
+}
+
+func TestCronEscape1(t *testing.T) {
+	cron, _ := NewCronRes("dump", "exists", "daily", "/bin/sh -c 'date +%F > /tmp/%i'")
+	if err := cron.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	service := cron.files()[cronUnitDir+"/dump.service"]
+	if !strings.Contains(service, "\nExecStart=/bin/sh -c 'date +%%F > /tmp/%%i'\n") {
+		t.Errorf("The specifiers weren't escaped:\n%s", service)
+	}
+}
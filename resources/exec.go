@@ -23,8 +23,14 @@ import (
 	"encoding/gob"
 	"fmt"
 	"log"
+	"os"
 	"os/exec"
+	"os/user"
+	"path"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 
 	"github.com/purpleidea/mgmt/event"
 	"github.com/purpleidea/mgmt/util"
@@ -49,6 +55,21 @@ type ExecRes struct {
 	IfCmd      string `yaml:"ifcmd"`      // the if command to run
 	IfShell    string `yaml:"ifshell"`    // the (optional) shell to use to run the if cmd
 	PollInt    int    `yaml:"pollint"`    // the poll interval for the ifcmd
+
+	// These set up the process of the cmd, the watch cmd and the if cmd.
+	Env   map[string]string `yaml:"env"`   // extra environment variables
+	Cwd   string            `yaml:"cwd"`   // the working directory
+	User  string            `yaml:"user"`  // run as this user name or uid
+	Group string            `yaml:"group"` // run as this group name or gid
+	Umask string            `yaml:"umask"` // octal umask, eg: 022
+
+	Creates string `yaml:"creates"` // don't run the cmd if this path exists
+
+	// These are the outputs of the last run of the cmd. They are read only,
+	// and are meant to be used as values to send to other resources.
+	Stdout   *string `yaml:"-"` // the cmd stdout, nil if it never ran
+	Stderr   *string `yaml:"-"` // the cmd stderr, nil if it never ran
+	ExitCode *int    `yaml:"-"` // the cmd exit code, nil if it never ran
 }
 
 // NewExecRes is a constructor for this resource. It also calls Init() for you.
@@ -86,6 +107,18 @@ func (obj *ExecRes) Validate() error {
 		return fmt.Errorf("Don't poll when we have a watch command.")
 	}
 
+	if obj.Cwd != "" && !path.IsAbs(obj.Cwd) {
+		return fmt.Errorf("Cwd must be an absolute path.")
+	}
+	if obj.Creates != "" && !path.IsAbs(obj.Creates) {
+		return fmt.Errorf("Creates must be an absolute path.")
+	}
+	if obj.Umask != "" {
+		if umask, err := strconv.ParseUint(obj.Umask, 8, 32); err != nil || umask > 0777 {
+			return fmt.Errorf("Umask must be an octal value, eg: 022.")
+		}
+	}
+
 	return obj.BaseRes.Validate()
 }
 
@@ -120,22 +153,10 @@ func (obj *ExecRes) Watch(processChan chan *event.Event) error {
 	bufioch, errch := make(chan string), make(chan error)
 
 	if obj.WatchCmd != "" {
-		var cmdName string
-		var cmdArgs []string
-		if obj.WatchShell == "" {
-			// call without a shell
-			// FIXME: are there still whitespace splitting issues?
-			split := strings.Fields(obj.WatchCmd)
-			cmdName = split[0]
-			//d, _ := os.Getwd() // TODO: how does this ever error ?
-			//cmdName = path.Join(d, cmdName)
-			cmdArgs = split[1:]
-		} else {
-			cmdName = obj.Shell // usually bash, or sh
-			cmdArgs = []string{"-c", obj.WatchCmd}
-		}
-		cmd := exec.Command(cmdName, cmdArgs...)
-		//cmd.Dir = "" // look for program in pwd ?
+		cmd, err := obj.command(obj.WatchCmd, obj.WatchShell)
+		if err != nil {
+			return errwrap.Wrapf(err, "Error building watch Cmd")
+		}
 
 		cmdReader, err := cmd.StdoutPipe()
 		if err != nil {
@@ -195,11 +216,95 @@ func (obj *ExecRes) Watch(processChan chan *event.Event) error {
 	}
 }
 
+// command builds the cmd to run with the shell, or without one if it's empty,
+// in which case it is split on whitespace. The process gets the environment,
+// the working directory, the credentials and the umask of the resource.
+func (obj *ExecRes) command(command, shell string) (*exec.Cmd, error) {
+	var cmdName string
+	var cmdArgs []string
+	if shell == "" {
+		// call without a shell
+		// FIXME: are there still whitespace splitting issues?
+		// TODO: we could make the split character user selectable...!
+		split := strings.Fields(command)
+		if len(split) == 0 {
+			return nil, fmt.Errorf("Command can't be empty!")
+		}
+		cmdName = split[0]
+		cmdArgs = split[1:]
+	} else {
+		cmdName = shell // usually bash, or sh
+		cmdArgs = []string{"-c", command}
+	}
+	if obj.Umask != "" { // the umask is process wide, so set it in a shell
+		script := fmt.Sprintf("umask %s && exec \"$0\" \"$@\"", obj.Umask)
+		cmdArgs = append([]string{"-c", script, cmdName}, cmdArgs...)
+		cmdName = "/bin/sh"
+	}
+	cmd := exec.Command(cmdName, cmdArgs...)
+	cmd.Dir = obj.Cwd // empty means the cwd of mgmt
+
+	if len(obj.Env) > 0 { // the variables get added to the env of mgmt
+		cmd.Env = util.MergeEnv(os.Environ(), obj.Env)
+	}
+
+	if obj.User != "" || obj.Group != "" {
+		credential, err := obj.credential()
+		if err != nil {
+			return nil, err
+		}
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: credential}
+	}
+	return cmd, nil
+}
+
+// credential returns the credential to run the cmds with. If only the user is
+// set, its primary group is used, and if only the group is set, we keep our uid.
+// The user also gets its supplementary groups, like it would when logging in.
+// It's looked up each time, since the user might be created by the graph.
+func (obj *ExecRes) credential() (*syscall.Credential, error) {
+	uid, gid := os.Getuid(), os.Getgid()
+	var groups []uint32
+	if obj.User != "" {
+		u, err := user.LookupId(obj.User)
+		if err != nil {
+			if u, err = user.Lookup(obj.User); err != nil {
+				return nil, errwrap.Wrapf(err, "User lookup error (%s)", obj.User)
+			}
+		}
+		if uid, err = strconv.Atoi(u.Uid); err != nil {
+			return nil, err
+		}
+		if gid, err = strconv.Atoi(u.Gid); err != nil {
+			return nil, err
+		}
+		if groups, err = lookupGroupIds(u); err != nil {
+			return nil, err
+		}
+	}
+	if obj.Group != "" {
+		var err error
+		if gid, err = lookupGid(obj.Group); err != nil {
+			return nil, err
+		}
+	}
+	return &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid), Groups: groups}, nil
+}
+
 // CheckApply checks the resource state and applies the resource if the bool
 // input is true. It returns error info and if the state check passed or not.
 // TODO: expand the IfCmd to be a list of commands
 func (obj *ExecRes) CheckApply(apply bool) (checkOK bool, err error) {
 
+	// if the path exists, then the cmd has already done its work
+	if obj.Creates != "" {
+		if _, err := os.Stat(obj.Creates); err == nil {
+			return true, nil
+		} else if !os.IsNotExist(err) {
+			return false, errwrap.Wrapf(err, "Error checking the creates path")
+		}
+	}
+
 	// if there is a watch command, but no if command, run based on state
 	if obj.WatchCmd != "" && obj.IfCmd == "" {
 		if obj.IsStateOK() { // FIXME: this is done by engine now...
@@ -217,22 +322,11 @@ func (obj *ExecRes) CheckApply(apply bool) (checkOK bool, err error) {
 			// return XXX
 		}
 
-		var cmdName string
-		var cmdArgs []string
-		if obj.IfShell == "" {
-			// call without a shell
-			// FIXME: are there still whitespace splitting issues?
-			split := strings.Fields(obj.IfCmd)
-			cmdName = split[0]
-			//d, _ := os.Getwd() // TODO: how does this ever error ?
-			//cmdName = path.Join(d, cmdName)
-			cmdArgs = split[1:]
-		} else {
-			cmdName = obj.IfShell // usually bash, or sh
-			cmdArgs = []string{"-c", obj.IfCmd}
-		}
-		err = exec.Command(cmdName, cmdArgs...).Run()
+		cmd, err := obj.command(obj.IfCmd, obj.IfShell)
 		if err != nil {
+			return false, errwrap.Wrapf(err, "Error building if Cmd")
+		}
+		if err := cmd.Run(); err != nil {
 			// TODO: check exit value
 			return true, nil // don't run
 		}
@@ -252,27 +346,16 @@ func (obj *ExecRes) CheckApply(apply bool) (checkOK bool, err error) {
 
 	// apply portion
 	log.Printf("%s[%s]: Apply", obj.Kind(), obj.GetName())
-	var cmdName string
-	var cmdArgs []string
-	if obj.Shell == "" {
-		// call without a shell
-		// FIXME: are there still whitespace splitting issues?
-		// TODO: we could make the split character user selectable...!
-		split := strings.Fields(obj.Cmd)
-		cmdName = split[0]
-		//d, _ := os.Getwd() // TODO: how does this ever error ?
-		//cmdName = path.Join(d, cmdName)
-		cmdArgs = split[1:]
-	} else {
-		cmdName = obj.Shell // usually bash, or sh
-		cmdArgs = []string{"-c", obj.Cmd}
+	cmd, err := obj.command(obj.Cmd, obj.Shell)
+	if err != nil {
+		return false, errwrap.Wrapf(err, "Error building Cmd")
 	}
-	cmd := exec.Command(cmdName, cmdArgs...)
-	//cmd.Dir = "" // look for program in pwd ?
-	var out bytes.Buffer
-	cmd.Stdout = &out
+	out, errOut := &execBuffer{}, &execBuffer{}
+	cmd.Stdout = out
+	cmd.Stderr = errOut
 
 	if err := cmd.Start(); err != nil {
+		obj.setOutputs("", "", -1)
 		return false, errwrap.Wrapf(err, "Error starting Cmd")
 	}
 
@@ -280,19 +363,30 @@ func (obj *ExecRes) CheckApply(apply bool) (checkOK bool, err error) {
 	if timeout == 0 { // zero timeout means no timer, so disable it
 		timeout = -1
 	}
-	done := make(chan error)
+	done := make(chan error, 1) // so that it can return after a kill
 	go func() { done <- cmd.Wait() }()
 
 	select {
 	case err := <-done:
+		exitCode := -1 // if it was killed by a signal
+		if status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok {
+			exitCode = status.ExitStatus()
+		}
+		obj.setOutputs(out.String(), errOut.String(), exitCode)
 		if err != nil {
 			e := errwrap.Wrapf(err, "Error waiting for Cmd")
 			return false, e
 		}
 
 	case <-util.TimeAfterOrBlock(timeout):
-		//cmd.Process.Kill() // TODO: is this necessary?
+		obj.kill(cmd)
+		obj.setOutputs(out.String(), errOut.String(), -1)
 		return false, fmt.Errorf("Timeout waiting for Cmd!")
+
+	case <-obj.Context().Done(): // the timeout metaparam expired
+		obj.kill(cmd)
+		obj.setOutputs(out.String(), errOut.String(), -1)
+		return false, errwrap.Wrapf(obj.Context().Err(), "Cmd was cancelled")
 	}
 
 	// TODO: if we printed the stdout while the command is running, this
@@ -305,6 +399,10 @@ func (obj *ExecRes) CheckApply(apply bool) (checkOK bool, err error) {
 		log.Printf("%s[%s]: Command output is:", obj.Kind(), obj.GetName())
 		log.Printf(out.String())
 	}
+	if s := errOut.String(); s != "" {
+		log.Printf("%s[%s]: Command stderr is:", obj.Kind(), obj.GetName())
+		log.Printf("%s", s)
+	}
 	// XXX: return based on exit value!!
 
 	// The state tracking is for exec resources that can't "detect" their
@@ -315,6 +413,41 @@ func (obj *ExecRes) CheckApply(apply bool) (checkOK bool, err error) {
 	return false, nil // success
 }
 
+// setOutputs stores the outputs of the cmd once it has ended, even if it was
+// killed or couldn't start, so that they can be sent.
+func (obj *ExecRes) setOutputs(stdout, stderr string, exitCode int) {
+	obj.Stdout, obj.Stderr, obj.ExitCode = &stdout, &stderr, &exitCode
+}
+
+// kill kills the cmd which took too long. Its children might still write to
+// the outputs, which is why they're read from an execBuffer.
+func (obj *ExecRes) kill(cmd *exec.Cmd) {
+	if err := cmd.Process.Kill(); err != nil {
+		log.Printf("%s[%s]: Unable to kill Cmd: %v", obj.Kind(), obj.GetName(), err)
+	}
+}
+
+// execBuffer is a buffer for the outputs of a cmd, which can be read while the
+// cmd is still writing to it.
+type execBuffer struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+// Write appends the data to the buffer.
+func (obj *execBuffer) Write(p []byte) (int, error) {
+	obj.mutex.Lock()
+	defer obj.mutex.Unlock()
+	return obj.buf.Write(p)
+}
+
+// String returns what was written so far.
+func (obj *execBuffer) String() string {
+	obj.mutex.Lock()
+	defer obj.mutex.Unlock()
+	return obj.buf.String()
+}
+
 // ExecUID is the UID struct for ExecRes.
 type ExecUID struct {
 	BaseUID
@@ -357,11 +490,54 @@ func (obj *ExecUID) IFF(uid ResUID) bool {
 	return true
 }
 
-// AutoEdges returns the AutoEdge interface. In this case no autoedges are used.
+// AutoEdges returns the AutoEdge interface. The file resource which manages the
+// working directory runs before us, and the one that manages the path that we
+// create runs after us, so that it can change its owner or mode for example.
+// The user and the group that we run as are created before us too.
 func (obj *ExecRes) AutoEdges() AutoEdge {
 	// TODO: parse as many exec params to look for auto edges, for example
 	// the path of the binary in the Cmd variable might be from in a pkg
-	return nil
+	var data []ResUID
+	if obj.Cwd != "" {
+		dir := path.Clean(obj.Cwd)
+		if dir != "/" {
+			dir += "/" // dirs have a trailing slash
+		}
+		var reversed = true // the dir happens before us
+		data = append(data, &FileUID{
+			BaseUID: BaseUID{
+				name:     obj.GetName(),
+				kind:     obj.Kind(),
+				reversed: &reversed,
+			},
+			path: dir,
+		})
+	}
+	if obj.Creates != "" {
+		var reversed = false // the path happens after us
+		data = append(data, &FileUID{
+			BaseUID: BaseUID{
+				name:     obj.GetName(),
+				kind:     obj.Kind(),
+				reversed: &reversed,
+			},
+			path: obj.Creates,
+		})
+	}
+	if obj.User != "" {
+		var reversed = true // the user happens before us
+		data = append(data, newUserUID(obj.GetName(), obj.Kind(), obj.User, &reversed))
+	}
+	if obj.Group != "" {
+		var reversed = true // the group happens before us
+		data = append(data, newGroupUID(obj.GetName(), obj.Kind(), obj.Group, &reversed))
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	return &BatchAutoEdges{
+		data: data,
+	}
 }
 
 // UIDs includes all params to make a unique identification of this object.
@@ -421,6 +597,29 @@ func (obj *ExecRes) Compare(res Res) bool {
 		if obj.State != res.State {
 			return false
 		}
+		if len(obj.Env) != len(res.Env) {
+			return false
+		}
+		for k, v := range obj.Env {
+			if x, exists := res.Env[k]; !exists || x != v {
+				return false
+			}
+		}
+		if obj.Cwd != res.Cwd {
+			return false
+		}
+		if obj.User != res.User {
+			return false
+		}
+		if obj.Group != res.Group {
+			return false
+		}
+		if obj.Umask != res.Umask {
+			return false
+		}
+		if obj.Creates != res.Creates {
+			return false
+		}
 	default:
 		return false
 	}
@@ -0,0 +1,176 @@
+// Mgmt
+// Copyright (C) 2013-2016+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package resources
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strings"
+	"testing"
+
+	"github.com/purpleidea/mgmt/util"
+)
+
+// TestExecUser1 runs the cmd as another user, and as another group.
+func TestExecUser1(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Running as another user needs root")
+	}
+	nobody, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skipf("Can't find the nobody user: %v", err)
+	}
+
+	for _, x := range []struct {
+		user, group string
+		out         string
+	}{
+		{"nobody", "", fmt.Sprintf("%s:%s\n", nobody.Uid, nobody.Gid)}, // the primary group
+		{nobody.Uid, "0", fmt.Sprintf("%s:0\n", nobody.Uid)},
+		{"", nobody.Gid, fmt.Sprintf("0:%s\n", nobody.Gid)}, // we keep our uid
+	} {
+		obj, _ := NewExecRes("id", "echo $(id -u):$(id -g)", "/bin/sh", 0, "", "", "", "", 0, "")
+		obj.User, obj.Group = x.user, x.group
+		if err := obj.Validate(); err != nil {
+			t.Fatalf("Validate failed: %v", err)
+		}
+		if _, err := obj.CheckApply(true); err != nil {
+			t.Fatalf("CheckApply failed: %v", err)
+		}
+		if obj.Stdout == nil || *obj.Stdout != x.out {
+			t.Errorf("Wrong ids for %q and %q: %v, expected: %q", x.user, x.group, obj.Stdout, x.out)
+		}
+	}
+}
+
+// TestExecUser2 checks that a missing user is only looked up when the cmd runs,
+// since it might be created by a resource of the graph.
+func TestExecUser2(t *testing.T) {
+	obj, _ := NewExecRes("missing", "true", "", 0, "", "", "", "", 0, "")
+	obj.User = "mgmt-missing-user"
+	obj.Group = "mgmt-missing-group"
+	if err := obj.Validate(); err != nil {
+		t.Errorf("Validate failed: %v", err)
+	}
+	if _, err := obj.CheckApply(true); err == nil {
+		t.Errorf("CheckApply should fail for a missing user")
+	}
+
+	u, _ := NewUserRes(obj.User, "exists", "")
+	g, _ := NewGroupRes(obj.Group, "exists")
+	found := map[string]bool{}
+	edges := obj.AutoEdges()
+	for _, uid := range edges.Next() {
+		for _, res := range []Res{u, g} {
+			if uid.IFF(res.UIDs()[0]) {
+				if !uid.Reversed() {
+					t.Errorf("The %s should happen before the exec", res.Kind())
+				}
+				found[res.Kind()] = true
+			}
+		}
+	}
+	if edges.Test(nil) {
+		t.Errorf("There should only be one batch")
+	}
+	if !found["User"] || !found["Group"] {
+		t.Errorf("Missing autoedges: %v", found)
+	}
+}
+
+// TestExecEnv1 checks that the env of the cmd overrides the variables of mgmt,
+// instead of adding a second copy of them.
+func TestExecEnv1(t *testing.T) {
+	old := os.Getenv("HOME")
+	defer os.Setenv("HOME", old)
+	os.Setenv("HOME", "/root")
+
+	obj, _ := NewExecRes("env", "echo $HOME", "/bin/sh", 0, "", "", "", "", 0, "")
+	obj.Env = map[string]string{"HOME": "/home/james"}
+	cmd, err := obj.command(obj.Cmd, obj.Shell)
+	if err != nil {
+		t.Fatalf("Command failed: %v", err)
+	}
+	home := []string{}
+	for _, x := range cmd.Env {
+		if strings.HasPrefix(x, "HOME=") {
+			home = append(home, x)
+		}
+	}
+	if len(home) != 1 || home[0] != "HOME=/home/james" {
+		t.Errorf("Wrong env: %v", home)
+	}
+}
+
+// TestExecGroups1 checks that the cmd of a user runs with all of its groups.
+func TestExecGroups1(t *testing.T) {
+	u, err := user.Current()
+	if err != nil {
+		t.Skipf("Can't find the current user: %v", err)
+	}
+	obj, _ := NewExecRes("groups", "id -G", "", 0, "", "", "", "", 0, "")
+	obj.User = u.Username
+	credential, err := obj.credential()
+	if err != nil {
+		t.Fatalf("Credential failed: %v", err)
+	}
+	ids, err := u.GroupIds()
+	if err != nil {
+		t.Skipf("Can't find the groups of the current user: %v", err)
+	}
+	if len(credential.Groups) != len(ids) {
+		t.Errorf("Wrong groups: %v, expected: %v", credential.Groups, ids)
+	}
+	for _, gid := range credential.Groups {
+		if !util.StrInList(fmt.Sprintf("%d", gid), ids) {
+			t.Errorf("Unknown group: %d, expected: %v", gid, ids)
+		}
+	}
+}
+
+// TestExecOutputs1 checks the outputs of the cmd, which are set on every path
+// that ends it, and which are unset until it first runs.
+func TestExecOutputs1(t *testing.T) {
+	obj, _ := NewExecRes("outputs", "echo out; echo err >&2; exit 3", "/bin/sh", 0, "", "", "", "", 0, "")
+	if obj.Stdout != nil || obj.Stderr != nil || obj.ExitCode != nil {
+		t.Errorf("The outputs are set before the cmd ran")
+	}
+	if _, err := obj.CheckApply(true); err == nil {
+		t.Errorf("CheckApply should fail for a cmd which fails")
+	}
+	if obj.Stdout == nil || *obj.Stdout != "out\n" || obj.Stderr == nil || *obj.Stderr != "err\n" || obj.ExitCode == nil || *obj.ExitCode != 3 {
+		t.Errorf("Wrong outputs: %v, %v, %v", obj.Stdout, obj.Stderr, obj.ExitCode)
+	}
+
+	obj, _ = NewExecRes("timeout", "echo started; sleep 10", "/bin/sh", 1, "", "", "", "", 0, "")
+	if _, err := obj.CheckApply(true); err == nil {
+		t.Errorf("CheckApply should time out")
+	}
+	if obj.Stdout == nil || *obj.Stdout != "started\n" || obj.ExitCode == nil || *obj.ExitCode != -1 {
+		t.Errorf("Wrong outputs after the timeout: %v, %v", obj.Stdout, obj.ExitCode)
+	}
+
+	obj, _ = NewExecRes("missing", "/mgmt/missing/cmd", "", 0, "", "", "", "", 0, "")
+	if _, err := obj.CheckApply(true); err == nil {
+		t.Errorf("CheckApply should fail for a missing cmd")
+	}
+	if obj.Stdout == nil || *obj.Stdout != "" || obj.ExitCode == nil || *obj.ExitCode != -1 {
+		t.Errorf("Wrong outputs of a missing cmd: %v, %v", obj.Stdout, obj.ExitCode)
+	}
+}
@@ -356,6 +356,7 @@ func (obj *FileRes) fileCheckApply(apply bool, src io.ReadSeeker, dst string, sh
 
 	if dstExists && dstStat.IsDir() { // oops, dst is a dir, and we want a file...
 		if !apply {
+			obj.AddChange(&Change{Property: "type", Old: "directory", New: "file"})
 			return "", false, nil
 		}
 		if !obj.Force {
@@ -411,6 +412,11 @@ func (obj *FileRes) fileCheckApply(apply bool, src io.ReadSeeker, dst string, sh
 
 	// state is not okay, no work done, exit, but without error
 	if !apply {
+		change, err := obj.contentChange(src, dst, dstExists)
+		if err != nil {
+			return sha256sum, false, err
+		}
+		obj.AddChange(change)
 		return sha256sum, false, nil
 	}
 	if obj.debug {
@@ -452,6 +458,55 @@ func (obj *FileRes) fileCheckApply(apply bool, src io.ReadSeeker, dst string, sh
 	return sha256sum, false, dstFile.Sync()
 }
 
+// contentChange builds the change which describes how the content of dst would
+// be modified to match src. The src is rewound afterwards. If the data is too
+// large or isn't text, then we only report that the content differs.
+func (obj *FileRes) contentChange(src io.ReadSeeker, dst string, dstExists bool) (*Change, error) {
+	const maxSize = 1024 * 1024 // don't diff anything bigger than this
+	change := &Change{Property: "content", New: "differs"}
+	if !dstExists {
+		change.Old = "absent"
+	}
+
+	if n, err := src.Seek(0, 0); err != nil || n != 0 {
+		return nil, errwrap.Wrapf(err, "could not seek src")
+	}
+	srcData, err := ioutil.ReadAll(io.LimitReader(src, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if n, err := src.Seek(0, 0); err != nil || n != 0 { // rewind for the copy
+		return nil, errwrap.Wrapf(err, "could not seek src")
+	}
+
+	var dstData []byte
+	if dstExists {
+		if st, err := os.Stat(dst); err != nil {
+			return nil, err
+		} else if st.Size() > maxSize {
+			return change, nil
+		}
+		if dstData, err = ioutil.ReadFile(dst); err != nil {
+			return nil, err
+		}
+	}
+	if len(srcData) > maxSize || bytes.IndexByte(srcData, 0) >= 0 || bytes.IndexByte(dstData, 0) >= 0 {
+		return change, nil // too big, or binary
+	}
+
+	nameA := dst
+	if !dstExists {
+		nameA = "/dev/null"
+	}
+	diff, err := util.UnifiedDiff(string(dstData), string(srcData), nameA, dst)
+	if err != nil { // too large to diff
+		return change, nil
+	}
+	change.Old, change.New = "", "" // the diff says it all
+	change.Diff = diff
+	return change, nil
+}
+
 // dirCheckApply is the CheckApply operation for an empty directory
 func (obj *FileRes) dirCheckApply(apply bool) (bool, error) {
 	// Check if the path exists and is a directory
@@ -468,6 +523,11 @@ func (obj *FileRes) dirCheckApply(apply bool) (bool, error) {
 	}
 
 	if !apply {
+		if err == nil { // it exists, but it's not a dir
+			obj.AddChange(&Change{Property: "type", Old: "file", New: "directory"})
+		} else {
+			obj.AddChange(&Change{Property: "state", Old: "absent", New: "exists"})
+		}
 		return false, nil
 	}
 
@@ -565,6 +625,7 @@ func (obj *FileRes) syncCheckApply(apply bool, src, dst string) (bool, error) {
 		if _, exists := smartDst[relPath]; !exists {
 			if fileInfo.IsDir() {
 				if !apply { // only checking and not identical!
+					obj.AddChange(&Change{Property: "mkdir", New: absDst})
 					return false, nil
 				}
 
@@ -614,6 +675,9 @@ func (obj *FileRes) syncCheckApply(apply bool, src, dst string) (bool, error) {
 	}
 
 	if !apply && len(smartDst) > 0 { // we know there are files to remove!
+		for _, fileInfo := range smartDst {
+			obj.AddChange(&Change{Property: "remove", Old: fileInfo.AbsPath})
+		}
 		return false, nil // so just exit now
 	}
 	// any files that now remain in smartDst need to be removed...
@@ -675,6 +739,7 @@ func (obj *FileRes) contentCheckApply(apply bool) (checkOK bool, _ error) {
 
 		// state is not okay, no work done, exit, but without error
 		if !apply {
+			obj.AddChange(&Change{Property: "state", Old: "exists", New: "absent"})
 			return false, nil
 		}
 
@@ -759,6 +824,7 @@ func (obj *FileRes) chmodCheckApply(apply bool) (checkOK bool, _ error) {
 
 	// Not clean but don't apply
 	if !apply {
+		obj.AddChange(&Change{Property: "mode", Old: st.Mode().String(), New: mode.String()})
 		return false, nil
 	}
 
@@ -821,6 +887,12 @@ func (obj *FileRes) chownCheckApply(apply bool) (checkOK bool, _ error) {
 
 	// Not clean, but don't apply
 	if !apply {
+		if int(stUnix.Uid) != expectedUID {
+			obj.AddChange(&Change{Property: "owner", Old: strconv.Itoa(int(stUnix.Uid)), New: strconv.Itoa(expectedUID)})
+		}
+		if int(stUnix.Gid) != expectedGID {
+			obj.AddChange(&Change{Property: "group", Old: strconv.Itoa(int(stUnix.Gid)), New: strconv.Itoa(expectedGID)})
+		}
 		return false, nil
 	}
 
@@ -887,6 +959,8 @@ type FileResAutoEdges struct {
 	data    []ResUID
 	pointer int
 	found   bool
+
+	first []ResUID // the owners and the mounts, which are matched first
 }
 
 // Next returns the next automatic edge.
@@ -894,6 +968,9 @@ func (obj *FileResAutoEdges) Next() []ResUID {
 	if obj.found {
 		log.Fatal("Shouldn't be called anymore!")
 	}
+	if len(obj.first) > 0 {
+		return obj.first
+	}
 	if len(obj.data) == 0 { // check length for rare scenarios
 		return nil
 	}
@@ -904,6 +981,11 @@ func (obj *FileResAutoEdges) Next() []ResUID {
 
 // Test gets results of the earlier Next() call, & returns if we should continue!
 func (obj *FileResAutoEdges) Test(input []bool) bool {
+	// ack the owners and the mounts, and then move on to the parent dirs
+	if len(obj.first) > 0 {
+		obj.first = nil
+		return len(obj.data) > 0
+	}
 	// if there aren't any more remaining
 	if len(obj.data) <= obj.pointer {
 		return false
@@ -922,7 +1004,8 @@ func (obj *FileResAutoEdges) Test(input []bool) bool {
 }
 
 // AutoEdges generates a simple linear sequence of each parent directory from
-// the bottom up!
+// the bottom up! Before that, it matches the user and the group of the file,
+// and the mounts of the parent dirs, since the file is on one of those.
 func (obj *FileRes) AutoEdges() AutoEdge {
 	var data []ResUID                              // store linear result chain here...
 	values := util.PathSplitFullReversed(obj.path) // build it
@@ -938,10 +1021,22 @@ func (obj *FileRes) AutoEdges() AutoEdge {
 			path: x, // what matters
 		}) // build list
 	}
+	// the user and the group need to exist before they can own the file
+	var first []ResUID
+	if obj.Owner != "" {
+		var reversed = true
+		first = append(first, newUserUID(obj.GetName(), obj.Kind(), obj.Owner, &reversed))
+	}
+	if obj.Group != "" {
+		var reversed = true
+		first = append(first, newGroupUID(obj.GetName(), obj.Kind(), obj.Group, &reversed))
+	}
+	first = append(first, mountParentUIDs(obj.GetName(), obj.Kind(), obj.path)...)
 	return &FileResAutoEdges{
 		data:    data,
 		pointer: 0,
 		found:   false,
+		first:   first,
 	}
 }
 
@@ -1007,6 +1102,22 @@ func (obj *FileRes) Compare(res Res) bool {
 	return true
 }
 
+// Reversed returns a resource which removes the file or directory that this
+// resource manages. A resource which already removes its file has no reverse.
+func (obj *FileRes) Reversed() (Res, error) {
+	if obj.State == "absent" {
+		return nil, nil // nothing to undo
+	}
+	return &FileRes{
+		BaseRes: BaseRes{
+			Name:       obj.Name,
+			MetaParams: DefaultMetaParams,
+		},
+		Path:  obj.path, // use the computed path
+		State: "absent",
+	}, nil
+}
+
 // CollectPattern applies the pattern for collection resources.
 func (obj *FileRes) CollectPattern(pattern string) {
 	// XXX: currently the pattern for files can only override the Dirname variable :P
@@ -29,15 +29,38 @@ import (
 // gid returns the group id for the group specified in the yaml file graph.
 // Caller should first check obj.Group is not empty
 func (obj *FileRes) gid() (int, error) {
-	g2, err2 := user.LookupGroupId(obj.Group)
+	return lookupGid(obj.Group)
+}
+
+// lookupGid returns the group id for the group name or gid.
+func lookupGid(name string) (int, error) {
+	g2, err2 := user.LookupGroupId(name)
 	if err2 == nil {
 		return strconv.Atoi(g2.Gid)
 	}
 
-	g, err := user.LookupGroup(obj.Group)
+	g, err := user.LookupGroup(name)
 	if err == nil {
 		return strconv.Atoi(g.Gid)
 	}
 
-	return -1, errwrap.Wrapf(err, "Group lookup error (%s)", obj.Group)
+	return -1, errwrap.Wrapf(err, "Group lookup error (%s)", name)
+}
+
+// lookupGroupIds returns the ids of all the groups of the user, including the
+// primary group, which is what a process of the user should run with.
+func lookupGroupIds(u *user.User) ([]uint32, error) {
+	ids, err := u.GroupIds()
+	if err != nil {
+		return nil, errwrap.Wrapf(err, "Group lookup error (%s)", u.Username)
+	}
+	result := []uint32{}
+	for _, id := range ids {
+		gid, err := strconv.Atoi(id)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, uint32(gid))
+	}
+	return result, nil
 }
@@ -20,7 +20,11 @@
 package resources
 
 import (
+	"bufio"
+	"os"
+	"os/user"
 	"strconv"
+	"strings"
 
 	group "github.com/hnakamur/group"
 	errwrap "github.com/pkg/errors"
@@ -29,15 +33,52 @@ import (
 // gid returns the group id for the group specified in the yaml file graph.
 // Caller should first check obj.Group is not empty
 func (obj *FileRes) gid() (int, error) {
-	g2, err2 := group.LookupId(obj.Group)
+	return lookupGid(obj.Group)
+}
+
+// lookupGid returns the group id for the group name or gid.
+func lookupGid(name string) (int, error) {
+	g2, err2 := group.LookupId(name)
 	if err2 == nil {
 		return strconv.Atoi(g2.Gid)
 	}
 
-	g, err := group.Lookup(obj.Group)
+	g, err := group.Lookup(name)
 	if err == nil {
 		return strconv.Atoi(g.Gid)
 	}
 
-	return -1, errwrap.Wrapf(err, "Group lookup error (%s)", obj.Group)
+	return -1, errwrap.Wrapf(err, "Group lookup error (%s)", name)
+}
+
+// lookupGroupIds returns the ids of all the groups of the user, including the
+// primary group, which is what a process of the user should run with. Before
+// go1.7, the user package can't list them, so they're read from /etc/group.
+func lookupGroupIds(u *user.User) ([]uint32, error) {
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return nil, err
+	}
+	result := []uint32{uint32(gid)}
+	f, err := os.Open("/etc/group")
+	if err != nil {
+		return nil, errwrap.Wrapf(err, "Group lookup error (%s)", u.Username)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() { // name:password:gid:members
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) != 4 {
+			continue
+		}
+		for _, member := range strings.Split(fields[3], ",") {
+			if member != u.Username {
+				continue
+			}
+			if gid, err := strconv.Atoi(fields[2]); err == nil {
+				result = append(result, uint32(gid))
+			}
+		}
+	}
+	return result, scanner.Err()
 }
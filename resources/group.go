@@ -0,0 +1,308 @@
+// Mgmt
+// Copyright (C) 2013-2016+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package resources
+
+import (
+	"encoding/gob"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/purpleidea/mgmt/event"
+	"github.com/purpleidea/mgmt/util"
+)
+
+func init() {
+	RegisterResource("group", func() Res { return &GroupRes{} })
+	gob.Register(&GroupRes{})
+}
+
+// The fields of an entry in /etc/group and in /etc/gshadow.
+const (
+	groupGID     = 2
+	groupMembers = 3
+	groupFields  = 4
+
+	gshadowMembers = 3
+	gshadowFields  = 4
+)
+
+// GroupRes is a group resource. It manages the entry of the group in /etc/group
+// and in /etc/gshadow. The name of the resource is the name of the group.
+type GroupRes struct {
+	BaseRes `yaml:",inline"`
+	State   string   `yaml:"state"`   // state: exists, absent
+	GID     *uint32  `yaml:"gid"`     // nil picks a free gid on creation
+	Members []string `yaml:"members"` // the exact list of members, or nil
+}
+
+// NewGroupRes is a constructor for this resource. It also calls Init() for you.
+func NewGroupRes(name, state string) (*GroupRes, error) {
+	obj := &GroupRes{
+		BaseRes: BaseRes{
+			Name: name,
+		},
+		State: state,
+	}
+	return obj, obj.Init()
+}
+
+// Default returns some sensible defaults for this resource.
+func (obj *GroupRes) Default() Res {
+	return &GroupRes{
+		State: "exists",
+	}
+}
+
+// Validate if the params passed in are valid data.
+func (obj *GroupRes) Validate() error {
+	if obj.State != "exists" && obj.State != "absent" {
+		return fmt.Errorf("State must be exists or absent.")
+	}
+	if err := validateUserDBName(obj.GetName()); err != nil {
+		return err
+	}
+	for _, x := range obj.Members {
+		if err := validateUserDBName(x); err != nil {
+			return err
+		}
+	}
+	return obj.BaseRes.Validate()
+}
+
+// Init runs some startup code for this resource.
+func (obj *GroupRes) Init() error {
+	obj.BaseRes.kind = "Group"
+	return obj.BaseRes.Init() // call base init, b/c we're overriding
+}
+
+// Watch is the primary listener for this resource and it outputs events.
+func (obj *GroupRes) Watch(processChan chan *event.Event) error {
+	return watchUserDB(obj, processChan)
+}
+
+// CheckApply checks the resource state and applies the resource if the bool
+// input is true. It returns error info and if the state check passed or not.
+func (obj *GroupRes) CheckApply(apply bool) (checkOK bool, err error) {
+	if apply { // hold the lock from the read to the write
+		unlock, err := lockUserDB()
+		if err != nil {
+			return false, err
+		}
+		defer unlock()
+	}
+	dbs, err := readUserDBs()
+	if err != nil {
+		return false, err
+	}
+	changed, err := obj.change(dbs)
+	if err != nil {
+		return false, err
+	}
+	if len(changed) == 0 {
+		return true, nil
+	}
+	if !apply {
+		dbs.report(obj)
+		return false, nil
+	}
+	log.Printf("%s[%s]: Apply", obj.Kind(), obj.GetName())
+	return false, dbs.write(changed)
+}
+
+// change makes the changes to the databases, in memory, and returns the set of
+// databases that changed.
+func (obj *GroupRes) change(dbs *userDBs) (map[*userDB]bool, error) {
+	name := obj.GetName()
+	changed := make(map[*userDB]bool)
+
+	if obj.State == "absent" {
+		changed[dbs.group] = dbs.group.remove(name)
+		changed[dbs.gshadow] = dbs.gshadow.remove(name)
+		return onlyChanged(changed), nil
+	}
+
+	fields := dbs.group.get(name, groupFields)
+	if fields == nil { // create the group
+		id, err := dbs.group.nextID(groupGID)
+		if err != nil {
+			return nil, err
+		}
+		fields = []string{name, "x", strconv.FormatUint(uint64(id), 10), ""}
+	}
+	if obj.GID != nil {
+		gid := strconv.FormatUint(uint64(*obj.GID), 10)
+		if owner, used := dbs.group.owner(*obj.GID, groupGID); used && owner != name {
+			return nil, fmt.Errorf("The gid %s is already used by %s", gid, owner)
+		}
+		fields[groupGID] = gid
+	}
+	if obj.Members != nil && !util.StrSetEq(obj.Members, splitMembers(fields[groupMembers])) {
+		fields[groupMembers] = strings.Join(obj.Members, ",")
+	}
+	changed[dbs.group] = dbs.group.set(fields)
+
+	if dbs.gshadow.exists {
+		gshadow := dbs.gshadow.get(name, gshadowFields)
+		if gshadow == nil { // without a password
+			gshadow = []string{name, "!", "", fields[groupMembers]}
+		}
+		if obj.Members != nil && !util.StrSetEq(obj.Members, splitMembers(gshadow[gshadowMembers])) {
+			gshadow[gshadowMembers] = strings.Join(obj.Members, ",")
+		}
+		changed[dbs.gshadow] = dbs.gshadow.set(gshadow)
+	}
+	return onlyChanged(changed), nil
+}
+
+// splitMembers splits a list of members, where the empty string has none.
+func splitMembers(s string) []string {
+	if s == "" {
+		return []string{}
+	}
+	return strings.Split(s, ",")
+}
+
+// GroupUID is the UID struct for GroupRes.
+type GroupUID struct {
+	BaseUID
+	name string
+	gid  *uint32
+}
+
+// IFF aka if and only if they are equivalent, return true. If not, false. The
+// groups match if they have the same name, or if both have the same gid.
+func (obj *GroupUID) IFF(uid ResUID) bool {
+	res, ok := uid.(*GroupUID)
+	if !ok {
+		return false
+	}
+	if obj.name != "" && obj.name == res.name {
+		return true
+	}
+	return obj.gid != nil && res.gid != nil && *obj.gid == *res.gid
+}
+
+// newGroupUID returns the UID which matches the group resource for the group
+// name or gid, such as the group of a file.
+func newGroupUID(name, kind, group string, reversed *bool) *GroupUID {
+	x := &GroupUID{
+		BaseUID: BaseUID{
+			name:     name,
+			kind:     kind,
+			reversed: reversed,
+		},
+	}
+	if id, err := strconv.ParseUint(group, 10, 32); err == nil {
+		gid := uint32(id)
+		x.gid = &gid
+	} else {
+		x.name = group
+	}
+	return x
+}
+
+// AutoEdges returns the AutoEdge interface. The users that the group lists are
+// created after it, like the users that list the group do.
+func (obj *GroupRes) AutoEdges() AutoEdge {
+	if obj.State == "absent" || len(obj.Members) == 0 {
+		return nil
+	}
+	var data []ResUID
+	for _, x := range obj.Members {
+		var reversed = false // the user happens after us
+		data = append(data, newUserUID(obj.GetName(), obj.Kind(), x, &reversed))
+	}
+	return &BatchAutoEdges{
+		data: data,
+	}
+}
+
+// UIDs includes all params to make a unique identification of this object.
+// Most resources only return one, although some resources can return multiple.
+func (obj *GroupRes) UIDs() []ResUID {
+	x := &GroupUID{
+		BaseUID: BaseUID{name: obj.GetName(), kind: obj.Kind()},
+		name:    obj.GetName(),
+		gid:     obj.GID,
+	}
+	return []ResUID{x}
+}
+
+// GroupCmp returns whether two resources can be grouped together or not.
+func (obj *GroupRes) GroupCmp(r Res) bool {
+	_, ok := r.(*GroupRes)
+	if !ok {
+		return false
+	}
+	return false // TODO: this could save some reads and writes
+}
+
+// Compare two resources and return if they are equivalent.
+func (obj *GroupRes) Compare(res Res) bool {
+	switch res.(type) {
+	case *GroupRes:
+		res := res.(*GroupRes)
+		if !obj.BaseRes.Compare(res) { // call base Compare
+			return false
+		}
+
+		if obj.Name != res.Name {
+			return false
+		}
+		if obj.State != res.State {
+			return false
+		}
+		if (obj.GID == nil) != (res.GID == nil) {
+			return false
+		}
+		if obj.GID != nil && *obj.GID != *res.GID {
+			return false
+		}
+		if (obj.Members == nil) != (res.Members == nil) {
+			return false
+		}
+		if !util.StrSetEq(obj.Members, res.Members) {
+			return false
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// UnmarshalYAML is the custom unmarshal handler for this struct.
+// It is primarily useful for setting the defaults.
+func (obj *GroupRes) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type rawRes GroupRes // indirection to avoid infinite recursion
+
+	def := obj.Default()       // get the default
+	res, ok := def.(*GroupRes) // put in the right format
+	if !ok {
+		return fmt.Errorf("could not convert to GroupRes")
+	}
+	raw := rawRes(*res) // convert; the defaults go here
+
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+
+	*obj = GroupRes(raw) // restore from indirection with type conversion!
+	return nil
+}
@@ -0,0 +1,393 @@
+// Mgmt
+// Copyright (C) 2013-2016+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package resources
+
+import (
+	"encoding/gob"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/purpleidea/mgmt/event"
+	"github.com/purpleidea/mgmt/util"
+
+	errwrap "github.com/pkg/errors"
+)
+
+func init() {
+	RegisterResource("http", func() Res { return &HTTPRes{} })
+	gob.Register(&HTTPRes{})
+}
+
+// HTTPRes is an http server resource. It serves local files and directories,
+// and inline content, at url paths on its listen address. This is useful for
+// giving kickstart files and other artifacts to new hosts. Directories end with
+// a slash, as in the file resource, and so must the url paths they are served
+// at. Only one resource can use each listen address.
+type HTTPRes struct {
+	BaseRes `yaml:",inline"`
+	Listen  string            `yaml:"listen"`  // the address to listen on, such as :8080
+	Files   map[string]string `yaml:"files"`   // the file or directory to serve at each url path
+	Content map[string]string `yaml:"content"` // the inline content to serve at each url path
+
+	mutex   *sync.Mutex
+	handler http.Handler // what we serve, which is nil until CheckApply
+}
+
+// NewHTTPRes is a constructor for this resource. It also calls Init() for you.
+func NewHTTPRes(name, listen string, files, content map[string]string) (*HTTPRes, error) {
+	obj := &HTTPRes{
+		BaseRes: BaseRes{
+			Name: name,
+		},
+		Listen:  listen,
+		Files:   files,
+		Content: content,
+	}
+	return obj, obj.Init()
+}
+
+// Default returns some sensible defaults for this resource.
+func (obj *HTTPRes) Default() Res {
+	return &HTTPRes{}
+}
+
+// Validate if the params passed in are valid data.
+func (obj *HTTPRes) Validate() error {
+	if _, _, err := net.SplitHostPort(obj.Listen); err != nil {
+		return errwrap.Wrapf(err, "invalid listen address")
+	}
+	if len(obj.Files) == 0 && len(obj.Content) == 0 {
+		return fmt.Errorf("Nothing to serve.")
+	}
+	for u, p := range obj.Files {
+		if !strings.HasPrefix(u, "/") {
+			return fmt.Errorf("The url path %s must be absolute.", u)
+		}
+		if !path.IsAbs(p) {
+			return fmt.Errorf("The path %s must be absolute.", p)
+		}
+		if strings.HasSuffix(u, "/") != strings.HasSuffix(p, "/") {
+			return fmt.Errorf("Only directories can be served at url paths ending in a slash: %s", u)
+		}
+		if _, exists := obj.Content[u]; exists {
+			return fmt.Errorf("The url path %s has both a file and content.", u)
+		}
+	}
+	for u := range obj.Content {
+		if !strings.HasPrefix(u, "/") {
+			return fmt.Errorf("The url path %s must be absolute.", u)
+		}
+	}
+	return obj.BaseRes.Validate()
+}
+
+// Init runs some startup code for this resource.
+func (obj *HTTPRes) Init() error {
+	obj.mutex = &sync.Mutex{}
+	obj.BaseRes.kind = "Http"
+	return obj.BaseRes.Init() // call base init, b/c we're overriding
+}
+
+// urls returns the sorted url paths that we serve.
+func (obj *HTTPRes) urls() []string {
+	result := []string{}
+	for u := range obj.Files {
+		result = append(result, u)
+	}
+	for u := range obj.Content {
+		result = append(result, u)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// serve is the handler of the server. Nothing is served until CheckApply has
+// built the real handler, such as when the resource is in noop mode.
+func (obj *HTTPRes) serve(w http.ResponseWriter, req *http.Request) {
+	obj.mutex.Lock()
+	handler := obj.handler
+	obj.mutex.Unlock()
+	if obj.debug {
+		log.Printf("%s[%s]: %s %s from %s", obj.Kind(), obj.GetName(), req.Method, req.URL.Path, req.RemoteAddr)
+	}
+	if handler == nil {
+		http.NotFound(w, req)
+		return
+	}
+	handler.ServeHTTP(w, req)
+}
+
+// mux builds the handler which serves our files and content. The files are
+// read on each request, so that they are always up to date, and the content
+// is shown as last modified at the time of the build.
+func (obj *HTTPRes) mux() http.Handler {
+	mux := http.NewServeMux()
+	modified := time.Now()
+	for u, p := range obj.Files {
+		u, p := u, p                   // the closures need their own copies
+		if strings.HasSuffix(p, "/") { // the whole tree below the url path
+			mux.Handle(u, http.StripPrefix(strings.TrimSuffix(u, "/"), http.FileServer(http.Dir(p))))
+			continue
+		}
+		mux.Handle(u, httpExact(u, func(w http.ResponseWriter, req *http.Request) {
+			http.ServeFile(w, req, p)
+		}))
+	}
+	for u, content := range obj.Content {
+		u, content := u, content
+		mux.Handle(u, httpExact(u, func(w http.ResponseWriter, req *http.Request) {
+			http.ServeContent(w, req, path.Base(u), modified, strings.NewReader(content))
+		}))
+	}
+	return mux
+}
+
+// httpExact wraps the handler so that it only serves the url path itself, and
+// not the whole tree below it if it ends with a slash.
+func httpExact(u string, f http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != u {
+			http.NotFound(w, req)
+			return
+		}
+		f(w, req)
+	})
+}
+
+// Watch is the primary listener for this resource and it outputs events. It
+// runs the server, which stops when the resource does, so that a new one with
+// changed params listens afresh. The served paths are watched too, since they
+// must exist.
+func (obj *HTTPRes) Watch(processChan chan *event.Event) error {
+	listener, err := net.Listen("tcp", obj.Listen)
+	if err != nil {
+		return errwrap.Wrapf(err, "can't listen on %s", obj.Listen)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(obj.serve)}
+	serveErr := make(chan error, 1) // the server never returns without error
+	go func() {
+		serveErr <- server.Serve(listener)
+	}()
+	defer func() {
+		server.SetKeepAlivesEnabled(false) // close the idle connections
+		listener.Close()                   // stops the server
+	}()
+
+	paths := []string{}
+	for _, u := range obj.urls() {
+		if p, exists := obj.Files[u]; exists { // not inline content
+			paths = append(paths, p)
+		}
+	}
+	watcher, err := newMultiWatcher(paths...)
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	// notify engine that we're running
+	if err := obj.Running(processChan); err != nil {
+		return err // bubble up a NACK...
+	}
+
+	var send = false // send event?
+	var exit *error
+	for {
+		select {
+		case err := <-serveErr:
+			return errwrap.Wrapf(err, "the server on %s failed", obj.Listen)
+
+		case err := <-watcher.Events():
+			if err != nil {
+				return errwrap.Wrapf(err, "Unknown %s[%s] watcher error", obj.Kind(), obj.GetName())
+			}
+			send = true
+			obj.StateOK(false) // dirty
+
+		case event := <-obj.Events():
+			if exit, send = obj.ReadEvent(event); exit != nil {
+				return *exit // exit
+			}
+		}
+
+		// do all our event sending all together to avoid duplicate msgs
+		if send {
+			send = false
+			obj.Event(processChan)
+		}
+	}
+}
+
+// check returns an error if one of the served paths is missing, or if it's not
+// the kind of file that its trailing slash or lack of one says it is.
+func (obj *HTTPRes) check() error {
+	for _, u := range obj.urls() {
+		p, exists := obj.Files[u]
+		if !exists {
+			continue
+		}
+		fi, err := os.Stat(p)
+		if err != nil {
+			return errwrap.Wrapf(err, "can't serve %s", p)
+		}
+		if fi.IsDir() != strings.HasSuffix(p, "/") {
+			return fmt.Errorf("Can't serve %s, since it is the wrong type of file.", p)
+		}
+	}
+	return nil
+}
+
+// CheckApply checks the resource state and applies the resource if the bool
+// input is true. It returns error info and if the state check passed or not.
+// Applying starts serving everything, since the server doesn't serve anything
+// before that. The files are only checked when they are, or would be, served.
+func (obj *HTTPRes) CheckApply(apply bool) (checkOK bool, err error) {
+	obj.mutex.Lock()
+	serving := obj.handler != nil
+	obj.mutex.Unlock()
+
+	if serving || apply {
+		if err := obj.check(); err != nil {
+			return false, err
+		}
+	}
+	if serving {
+		return true, nil // we are in the correct state
+	}
+
+	// state is not okay, no work done, exit, but without error
+	if !apply {
+		for _, u := range obj.urls() {
+			what, exists := obj.Files[u]
+			if !exists {
+				what = "content"
+			}
+			obj.AddChange(&Change{Property: u, New: what})
+		}
+		return false, nil
+	}
+
+	log.Printf("%s[%s]: Serving on %s", obj.Kind(), obj.GetName(), obj.Listen)
+	handler := obj.mux()
+	obj.mutex.Lock()
+	obj.handler = handler
+	obj.mutex.Unlock()
+	return false, nil // success
+}
+
+// HTTPUID is the UID struct for HTTPRes.
+type HTTPUID struct {
+	BaseUID
+	listen string
+}
+
+// IFF aka if and only if they are equivalent, return true. If not, false.
+func (obj *HTTPUID) IFF(uid ResUID) bool {
+	res, ok := uid.(*HTTPUID)
+	if !ok {
+		return false
+	}
+	return obj.listen == res.listen
+}
+
+// AutoEdges returns the AutoEdge interface. Like with the file resource, the
+// file resource which manages each served path, or else the one which manages
+// its nearest parent dir, happens before us.
+func (obj *HTTPRes) AutoEdges() AutoEdge {
+	paths := []string{}
+	for _, u := range obj.urls() {
+		if p, exists := obj.Files[u]; exists {
+			paths = append(paths, p)
+		}
+	}
+	return newParentDirAutoEdges(obj, paths)
+}
+
+// UIDs includes all params to make a unique identification of this object.
+// Most resources only return one, although some resources can return multiple.
+func (obj *HTTPRes) UIDs() []ResUID {
+	x := &HTTPUID{
+		BaseUID: BaseUID{name: obj.GetName(), kind: obj.Kind()},
+		listen:  obj.Listen,
+	}
+	return []ResUID{x}
+}
+
+// GroupCmp returns whether two resources can be grouped together or not.
+func (obj *HTTPRes) GroupCmp(r Res) bool {
+	_, ok := r.(*HTTPRes)
+	if !ok {
+		return false
+	}
+	return false // not possible atm
+}
+
+// Compare two resources and return if they are equivalent.
+func (obj *HTTPRes) Compare(res Res) bool {
+	switch res.(type) {
+	case *HTTPRes:
+		res := res.(*HTTPRes)
+		if !obj.BaseRes.Compare(res) { // call base Compare
+			return false
+		}
+
+		if obj.Name != res.Name {
+			return false
+		}
+		if obj.Listen != res.Listen {
+			return false
+		}
+		if !util.StrMapEq(obj.Files, res.Files) {
+			return false
+		}
+		if !util.StrMapEq(obj.Content, res.Content) {
+			return false
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// UnmarshalYAML is the custom unmarshal handler for this struct.
+// It is primarily useful for setting the defaults.
+func (obj *HTTPRes) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type rawRes HTTPRes // indirection to avoid infinite recursion
+
+	def := obj.Default()      // get the default
+	res, ok := def.(*HTTPRes) // put in the right format
+	if !ok {
+		return fmt.Errorf("could not convert to HTTPRes")
+	}
+	raw := rawRes(*res) // convert; the defaults go here
+
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+
+	*obj = HTTPRes(raw) // restore from indirection with type conversion!
+	return nil
+}
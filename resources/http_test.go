@@ -0,0 +1,160 @@
+// Mgmt
+// Copyright (C) 2013-2016+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package resources
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+// httpGet returns the status code and the body of a request to the resource.
+func httpGet(obj *HTTPRes, u string) (int, string) {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", u, nil)
+	obj.serve(w, req)
+	return w.Code, w.Body.String()
+}
+
+func TestHTTPRes1(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mgmt-http-")
+	if err != nil {
+		t.Fatalf("Can't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Mkdir(path.Join(dir, "repo"), 0755); err != nil {
+		t.Fatalf("Can't create dir: %v", err)
+	}
+	for p, data := range map[string]string{"ks.cfg": "install\n", "repo/a.rpm": "rpm"} {
+		if err := ioutil.WriteFile(path.Join(dir, p), []byte(data), 0644); err != nil {
+			t.Fatalf("Can't write %s: %v", p, err)
+		}
+	}
+
+	files := map[string]string{
+		"/ks/host1.cfg": path.Join(dir, "ks.cfg"),
+		"/repo/":        path.Join(dir, "repo") + "/",
+	}
+	content := map[string]string{"/": "hello\n"}
+	obj, _ := NewHTTPRes("http1", ":0", files, content)
+	obj.MetaParams = DefaultMetaParams
+	if err := obj.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+
+	if checkOK, err := obj.CheckApply(false); err != nil || checkOK {
+		t.Fatalf("Noop CheckApply returned: %v, %v", checkOK, err)
+	}
+	if n := len(obj.Changes()); n != 3 {
+		t.Errorf("Expected 3 changes, got: %d", n)
+	}
+	if code, _ := httpGet(obj, "/"); code != http.StatusNotFound {
+		t.Errorf("Served before CheckApply: %d", code)
+	}
+
+	checkApply(t, obj)
+	for u, expected := range map[string]string{"/": "hello\n", "/ks/host1.cfg": "install\n", "/repo/a.rpm": "rpm"} {
+		if code, body := httpGet(obj, u); code != http.StatusOK || body != expected {
+			t.Errorf("GET %s returned: %d, %q", u, code, body)
+		}
+	}
+	for _, u := range []string{"/missing", "/ks/host1.cfg/x", "/repo/b.rpm"} {
+		if code, _ := httpGet(obj, u); code != http.StatusNotFound {
+			t.Errorf("GET %s returned: %d", u, code)
+		}
+	}
+
+	os.Remove(path.Join(dir, "ks.cfg"))
+	if _, err := obj.CheckApply(true); err == nil {
+		t.Errorf("CheckApply should fail with a missing file")
+	}
+}
+
+// TestHTTPWatch1 runs the server of the resource, and checks that a change of a
+// served file is noticed.
+func TestHTTPWatch1(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mgmt-http-")
+	if err != nil {
+		t.Fatalf("Can't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	p := path.Join(dir, "ks.cfg")
+	if err := ioutil.WriteFile(p, []byte("install\n"), 0644); err != nil {
+		t.Fatalf("Can't write %s: %v", p, err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0") // find a free port
+	if err != nil {
+		t.Fatalf("Can't listen: %v", err)
+	}
+	listen := l.Addr().String()
+	l.Close()
+
+	obj, _ := NewHTTPRes("http1", listen, map[string]string{"/ks.cfg": p}, nil)
+	obj.MetaParams = DefaultMetaParams
+	if err := obj.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	events, stop := testWatch(t, obj)
+	defer stop()
+	checkApply(t, obj)
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/ks.cfg", listen))
+	if err != nil {
+		t.Fatalf("GET failed: %v", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "install\n" {
+		t.Errorf("GET returned: %d, %q", resp.StatusCode, body)
+	}
+
+	obj.StateOK(true)                  // like the engine does after CheckApply
+	time.Sleep(100 * time.Millisecond) // the watches are added asynchronously
+	if err := ioutil.WriteFile(p, []byte("reinstall\n"), 0644); err != nil {
+		t.Fatalf("Can't write %s: %v", p, err)
+	}
+	select {
+	case <-events:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("No event for the changed file")
+	}
+	if obj.IsStateOK() {
+		t.Errorf("The state wasn't invalidated by the change")
+	}
+}
+
+func TestHTTPResValidate1(t *testing.T) {
+	for _, obj := range []*HTTPRes{
+		{Listen: "8080", Content: map[string]string{"/": ""}},
+		{Listen: ":8080"},
+		{Listen: ":8080", Files: map[string]string{"/dir/": "/srv/file"}},
+		{Listen: ":8080", Files: map[string]string{"/file": "srv/file"}},
+		{Listen: ":8080", Files: map[string]string{"/a": "/a"}, Content: map[string]string{"/a": ""}},
+	} {
+		obj.MetaParams = DefaultMetaParams
+		if err := obj.Validate(); err == nil {
+			t.Errorf("Validate should have failed: %+v", obj)
+		}
+	}
+}
@@ -0,0 +1,1025 @@
+// Mgmt
+// Copyright (C) 2013-2016+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package resources
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/purpleidea/mgmt/event"
+	"github.com/purpleidea/mgmt/util"
+
+	systemd "github.com/coreos/go-systemd/dbus" // change namespace
+	"github.com/coreos/go-systemd/unit"
+	systemdUtil "github.com/coreos/go-systemd/util"
+	"github.com/godbus/dbus" // namespace collides with systemd wrapper
+	errwrap "github.com/pkg/errors"
+)
+
+func init() {
+	RegisterResource("mount", func() Res { return &MountRes{} })
+	gob.Register(&MountRes{})
+}
+
+// These are the files which the mount resource reads. They are variables so
+// that the tests can point them elsewhere.
+var (
+	mountInfoPath = "/proc/self/mountinfo"
+	fstabPath     = "/etc/fstab"
+)
+
+// mountSystemd tells us if the mounts are done with systemd.
+var mountSystemd = systemdUtil.IsRunningSystemd
+
+// mountOption is the effect of a mount option on the flags of mount(2).
+type mountOption struct {
+	flag  uintptr
+	clear bool // the option removes the flag instead of adding it
+}
+
+// mountOptions are the options which are flags of mount(2). The other options
+// are passed on to the filesystem, except for the ones in mountIgnored.
+var mountOptions = map[string]mountOption{
+	"defaults":    {0, false},
+	"ro":          {syscall.MS_RDONLY, false},
+	"rw":          {syscall.MS_RDONLY, true},
+	"nosuid":      {syscall.MS_NOSUID, false},
+	"suid":        {syscall.MS_NOSUID, true},
+	"nodev":       {syscall.MS_NODEV, false},
+	"dev":         {syscall.MS_NODEV, true},
+	"noexec":      {syscall.MS_NOEXEC, false},
+	"exec":        {syscall.MS_NOEXEC, true},
+	"sync":        {syscall.MS_SYNCHRONOUS, false},
+	"async":       {syscall.MS_SYNCHRONOUS, true},
+	"dirsync":     {syscall.MS_DIRSYNC, false},
+	"mand":        {syscall.MS_MANDLOCK, false},
+	"nomand":      {syscall.MS_MANDLOCK, true},
+	"noatime":     {syscall.MS_NOATIME, false},
+	"atime":       {syscall.MS_NOATIME, true},
+	"nodiratime":  {syscall.MS_NODIRATIME, false},
+	"diratime":    {syscall.MS_NODIRATIME, true},
+	"relatime":    {syscall.MS_RELATIME, false},
+	"norelatime":  {syscall.MS_RELATIME, true},
+	"strictatime": {syscall.MS_STRICTATIME, false},
+	"bind":        {syscall.MS_BIND, false},
+	"rbind":       {syscall.MS_BIND | syscall.MS_REC, false},
+}
+
+// mountIgnored are the options which only mean something to mount(8) or to the
+// fstab, and not to the kernel.
+var mountIgnored = []string{"auto", "noauto", "user", "nouser", "users", "owner", "group", "nofail", "_netdev"}
+
+// MountRes is a mount resource. It manages a mounted filesystem, and if asked
+// to, its entry in the fstab. When systemd is running, the mount is done with
+// the .mount unit of the mountpoint, and otherwise with the mount syscall.
+type MountRes struct {
+	BaseRes `yaml:",inline"`
+	State   string   `yaml:"state"`   // state: mounted, unmounted, absent
+	Path    string   `yaml:"path"`    // the mountpoint, defaults to the name
+	Device  string   `yaml:"device"`  // the device, such as UUID=... or tmpfs
+	Type    string   `yaml:"type"`    // the filesystem type
+	Options []string `yaml:"options"` // the mount options
+	Persist bool     `yaml:"persist"` // add the mount to the fstab
+}
+
+// NewMountRes is a constructor for this resource. It also calls Init() for you.
+func NewMountRes(name, state, device, fstype string, options []string) (*MountRes, error) {
+	obj := &MountRes{
+		BaseRes: BaseRes{
+			Name: name,
+		},
+		State:   state,
+		Device:  device,
+		Type:    fstype,
+		Options: options,
+	}
+	return obj, obj.Init()
+}
+
+// Default returns some sensible defaults for this resource.
+func (obj *MountRes) Default() Res {
+	return &MountRes{
+		State: "mounted",
+	}
+}
+
+// Validate if the params passed in are valid data.
+func (obj *MountRes) Validate() error {
+	if obj.State != "mounted" && obj.State != "unmounted" && obj.State != "absent" {
+		return fmt.Errorf("State must be mounted, unmounted or absent.")
+	}
+	if !path.IsAbs(obj.mountpoint()) {
+		return fmt.Errorf("The mountpoint must be an absolute path.")
+	}
+	if obj.State != "absent" {
+		if obj.Device == "" {
+			return fmt.Errorf("The device is required.")
+		}
+		if obj.Type == "" && !obj.bind() {
+			return fmt.Errorf("The type is required.")
+		}
+	}
+	for _, x := range obj.Options {
+		if x == "" || strings.ContainsAny(x, ", \t\n") {
+			return fmt.Errorf("Invalid mount option: %q", x)
+		}
+	}
+	return obj.BaseRes.Validate()
+}
+
+// Init runs some startup code for this resource.
+func (obj *MountRes) Init() error {
+	obj.BaseRes.kind = "Mount"
+	return obj.BaseRes.Init() // call base init, b/c we're overriding
+}
+
+// mountpoint returns the cleaned up path of the mountpoint.
+func (obj *MountRes) mountpoint() string {
+	if obj.Path != "" {
+		return path.Clean(obj.Path)
+	}
+	return path.Clean(obj.GetName())
+}
+
+// bind returns true if this is a bind mount, which doesn't need a type.
+func (obj *MountRes) bind() bool {
+	return util.StrInList("bind", obj.Options) || util.StrInList("rbind", obj.Options)
+}
+
+// fstype returns the filesystem type, which is none for the bind mounts.
+func (obj *MountRes) fstype() string {
+	if obj.Type == "" {
+		return "none"
+	}
+	return obj.Type
+}
+
+// options returns the options in the format of the fstab and mount(8).
+func (obj *MountRes) options() string {
+	if len(obj.Options) == 0 {
+		return "defaults"
+	}
+	return strings.Join(obj.Options, ",")
+}
+
+// unit returns the name of the systemd unit of the mountpoint.
+func (obj *MountRes) unit() string {
+	return unit.UnitNamePathEscape(obj.mountpoint()) + ".mount"
+}
+
+// Watch is the primary listener for this resource and it outputs events. The
+// kernel signals a change of the mounts by polling /proc/self/mountinfo.
+func (obj *MountRes) Watch(processChan chan *event.Event) error {
+	mounts, err := newMountInfoWatcher(mountInfoPath)
+	if err != nil {
+		return errwrap.Wrapf(err, "can't watch %s", mountInfoPath)
+	}
+	defer mounts.Close()
+
+	watcher, err := newMultiWatcher(fstabPath)
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	// notify engine that we're running
+	if err := obj.Running(processChan); err != nil {
+		return err // bubble up a NACK...
+	}
+
+	var send = false // send event?
+	var exit *error
+	for {
+		select {
+		case err := <-mounts.Events():
+			if err != nil {
+				return errwrap.Wrapf(err, "Unknown %s[%s] watcher error", obj.Kind(), obj.GetName())
+			}
+			send = true
+			obj.StateOK(false) // dirty
+
+		case err := <-watcher.Events():
+			if err != nil {
+				return errwrap.Wrapf(err, "Unknown %s[%s] watcher error", obj.Kind(), obj.GetName())
+			}
+			send = true
+			obj.StateOK(false) // dirty
+
+		case event := <-obj.Events():
+			if exit, send = obj.ReadEvent(event); exit != nil {
+				return *exit // exit
+			}
+		}
+
+		// do all our event sending all together to avoid duplicate msgs
+		if send {
+			send = false
+			obj.Event(processChan)
+		}
+	}
+}
+
+// CheckApply checks the resource state and applies the resource if the bool
+// input is true. It returns error info and if the state check passed or not. A
+// refresh remounts the filesystem, which applies the changed options.
+func (obj *MountRes) CheckApply(apply bool) (checkOK bool, err error) {
+	info, err := readMountInfo(obj.mountpoint())
+	if err != nil {
+		return false, err
+	}
+	tab, err := readFstab()
+	if err != nil {
+		return false, err
+	}
+	before := tab.get(obj.mountpoint())
+	after := before
+	if obj.State == "absent" {
+		after = ""
+	} else if obj.Persist && !fstabEqual(before, obj.fstabLine()) {
+		after = obj.fstabLine()
+	}
+
+	mounted := info != nil
+	var wrongDevice = mounted && obj.State == "mounted" && !obj.bind() && !sameDevice(info.source, obj.Device)
+	var stateOK = mounted == (obj.State == "mounted") && !wrongDevice
+	var optionsOK = !stateOK || obj.State != "mounted" || obj.optionsOK(info)
+	var refresh = obj.Refresh() && obj.State == "mounted" && stateOK
+
+	if stateOK && optionsOK && before == after && !refresh {
+		return true, nil // we are in the correct state
+	}
+
+	// state is not okay, no work done, exit, but without error
+	if !apply {
+		if !stateOK {
+			var current = "unmounted"
+			if mounted {
+				current = "mounted"
+			}
+			if wrongDevice {
+				current = fmt.Sprintf("mounted from %s", info.source)
+			}
+			obj.AddChange(&Change{Property: "state", Old: current, New: obj.State})
+		}
+		if !optionsOK {
+			obj.AddChange(&Change{Property: "options", Old: strings.Join(info.options, ","), New: obj.options()})
+		}
+		if before != after {
+			obj.AddChange(&Change{Property: "fstab", Old: before, New: after})
+		}
+		if refresh {
+			obj.AddChange(&Change{Property: "refresh", New: "remount"})
+		}
+		return false, nil
+	}
+
+	log.Printf("%s[%s]: Apply", obj.Kind(), obj.GetName())
+	if before != after {
+		tab.set(obj.mountpoint(), after)
+		if err := tab.write(); err != nil {
+			return false, err
+		}
+	}
+
+	var m mounter = &syscallMounter{res: obj}
+	if mountSystemd() {
+		conn, err := systemd.NewSystemdConnection() // needs root access
+		if err != nil {
+			return false, errwrap.Wrapf(err, "Failed to connect to systemd")
+		}
+		defer conn.Close()
+		if before != after { // regenerate the units from the fstab
+			if err := conn.Reload(); err != nil {
+				return false, errwrap.Wrapf(err, "Failed to reload systemd")
+			}
+		}
+		m = &systemdMounter{res: obj, conn: conn, fstab: after != ""}
+	}
+
+	if wrongDevice || (mounted && obj.State != "mounted") {
+		log.Printf("%s[%s]: Unmounting %s", obj.Kind(), obj.GetName(), obj.mountpoint())
+		if err := m.unmount(); err != nil {
+			return false, err
+		}
+	}
+	if !stateOK && obj.State == "mounted" {
+		log.Printf("%s[%s]: Mounting %s", obj.Kind(), obj.GetName(), obj.mountpoint())
+		if err := m.mount(); err != nil {
+			return false, err
+		}
+	} else if !optionsOK { // the kernel applies the options that changed
+		log.Printf("%s[%s]: Remounting %s with %s", obj.Kind(), obj.GetName(), obj.mountpoint(), obj.options())
+		if err := (&syscallMounter{res: obj}).remount(); err != nil {
+			return false, err
+		}
+	} else if refresh {
+		log.Printf("%s[%s]: Remounting %s", obj.Kind(), obj.GetName(), obj.mountpoint())
+		if err := m.remount(); err != nil {
+			return false, err
+		}
+	}
+	return false, nil // success
+}
+
+// optionsOK returns true if the mount has the options. The flags are compared
+// with the options of the mount, and the filesystem options with the ones that
+// the kernel shows, which leaves out the ones that it doesn't show.
+func (obj *MountRes) optionsOK(info *mountInfo) bool {
+	values := make(map[string]string) // the filesystem options, by key
+	for _, x := range info.options {
+		split := strings.SplitN(x, "=", 2)
+		if len(split) == 2 {
+			values[split[0]] = split[1]
+		}
+	}
+	for _, x := range obj.Options {
+		// the kernel doesn't show these, so they can't be compared
+		if util.StrInList(x, []string{"defaults", "bind", "rbind", "loop", "strictatime"}) || util.StrInList(x, mountIgnored) || strings.HasPrefix(x, "x-") || strings.HasPrefix(x, "comment=") {
+			continue
+		}
+		if opt, exists := mountOptions[x]; exists {
+			if mountHasFlag(info.options, opt) != !opt.clear {
+				return false
+			}
+			continue
+		}
+		split := strings.SplitN(x, "=", 2)
+		value, exists := values[split[0]]
+		if len(split) != 2 || strings.HasSuffix(split[1], "%") { // eg: size=50%
+			continue
+		}
+		if exists && mountOptionValue(value) != mountOptionValue(split[1]) {
+			return false
+		}
+	}
+	return true
+}
+
+// mountHasFlag returns true if one of the options sets the flag of the option.
+func mountHasFlag(options []string, opt mountOption) bool {
+	for _, x := range options {
+		if o, exists := mountOptions[x]; exists && o.flag == opt.flag && !o.clear {
+			return true
+		}
+	}
+	return false
+}
+
+// mountOptionValue normalizes the value of a filesystem option, the way that
+// the kernel shows it, so that size=1m matches size=1024k, and mode=0755 matches
+// mode=755.
+func mountOptionValue(value string) string {
+	units := map[string]uint{"k": 10, "m": 20, "g": 30, "t": 40}
+	if n := len(value); n > 1 {
+		if shift, exists := units[strings.ToLower(value[n-1:])]; exists {
+			if i, err := strconv.ParseUint(value[:n-1], 10, 64); err == nil {
+				return strconv.FormatUint(i<<shift, 10)
+			}
+		}
+	}
+	if i, err := strconv.ParseUint(value, 10, 64); err == nil {
+		if strings.HasPrefix(value, "0") && len(value) > 1 {
+			if j, err := strconv.ParseUint(value, 8, 64); err == nil {
+				return strconv.FormatUint(j, 8) // an octal mode
+			}
+		}
+		return strconv.FormatUint(i, 10)
+	}
+	return value
+}
+
+// fstabLine returns the entry of this mount in the fstab. An unmounted one gets
+// the noauto option, so that it isn't mounted again at boot.
+func (obj *MountRes) fstabLine() string {
+	options := obj.options()
+	if obj.State == "unmounted" {
+		opts := []string{}
+		for _, x := range obj.Options {
+			if x != "auto" && x != "noauto" {
+				opts = append(opts, x)
+			}
+		}
+		options = strings.Join(append(opts, "noauto"), ",")
+	}
+	fields := []string{
+		mountEscape(obj.Device),
+		mountEscape(obj.mountpoint()),
+		mountEscape(obj.fstype()),
+		mountEscape(options),
+		"0", // dump
+		"0", // pass
+	}
+	return strings.Join(fields, "\t")
+}
+
+// mounter applies the mount, either with the mount syscall, or with systemd.
+type mounter interface {
+	mount() error
+	unmount() error
+	remount() error
+}
+
+// syscallMounter mounts with the mount syscall.
+type syscallMounter struct {
+	res *MountRes
+}
+
+// flags returns the flags and the filesystem data of the mount options.
+func (obj *syscallMounter) flags() (uintptr, string, error) {
+	var flags uintptr
+	data := []string{}
+	for _, x := range obj.res.Options {
+		if x == "loop" {
+			return 0, "", fmt.Errorf("The loop option needs systemd")
+		}
+		if util.StrInList(x, mountIgnored) || strings.HasPrefix(x, "x-") || strings.HasPrefix(x, "comment=") {
+			continue
+		}
+		opt, exists := mountOptions[x]
+		if !exists {
+			data = append(data, x) // for the filesystem
+			continue
+		}
+		if opt.clear {
+			flags &^= opt.flag
+		} else {
+			flags |= opt.flag
+		}
+	}
+	return flags, strings.Join(data, ","), nil
+}
+
+func (obj *syscallMounter) mount() error {
+	flags, data, err := obj.flags()
+	if err != nil {
+		return err
+	}
+	device := resolveDevice(obj.res.Device)
+	if err := syscall.Mount(device, obj.res.mountpoint(), obj.res.Type, flags, data); err != nil {
+		return errwrap.Wrapf(err, "can't mount %s", obj.res.mountpoint())
+	}
+	if flags&syscall.MS_BIND != 0 && flags&syscall.MS_RDONLY != 0 { // a bind mount ignores ro
+		return obj.remount()
+	}
+	return nil
+}
+
+func (obj *syscallMounter) unmount() error {
+	if err := syscall.Unmount(obj.res.mountpoint(), 0); err != nil {
+		return errwrap.Wrapf(err, "can't unmount %s", obj.res.mountpoint())
+	}
+	return nil
+}
+
+func (obj *syscallMounter) remount() error {
+	flags, data, err := obj.flags()
+	if err != nil {
+		return err
+	}
+	device := resolveDevice(obj.res.Device)
+	if err := syscall.Mount(device, obj.res.mountpoint(), obj.res.Type, flags|syscall.MS_REMOUNT, data); err != nil {
+		return errwrap.Wrapf(err, "can't remount %s", obj.res.mountpoint())
+	}
+	return nil
+}
+
+// systemdMounter mounts with the .mount unit of the mountpoint. If the mount is
+// in the fstab, systemd generated the unit from there, and otherwise we create
+// a transient unit.
+type systemdMounter struct {
+	res   *MountRes
+	conn  *systemd.Conn
+	fstab bool // the unit comes from the fstab
+}
+
+// wait waits for the result of the job which started.
+func (obj *systemdMounter) wait(result chan string, err error) error {
+	if err != nil {
+		return errwrap.Wrapf(err, "Failed to start job for %s", obj.res.unit())
+	}
+	if status := <-result; status != "done" {
+		return fmt.Errorf("Unknown systemd return string: %v", status)
+	}
+	return nil
+}
+
+func (obj *systemdMounter) mount() error {
+	result := make(chan string, 1) // catch result information
+	if obj.fstab {
+		_, err := obj.conn.StartUnit(obj.res.unit(), "fail", result)
+		return obj.wait(result, err)
+	}
+	properties := []systemd.Property{
+		systemd.PropDescription(fmt.Sprintf("mgmt mount of %s", obj.res.mountpoint())),
+		{Name: "What", Value: dbus.MakeVariant(obj.res.Device)},
+		{Name: "Type", Value: dbus.MakeVariant(obj.res.fstype())},
+		{Name: "Options", Value: dbus.MakeVariant(obj.res.options())},
+	}
+	_, err := obj.conn.StartTransientUnit(obj.res.unit(), "fail", properties, result)
+	return obj.wait(result, err)
+}
+
+func (obj *systemdMounter) unmount() error {
+	result := make(chan string, 1) // catch result information
+	_, err := obj.conn.StopUnit(obj.res.unit(), "fail", result)
+	return obj.wait(result, err)
+}
+
+func (obj *systemdMounter) remount() error {
+	result := make(chan string, 1) // catch result information
+	_, err := obj.conn.ReloadUnit(obj.res.unit(), "fail", result)
+	return obj.wait(result, err)
+}
+
+// mountInfo is the entry of a mount in /proc/self/mountinfo.
+type mountInfo struct {
+	mountpoint string
+	fstype     string
+	source     string
+	options    []string // the mount options, and then the superblock ones
+}
+
+// readMountInfo returns the mount at the mountpoint, or nil if nothing is
+// mounted there. If there are several mounts at the mountpoint, the last one
+// is the visible one.
+func readMountInfo(mountpoint string) (*mountInfo, error) {
+	data, err := ioutil.ReadFile(mountInfoPath)
+	if err != nil {
+		return nil, errwrap.Wrapf(err, "can't read %s", mountInfoPath)
+	}
+	var result *mountInfo
+	for _, line := range strings.Split(string(data), "\n") {
+		// id parent major:minor root mountpoint options [optional...] - fstype source superoptions
+		fields := strings.Fields(line)
+		sep := -1
+		for i := 6; i < len(fields); i++ {
+			if fields[i] == "-" {
+				sep = i
+				break
+			}
+		}
+		if sep < 0 || sep+2 >= len(fields) {
+			continue // not an entry
+		}
+		if mountUnescape(fields[4]) != mountpoint {
+			continue
+		}
+		result = &mountInfo{
+			mountpoint: mountpoint,
+			fstype:     fields[sep+1],
+			source:     mountUnescape(fields[sep+2]),
+			options:    strings.Split(fields[5], ","),
+		}
+		if sep+3 < len(fields) {
+			result.options = append(result.options, strings.Split(fields[sep+3], ",")...)
+		}
+	}
+	return result, nil
+}
+
+// mountEscape escapes the whitespace and the backslashes of a field of the
+// fstab or of the mountinfo.
+func mountEscape(s string) string {
+	r := strings.NewReplacer(`\`, `\134`, " ", `\040`, "\t", `\011`, "\n", `\012`)
+	return r.Replace(s)
+}
+
+// mountUnescape undoes the octal escapes of a field of the fstab or of the
+// mountinfo.
+func mountUnescape(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	result := []byte{}
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				result = append(result, byte(c))
+				i += 3
+				continue
+			}
+		}
+		result = append(result, s[i])
+	}
+	return string(result)
+}
+
+// resolveDevice returns the path of the device for the UUID=, LABEL=, PARTUUID=
+// and PARTLABEL= specs of the fstab, and otherwise the device as it is.
+func resolveDevice(device string) string {
+	for spec, dir := range map[string]string{
+		"UUID=":      "/dev/disk/by-uuid",
+		"LABEL=":     "/dev/disk/by-label",
+		"PARTUUID=":  "/dev/disk/by-partuuid",
+		"PARTLABEL=": "/dev/disk/by-partlabel",
+	} {
+		if strings.HasPrefix(device, spec) {
+			return path.Join(dir, strings.Trim(strings.TrimPrefix(device, spec), `"`))
+		}
+	}
+	return device
+}
+
+// sameDevice returns true if the source of a mount is the device. The paths
+// are compared after following the symlinks, such as the ones in /dev/disk/.
+func sameDevice(source, device string) bool {
+	device = resolveDevice(device)
+	if source == device {
+		return true
+	}
+	if !path.IsAbs(source) || !path.IsAbs(device) {
+		return false
+	}
+	a, err := filepath.EvalSymlinks(source)
+	if err != nil {
+		return false
+	}
+	b, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		return false
+	}
+	return a == b
+}
+
+// fstab is the content of the fstab. The lines which aren't entries, such as
+// comments and blank lines, are kept as they are.
+type fstab struct {
+	lines []string
+	mode  os.FileMode
+}
+
+// readFstab reads the fstab. A missing one is empty.
+func readFstab() (*fstab, error) {
+	tab := &fstab{mode: 0644}
+	fi, err := os.Stat(fstabPath)
+	if os.IsNotExist(err) {
+		return tab, nil
+	} else if err != nil {
+		return nil, errwrap.Wrapf(err, "can't stat %s", fstabPath)
+	}
+	tab.mode = fi.Mode()
+	data, err := ioutil.ReadFile(fstabPath)
+	if err != nil {
+		return nil, errwrap.Wrapf(err, "can't read %s", fstabPath)
+	}
+	tab.lines = strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	return tab, nil
+}
+
+// find returns the index of the line of the entry for the mountpoint, or -1 if
+// it's absent. If there are several, the last one wins, like with mount(8).
+func (obj *fstab) find(mountpoint string) int {
+	result := -1
+	for i, line := range obj.lines {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if path.Clean(mountUnescape(fields[1])) == mountpoint {
+			result = i
+		}
+	}
+	return result
+}
+
+// get returns the entry for the mountpoint, or the empty string.
+func (obj *fstab) get(mountpoint string) string {
+	if i := obj.find(mountpoint); i >= 0 {
+		return obj.lines[i]
+	}
+	return ""
+}
+
+// set replaces the entry for the mountpoint with the line, and it removes the
+// entry if the line is empty.
+func (obj *fstab) set(mountpoint, line string) {
+	i := obj.find(mountpoint)
+	if i < 0 {
+		if line != "" {
+			obj.lines = append(obj.lines, line)
+		}
+		return
+	}
+	if line == "" {
+		obj.lines = append(obj.lines[:i], obj.lines[i+1:]...)
+		return
+	}
+	obj.lines[i] = line
+}
+
+// write replaces the fstab atomically, and keeps its mode.
+func (obj *fstab) write() error {
+	tmp := fstabPath + ".mgmt"
+	data := strings.Join(obj.lines, "\n") + "\n"
+	if err := ioutil.WriteFile(tmp, []byte(data), obj.mode); err != nil {
+		return errwrap.Wrapf(err, "can't write %s", tmp)
+	}
+	if err := os.Chmod(tmp, obj.mode); err != nil { // in case of a umask
+		os.Remove(tmp)
+		return errwrap.Wrapf(err, "can't chmod %s", tmp)
+	}
+	if err := os.Rename(tmp, fstabPath); err != nil {
+		os.Remove(tmp)
+		return errwrap.Wrapf(err, "can't replace %s", fstabPath)
+	}
+	return nil
+}
+
+// fstabEqual returns true if the entries have the same device, mountpoint, type
+// and options. The dump and pass fields, and the whitespace, don't matter.
+func fstabEqual(a, b string) bool {
+	x, y := strings.Fields(a), strings.Fields(b)
+	if len(x) < 4 || len(y) < 4 {
+		return false
+	}
+	for i := 0; i < 4; i++ {
+		if mountUnescape(x[i]) != mountUnescape(y[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// mountInfoWatcher sends an event each time that the mounts change. It polls
+// the mountinfo file, which the kernel marks with POLLPRI after each change.
+type mountInfoWatcher struct {
+	file   *os.File
+	epfd   int
+	wake   [2]*os.File // a pipe which wakes up the poller when closing
+	events chan error
+	done   chan struct{}
+	wg     *sync.WaitGroup
+}
+
+// newMountInfoWatcher starts watching the mountinfo file at the path.
+func newMountInfoWatcher(p string) (*mountInfoWatcher, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		f.Close()
+		r.Close()
+		w.Close()
+		return nil, err
+	}
+	obj := &mountInfoWatcher{
+		file:   f,
+		epfd:   epfd,
+		wake:   [2]*os.File{r, w},
+		events: make(chan error),
+		done:   make(chan struct{}),
+		wg:     &sync.WaitGroup{},
+	}
+	for fd, events := range map[int]uint32{
+		int(f.Fd()): syscall.EPOLLPRI | syscall.EPOLLERR,
+		int(r.Fd()): syscall.EPOLLIN | syscall.EPOLLHUP,
+	} {
+		ev := &syscall.EpollEvent{Events: events, Fd: int32(fd)}
+		if err := syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, fd, ev); err != nil {
+			obj.wake[1].Close()
+			obj.close()
+			return nil, err
+		}
+	}
+	obj.wg.Add(1)
+	go obj.poll()
+	return obj, nil
+}
+
+// poll waits for the changes, until the wake up pipe is closed.
+func (obj *mountInfoWatcher) poll() {
+	defer obj.wg.Done()
+	defer close(obj.events)
+	events := make([]syscall.EpollEvent, 2)
+	for {
+		n, err := syscall.EpollWait(obj.epfd, events, -1)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			select {
+			case obj.events <- err:
+			case <-obj.done:
+			}
+			return
+		}
+		changed := false
+		for _, ev := range events[:n] {
+			if int(ev.Fd) == int(obj.wake[0].Fd()) {
+				return // closing
+			}
+			changed = true
+		}
+		if !changed {
+			continue
+		}
+		select {
+		case obj.events <- nil:
+		case <-obj.done:
+			return
+		}
+	}
+}
+
+// Events returns the channel of the changes. A nil error is a change.
+func (obj *mountInfoWatcher) Events() <-chan error {
+	return obj.events
+}
+
+// Close stops the watcher and waits for it to exit.
+func (obj *mountInfoWatcher) Close() {
+	close(obj.done)
+	obj.wake[1].Close() // wakes up the poller
+	obj.wg.Wait()
+	obj.close()
+}
+
+// close releases the file descriptors.
+func (obj *mountInfoWatcher) close() {
+	syscall.Close(obj.epfd)
+	obj.file.Close()
+	obj.wake[0].Close()
+}
+
+// MountUID is the UID struct for MountRes. It matches on the mountpoint, which
+// has a trailing slash like the dirs of the file resource.
+type MountUID struct {
+	BaseUID
+	path string
+}
+
+// IFF aka if and only if they are equivalent, return true. If not, false.
+func (obj *MountUID) IFF(uid ResUID) bool {
+	res, ok := uid.(*MountUID)
+	if !ok {
+		return false
+	}
+	return obj.path == res.path
+}
+
+// AutoEdges returns the AutoEdge interface. The mountpoint dir, the device if
+// it is a file such as a disk image or the source of a bind mount, and the
+// mounts of the parent dirs all happen before us.
+func (obj *MountRes) AutoEdges() AutoEdge {
+	var data []ResUID
+	var reversed = true // these all happen before us
+	data = append(data, &FileUID{
+		BaseUID: BaseUID{
+			name:     obj.GetName(),
+			kind:     obj.Kind(),
+			reversed: &reversed,
+		},
+		path: mountDir(obj.mountpoint()),
+	})
+	if device := path.Clean(obj.Device); path.IsAbs(obj.Device) && !util.HasPathPrefix(device, "/dev") {
+		if obj.bind() {
+			device = mountDir(device)
+		}
+		data = append(data, &FileUID{
+			BaseUID: BaseUID{
+				name:     obj.GetName(),
+				kind:     obj.Kind(),
+				reversed: &reversed,
+			},
+			path: device,
+		})
+	}
+	data = append(data, mountParentUIDs(obj.GetName(), obj.Kind(), obj.mountpoint())...)
+	return &BatchAutoEdges{
+		data: data,
+	}
+}
+
+// mountDir returns the path with the trailing slash that dirs have.
+func mountDir(p string) string {
+	p = path.Clean(p)
+	if p != "/" {
+		p += "/"
+	}
+	return p
+}
+
+// mountParentUIDs returns the UIDs which match the mounts of the parent dirs
+// of the path, so that these are mounted before something at the path is used.
+func mountParentUIDs(name, kind, p string) []ResUID {
+	var result []ResUID
+	values := util.PathSplitFullReversed(path.Clean(p))
+	for _, x := range values[1:] { // not the path itself
+		var reversed = true // the mount happens before us
+		result = append(result, &MountUID{
+			BaseUID: BaseUID{
+				name:     name,
+				kind:     kind,
+				reversed: &reversed,
+			},
+			path: x,
+		})
+	}
+	return result
+}
+
+// UIDs includes all params to make a unique identification of this object.
+// Most resources only return one, although some resources can return multiple.
+func (obj *MountRes) UIDs() []ResUID {
+	x := &MountUID{
+		BaseUID: BaseUID{name: obj.GetName(), kind: obj.Kind()},
+		path:    mountDir(obj.mountpoint()),
+	}
+	return []ResUID{x}
+}
+
+// GroupCmp returns whether two resources can be grouped together or not.
+func (obj *MountRes) GroupCmp(r Res) bool {
+	_, ok := r.(*MountRes)
+	if !ok {
+		return false
+	}
+	return false // not possible atm
+}
+
+// Compare two resources and return if they are equivalent.
+func (obj *MountRes) Compare(res Res) bool {
+	switch res.(type) {
+	case *MountRes:
+		res := res.(*MountRes)
+		if !obj.BaseRes.Compare(res) { // call base Compare
+			return false
+		}
+
+		if obj.Name != res.Name {
+			return false
+		}
+		if obj.State != res.State {
+			return false
+		}
+		if obj.mountpoint() != res.mountpoint() {
+			return false
+		}
+		if obj.Device != res.Device {
+			return false
+		}
+		if obj.Type != res.Type {
+			return false
+		}
+		if obj.options() != res.options() {
+			return false
+		}
+		if obj.Persist != res.Persist {
+			return false
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// UnmarshalYAML is the custom unmarshal handler for this struct.
+// It is primarily useful for setting the defaults.
+func (obj *MountRes) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type rawRes MountRes // indirection to avoid infinite recursion
+
+	def := obj.Default()       // get the default
+	res, ok := def.(*MountRes) // put in the right format
+	if !ok {
+		return fmt.Errorf("could not convert to MountRes")
+	}
+	raw := rawRes(*res) // convert; the defaults go here
+
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+
+	*obj = MountRes(raw) // restore from indirection with type conversion!
+	return nil
+}
@@ -0,0 +1,231 @@
+// Mgmt
+// Copyright (C) 2013-2016+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package resources
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/purpleidea/mgmt/util"
+)
+
+func TestMountEscape1(t *testing.T) {
+	for _, s := range []string{"", "/mnt/data", "/mnt/my data", "a\tb\\c"} {
+		if x := mountUnescape(mountEscape(s)); x != s {
+			t.Errorf("Escaping %q returned %q", s, x)
+		}
+	}
+	if x := mountEscape("/mnt/my data"); x != `/mnt/my\040data` {
+		t.Errorf("Escaping returned %q", x)
+	}
+}
+
+// mountTest points the fstab to a temporary file and it creates a mountpoint
+// for the test.
+func mountTest(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "mgmt-mount-")
+	if err != nil {
+		t.Fatalf("Can't create temp dir: %v", err)
+	}
+	old, oldSystemd := fstabPath, mountSystemd
+	fstabPath = path.Join(dir, "fstab")
+	mountSystemd = func() bool { return false } // use the mount syscall
+	if err := ioutil.WriteFile(fstabPath, []byte("# comment\n\nproc /proc proc defaults 0 0\n"), 0644); err != nil {
+		t.Fatalf("Can't write %s: %v", fstabPath, err)
+	}
+	mountpoint := path.Join(dir, "my data")
+	if err := os.Mkdir(mountpoint, 0755); err != nil {
+		t.Fatalf("Can't create %s: %v", mountpoint, err)
+	}
+	return mountpoint, func() {
+		syscall.Unmount(mountpoint, 0)
+		fstabPath, mountSystemd = old, oldSystemd
+		os.RemoveAll(dir)
+	}
+}
+
+func TestMountRes1(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Mounting needs root")
+	}
+	mountpoint, cleanup := mountTest(t)
+	defer cleanup()
+
+	mount, _ := NewMountRes(mountpoint, "unmounted", "tmpfs", "tmpfs", []string{"size=1m"})
+	mount.Persist = true
+	checkApply(t, mount) // only adds the fstab entry
+	if s := userDBRead(t, fstabPath); !strings.HasPrefix(s, "# comment\n\nproc") || !strings.Contains(s, "\ntmpfs\t"+mountEscape(mountpoint)+"\ttmpfs\tsize=1m,noauto\t0\t0\n") {
+		t.Errorf("Mount wasn't added to the fstab:\n%s", s)
+	}
+
+	mount, _ = NewMountRes(mountpoint, "mounted", "tmpfs", "tmpfs", []string{"size=1m", "noexec"})
+	checkApply(t, mount)
+	info, err := readMountInfo(mountpoint)
+	if err != nil || info == nil || info.fstype != "tmpfs" {
+		t.Fatalf("Mount is missing: %+v, %v", info, err)
+	}
+
+	mount, _ = NewMountRes(mountpoint, "absent", "", "", nil)
+	checkApply(t, mount)
+	if info, err := readMountInfo(mountpoint); err != nil || info != nil {
+		t.Errorf("Mount wasn't removed: %+v, %v", info, err)
+	}
+	if s := userDBRead(t, fstabPath); s != "# comment\n\nproc /proc proc defaults 0 0\n" {
+		t.Errorf("Mount wasn't removed from the fstab:\n%s", s)
+	}
+}
+
+func TestMountFstabLine1(t *testing.T) {
+	mount, _ := NewMountRes("/mnt/my data", "mounted", "tmpfs", "tmpfs", []string{"size=1m"})
+	if x := mount.fstabLine(); x != "tmpfs\t/mnt/my\\040data\ttmpfs\tsize=1m\t0\t0" {
+		t.Errorf("Wrong fstab line: %q", x)
+	}
+	// an unmounted one mustn't be mounted at boot
+	mount, _ = NewMountRes("/mnt/data", "unmounted", "/dev/sdb1", "ext4", []string{"auto", "ro"})
+	if x := mount.fstabLine(); x != "/dev/sdb1\t/mnt/data\text4\tro,noauto\t0\t0" {
+		t.Errorf("Wrong fstab line: %q", x)
+	}
+	mount, _ = NewMountRes("/mnt/data", "unmounted", "/dev/sdb1", "ext4", nil)
+	if x := mount.fstabLine(); x != "/dev/sdb1\t/mnt/data\text4\tnoauto\t0\t0" {
+		t.Errorf("Wrong fstab line: %q", x)
+	}
+}
+
+// mountInfoTest points the mountinfo to a file with the mount at the mountpoint.
+func mountInfoTest(t *testing.T, mountpoint, line string) func() {
+	old := mountInfoPath
+	mountInfoPath = path.Join(path.Dir(mountpoint), "mountinfo")
+	data := "22 1 0:20 / /proc rw,nosuid,nodev,noexec,relatime shared:12 - proc proc rw\n"
+	if line != "" {
+		data += fmt.Sprintf(line, mountEscape(mountpoint)) + "\n"
+	}
+	if err := ioutil.WriteFile(mountInfoPath, []byte(data), 0644); err != nil {
+		t.Fatalf("Can't write %s: %v", mountInfoPath, err)
+	}
+	return func() {
+		mountInfoPath = old
+	}
+}
+
+func TestMountInfo1(t *testing.T) {
+	mountpoint, cleanup := mountTest(t)
+	defer cleanup()
+	defer mountInfoTest(t, mountpoint, "36 22 0:45 / %s rw,nosuid,noatime shared:1 - tmpfs tmpfs rw,size=1024k,mode=755")()
+
+	info, err := readMountInfo(mountpoint)
+	if err != nil || info == nil {
+		t.Fatalf("Mount is missing: %+v, %v", info, err)
+	}
+	if info.fstype != "tmpfs" || info.source != "tmpfs" || strings.Join(info.options, ",") != "rw,nosuid,noatime,rw,size=1024k,mode=755" {
+		t.Errorf("Wrong mount: %+v", info)
+	}
+
+	for _, x := range []struct {
+		options []string
+		ok      bool
+	}{
+		{nil, true},
+		{[]string{"defaults", "nofail", "x-systemd.automount"}, true},
+		{[]string{"rw", "nosuid", "noatime", "dev", "exec"}, true},
+		{[]string{"size=1m", "mode=0755", "uid=0"}, true}, // uid isn't shown
+		{[]string{"size=1048576", "mode=755"}, true},
+		{[]string{"size=50%"}, true}, // can't be compared
+		{[]string{"ro"}, false},
+		{[]string{"suid"}, false},
+		{[]string{"noexec"}, false},
+		{[]string{"atime"}, false},
+		{[]string{"size=2m"}, false},
+		{[]string{"mode=0700"}, false},
+	} {
+		obj := &MountRes{Options: x.options}
+		if ok := obj.optionsOK(info); ok != x.ok {
+			t.Errorf("Options %v: ok: %t, expected: %t", x.options, ok, x.ok)
+		}
+	}
+}
+
+// TestMountResNoop1 checks what CheckApply would change, which doesn't need
+// root, since nothing is mounted.
+func TestMountResNoop1(t *testing.T) {
+	mountpoint, cleanup := mountTest(t)
+	defer cleanup()
+	defer mountInfoTest(t, mountpoint, "36 22 0:45 / %s rw,relatime shared:1 - tmpfs tmpfs rw,size=1024k")()
+
+	for _, x := range []struct {
+		state, device string
+		options       []string
+		changes       []string // the changed properties
+	}{
+		{"mounted", "tmpfs", []string{"size=1m"}, nil},
+		{"mounted", "tmpfs", []string{"size=1m", "noexec"}, []string{"options"}},
+		{"mounted", "/dev/null", []string{"noexec"}, []string{"state"}}, // mounted again
+		{"unmounted", "tmpfs", []string{"noexec"}, []string{"state"}},
+	} {
+		obj, _ := NewMountRes(mountpoint, x.state, x.device, "tmpfs", x.options)
+		checkOK, err := obj.CheckApply(false)
+		if err != nil || checkOK != (len(x.changes) == 0) {
+			t.Errorf("CheckApply of %+v returned: %v, %v", x, checkOK, err)
+			continue
+		}
+		changes := []string{}
+		for _, c := range obj.Changes() {
+			changes = append(changes, c.Property)
+		}
+		if strings.Join(changes, ",") != strings.Join(x.changes, ",") {
+			t.Errorf("Wrong changes for %+v: %v", x, changes)
+		}
+	}
+}
+
+func TestMountRes2(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Mounting needs root")
+	}
+	mountpoint, cleanup := mountTest(t)
+	defer cleanup()
+	source := path.Join(path.Dir(mountpoint), "source")
+	if err := os.Mkdir(source, 0755); err != nil {
+		t.Fatalf("Can't create %s: %v", source, err)
+	}
+
+	// a read only bind mount, which is remounted read write
+	for _, options := range [][]string{{"bind", "ro"}, {"bind", "rw"}} {
+		mount, _ := NewMountRes(mountpoint, "mounted", source, "", options)
+		checkApply(t, mount)
+		info, err := readMountInfo(mountpoint)
+		if err != nil || info == nil || info.options[0] != options[1] {
+			t.Errorf("Wrong mount for %v: %+v, %v", options, info, err)
+		}
+	}
+	syscall.Unmount(mountpoint, 0)
+
+	// the changed options of a tmpfs are applied with a remount
+	mount, _ := NewMountRes(mountpoint, "mounted", "tmpfs", "tmpfs", []string{"size=1m", "noexec"})
+	checkApply(t, mount)
+	mount, _ = NewMountRes(mountpoint, "mounted", "tmpfs", "tmpfs", []string{"size=2m", "exec"})
+	checkApply(t, mount)
+	info, err := readMountInfo(mountpoint)
+	if err != nil || info == nil || !util.StrInList("size=2048k", info.options) || util.StrInList("noexec", info.options) {
+		t.Errorf("Mount wasn't remounted: %+v, %v", info, err)
+	}
+}
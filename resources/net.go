@@ -0,0 +1,618 @@
+// Mgmt
+// Copyright (C) 2013-2016+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package resources
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"log"
+	"net"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/purpleidea/mgmt/event"
+	"github.com/purpleidea/mgmt/util"
+
+	systemd "github.com/coreos/go-systemd/dbus" // change namespace
+	"github.com/godbus/dbus"                    // namespace collides with systemd wrapper
+	errwrap "github.com/pkg/errors"
+)
+
+func init() {
+	RegisterResource("net", func() Res { return &NetRes{} })
+	gob.Register(&NetRes{})
+}
+
+// netUnitDir is where the unit files of the net resource are generated.
+var netUnitDir = "/etc/systemd/network"
+
+const (
+	network1Path  = "/org/freedesktop/network1"
+	network1Iface = "org.freedesktop.network1"
+	networkdUnit  = "systemd-networkd.service"
+)
+
+// netNameRegexp matches the valid names of a network interface.
+var netNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_.-]{1,15}$`)
+
+// NetRoute is a static route of the net resource.
+type NetRoute struct {
+	Destination string `yaml:"destination"` // in CIDR notation, such as 10.0.0.0/8
+	Gateway     string `yaml:"gateway"`     // the address of the next hop, if any
+	Metric      uint32 `yaml:"metric"`      // the priority of the route, 0 for the default
+}
+
+// NetRes is a systemd-networkd resource. It generates the .network unit which
+// configures the network interface of the same name as the resource, and the
+// .netdev unit which creates it if it is virtual, such as a bridge or a vlan. A
+// physical interface can be given its name with a .link unit which matches its
+// mac address. networkd is only reloaded when the generated units changed.
+type NetRes struct {
+	BaseRes    `yaml:",inline"`
+	State      string     `yaml:"state"`      // state: exists, absent
+	Type       string     `yaml:"type"`       // the virtual device to create: bridge, vlan or dummy, or empty
+	VLAN       uint16     `yaml:"vlan"`       // vlan: the vlan id
+	Parent     string     `yaml:"parent"`     // vlan: the interface which carries the vlan
+	Bridge     string     `yaml:"bridge"`     // the bridge that this interface is a port of
+	MACAddress string     `yaml:"macaddress"` // the mac address of the physical interface to name
+	MTU        uint32     `yaml:"mtu"`        // the mtu in bytes, 0 for the default
+	DHCP       string     `yaml:"dhcp"`       // yes, no, ipv4 or ipv6, empty for the networkd default
+	Addrs      []string   `yaml:"addrs"`      // static addresses in CIDR notation, such as 192.0.2.10/24
+	Gateway    string     `yaml:"gateway"`    // the default gateway
+	Routes     []NetRoute `yaml:"routes"`     // static routes
+	DNS        []string   `yaml:"dns"`        // dns servers
+	Domains    []string   `yaml:"domains"`    // dns search domains
+}
+
+// NewNetRes is a constructor for this resource. It also calls Init() for you.
+func NewNetRes(name, state string, addrs []string) (*NetRes, error) {
+	obj := &NetRes{
+		BaseRes: BaseRes{
+			Name: name,
+		},
+		State: state,
+		Addrs: addrs,
+	}
+	return obj, obj.Init()
+}
+
+// Default returns some sensible defaults for this resource.
+func (obj *NetRes) Default() Res {
+	return &NetRes{
+		State: "exists",
+	}
+}
+
+// Validate if the params passed in are valid data.
+func (obj *NetRes) Validate() error {
+	if obj.State != "exists" && obj.State != "absent" {
+		return fmt.Errorf("State must be exists or absent.")
+	}
+	for _, name := range []string{obj.GetName(), obj.Parent, obj.Bridge} {
+		if name != "" && !netNameRegexp.MatchString(name) {
+			return fmt.Errorf("Invalid interface name: %s", name)
+		}
+	}
+	switch obj.Type {
+	case "", "bridge", "dummy":
+		if obj.VLAN != 0 || obj.Parent != "" {
+			return fmt.Errorf("Only a vlan has a vlan id and a parent.")
+		}
+	case "vlan":
+		if obj.VLAN < 1 || obj.VLAN > 4094 {
+			return fmt.Errorf("The vlan id must be between 1 and 4094.")
+		}
+		if obj.Parent == "" {
+			return fmt.Errorf("A vlan needs a parent.")
+		}
+	default:
+		return fmt.Errorf("Unknown type: %s", obj.Type)
+	}
+	if obj.MACAddress != "" {
+		if obj.Type != "" {
+			return fmt.Errorf("Only a physical interface can be matched by mac address.")
+		}
+		if _, err := net.ParseMAC(obj.MACAddress); err != nil {
+			return errwrap.Wrapf(err, "invalid mac address")
+		}
+	}
+	switch obj.DHCP {
+	case "", "yes", "no", "ipv4", "ipv6":
+	default:
+		return fmt.Errorf("DHCP must be yes, no, ipv4 or ipv6.")
+	}
+	for _, addr := range obj.Addrs {
+		if _, _, err := net.ParseCIDR(addr); err != nil {
+			return errwrap.Wrapf(err, "invalid address")
+		}
+	}
+	for _, route := range obj.Routes {
+		if _, _, err := net.ParseCIDR(route.Destination); route.Destination != "" && err != nil {
+			return errwrap.Wrapf(err, "invalid route destination")
+		}
+		if route.Gateway != "" && net.ParseIP(route.Gateway) == nil {
+			return fmt.Errorf("Invalid route gateway: %s", route.Gateway)
+		}
+	}
+	for _, ip := range append([]string{obj.Gateway}, obj.DNS...) {
+		if ip != "" && net.ParseIP(ip) == nil {
+			return fmt.Errorf("Invalid address: %s", ip)
+		}
+	}
+	for _, domain := range obj.Domains {
+		if domain == "" || strings.ContainsAny(domain, " \t\n") {
+			return fmt.Errorf("Invalid domain: %q", domain)
+		}
+	}
+	return obj.BaseRes.Validate()
+}
+
+// Init runs some startup code for this resource.
+func (obj *NetRes) Init() error {
+	obj.BaseRes.kind = "Net"
+	return obj.BaseRes.Init() // call base init, b/c we're overriding
+}
+
+// netFile returns the path of a unit file that we generate for the interface.
+func netFile(name, ext string) string {
+	return path.Join(netUnitDir, fmt.Sprintf("50-mgmt-%s.%s", name, ext))
+}
+
+// files returns the content of the unit files that we generate, by path. The
+// content is empty for the files that must be absent. The vlan is added to the
+// .network unit of its parent with a drop-in, so the parent interface needs to
+// be managed by a net resource too.
+func (obj *NetRes) files() map[string]string {
+	network := netFile(obj.GetName(), "network")
+	netdev := netFile(obj.GetName(), "netdev")
+	link := netFile(obj.GetName(), "link")
+	result := map[string]string{network: "", netdev: "", link: ""}
+	var dropin string
+	if obj.Parent != "" {
+		dropin = path.Join(netFile(obj.Parent, "network.d"), fmt.Sprintf("mgmt-vlan-%s.conf", obj.GetName()))
+		result[dropin] = ""
+	}
+	if obj.State == "absent" {
+		return result
+	}
+	result[network] = obj.networkFile()
+	if obj.Type != "" {
+		result[netdev] = obj.netdevFile()
+	}
+	if obj.MACAddress != "" {
+		result[link] = obj.linkFile()
+	}
+	if dropin != "" {
+		result[dropin] = fmt.Sprintf("%s[Network]\nVLAN=%s\n", unitHeader, obj.GetName())
+	}
+	return result
+}
+
+// networkFile returns the content of the .network unit.
+func (obj *NetRes) networkFile() string {
+	var b bytes.Buffer
+	b.WriteString(unitHeader)
+	fmt.Fprintf(&b, "[Match]\nName=%s\n", obj.GetName())
+	if obj.MTU > 0 {
+		fmt.Fprintf(&b, "\n[Link]\nMTUBytes=%d\n", obj.MTU)
+	}
+	fmt.Fprintf(&b, "\n[Network]\n")
+	if obj.DHCP != "" {
+		fmt.Fprintf(&b, "DHCP=%s\n", obj.DHCP)
+	}
+	for _, addr := range obj.Addrs {
+		fmt.Fprintf(&b, "Address=%s\n", addr)
+	}
+	if obj.Gateway != "" {
+		fmt.Fprintf(&b, "Gateway=%s\n", obj.Gateway)
+	}
+	for _, dns := range obj.DNS {
+		fmt.Fprintf(&b, "DNS=%s\n", dns)
+	}
+	if len(obj.Domains) > 0 {
+		fmt.Fprintf(&b, "Domains=%s\n", strings.Join(obj.Domains, " "))
+	}
+	if obj.Bridge != "" {
+		fmt.Fprintf(&b, "Bridge=%s\n", obj.Bridge)
+	}
+	for _, route := range obj.Routes {
+		fmt.Fprintf(&b, "\n[Route]\n")
+		if route.Destination != "" {
+			fmt.Fprintf(&b, "Destination=%s\n", route.Destination)
+		}
+		if route.Gateway != "" {
+			fmt.Fprintf(&b, "Gateway=%s\n", route.Gateway)
+		}
+		if route.Metric > 0 {
+			fmt.Fprintf(&b, "Metric=%d\n", route.Metric)
+		}
+	}
+	return b.String()
+}
+
+// netdevFile returns the content of the .netdev unit of a virtual interface.
+func (obj *NetRes) netdevFile() string {
+	var b bytes.Buffer
+	b.WriteString(unitHeader)
+	fmt.Fprintf(&b, "[NetDev]\nName=%s\nKind=%s\n", obj.GetName(), obj.Type)
+	if obj.Type == "vlan" {
+		fmt.Fprintf(&b, "\n[VLAN]\nId=%d\n", obj.VLAN)
+	}
+	return b.String()
+}
+
+// linkFile returns the content of the .link unit which names the interface.
+func (obj *NetRes) linkFile() string {
+	var b bytes.Buffer
+	b.WriteString(unitHeader)
+	fmt.Fprintf(&b, "[Match]\nMACAddress=%s\n\n", obj.MACAddress)
+	fmt.Fprintf(&b, "[Link]\nName=%s\n", obj.GetName())
+	return b.String()
+}
+
+// Watch is the primary listener for this resource and it outputs events. It
+// watches the state of the links over the networkd dbus api, and the unit
+// files so that edits get reverted.
+func (obj *NetRes) Watch(processChan chan *event.Event) error {
+	// if we share the bus with others, we will get each others messages!!
+	bus, err := util.SystemBusPrivateUsable() // don't share the bus connection!
+	if err != nil {
+		return errwrap.Wrapf(err, "Failed to connect to bus")
+	}
+	defer bus.Close()
+	callResult := bus.BusObject().Call(dbusAddMatch, 0,
+		fmt.Sprintf("type='signal',path_namespace='%s',interface='org.freedesktop.DBus.Properties',member='PropertiesChanged'", network1Path))
+	if callResult.Err != nil {
+		return errwrap.Wrapf(callResult.Err, "Failed to subscribe to DBus events for network1")
+	}
+	signals := make(chan *dbus.Signal, 10) // closed by dbus package
+	bus.Signal(signals)
+
+	files := []string{}
+	for p := range obj.files() {
+		files = append(files, p)
+	}
+	watcher, err := newMultiWatcher(files...)
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	// notify engine that we're running
+	if err := obj.Running(processChan); err != nil {
+		return err // bubble up a NACK...
+	}
+
+	var send = false // send event?
+	var exit *error
+	for {
+		select {
+		case <-signals: // the state of some link changed
+			send = true
+			obj.StateOK(false) // dirty
+
+		case err := <-watcher.Events():
+			if err != nil {
+				return errwrap.Wrapf(err, "Unknown %s[%s] watcher error", obj.Kind(), obj.GetName())
+			}
+			send = true
+			obj.StateOK(false) // dirty
+
+		case event := <-obj.Events():
+			if exit, send = obj.ReadEvent(event); exit != nil {
+				return *exit // exit
+			}
+		}
+
+		// do all our event sending all together to avoid duplicate msgs
+		if send {
+			send = false
+			obj.Event(processChan)
+		}
+	}
+}
+
+// netNoService returns true if the dbus error says that networkd isn't running,
+// and that it can't be activated either.
+func netNoService(err error) bool {
+	e, ok := err.(dbus.Error)
+	return ok && (e.Name == "org.freedesktop.DBus.Error.ServiceUnknown" || e.Name == "org.freedesktop.DBus.Error.NameHasNoOwner")
+}
+
+// netLink returns the index and the administrative state of the link, as seen
+// by networkd. The index is zero if there is no such link, which is also the
+// case when networkd isn't running.
+func netLink(bus *dbus.Conn, name string) (int32, string, error) {
+	var index int32
+	var p dbus.ObjectPath
+	call := bus.Object(network1Iface, network1Path).Call(network1Iface+".Manager.GetLinkByName", 0, name)
+	if e, ok := call.Err.(dbus.Error); ok && e.Name == network1Iface+".NoSuchLink" {
+		return 0, "", nil
+	}
+	if netNoService(call.Err) { // so it has no links
+		return 0, "", nil
+	}
+	if err := call.Store(&index, &p); err != nil {
+		return 0, "", errwrap.Wrapf(err, "failed to get the link %s from networkd", name)
+	}
+	v, err := bus.Object(network1Iface, p).GetProperty(network1Iface + ".Link.AdministrativeState")
+	if err != nil {
+		return 0, "", errwrap.Wrapf(err, "failed to get the state of the link %s", name)
+	}
+	state, ok := v.Value().(string)
+	if !ok {
+		return 0, "", fmt.Errorf("Received unexpected type as AdministrativeState value, expected string got '%T'", v.Value())
+	}
+	return index, state, nil
+}
+
+// missingAddrs returns the addresses which aren't on the interface.
+func (obj *NetRes) missingAddrs() ([]string, error) {
+	iface, err := net.InterfaceByName(obj.GetName())
+	if err != nil {
+		return nil, errwrap.Wrapf(err, "can't get interface %s", obj.GetName())
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, errwrap.Wrapf(err, "can't get the addresses of %s", obj.GetName())
+	}
+	missing := []string{}
+	for _, addr := range obj.Addrs {
+		ip, ipnet, _ := net.ParseCIDR(addr) // already validated
+		found := false
+		for _, x := range addrs {
+			if x, ok := x.(*net.IPNet); ok && x.IP.Equal(ip) && x.Mask.String() == ipnet.Mask.String() {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, addr)
+		}
+	}
+	return missing, nil
+}
+
+// netReload makes networkd load the changed units. The older versions which
+// can't reload are restarted. If networkd isn't running, it loads them once it
+// starts, so there's nothing to do.
+func netReload(bus *dbus.Conn) error {
+	err := bus.Object(network1Iface, network1Path).Call(network1Iface+".Manager.Reload", 0).Err
+	if netNoService(err) {
+		log.Printf("Net: %s isn't running, so it isn't reloaded", networkdUnit)
+		return nil
+	}
+	if e, ok := err.(dbus.Error); !ok || e.Name != "org.freedesktop.DBus.Error.UnknownMethod" {
+		return errwrap.Wrapf(err, "failed to reload networkd") // nil if no error
+	}
+	conn, err := systemd.NewSystemdConnection() // needs root access
+	if err != nil {
+		return errwrap.Wrapf(err, "Failed to connect to systemd")
+	}
+	defer conn.Close()
+	result := make(chan string, 1) // catch result information
+	if _, err := conn.RestartUnit(networkdUnit, "replace", result); err != nil {
+		return errwrap.Wrapf(err, "Failed to restart %s", networkdUnit)
+	}
+	if status := <-result; status != "done" {
+		return fmt.Errorf("Unknown systemd return string: %v", status)
+	}
+	return nil
+}
+
+// CheckApply checks the resource state and applies the resource if the bool
+// input is true. It returns error info and if the state check passed or not.
+// Besides the unit files, it checks that a virtual interface exists, and that
+// no address was removed from the interface behind the back of networkd.
+func (obj *NetRes) CheckApply(apply bool) (checkOK bool, err error) {
+	// the unit files come first, since networkd doesn't need to be running
+	// for them to be right, and it loads them whenever it starts
+	files := obj.files()
+	changed, err := unitFilesChanged(files) // the files which aren't right
+	if err != nil {
+		return false, err
+	}
+
+	var bus *dbus.Conn
+	defer func() {
+		if bus != nil {
+			bus.Close()
+		}
+	}()
+	connect := func() error { // the bus is only used if it's needed
+		if bus != nil {
+			return nil
+		}
+		var err error
+		if bus, err = util.SystemBusPrivateUsable(); err != nil {
+			return errwrap.Wrapf(err, "Failed to connect to bus")
+		}
+		return nil
+	}
+
+	var index int32     // the link index, zero if there's no link
+	var missing = false // does the virtual interface need to be created?
+	var addrs []string  // the addresses which were removed
+	if obj.State == "exists" && len(changed) == 0 {
+		if err := connect(); err != nil {
+			return false, err
+		}
+		var state string
+		if index, state, err = netLink(bus, obj.GetName()); err != nil {
+			return false, err
+		}
+		switch {
+		case index == 0:
+			missing = obj.Type != "" // a physical one might be unplugged
+		case state == "failed":
+			return false, fmt.Errorf("Networkd failed to configure %s.", obj.GetName())
+		case state == "configured":
+			if addrs, err = obj.missingAddrs(); err != nil {
+				return false, err
+			}
+		}
+	}
+	if len(changed) == 0 && !missing && len(addrs) == 0 {
+		return true, nil // we are in the correct state
+	}
+
+	// state is not okay, no work done, exit, but without error
+	if !apply {
+		unitFileChanges(obj, files, changed)
+		if missing {
+			obj.AddChange(&Change{Property: "link", Old: "absent", New: "exists"})
+		}
+		for _, addr := range addrs {
+			obj.AddChange(&Change{Property: "addr", New: addr})
+		}
+		return false, nil
+	}
+
+	if len(addrs) > 0 { // networkd only sets them when it configures the link
+		log.Printf("%s[%s]: Reconfiguring the link", obj.Kind(), obj.GetName())
+		if err := bus.Object(network1Iface, network1Path).Call(network1Iface+".Manager.ReconfigureLink", 0, index).Err; err != nil {
+			return false, errwrap.Wrapf(err, "failed to reconfigure %s", obj.GetName())
+		}
+		return false, nil
+	}
+
+	log.Printf("%s[%s]: Apply", obj.Kind(), obj.GetName())
+	if err := writeUnitFiles(files, changed); err != nil {
+		return false, err
+	}
+	reload := missing
+	for _, p := range changed {
+		// the .link units are applied by udev, when the device appears
+		if path.Ext(p) != ".link" {
+			reload = true
+		}
+	}
+	if reload {
+		if err := connect(); err != nil {
+			return false, err
+		}
+		if err := netReload(bus); err != nil {
+			return false, err
+		}
+	}
+	return false, nil // success
+}
+
+// NetUID is the UID struct for NetRes.
+type NetUID struct {
+	BaseUID
+	name string // the name of the interface
+}
+
+// IFF aka if and only if they are equivalent, return true. If not, false.
+func (obj *NetUID) IFF(uid ResUID) bool {
+	res, ok := uid.(*NetUID)
+	if !ok {
+		return false
+	}
+	return obj.name == res.name
+}
+
+// AutoEdges returns the AutoEdge interface. The parent of a vlan, and the bridge
+// of a port happen before us.
+func (obj *NetRes) AutoEdges() AutoEdge {
+	var data []ResUID
+	for _, name := range []string{obj.Parent, obj.Bridge} {
+		if name == "" {
+			continue
+		}
+		var reversed = true // these happen before us
+		data = append(data, &NetUID{
+			BaseUID: BaseUID{
+				name:     obj.GetName(),
+				kind:     obj.Kind(),
+				reversed: &reversed,
+			},
+			name: name,
+		})
+	}
+	return &BatchAutoEdges{
+		data: data,
+	}
+}
+
+// UIDs includes all params to make a unique identification of this object.
+// Most resources only return one, although some resources can return multiple.
+func (obj *NetRes) UIDs() []ResUID {
+	x := &NetUID{
+		BaseUID: BaseUID{name: obj.GetName(), kind: obj.Kind()},
+		name:    obj.GetName(),
+	}
+	return []ResUID{x}
+}
+
+// GroupCmp returns whether two resources can be grouped together or not.
+func (obj *NetRes) GroupCmp(r Res) bool {
+	_, ok := r.(*NetRes)
+	if !ok {
+		return false
+	}
+	return false // not possible atm
+}
+
+// Compare two resources and return if they are equivalent.
+func (obj *NetRes) Compare(res Res) bool {
+	switch res.(type) {
+	case *NetRes:
+		res := res.(*NetRes)
+		if !obj.BaseRes.Compare(res) { // call base Compare
+			return false
+		}
+
+		if obj.Name != res.Name {
+			return false
+		}
+		if obj.State != res.State {
+			return false
+		}
+		// the generated units contain all the other params
+		if !util.StrMapEq(obj.files(), res.files()) {
+			return false
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// UnmarshalYAML is the custom unmarshal handler for this struct.
+// It is primarily useful for setting the defaults.
+func (obj *NetRes) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type rawRes NetRes // indirection to avoid infinite recursion
+
+	def := obj.Default()     // get the default
+	res, ok := def.(*NetRes) // put in the right format
+	if !ok {
+		return fmt.Errorf("could not convert to NetRes")
+	}
+	raw := rawRes(*res) // convert; the defaults go here
+
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+
+	*obj = NetRes(raw) // restore from indirection with type conversion!
+	return nil
+}
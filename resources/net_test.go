@@ -0,0 +1,172 @@
+// Mgmt
+// Copyright (C) 2013-2016+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package resources
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestNetFiles1(t *testing.T) {
+	vlan, _ := NewNetRes("vlan10", "exists", []string{"192.0.2.10/24"})
+	vlan.Type = "vlan"
+	vlan.VLAN = 10
+	vlan.Parent = "eth0"
+	vlan.Gateway = "192.0.2.1"
+	vlan.DNS = []string{"192.0.2.53"}
+	vlan.Domains = []string{"example.com", "example.org"}
+	vlan.Routes = []NetRoute{{Destination: "10.0.0.0/8", Gateway: "192.0.2.254", Metric: 100}}
+	if err := vlan.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	files := vlan.files()
+	network := unitHeader + `[Match]
+Name=vlan10
+
+[Network]
+Address=192.0.2.10/24
+Gateway=192.0.2.1
+DNS=192.0.2.53
+Domains=example.com example.org
+
+[Route]
+Destination=10.0.0.0/8
+Gateway=192.0.2.254
+Metric=100
+`
+	if s := files[netUnitDir+"/50-mgmt-vlan10.network"]; s != network {
+		t.Errorf("Wrong network unit:\n%s", s)
+	}
+	netdev := unitHeader + `[NetDev]
+Name=vlan10
+Kind=vlan
+
+[VLAN]
+Id=10
+`
+	if s := files[netUnitDir+"/50-mgmt-vlan10.netdev"]; s != netdev {
+		t.Errorf("Wrong netdev unit:\n%s", s)
+	}
+	if s := files[netUnitDir+"/50-mgmt-eth0.network.d/mgmt-vlan-vlan10.conf"]; s != unitHeader+"[Network]\nVLAN=vlan10\n" {
+		t.Errorf("Wrong vlan drop-in:\n%s", s)
+	}
+	if s := files[netUnitDir+"/50-mgmt-vlan10.link"]; s != "" {
+		t.Errorf("The link unit shouldn't be generated:\n%s", s)
+	}
+
+	port, _ := NewNetRes("eth1", "exists", nil)
+	port.Bridge = "br0"
+	port.MACAddress = "52:54:00:12:34:56"
+	port.MTU = 9000
+	if err := port.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	files = port.files()
+	if s := files[netUnitDir+"/50-mgmt-eth1.network"]; s != unitHeader+"[Match]\nName=eth1\n\n[Link]\nMTUBytes=9000\n\n[Network]\nBridge=br0\n" {
+		t.Errorf("Wrong network unit:\n%s", s)
+	}
+	if s := files[netUnitDir+"/50-mgmt-eth1.link"]; s != unitHeader+"[Match]\nMACAddress=52:54:00:12:34:56\n\n[Link]\nName=eth1\n" {
+		t.Errorf("Wrong link unit:\n%s", s)
+	}
+	port.Type = "bridge"
+	if err := port.Validate(); err == nil {
+		t.Errorf("A bridge was matched by mac address")
+	}
+
+	bridge, _ := NewNetRes("br0", "exists", nil)
+	bridge.Type = "bridge"
+	bridge.DHCP = "ipv4"
+	if err := bridge.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	files = bridge.files()
+	if s := files[netUnitDir+"/50-mgmt-br0.network"]; s != unitHeader+"[Match]\nName=br0\n\n[Network]\nDHCP=ipv4\n" {
+		t.Errorf("Wrong network unit:\n%s", s)
+	}
+	if s := files[netUnitDir+"/50-mgmt-br0.netdev"]; s != unitHeader+"[NetDev]\nName=br0\nKind=bridge\n" {
+		t.Errorf("Wrong netdev unit:\n%s", s)
+	}
+
+	vlan.State = "absent"
+	files = vlan.files()
+	if len(files) != 4 {
+		t.Errorf("Wrong files: %v", files)
+	}
+	for p, s := range files {
+		if s != "" {
+			t.Errorf("The file %s should be removed:\n%s", p, s)
+		}
+	}
+}
+
+func TestNetValidate1(t *testing.T) {
+	for _, f := range []func(*NetRes){
+		func(obj *NetRes) { obj.State = "up" },
+		func(obj *NetRes) { obj.Name = "eth 0" },
+		func(obj *NetRes) { obj.Type = "bond" },
+		func(obj *NetRes) { obj.VLAN = 10 },
+		func(obj *NetRes) { obj.Type = "vlan"; obj.VLAN = 10 },
+		func(obj *NetRes) { obj.Type = "vlan"; obj.VLAN = 4095; obj.Parent = "eth0" },
+		func(obj *NetRes) { obj.MACAddress = "52:54:00" },
+		func(obj *NetRes) { obj.DHCP = "maybe" },
+		func(obj *NetRes) { obj.Addrs = []string{"192.0.2.10"} },
+		func(obj *NetRes) { obj.Routes = []NetRoute{{Destination: "10.0.0.0"}} },
+		func(obj *NetRes) { obj.Routes = []NetRoute{{Gateway: "gw"}} },
+		func(obj *NetRes) { obj.DNS = []string{"dns.example.com"} },
+		func(obj *NetRes) { obj.Domains = []string{"example com"} },
+	} {
+		obj, _ := NewNetRes("eth0", "exists", []string{"192.0.2.10/24"})
+		f(obj)
+		if err := obj.Validate(); err == nil {
+			t.Errorf("Validate should fail: %+v", obj)
+		}
+	}
+}
+
+// TestNetCheckApply1 checks that the unit files are checked before networkd is
+// asked about the link, so that the changes are known without networkd.
+func TestNetCheckApply1(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mgmt-net-")
+	if err != nil {
+		t.Fatalf("Can't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	old := netUnitDir
+	netUnitDir = dir
+	defer func() { netUnitDir = old }()
+
+	vlan, _ := NewNetRes("vlan10", "exists", []string{"192.0.2.10/24"})
+	vlan.Type = "vlan"
+	vlan.VLAN = 10
+	vlan.Parent = "eth0"
+	if err := vlan.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	if checkOK, err := vlan.CheckApply(false); err != nil || checkOK {
+		t.Fatalf("Noop CheckApply returned: %v, %v", checkOK, err)
+	}
+	if n := len(vlan.Changes()); n != 3 { // the network, netdev and drop-in
+		t.Errorf("Expected 3 changes, got: %d", n)
+	}
+
+	vlan.State = "absent"
+	if checkOK, err := vlan.CheckApply(true); err != nil || !checkOK {
+		t.Errorf("CheckApply returned: %v, %v", checkOK, err)
+	}
+}
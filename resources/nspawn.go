@@ -18,14 +18,21 @@
 package resources
 
 import (
+	"bytes"
 	"encoding/gob"
 	"errors"
 	"fmt"
 	"log"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
 
 	"github.com/purpleidea/mgmt/event"
 	"github.com/purpleidea/mgmt/util"
 
+	systemd "github.com/coreos/go-systemd/dbus" // change namespace
 	systemdUtil "github.com/coreos/go-systemd/util"
 	"github.com/godbus/dbus"
 	errwrap "github.com/pkg/errors"
@@ -39,17 +46,58 @@ const (
 	machineNew        = "org.freedesktop.machine1.Manager.MachineNew"
 	machineRemoved    = "org.freedesktop.machine1.Manager.MachineRemoved"
 	nspawnServiceTmpl = "systemd-nspawn@%s"
+	absent            = "absent"
+	machine1Path      = "/org/freedesktop/machine1"
+	machine1Iface     = "org.freedesktop.machine1"
+	import1Path       = "/org/freedesktop/import1"
+	import1Iface      = "org.freedesktop.import1"
 )
 
+// nspawnPollInterval is how often we check if a machine that we stop is gone.
+const nspawnPollInterval = 100 * time.Millisecond
+
+// nspawnUnitDir is where the settings files of the nspawn resource are kept.
+var nspawnUnitDir = "/etc/systemd/nspawn"
+
+// nspawnImageTypes are the suffixes of the images that can be imported, and the
+// import1 methods which import them. A directory tree ends with a slash.
+var nspawnImageTypes = map[string]string{
+	".tar":     "ImportTar",
+	".tar.gz":  "ImportTar",
+	".tgz":     "ImportTar",
+	".tar.xz":  "ImportTar",
+	".tar.bz2": "ImportTar",
+	".raw":     "ImportRaw",
+	".raw.gz":  "ImportRaw",
+	".raw.xz":  "ImportRaw",
+	".qcow2":   "ImportRaw",
+	"/":        "ImportFileSystem",
+}
+
+// nspawnZoneRegexp matches the names of the network zones, which become part of
+// the name of the bridge, which is limited to 15 characters.
+var nspawnZoneRegexp = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,12}$`)
+
+// nspawnUsersRegexp matches a uid shift, and optionally a range, for the
+// PrivateUsers setting.
+var nspawnUsersRegexp = regexp.MustCompile(`^[0-9]+(:[0-9]+)?$`)
+
 func init() {
 	RegisterResource("nspawn", func() Res { return &NspawnRes{} })
 	gob.Register(&NspawnRes{})
 }
 
-// NspawnRes is an nspawn container resource
+// NspawnRes is an nspawn container resource. The machine is created from its
+// image, which is imported if it doesn't exist yet, and its settings are kept
+// in a .nspawn file. The absent state removes the machine and its image.
 type NspawnRes struct {
-	BaseRes `yaml:",inline"`
-	State   string `yaml:"state"`
+	BaseRes      `yaml:",inline"`
+	State        string   `yaml:"state"`        // running, stopped or absent
+	Image        string   `yaml:"image"`        // a tarball, a raw image or a directory tree to import
+	Bind         []string `yaml:"bind"`         // bind mounts, in the src[:dst[:options]] format
+	BindReadOnly []string `yaml:"bindreadonly"` // read only bind mounts, in the same format
+	Zone         string   `yaml:"zone"`         // the network zone to connect the machine to
+	PrivateUsers string   `yaml:"privateusers"` // yes, no, pick, identity or a uid shift
 	// we're using the svc resource to start the machine because that's
 	// what machinectl does. We're not using svc.Watch because then we
 	// would have two watches potentially racing each other and producing
@@ -82,10 +130,34 @@ func (obj *NspawnRes) Validate() error {
 	validStates := map[string]struct{}{
 		stopped: {},
 		running: {},
+		absent:  {},
 	}
 	if _, exists := validStates[obj.State]; !exists {
 		return fmt.Errorf("Invalid State: %s", obj.State)
 	}
+	if obj.Image != "" {
+		if !path.IsAbs(obj.Image) {
+			return fmt.Errorf("The image path must be absolute.")
+		}
+		if obj.importMethod() == "" {
+			return fmt.Errorf("Unknown image type: %s", obj.Image)
+		}
+	}
+	for _, bind := range append(obj.Bind, obj.BindReadOnly...) {
+		if !strings.HasPrefix(bind, "/") || strings.ContainsAny(bind, "\n") {
+			return fmt.Errorf("Invalid bind mount: %q", bind)
+		}
+	}
+	if obj.Zone != "" && !nspawnZoneRegexp.MatchString(obj.Zone) {
+		return fmt.Errorf("Invalid zone: %s", obj.Zone)
+	}
+	switch obj.PrivateUsers {
+	case "", "yes", "no", "pick", "identity":
+	default:
+		if !nspawnUsersRegexp.MatchString(obj.PrivateUsers) {
+			return fmt.Errorf("Invalid PrivateUsers: %s", obj.PrivateUsers)
+		}
+	}
 
 	if err := obj.svc.Validate(); err != nil { // composite resource
 		return errwrap.Wrapf(err, "validate failed for embedded svc")
@@ -99,6 +171,9 @@ func (obj *NspawnRes) Init() error {
 	obj.svc = &SvcRes{}
 	obj.svc.Name = serviceName
 	obj.svc.State = obj.State
+	if obj.State == absent {
+		obj.svc.State = stopped
+	}
 	if err := obj.svc.Init(); err != nil {
 		return err
 	}
@@ -106,6 +181,52 @@ func (obj *NspawnRes) Init() error {
 	return obj.BaseRes.Init()
 }
 
+// importMethod returns the import1 method which imports the image, or the empty
+// string if the image can't be imported.
+func (obj *NspawnRes) importMethod() string {
+	for suffix, method := range nspawnImageTypes {
+		if strings.HasSuffix(obj.Image, suffix) {
+			return method
+		}
+	}
+	return ""
+}
+
+// files returns the content of the settings file, by path. The content is empty
+// if the file must be absent, such as when there are no settings.
+func (obj *NspawnRes) files() map[string]string {
+	p := path.Join(nspawnUnitDir, fmt.Sprintf("%s.nspawn", obj.GetName()))
+	if obj.State == absent {
+		return map[string]string{p: ""}
+	}
+	return map[string]string{p: obj.settingsFile()}
+}
+
+// settingsFile returns the content of the .nspawn file, which is empty if there
+// are no settings to put in it.
+func (obj *NspawnRes) settingsFile() string {
+	var b bytes.Buffer
+	if obj.PrivateUsers != "" {
+		fmt.Fprintf(&b, "\n[Exec]\nPrivateUsers=%s\n", obj.PrivateUsers)
+	}
+	if len(obj.Bind) > 0 || len(obj.BindReadOnly) > 0 {
+		fmt.Fprintf(&b, "\n[Files]\n")
+		for _, bind := range obj.Bind {
+			fmt.Fprintf(&b, "Bind=%s\n", bind)
+		}
+		for _, bind := range obj.BindReadOnly {
+			fmt.Fprintf(&b, "BindReadOnly=%s\n", bind)
+		}
+	}
+	if obj.Zone != "" {
+		fmt.Fprintf(&b, "\n[Network]\nZone=%s\n", obj.Zone)
+	}
+	if b.Len() == 0 {
+		return ""
+	}
+	return unitHeader + strings.TrimPrefix(b.String(), "\n")
+}
+
 // Watch for state changes and sends a message to the bus if there is a change
 func (obj *NspawnRes) Watch(processChan chan *event.Event) error {
 	// this resource depends on systemd ensure that it's running
@@ -118,6 +239,7 @@ func (obj *NspawnRes) Watch(processChan chan *event.Event) error {
 	if err != nil {
 		return errwrap.Wrapf(err, "Failed to connect to bus")
 	}
+	defer bus.Close()
 
 	// add a match rule to match messages going through the message bus
 	call := bus.BusObject().Call("org.freedesktop.DBus.AddMatch", 0,
@@ -130,6 +252,13 @@ func (obj *NspawnRes) Watch(processChan chan *event.Event) error {
 	buschan := make(chan *dbus.Signal, 10)
 	bus.Signal(buschan)
 
+	// the settings file, so that edits get reverted
+	watcher, err := newMultiWatcher(path.Join(nspawnUnitDir, fmt.Sprintf("%s.nspawn", obj.GetName())))
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
 	// notify engine that we're running
 	if err := obj.Running(processChan); err != nil {
 		return err // bubble up a NACK...
@@ -155,6 +284,13 @@ func (obj *NspawnRes) Watch(processChan chan *event.Event) error {
 				obj.StateOK(false) // dirty
 			}
 
+		case err := <-watcher.Events():
+			if err != nil {
+				return errwrap.Wrapf(err, "Unknown %s[%s] watcher error", obj.Kind(), obj.GetName())
+			}
+			send = true
+			obj.StateOK(false) // dirty
+
 		case event := <-obj.Events():
 			if exit, send = obj.ReadEvent(event); exit != nil {
 				return *exit // exit
@@ -194,21 +330,36 @@ func (obj *NspawnRes) CheckApply(apply bool) (checkOK bool, err error) {
 			return false, err
 		}
 		exists = false
-		// if we could not successfully get the properties because
-		// there's no such machine the machine is stopped
-		// error if we need the image ignore if we don't
-		if _, err = conn.GetImage(obj.GetName()); err != nil && obj.State != stopped {
-			return false, fmt.Errorf(
-				"No machine nor image named '%s'",
-				obj.GetName())
-		}
 	}
 	if obj.debug {
 		log.Printf("%s[%s]: properties: %v", obj.Kind(), obj.GetName(), properties)
 	}
-	// if the machine doesn't exist and is supposed to
-	// be stopped or the state matches we're done
-	if !exists && obj.State == stopped || properties["State"] == obj.State {
+	_, err = conn.GetImage(obj.GetName())
+	var image = err == nil                                          // does the image exist?
+	var imported = !image && obj.Image != "" && obj.State != absent // do we need to import it?
+	// error if we need the image but can't import it, ignore if we don't
+	if !exists && !image && obj.Image == "" && obj.State == running {
+		return false, fmt.Errorf(
+			"No machine nor image named '%s'",
+			obj.GetName())
+	}
+
+	files := obj.files()
+	changed, err := unitFilesChanged(files) // the settings which aren't right
+	if err != nil {
+		return false, err
+	}
+
+	var stateOK bool
+	switch obj.State {
+	case running:
+		stateOK = properties["State"] == obj.State
+	case stopped:
+		stateOK = !exists
+	case absent:
+		stateOK = !exists && !image
+	}
+	if stateOK && !imported && len(changed) == 0 {
 		if obj.debug {
 			log.Printf("%s[%s]: CheckApply() in valid state", obj.Kind(), obj.GetName())
 		}
@@ -217,6 +368,19 @@ func (obj *NspawnRes) CheckApply(apply bool) (checkOK bool, err error) {
 
 	// end of state checking. if we're here, checkOK is false
 	if !apply {
+		unitFileChanges(obj, files, changed)
+		if imported {
+			obj.AddChange(&Change{Property: "image", New: obj.Image})
+		}
+		if !stateOK {
+			var state = stopped
+			if exists {
+				state = fmt.Sprintf("%v", properties["State"])
+			} else if !image {
+				state = absent
+			}
+			obj.AddChange(&Change{Property: "state", Old: state, New: obj.State})
+		}
 		return false, nil
 	}
 
@@ -224,7 +388,53 @@ func (obj *NspawnRes) CheckApply(apply bool) (checkOK bool, err error) {
 		log.Printf("%s[%s]: CheckApply() applying '%s' state", obj.Kind(), obj.GetName(), obj.State)
 	}
 
-	if obj.State == running {
+	if exists && obj.State != running {
+		// terminate the machine with
+		// org.freedesktop.machine1.Manager.TerminateMachine
+		log.Printf("%s[%s]: Stopping machine", obj.Kind(), obj.GetName())
+		if err := conn.TerminateMachine(obj.GetName()); err != nil {
+			return false, errwrap.Wrapf(err, "Failed to stop machine")
+		}
+	}
+	if obj.State == absent {
+		if err := writeUnitFiles(files, changed); err != nil {
+			return false, err
+		}
+		if image {
+			log.Printf("%s[%s]: Removing image", obj.Kind(), obj.GetName())
+			if err := obj.removeImage(conn, exists); err != nil {
+				return false, err
+			}
+		}
+		return false, nil
+	}
+
+	if imported {
+		log.Printf("%s[%s]: Importing %s", obj.Kind(), obj.GetName(), obj.Image)
+		if err := obj.importImage(); err != nil {
+			return false, err
+		}
+	}
+	if err := writeUnitFiles(files, changed); err != nil {
+		return false, err
+	}
+
+	if obj.State == running && exists && len(changed) > 0 {
+		// the settings only apply when the machine starts
+		log.Printf("%s[%s]: Restarting machine", obj.Kind(), obj.GetName())
+		sconn, err := systemd.NewSystemdConnection() // needs root access
+		if err != nil {
+			return false, errwrap.Wrapf(err, "Failed to connect to systemd")
+		}
+		defer sconn.Close()
+		result := make(chan string, 1) // catch result information
+		if _, err := sconn.RestartUnit(obj.svc.unit(), "replace", result); err != nil {
+			return false, errwrap.Wrapf(err, "Failed to restart machine")
+		}
+		if status := <-result; status != "done" {
+			return false, fmt.Errorf("Unknown systemd return string: %v", status)
+		}
+	} else if obj.State == running && !stateOK {
 		// start the machine using svc resource
 		log.Printf("%s[%s]: Starting machine", obj.Kind(), obj.GetName())
 		// assume state had to be changed at this point, ignore checkOK
@@ -232,16 +442,82 @@ func (obj *NspawnRes) CheckApply(apply bool) (checkOK bool, err error) {
 			return false, errwrap.Wrapf(err, "Nested svc failed")
 		}
 	}
-	if obj.State == stopped {
-		// terminate the machine with
-		// org.freedesktop.machine1.Manager.KillMachine
-		log.Printf("%s[%s]: Stopping machine", obj.Kind(), obj.GetName())
-		if err := conn.TerminateMachine(obj.GetName()); err != nil {
-			return false, errwrap.Wrapf(err, "Failed to stop machine")
+
+	return false, nil
+}
+
+// importImage imports the image with org.freedesktop.import1 as the image of
+// the machine, and waits for the transfer to finish.
+func (obj *NspawnRes) importImage() error {
+	bus, err := util.SystemBusPrivateUsable()
+	if err != nil {
+		return errwrap.Wrapf(err, "Failed to connect to bus")
+	}
+	defer bus.Close()
+	call := bus.BusObject().Call(dbusAddMatch, 0,
+		fmt.Sprintf("type='signal',interface='%s.Manager',member='TransferRemoved'", import1Iface))
+	if err := call.Err; err != nil {
+		return errwrap.Wrapf(err, "Failed to subscribe to DBus events for import1")
+	}
+	signals := make(chan *dbus.Signal, 10) // closed by dbus package
+	bus.Signal(signals)
+
+	f, err := os.Open(obj.Image) // a directory tree is passed as a dir fd
+	if err != nil {
+		return errwrap.Wrapf(err, "can't open %s", obj.Image)
+	}
+	defer f.Close()
+	var id uint32
+	var transfer dbus.ObjectPath
+	manager := bus.Object(import1Iface, import1Path)
+	method := fmt.Sprintf("%s.Manager.%s", import1Iface, obj.importMethod())
+	// the args are the fd, the name, force and read only
+	if err := manager.Call(method, 0, dbus.UnixFD(f.Fd()), obj.GetName(), false, false).Store(&id, &transfer); err != nil {
+		return errwrap.Wrapf(err, "Failed to import %s", obj.Image)
+	}
+	for {
+		select {
+		case signal, ok := <-signals:
+			if !ok {
+				return fmt.Errorf("The bus closed during the import of %s.", obj.Image)
+			}
+			// the body is the id, the path and the result of the transfer
+			if len(signal.Body) != 3 || signal.Body[0] != id {
+				continue // not our transfer
+			}
+			if result := fmt.Sprintf("%v", signal.Body[2]); result != "done" {
+				return fmt.Errorf("The import of %s failed: %s", obj.Image, result)
+			}
+			return nil
+
+		case <-obj.Context().Done(): // the timeout metaparam expired
+			manager.Call(import1Iface+".Manager.CancelTransfer", 0, id)
+			return fmt.Errorf("The import of %s was cancelled.", obj.Image)
 		}
 	}
+}
 
-	return false, nil
+// removeImage removes the image of the machine. If the machine was running, it
+// first waits for it to stop, since a running machine keeps its image busy.
+func (obj *NspawnRes) removeImage(conn *machined.Conn, running bool) error {
+	for running {
+		select {
+		case <-time.After(nspawnPollInterval):
+		case <-obj.Context().Done(): // the timeout metaparam expired
+			return fmt.Errorf("The machine didn't stop.")
+		}
+		_, err := conn.GetProperties(obj.GetName())
+		running = err == nil
+	}
+	bus, err := util.SystemBusPrivateUsable()
+	if err != nil {
+		return errwrap.Wrapf(err, "Failed to connect to bus")
+	}
+	defer bus.Close()
+	if err := bus.Object(machine1Iface, machine1Path).Call(machine1Iface+".Manager.RemoveImage", 0, obj.GetName()).Err; err != nil {
+		return errwrap.Wrapf(err, "Failed to remove image")
+	}
+	return nil
 }
 
 // NspawnUID is a unique resource identifier
@@ -294,6 +570,16 @@ func (obj *NspawnRes) Compare(res Res) bool {
 		if obj.Name != res.Name {
 			return false
 		}
+		if obj.State != res.State {
+			return false
+		}
+		if obj.Image != res.Image {
+			return false
+		}
+		// the order of the bind mounts matters, since they can nest
+		if obj.settingsFile() != res.settingsFile() {
+			return false
+		}
 		if !obj.svc.Compare(res.svc) {
 			return false
 		}
@@ -303,9 +589,18 @@ func (obj *NspawnRes) Compare(res Res) bool {
 	return true
 }
 
-// AutoEdges returns the AutoEdge interface in this case no autoedges are used
+// AutoEdges returns the AutoEdge interface. The file resource which manages the
+// image, or the source of a bind mount, or else the one which manages its
+// nearest parent dir, happens before us.
 func (obj *NspawnRes) AutoEdges() AutoEdge {
-	return nil
+	paths := []string{}
+	if obj.Image != "" {
+		paths = append(paths, obj.Image)
+	}
+	for _, bind := range append(obj.Bind, obj.BindReadOnly...) {
+		paths = append(paths, strings.SplitN(bind, ":", 2)[0])
+	}
+	return newParentDirAutoEdges(obj, paths)
 }
 
 // UnmarshalYAML is the custom unmarshal handler for this struct.
@@ -0,0 +1,97 @@
+// Mgmt
+// Copyright (C) 2013-2016+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package resources
+
+import (
+	"testing"
+)
+
+func TestNspawnFiles1(t *testing.T) {
+	obj, _ := NewNspawnRes("test1", "running")
+	obj.Image = "/var/lib/images/test1.tar.xz"
+	obj.Bind = []string{"/srv/data:/data"}
+	obj.BindReadOnly = []string{"/etc/resolv.conf"}
+	obj.Zone = "mgmt"
+	obj.PrivateUsers = "pick"
+	if err := obj.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	if m := obj.importMethod(); m != "ImportTar" {
+		t.Errorf("Wrong import method: %s", m)
+	}
+	settings := unitHeader + `[Exec]
+PrivateUsers=pick
+
+[Files]
+Bind=/srv/data:/data
+BindReadOnly=/etc/resolv.conf
+
+[Network]
+Zone=mgmt
+`
+	if s := obj.files()[nspawnUnitDir+"/test1.nspawn"]; s != settings {
+		t.Errorf("Wrong settings file:\n%s", s)
+	}
+
+	empty, _ := NewNspawnRes("test2", "stopped")
+	if s := empty.settingsFile(); s != "" {
+		t.Errorf("The settings file should be empty:\n%s", s)
+	}
+	gone, _ := NewNspawnRes("test1", "absent")
+	gone.Zone = "mgmt" // the settings are removed anyways
+	if s, exists := gone.files()[nspawnUnitDir+"/test1.nspawn"]; !exists || s != "" {
+		t.Errorf("The settings file should be removed: %q", s)
+	}
+	if obj.Compare(gone) {
+		t.Errorf("The resources shouldn't be equivalent")
+	}
+}
+
+func TestNspawnImportMethod1(t *testing.T) {
+	for image, method := range map[string]string{
+		"/var/lib/images/test.tar":    "ImportTar",
+		"/var/lib/images/test.tar.xz": "ImportTar",
+		"/var/lib/images/test.tgz":    "ImportTar",
+		"/var/lib/images/test.raw":    "ImportRaw",
+		"/var/lib/images/test.raw.gz": "ImportRaw",
+		"/var/lib/images/test.zip":    "",
+	} {
+		obj := &NspawnRes{Image: image}
+		if m := obj.importMethod(); m != method {
+			t.Errorf("Wrong import method of %s: %q", image, m)
+		}
+	}
+}
+
+func TestNspawnValidate1(t *testing.T) {
+	for _, f := range []func(*NspawnRes){
+		func(obj *NspawnRes) { obj.State = "paused" },
+		func(obj *NspawnRes) { obj.Image = "images/test.tar" },
+		func(obj *NspawnRes) { obj.Image = "/images/test.zip" },
+		func(obj *NspawnRes) { obj.Bind = []string{"data:/data"} },
+		func(obj *NspawnRes) { obj.BindReadOnly = []string{"/data\nBind=/etc"} },
+		func(obj *NspawnRes) { obj.Zone = "a-very-long-zone" },
+		func(obj *NspawnRes) { obj.PrivateUsers = "maybe" },
+	} {
+		obj, _ := NewNspawnRes("test", "running")
+		f(obj)
+		if err := obj.Validate(); err == nil {
+			t.Errorf("Validate should fail: %+v", obj)
+		}
+	}
+}
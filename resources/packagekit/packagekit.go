@@ -148,7 +148,8 @@ const ( //typedef enum
 
 // Conn is a wrapper struct so we can pass bus connection around in the struct.
 type Conn struct {
-	conn *dbus.Conn
+	conn   *dbus.Conn
+	cancel <-chan struct{} // closes when the transactions should be cancelled
 }
 
 // PkPackageIDActionData is a struct that is returned by PackagesToPackageIDs in the map values.
@@ -177,6 +178,22 @@ func (bus *Conn) GetBus() *dbus.Conn {
 	return bus.conn
 }
 
+// SetCancel sets a channel which causes any running transaction to be cancelled
+// when it closes. This lets a caller bound the time it waits for PackageKit.
+func (bus *Conn) SetCancel(cancel <-chan struct{}) {
+	bus.cancel = cancel
+}
+
+// cancelTransaction asks PackageKit to cancel a running transaction, and then
+// returns the error which the transaction method should return to its caller.
+func (bus *Conn) cancelTransaction(interfacePath dbus.ObjectPath, method string) error {
+	obj := bus.GetBus().Object(PkIface, interfacePath)
+	if call := obj.Call(FmtTransactionMethod("Cancel"), 0); call.Err != nil {
+		log.Printf("PackageKit: Cancel: %s: %v", method, call.Err)
+	}
+	return fmt.Errorf("PackageKit: Cancelled: %s", method)
+}
+
 // Close closes the dbus connection object.
 func (bus *Conn) Close() error {
 	return bus.conn.Close()
@@ -299,6 +316,8 @@ loop:
 	for {
 		// FIXME: add a timeout option to error in case signals are dropped!
 		select {
+		case <-bus.cancel:
+			return []string{}, bus.cancelTransaction(interfacePath, "ResolvePackages")
 		case signal := <-ch:
 			if PK_DEBUG {
 				log.Printf("PackageKit: ResolvePackages(): Signal: %+v", signal)
@@ -405,6 +424,8 @@ func (bus *Conn) InstallPackages(packageIDs []string, transactionFlags uint64) e
 loop:
 	for {
 		select {
+		case <-bus.cancel:
+			return bus.cancelTransaction(interfacePath, "InstallPackages")
 		case signal := <-ch:
 			if signal.Path != interfacePath {
 				log.Printf("PackageKit: Woops: Signal.Path: %+v", signal.Path)
@@ -458,6 +479,8 @@ loop:
 	for {
 		// FIXME: add a timeout option to error in case signals are dropped!
 		select {
+		case <-bus.cancel:
+			return bus.cancelTransaction(interfacePath, "RemovePackages")
 		case signal := <-ch:
 			if signal.Path != interfacePath {
 				log.Printf("PackageKit: Woops: Signal.Path: %+v", signal.Path)
@@ -503,6 +526,8 @@ loop:
 	for {
 		// FIXME: add a timeout option to error in case signals are dropped!
 		select {
+		case <-bus.cancel:
+			return bus.cancelTransaction(interfacePath, "UpdatePackages")
 		case signal := <-ch:
 			if signal.Path != interfacePath {
 				log.Printf("PackageKit: Woops: Signal.Path: %+v", signal.Path)
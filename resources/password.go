@@ -51,7 +51,7 @@ type PasswordRes struct {
 	Length        uint16  `yaml:"length"` // number of characters to return
 	Saved         bool    // this caches the password in the clear locally
 	CheckRecovery bool    // recovery from integrity checks by re-generating
-	Password      *string // the generated password, read only, do not set!
+	Password      *string `json:"-"` // the generated password, read only, do not set!
 
 	path       string // the path to local storage
 	recWatcher *recwatch.RecWatcher
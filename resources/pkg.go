@@ -25,9 +25,9 @@ import (
 	"strings"
 
 	"github.com/purpleidea/mgmt/event"
-	"github.com/purpleidea/mgmt/resources/packagekit"
 	"github.com/purpleidea/mgmt/util"
 
+	multierr "github.com/hashicorp/go-multierror"
 	errwrap "github.com/pkg/errors"
 )
 
@@ -36,14 +36,18 @@ func init() {
 	gob.Register(&PkgRes{})
 }
 
-// PkgRes is a package resource for packagekit.
+// PkgRes is a package resource. It uses PackageKit when it's available, and
+// otherwise runs the package manager of the distro directly.
 type PkgRes struct {
 	BaseRes          `yaml:",inline"`
 	State            string `yaml:"state"`            // state: installed, uninstalled, newest, <version>
 	AllowUntrusted   bool   `yaml:"allowuntrusted"`   // allow untrusted packages to be installed?
 	AllowNonFree     bool   `yaml:"allownonfree"`     // allow nonfree packages to be found?
 	AllowUnsupported bool   `yaml:"allowunsupported"` // allow unsupported packages to be found?
-	//bus              *packagekit.Conn    // pk bus connection
+	Backend          string `yaml:"backend"`          // backend: packagekit, dnf, apt, or auto if empty
+	Hold             bool   `yaml:"hold"`             // hold the package at its installed version? or leave the holds alone
+
+	backend  string   // the name of the backend that is used
 	fileList []string // FIXME: update if pkg changes
 }
 
@@ -73,6 +77,15 @@ func (obj *PkgRes) Validate() error {
 	if obj.State == "" {
 		return fmt.Errorf("State cannot be empty!")
 	}
+	if _, exists := pkgBackends[obj.Backend]; !exists && obj.Backend != "" && obj.Backend != "auto" {
+		return fmt.Errorf("Unknown Backend: %s", obj.Backend)
+	}
+	if obj.Hold && obj.State == "uninstalled" {
+		return fmt.Errorf("Can't Hold a package that is uninstalled!")
+	}
+	if obj.Hold && obj.State == "newest" { // it would be upgraded anyways
+		return fmt.Errorf("Can't Hold a package at the newest version!")
+	}
 
 	return obj.BaseRes.Validate()
 }
@@ -84,48 +97,57 @@ func (obj *PkgRes) Init() error {
 		return err
 	}
 
-	bus := packagekit.NewBus()
-	if bus == nil {
-		return fmt.Errorf("Can't connect to PackageKit bus.")
+	obj.backend = obj.Backend
+	if obj.backend == "" || obj.backend == "auto" {
+		obj.backend = pkgBackendAuto()
 	}
-	defer bus.Close()
 
-	result, err := obj.pkgMappingHelper(bus)
+	backend, err := obj.newBackend()
 	if err != nil {
-		return errwrap.Wrapf(err, "The pkgMappingHelper failed")
+		return err
 	}
+	defer backend.Close()
 
+	result, err := backend.Query(map[string]string{obj.Name: obj.State})
+	if err != nil {
+		return errwrap.Wrapf(err, "The %s backend query failed", obj.backend)
+	}
 	data, ok := result[obj.Name] // lookup single package (init does just one)
 	// package doesn't exist, this is an error!
 	if !ok || !data.Found {
 		return fmt.Errorf("Can't find package named '%s'.", obj.Name)
 	}
 
-	packageIDs := []string{data.PackageID} // just one for now
-	filesMap, err := bus.GetFilesByPackageID(packageIDs)
+	files, err := backend.Files(obj.Name)
 	if err != nil {
-		return errwrap.Wrapf(err, "Can't run GetFilesByPackageID")
-	}
-	if files, ok := filesMap[data.PackageID]; ok {
-		obj.fileList = util.DirifyFileList(files, false)
+		return errwrap.Wrapf(err, "Can't get the files of '%s'", obj.Name)
 	}
+	obj.fileList = util.DirifyFileList(files, false)
 	return nil
 }
 
+// newBackend returns a new connection to the backend of this resource. The
+// caller must close it.
+func (obj *PkgRes) newBackend() (pkgBackend, error) {
+	fn, exists := pkgBackends[obj.backend]
+	if !exists {
+		return nil, fmt.Errorf("Unknown Backend: %s", obj.backend)
+	}
+	return fn(obj)
+}
+
 // Watch is the primary listener for this resource and it outputs events.
-// It uses the PackageKit UpdatesChanged signal to watch for changes.
-// TODO: https://github.com/hughsie/PackageKit/issues/109
-// TODO: https://github.com/hughsie/PackageKit/issues/110
+// The backend decides how the package changes are watched.
 func (obj *PkgRes) Watch(processChan chan *event.Event) error {
-	bus := packagekit.NewBus()
-	if bus == nil {
-		return fmt.Errorf("Can't connect to PackageKit bus.")
+	backend, err := obj.newBackend()
+	if err != nil {
+		return err
 	}
-	defer bus.Close()
+	defer backend.Close()
 
-	ch, err := bus.WatchChanges()
+	ch, err := backend.Watch()
 	if err != nil {
-		return errwrap.Wrapf(err, "Error adding signal match")
+		return errwrap.Wrapf(err, "The %s backend can't watch", obj.backend)
 	}
 
 	// notify engine that we're running
@@ -142,18 +164,13 @@ func (obj *PkgRes) Watch(processChan chan *event.Event) error {
 		}
 
 		select {
-		case event := <-ch:
-			// FIXME: ask packagekit for info on what packages changed
-			if obj.debug {
-				log.Printf("%s: Event: %v", obj.fmtNames(obj.getNames()), event.Name)
+		case err := <-ch:
+			if err != nil {
+				return errwrap.Wrapf(err, "Unknown %s watcher error", obj.fmtNames(obj.getNames()))
 			}
-
-			// since the chan is buffered, remove any supplemental
-			// events since they would just be duplicates anyways!
-			for len(ch) > 0 { // we can detect pending count here!
-				<-ch // discard
+			if obj.debug {
+				log.Printf("%s: Event", obj.fmtNames(obj.getNames()))
 			}
-
 			send = true
 			obj.StateOK(false) // dirty
 
@@ -210,118 +227,141 @@ func (obj *PkgRes) groupMappingHelper() map[string]string {
 	return result
 }
 
-func (obj *PkgRes) pkgMappingHelper(bus *packagekit.Conn) (map[string]*packagekit.PkPackageIDActionData, error) {
-	packageMap := obj.groupMappingHelper()   // get the grouped values
-	packageMap[obj.Name] = obj.State         // key is pkg name, value is pkg state
-	var filter uint64                        // initializes at the "zero" value of 0
-	filter += packagekit.PK_FILTER_ENUM_ARCH // always search in our arch (optional!)
-	// we're requesting latest version, or to narrow down install choices!
-	if obj.State == "newest" || obj.State == "installed" {
-		// if we add this, we'll still see older packages if installed
-		// this is an optimization, and is *optional*, this logic is
-		// handled inside of PackagesToPackageIDs now automatically!
-		filter += packagekit.PK_FILTER_ENUM_NEWEST // only search for newest packages
-	}
-	if !obj.AllowNonFree {
-		filter += packagekit.PK_FILTER_ENUM_FREE
-	}
-	if !obj.AllowUnsupported {
-		filter += packagekit.PK_FILTER_ENUM_SUPPORTED
-	}
-	result, err := bus.PackagesToPackageIDs(packageMap, filter)
-	if err != nil {
-		return nil, errwrap.Wrapf(err, "Can't run PackagesToPackageIDs")
-	}
-	return result, nil
-}
-
 // CheckApply checks the resource state and applies the resource if the bool
 // input is true. It returns error info and if the state check passed or not.
 func (obj *PkgRes) CheckApply(apply bool) (checkOK bool, err error) {
 	log.Printf("%s: Check", obj.fmtNames(obj.getNames()))
 
-	bus := packagekit.NewBus()
-	if bus == nil {
-		return false, fmt.Errorf("Can't connect to PackageKit bus.")
-	}
-	defer bus.Close()
-
-	result, err := obj.pkgMappingHelper(bus)
+	backend, err := obj.newBackend()
 	if err != nil {
-		return false, errwrap.Wrapf(err, "The pkgMappingHelper failed")
+		return false, err
 	}
+	defer backend.Close()
 
-	packageMap := obj.groupMappingHelper() // map[string]string
+	packageMap := obj.groupMappingHelper() // get the grouped values
+	packageMap[obj.Name] = obj.State       // key is pkg name, value is pkg state
 	packageList := []string{obj.Name}
-	packageList = append(packageList, util.StrMapKeys(packageMap)...)
-	//stateList := []string{obj.State}
-	//stateList = append(stateList, util.StrMapValues(packageMap)...)
+	packageList = append(packageList, util.StrMapKeys(obj.groupMappingHelper())...)
 
-	// TODO: at the moment, all the states are the same, but
-	// eventually we might be able to drop this constraint!
-	states, err := packagekit.FilterState(result, packageList, obj.State)
+	result, err := backend.Query(packageMap)
 	if err != nil {
-		return false, errwrap.Wrapf(err, "The FilterState method failed")
+		return false, errwrap.Wrapf(err, "The %s backend query failed", obj.backend)
 	}
-	data, _ := result[obj.Name] // if above didn't error, we won't either!
-	validState := util.BoolMapTrue(util.BoolMapValues(states))
 
-	// obj.State == "installed" || "uninstalled" || "newest" || "4.2-1.fc23"
-	switch obj.State {
-	case "installed":
-		fallthrough
-	case "uninstalled":
-		fallthrough
-	case "newest":
-		if validState {
-			return true, nil // state is correct, exit!
+	// TODO: at the moment, all the states are the same, but
+	// eventually we might be able to drop this constraint!
+	applyPackages := []string{} // these need their states applied
+	holdPackages := []string{}  // these need their holds changed
+	for _, name := range packageList {
+		data, ok := result[name] // lookup single package
+		// package doesn't exist, this is an error!
+		if !ok || !data.Found {
+			return false, fmt.Errorf("Can't find package named '%s'.", name)
 		}
-	default: // version string
-		if obj.State == data.Version && data.Version != "" {
-			return true, nil
+		if !pkgStateOK(obj.State, data) {
+			applyPackages = append(applyPackages, name)
+		}
+		if obj.Hold && !data.Held { // the holds are only managed if set
+			holdPackages = append(holdPackages, name)
 		}
 	}
+	if len(applyPackages) == 0 && len(holdPackages) == 0 {
+		return true, nil // state is correct, exit!
+	}
 
 	// state is not okay, no work done, exit, but without error
 	if !apply {
+		var property string
+		switch obj.State {
+		case "uninstalled":
+			property = "remove"
+		case "newest":
+			property = "update"
+		default: // installed or version string
+			property = "install"
+		}
+		for _, name := range applyPackages {
+			change := &Change{Property: property}
+			if d, ok := result[name]; ok && d != nil && d.Installed {
+				change.Old = fmt.Sprintf("%s-%s", name, d.Version)
+			}
+			switch obj.State {
+			case "uninstalled":
+				change.Old = name // the version doesn't matter here
+			case "installed", "newest":
+				change.New = name
+			default: // version string
+				change.New = fmt.Sprintf("%s-%s", name, obj.State)
+			}
+			obj.AddChange(change)
+		}
+		for _, name := range holdPackages {
+			obj.AddChange(&Change{
+				Property: "hold",
+				New:      name,
+			})
+		}
 		return false, nil
 	}
 
 	// apply portion
 	log.Printf("%s: Apply", obj.fmtNames(obj.getNames()))
-	readyPackages, err := packagekit.FilterPackageState(result, packageList, obj.State)
-	if err != nil {
-		return false, err // fail
+
+	// held packages can't be changed, so they're released first, and then
+	// held again afterwards, even if the apply fails; the holds are only
+	// known if we manage them
+	released := []string{}
+	for _, name := range applyPackages {
+		if obj.Hold && result[name].Held {
+			released = append(released, name)
+		}
+	}
+	if len(released) > 0 {
+		if err := backend.Hold(released, false); err != nil {
+			return false, errwrap.Wrapf(err, "Can't release the hold on: %v", released)
+		}
+		defer func() {
+			if e := backend.Hold(released, true); e != nil {
+				err = multierr.Append(err, errwrap.Wrapf(e, "Can't hold: %v", released))
+			}
+		}()
 	}
-	// these are the packages that actually need their states applied!
-	applyPackages := util.StrFilterElementsInList(readyPackages, packageList)
-	packageIDs, _ := packagekit.FilterPackageIDs(result, applyPackages) // would be same err as above
 
-	var transactionFlags uint64 // initializes at the "zero" value of 0
-	if !obj.AllowUntrusted {    // allow
-		transactionFlags += packagekit.PK_TRANSACTION_FLAG_ENUM_ONLY_TRUSTED
+	if len(applyPackages) > 0 {
+		// apply correct state!
+		log.Printf("%s: Set: %v...", obj.fmtNames(util.StrListIntersection(applyPackages, obj.getNames())), obj.State)
+		states := make(map[string]string)
+		for _, name := range applyPackages {
+			states[name] = obj.State
+		}
+		if err := backend.Apply(states); err != nil {
+			return false, err // fail
+		}
+		log.Printf("%s: Set: %v success!", obj.fmtNames(util.StrListIntersection(applyPackages, obj.getNames())), obj.State)
 	}
-	// apply correct state!
-	log.Printf("%s: Set: %v...", obj.fmtNames(util.StrListIntersection(applyPackages, obj.getNames())), obj.State)
-	switch obj.State {
-	case "uninstalled": // run remove
-		// NOTE: packageID is different than when installed, because now
-		// it has the "installed" flag added to the data portion if it!!
-		err = bus.RemovePackages(packageIDs, transactionFlags)
 
-	case "newest": // TODO: isn't this the same operation as install, below?
-		err = bus.UpdatePackages(packageIDs, transactionFlags)
+	if len(holdPackages) > 0 { // the released ones are held again above
+		if err := backend.Hold(holdPackages, true); err != nil {
+			return false, errwrap.Wrapf(err, "Can't hold: %v", holdPackages)
+		}
+	}
+	return false, nil // success
+}
 
+// pkgStateOK returns whether the package is in the state. A version state only
+// matches the version that is installed.
+func pkgStateOK(state string, data *pkgInfo) bool {
+	// state == "installed" || "uninstalled" || "newest" || "4.2-1.fc23"
+	switch state {
 	case "installed":
-		fallthrough // same method as for "set specific version", below
+		return data.Installed
+	case "uninstalled":
+		return !data.Installed
+	case "newest":
+		return data.Newest
 	default: // version string
-		err = bus.InstallPackages(packageIDs, transactionFlags)
-	}
-	if err != nil {
-		return false, err // fail
+		return data.Installed && data.Version == state
 	}
-	log.Printf("%s: Set: %v success!", obj.fmtNames(util.StrListIntersection(applyPackages, obj.getNames())), obj.State)
-	return false, nil // success
 }
 
 // PkgUID is the UID struct for PkgRes.
@@ -490,6 +530,10 @@ func (obj *PkgRes) GroupCmp(r Res) bool {
 	if obj.State != res.State {
 		return false
 	}
+	// the packages are applied and held together by one backend
+	if obj.Backend != res.Backend || obj.Hold != res.Hold {
+		return false
+	}
 	return true
 }
 
@@ -517,12 +561,38 @@ func (obj *PkgRes) Compare(res Res) bool {
 		if obj.AllowUnsupported != res.AllowUnsupported {
 			return false
 		}
+		if obj.Backend != res.Backend {
+			return false
+		}
+		if obj.Hold != res.Hold {
+			return false
+		}
 	default:
 		return false
 	}
 	return true
 }
 
+// Reversed returns a resource which uninstalls the package, unless this one
+// already uninstalls it. It doesn't know if the package was installed before,
+// so it gets removed even if this resource didn't install it.
+func (obj *PkgRes) Reversed() (Res, error) {
+	if obj.State == "uninstalled" {
+		return nil, nil // nothing to undo
+	}
+	return &PkgRes{
+		BaseRes: BaseRes{
+			Name:       obj.Name,
+			MetaParams: DefaultMetaParams,
+		},
+		State:            "uninstalled",
+		AllowUntrusted:   obj.AllowUntrusted,
+		AllowNonFree:     obj.AllowNonFree,
+		AllowUnsupported: obj.AllowUnsupported,
+		Backend:          obj.Backend,
+	}, nil
+}
+
 // ReturnSvcInFileList returns a list of svc names for matches like: `/usr/lib/systemd/system/*.service`.
 func ReturnSvcInFileList(fileList []string) []string {
 	result := []string{}
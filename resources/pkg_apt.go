@@ -0,0 +1,217 @@
+// Mgmt
+// Copyright (C) 2013-2016+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package resources
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/purpleidea/mgmt/util"
+)
+
+// pkgAptBackend is the pkg backend which runs apt-get and dpkg directly.
+// Packages are held with apt-mark.
+type pkgAptBackend struct {
+	res     *PkgRes
+	watcher *multiWatcher
+}
+
+// newPkgAptBackend returns the apt backend.
+func newPkgAptBackend(obj *PkgRes) (pkgBackend, error) {
+	return &pkgAptBackend{res: obj}, nil
+}
+
+// Query asks dpkg for the installed versions and for the holds, and apt for the
+// candidate versions, which are the newest ones that apt would install. Like
+// with the other backends, the holds are only reported if the resource sets
+// hold, even though dpkg tells us about them anyways.
+func (obj *pkgAptBackend) Query(packages map[string]string) (map[string]*pkgInfo, error) {
+	ctx := obj.res.Context()
+	names := util.StrMapKeys(packages)
+
+	// dpkg-query fails for the packages that it has never seen, but it still
+	// prints the others, which is what we want to know.
+	args := append([]string{"-W", "-f", "${Package} ${Status} ${Version}\n"}, names...)
+	out, _ := pkgCmd(ctx, "dpkg-query", args...)
+	installed, held := pkgAptParseStatus(out)
+
+	out, err := pkgCmd(ctx, "apt-cache", append([]string{"policy"}, names...)...)
+	if err != nil {
+		return nil, err
+	}
+	candidates := pkgAptParsePolicy(out)
+
+	result := make(map[string]*pkgInfo)
+	for _, name := range names {
+		version, isInstalled := installed[name]
+		candidate, isAvailable := candidates[name]
+		result[name] = &pkgInfo{
+			Found:     isInstalled || isAvailable,
+			Installed: isInstalled,
+			Version:   version,
+			Newest:    isInstalled && (!isAvailable || version == candidate),
+			Held:      obj.res.Hold && isInstalled && util.StrInList(name, held),
+		}
+	}
+	return result, nil
+}
+
+// Apply runs apt-get to remove and install the packages. A version state is
+// installed as name=version, and newest is what apt-get installs anyways.
+func (obj *pkgAptBackend) Apply(packages map[string]string) error {
+	ctx := obj.res.Context()
+	var remove, install []string
+	downgrade := false
+	for _, name := range util.StrMapKeys(packages) {
+		switch state := packages[name]; state {
+		case "uninstalled":
+			remove = append(remove, name)
+		case "installed", "newest":
+			install = append(install, name)
+		default: // version string
+			install = append(install, fmt.Sprintf("%s=%s", name, state))
+			downgrade = true // the version might be older
+		}
+	}
+
+	if len(remove) > 0 {
+		args := append([]string{"-y", "remove"}, remove...)
+		if _, err := pkgCmd(ctx, "apt-get", args...); err != nil {
+			return err
+		}
+	}
+	if len(install) > 0 {
+		args := []string{"-y", "install"}
+		if downgrade {
+			args = append(args, "--allow-downgrades")
+		}
+		if obj.res.AllowUntrusted {
+			args = append(args, "--allow-unauthenticated")
+		}
+		if _, err := pkgCmd(ctx, "apt-get", append(args, install...)...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// held returns which of the packages are marked as held.
+func (obj *pkgAptBackend) held(packages []string) (map[string]bool, error) {
+	out, err := pkgCmd(obj.res.Context(), "apt-mark", "showhold")
+	if err != nil {
+		return nil, err
+	}
+	holds := []string{}
+	for _, x := range strings.Fields(out) {
+		holds = append(holds, strings.SplitN(x, ":", 2)[0]) // strip the arch
+	}
+	result := make(map[string]bool)
+	for _, name := range packages {
+		result[name] = util.StrInList(name, holds)
+	}
+	return result, nil
+}
+
+// Hold marks the packages as held, or removes the mark.
+func (obj *pkgAptBackend) Hold(packages []string, hold bool) error {
+	cmd := "unhold"
+	if hold {
+		cmd = "hold"
+	}
+	_, err := pkgCmd(obj.res.Context(), "apt-mark", append([]string{cmd}, packages...)...)
+	return err
+}
+
+// Files returns the file list of the package. It's only known once it's been
+// installed, since apt doesn't know the contents of the other packages.
+func (obj *pkgAptBackend) Files(name string) ([]string, error) {
+	out, err := pkgCmd(obj.res.Context(), "dpkg-query", "-L", name)
+	if err != nil {
+		return []string{}, nil // not installed
+	}
+	files := []string{}
+	for _, x := range strings.Split(out, "\n") {
+		if strings.HasPrefix(x, "/") && x != "/." { // skip the diversions and such
+			files = append(files, x)
+		}
+	}
+	return files, nil
+}
+
+// Watch watches the dpkg status file, which also contains the holds.
+func (obj *pkgAptBackend) Watch() (<-chan error, error) {
+	watcher, err := newPkgWatcher([]string{"/var/lib/dpkg/status"})
+	if err != nil {
+		return nil, err
+	}
+	obj.watcher = watcher
+	return watcher.Events(), nil
+}
+
+// Close stops the watch.
+func (obj *pkgAptBackend) Close() error {
+	if obj.watcher == nil {
+		return nil
+	}
+	return obj.watcher.Close()
+}
+
+// pkgAptParseStatus parses the `${Package} ${Status} ${Version}` lines that we
+// ask dpkg-query to print. It returns the versions of the installed packages,
+// and the names of the packages which are held. The status is three words, the
+// first of which is the selection, eg: hold ok installed
+func pkgAptParseStatus(output string) (map[string]string, []string) {
+	installed := make(map[string]string)
+	held := []string{}
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 5 || fields[3] != "installed" {
+			continue // eg: config-files, or a missing version
+		}
+		name := strings.SplitN(fields[0], ":", 2)[0] // strip the arch
+		installed[name] = fields[4]
+		if fields[1] == "hold" {
+			held = append(held, name)
+		}
+	}
+	return installed, held
+}
+
+// pkgAptParsePolicy returns the candidate versions in the output of apt-cache
+// policy. A package without a candidate can't be installed and is skipped.
+func pkgAptParsePolicy(output string) map[string]string {
+	result := make(map[string]string)
+	name := ""
+	for _, line := range strings.Split(output, "\n") {
+		if line == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, " ") && strings.HasSuffix(line, ":") {
+			name = strings.SplitN(strings.TrimSuffix(line, ":"), ":", 2)[0]
+			continue
+		}
+		fields := strings.Fields(line)
+		if name == "" || len(fields) != 2 || fields[0] != "Candidate:" {
+			continue
+		}
+		if fields[1] != "(none)" {
+			result[name] = fields[1]
+		}
+	}
+	return result
+}
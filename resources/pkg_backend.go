@@ -0,0 +1,183 @@
+// Mgmt
+// Copyright (C) 2013-2016+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package resources
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/purpleidea/mgmt/util"
+
+	errwrap "github.com/pkg/errors"
+	context "golang.org/x/net/context"
+)
+
+// pkgInfo is what a pkg backend knows about a package.
+type pkgInfo struct {
+	Found     bool   // does the package exist?
+	Installed bool   // is it installed?
+	Version   string // the installed version, if any
+	Newest    bool   // is the newest version installed?
+	Held      bool   // is it held? only queried if the resource sets hold
+}
+
+// pkgBackend is a package manager which the pkg resource uses. The packages
+// are mapped to the state they should have, which is one of the states that
+// the pkg resource accepts: installed, uninstalled, newest or a version.
+type pkgBackend interface {
+	// Query returns what the backend knows about each of the packages. The
+	// holds are only queried if the resource sets hold, since holding might
+	// need a plugin that isn't installed.
+	Query(packages map[string]string) (map[string]*pkgInfo, error)
+
+	// Apply changes the packages to their states. It's always called after
+	// a Query of the same packages, so that result can be reused.
+	Apply(packages map[string]string) error
+
+	// Hold holds the packages at their installed version, or releases them
+	// if hold is false.
+	Hold(packages []string, hold bool) error
+
+	// Files returns the files that the package contains, if they're known.
+	Files(name string) ([]string, error)
+
+	// Watch returns a channel which gets a nil when the packages might have
+	// changed, or an error if the watch failed. It runs until Close.
+	Watch() (<-chan error, error)
+
+	// Close releases whatever the backend holds open.
+	Close() error
+}
+
+// pkgHolder is the part of a backend which holds packages. PackageKit has no
+// such concept, so its backend uses the one of the native package manager.
+type pkgHolder interface {
+	// held returns which of the packages are held.
+	held(packages []string) (map[string]bool, error)
+
+	// Hold holds or releases the packages.
+	Hold(packages []string, hold bool) error
+}
+
+// pkgBackends are the constructors of the pkg backends by name. Tests can add
+// their own here.
+var pkgBackends = map[string]func(obj *PkgRes) (pkgBackend, error){
+	"packagekit": newPkgKitBackend,
+	"dnf":        newPkgDnfBackend,
+	"apt":        newPkgAptBackend,
+}
+
+// pkgBackendAuto picks a backend when none was asked for. PackageKit is used if
+// it's available, and otherwise the package manager that we can find. If none
+// is found, we pick PackageKit so that its error is the one that is returned.
+func pkgBackendAuto() string {
+	if pkgKitAvailable() {
+		return "packagekit"
+	}
+	if _, err := exec.LookPath("dnf"); err == nil {
+		return "dnf"
+	}
+	if _, err := exec.LookPath("apt-get"); err == nil {
+		return "apt"
+	}
+	return "packagekit"
+}
+
+// pkgNativeHolder returns the holder of the native package manager, or nil if
+// there isn't one that we know.
+func pkgNativeHolder(obj *PkgRes) pkgHolder {
+	if _, err := exec.LookPath("dnf"); err == nil {
+		return &pkgDnfBackend{res: obj}
+	}
+	if _, err := exec.LookPath("apt-mark"); err == nil {
+		return &pkgAptBackend{res: obj}
+	}
+	return nil
+}
+
+// pkgCmd runs a command of a package manager and returns what it printed. The
+// command is killed when the context is done, such as when a timeout expires.
+// The output is returned even on error, because the query commands print what
+// they know and then fail for the packages which they don't.
+func pkgCmd(ctx context.Context, name string, args ...string) (string, error) {
+	cmd := exec.Command(name, args...)
+	// the output is parsed, so it mustn't be translated or interactive
+	cmd.Env = util.MergeEnv(os.Environ(), map[string]string{
+		"LC_ALL":          "C",
+		"DEBIAN_FRONTEND": "noninteractive",
+	})
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		return "", errwrap.Wrapf(err, "can't start %s", name)
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			msg := strings.TrimSpace(stderr.String())
+			return stdout.String(), errwrap.Wrapf(err, "%s %s failed: %s", name, strings.Join(args, " "), msg)
+		}
+		return stdout.String(), nil
+
+	case <-ctx.Done(): // the timeout metaparam expired
+		if err := cmd.Process.Kill(); err != nil {
+			log.Printf("%s: Unable to kill: %v", name, err)
+		}
+		<-done // wait for it to exit, so that the output isn't in use
+		return stdout.String(), errwrap.Wrapf(ctx.Err(), "%s was cancelled", name)
+	}
+}
+
+// pkgParseVersions parses lines of the form `<name> <version>`, such as those
+// which we ask rpm and dnf to print. Lines that don't match are skipped.
+func pkgParseVersions(output string) map[string]string {
+	result := make(map[string]string)
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		result[fields[0]] = fields[1]
+	}
+	return result
+}
+
+// newPkgWatcher watches the first path which exists in each of the lists. The
+// lists are alternatives, since the database moved between distro versions. The
+// package database is only written when packages change, so any event will do.
+func newPkgWatcher(paths ...[]string) (*multiWatcher, error) {
+	files := []string{}
+	for _, list := range paths {
+		p := list[0]
+		for _, x := range list {
+			if _, err := os.Stat(x); err == nil {
+				p = x
+				break
+			}
+		}
+		files = append(files, p)
+	}
+	return newMultiWatcher(files...)
+}
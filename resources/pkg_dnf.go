@@ -0,0 +1,232 @@
+// Mgmt
+// Copyright (C) 2013-2016+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package resources
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/purpleidea/mgmt/util"
+
+	errwrap "github.com/pkg/errors"
+)
+
+// pkgDnfQueryFormat is the query format of rpm and dnf. The version matches the
+// one that PackageKit uses, which is the version and the release, eg: 4.2-1.fc23
+const pkgDnfQueryFormat = "%{name} %{version}-%{release}\n"
+
+// pkgDnfBackend is the pkg backend which runs dnf and rpm directly. Packages
+// are held with the dnf versionlock plugin.
+type pkgDnfBackend struct {
+	res     *PkgRes
+	watcher *multiWatcher
+}
+
+// newPkgDnfBackend returns the dnf backend.
+func newPkgDnfBackend(obj *PkgRes) (pkgBackend, error) {
+	return &pkgDnfBackend{res: obj}, nil
+}
+
+// Query asks rpm for the installed versions and dnf for the newest ones.
+func (obj *pkgDnfBackend) Query(packages map[string]string) (map[string]*pkgInfo, error) {
+	ctx := obj.res.Context()
+	names := util.StrMapKeys(packages)
+
+	// rpm fails if one of the packages isn't installed, but it still prints
+	// the ones that are, which is what we want to know.
+	args := append([]string{"-q", "--qf", pkgDnfQueryFormat}, names...)
+	out, _ := pkgCmd(ctx, "rpm", args...)
+	installed := pkgParseVersions(out)
+
+	args = []string{"-q", "repoquery", "--latest-limit", "1", "--qf", pkgDnfQueryFormat}
+	args = append(args, obj.flags()...)
+	out, err := pkgCmd(ctx, "dnf", append(args, names...)...)
+	if err != nil {
+		return nil, err
+	}
+	newest := pkgParseVersions(out)
+
+	held := make(map[string]bool)
+	if obj.res.Hold {
+		if held, err = obj.held(names); err != nil {
+			return nil, err
+		}
+	}
+
+	result := make(map[string]*pkgInfo)
+	for _, name := range names {
+		version, isInstalled := installed[name]
+		newestVersion, isAvailable := newest[name]
+		result[name] = &pkgInfo{
+			Found:     isInstalled || isAvailable,
+			Installed: isInstalled,
+			Version:   version,
+			Newest:    isInstalled && (!isAvailable || version == newestVersion),
+			Held:      held[name],
+		}
+	}
+	return result, nil
+}
+
+// flags returns the dnf flags which the params of the resource ask for.
+func (obj *pkgDnfBackend) flags() []string {
+	if obj.res.AllowUntrusted {
+		return []string{"--nogpgcheck"}
+	}
+	return []string{}
+}
+
+// Apply runs dnf to remove, install and upgrade the packages. A version state is
+// installed as name-version.
+func (obj *pkgDnfBackend) Apply(packages map[string]string) error {
+	ctx := obj.res.Context()
+	var remove, install, upgrade []string
+	for _, name := range util.StrMapKeys(packages) {
+		switch state := packages[name]; state {
+		case "uninstalled":
+			remove = append(remove, name)
+		case "installed":
+			install = append(install, name)
+		case "newest":
+			install = append(install, name)
+			upgrade = append(upgrade, name)
+		default: // version string
+			// dnf installs the exact version, even if it's older
+			install = append(install, fmt.Sprintf("%s-%s", name, state))
+		}
+	}
+
+	for _, x := range []struct {
+		cmd      string
+		packages []string
+	}{
+		{"remove", remove},
+		{"install", install},
+		{"upgrade", upgrade},
+	} {
+		if len(x.packages) == 0 {
+			continue
+		}
+		args := append([]string{"-y", x.cmd}, obj.flags()...)
+		if _, err := pkgCmd(ctx, "dnf", append(args, x.packages...)...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// held returns which of the packages have a versionlock entry. If the plugin
+// isn't installed, then nothing can be held.
+func (obj *pkgDnfBackend) held(packages []string) (map[string]bool, error) {
+	result := make(map[string]bool)
+	out, err := pkgCmd(obj.res.Context(), "dnf", "-q", "versionlock", "list")
+	if err != nil && pkgDnfNoVersionlock(err) {
+		return result, nil // nothing is held
+	} else if err != nil {
+		return nil, err
+	}
+	locked := pkgDnfParseLocks(out)
+	for _, name := range packages {
+		result[name] = util.StrInList(name, locked)
+	}
+	return result, nil
+}
+
+// Hold adds the packages to the versionlock list, or deletes them from it.
+func (obj *pkgDnfBackend) Hold(packages []string, hold bool) error {
+	cmd := "delete"
+	if hold {
+		cmd = "add"
+	}
+	args := append([]string{"-q", "versionlock", cmd}, packages...)
+	_, err := pkgCmd(obj.res.Context(), "dnf", args...)
+	if err != nil && pkgDnfNoVersionlock(err) {
+		return errwrap.Wrapf(err, "Holding packages with dnf needs the versionlock plugin")
+	}
+	return err
+}
+
+// pkgDnfNoVersionlock returns true if dnf failed because the versionlock plugin
+// isn't installed, in which case it doesn't know the command.
+func pkgDnfNoVersionlock(err error) bool {
+	return strings.Contains(err.Error(), "No such command")
+}
+
+// Files returns the file list of the package, from rpm if it's installed and
+// otherwise from the repositories.
+func (obj *pkgDnfBackend) Files(name string) ([]string, error) {
+	out, err := pkgCmd(obj.res.Context(), "rpm", "-ql", name)
+	if err != nil { // not installed
+		args := append([]string{"-q", "repoquery", "-l"}, obj.flags()...)
+		if out, err = pkgCmd(obj.res.Context(), "dnf", append(args, name)...); err != nil {
+			return nil, err
+		}
+	}
+	files := []string{}
+	for _, x := range strings.Split(out, "\n") {
+		if strings.HasPrefix(x, "/") { // skip (contains no files) and such
+			files = append(files, x)
+		}
+	}
+	return files, nil
+}
+
+// Watch watches the rpm database and the versionlock list.
+func (obj *pkgDnfBackend) Watch() (<-chan error, error) {
+	watcher, err := newPkgWatcher(
+		[]string{
+			"/usr/lib/sysimage/rpm/rpmdb.sqlite",
+			"/var/lib/rpm/rpmdb.sqlite",
+			"/var/lib/rpm/Packages",
+		},
+		[]string{"/etc/dnf/plugins/versionlock.list"},
+	)
+	if err != nil {
+		return nil, err
+	}
+	obj.watcher = watcher
+	return watcher.Events(), nil
+}
+
+// Close stops the watch.
+func (obj *pkgDnfBackend) Close() error {
+	if obj.watcher == nil {
+		return nil
+	}
+	return obj.watcher.Close()
+}
+
+// pkgDnfParseLocks returns the package names in the output of the versionlock
+// list command. The entries look like: name-epoch:version-release.*
+func pkgDnfParseLocks(output string) []string {
+	result := []string{}
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		// the excluded packages start with a !, and they aren't held
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "!") {
+			continue
+		}
+		// strip the version and the release to get the name
+		fields := strings.Split(line, "-")
+		if len(fields) < 3 {
+			continue
+		}
+		result = append(result, strings.Join(fields[:len(fields)-2], "-"))
+	}
+	return result
+}
@@ -0,0 +1,215 @@
+// Mgmt
+// Copyright (C) 2013-2016+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package resources
+
+import (
+	"fmt"
+
+	"github.com/purpleidea/mgmt/resources/packagekit"
+	"github.com/purpleidea/mgmt/util"
+
+	errwrap "github.com/pkg/errors"
+)
+
+// pkgKitBackend is the pkg backend which talks to PackageKit over dbus.
+type pkgKitBackend struct {
+	res    *PkgRes
+	bus    *packagekit.Conn
+	holder pkgHolder                                    // nil if we can't hold
+	result map[string]*packagekit.PkPackageIDActionData // from the last query
+}
+
+// pkgKitAvailable returns true if PackageKit is running or can be activated.
+func pkgKitAvailable() bool {
+	bus, err := util.SystemBusPrivateUsable()
+	if err != nil {
+		return false
+	}
+	defer bus.Close()
+	for _, method := range []string{"ListNames", "ListActivatableNames"} {
+		var names []string
+		if err := bus.BusObject().Call("org.freedesktop.DBus."+method, 0).Store(&names); err != nil {
+			continue
+		}
+		if util.StrInList(packagekit.PkIface, names) {
+			return true
+		}
+	}
+	return false
+}
+
+// newPkgKitBackend connects to PackageKit. Any running transaction is aborted
+// when the context of the resource is done.
+func newPkgKitBackend(obj *PkgRes) (pkgBackend, error) {
+	bus := packagekit.NewBus()
+	if bus == nil {
+		return nil, fmt.Errorf("Can't connect to PackageKit bus.")
+	}
+	bus.SetCancel(obj.Context().Done()) // abort the transaction on timeout
+	return &pkgKitBackend{
+		res:    obj,
+		bus:    bus,
+		holder: pkgNativeHolder(obj),
+	}, nil
+}
+
+// Query asks PackageKit for the package IDs that match the packages, which are
+// kept for the Apply that follows.
+func (obj *pkgKitBackend) Query(packages map[string]string) (map[string]*pkgInfo, error) {
+	var filter uint64                        // initializes at the "zero" value of 0
+	filter += packagekit.PK_FILTER_ENUM_ARCH // always search in our arch (optional!)
+	// we're requesting latest version, or to narrow down install choices!
+	if state := obj.res.State; state == "newest" || state == "installed" {
+		// if we add this, we'll still see older packages if installed
+		// this is an optimization, and is *optional*, this logic is
+		// handled inside of PackagesToPackageIDs now automatically!
+		filter += packagekit.PK_FILTER_ENUM_NEWEST // only search for newest packages
+	}
+	if !obj.res.AllowNonFree {
+		filter += packagekit.PK_FILTER_ENUM_FREE
+	}
+	if !obj.res.AllowUnsupported {
+		filter += packagekit.PK_FILTER_ENUM_SUPPORTED
+	}
+	result, err := obj.bus.PackagesToPackageIDs(packages, filter)
+	if err != nil {
+		return nil, errwrap.Wrapf(err, "Can't run PackagesToPackageIDs")
+	}
+	obj.result = result
+
+	infos := make(map[string]*pkgInfo)
+	installed := []string{}
+	for name, data := range result {
+		if data == nil {
+			continue
+		}
+		infos[name] = &pkgInfo{
+			Found:     data.Found,
+			Installed: data.Installed,
+			Version:   data.Version,
+			Newest:    data.Newest,
+		}
+		if data.Installed {
+			installed = append(installed, name)
+		}
+	}
+	if !obj.res.Hold || obj.holder == nil || len(installed) == 0 {
+		return infos, nil // we don't care, or nothing can be held
+	}
+	held, err := obj.holder.held(installed)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range installed {
+		infos[name].Held = held[name]
+	}
+	return infos, nil
+}
+
+// Apply runs the PackageKit transactions for the packages of each state.
+func (obj *pkgKitBackend) Apply(packages map[string]string) error {
+	var transactionFlags uint64  // initializes at the "zero" value of 0
+	if !obj.res.AllowUntrusted { // allow
+		transactionFlags += packagekit.PK_TRANSACTION_FLAG_ENUM_ONLY_TRUSTED
+	}
+
+	states := []string{}
+	names := make(map[string][]string) // state -> names
+	for _, name := range util.StrMapKeys(packages) {
+		state := packages[name]
+		if _, exists := names[state]; !exists {
+			states = append(states, state)
+		}
+		names[state] = append(names[state], name)
+	}
+	for _, state := range states {
+		packageIDs, err := packagekit.FilterPackageIDs(obj.result, names[state])
+		if err != nil {
+			return err
+		}
+		switch state {
+		case "uninstalled": // run remove
+			// NOTE: packageID is different than when installed, because now
+			// it has the "installed" flag added to the data portion if it!!
+			err = obj.bus.RemovePackages(packageIDs, transactionFlags)
+
+		case "newest": // TODO: isn't this the same operation as install, below?
+			err = obj.bus.UpdatePackages(packageIDs, transactionFlags)
+
+		default: // installed or version string
+			err = obj.bus.InstallPackages(packageIDs, transactionFlags)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Hold uses the native package manager, since PackageKit can't hold packages.
+func (obj *pkgKitBackend) Hold(packages []string, hold bool) error {
+	if obj.holder == nil {
+		return fmt.Errorf("Holding packages needs dnf or apt.")
+	}
+	return obj.holder.Hold(packages, hold)
+}
+
+// Files returns the file list that PackageKit has for the package.
+func (obj *pkgKitBackend) Files(name string) ([]string, error) {
+	data, ok := obj.result[name]
+	if !ok {
+		if _, err := obj.Query(map[string]string{name: obj.res.State}); err != nil {
+			return nil, err
+		}
+		data, ok = obj.result[name]
+	}
+	if !ok || !data.Found {
+		return nil, fmt.Errorf("Can't find package named '%s'.", name)
+	}
+	filesMap, err := obj.bus.GetFilesByPackageID([]string{data.PackageID})
+	if err != nil {
+		return nil, errwrap.Wrapf(err, "Can't run GetFilesByPackageID")
+	}
+	return filesMap[data.PackageID], nil
+}
+
+// Watch uses the PackageKit UpdatesChanged signal to watch for changes.
+// TODO: https://github.com/hughsie/PackageKit/issues/109
+// TODO: https://github.com/hughsie/PackageKit/issues/110
+func (obj *pkgKitBackend) Watch() (<-chan error, error) {
+	ch, err := obj.bus.WatchChanges()
+	if err != nil {
+		return nil, errwrap.Wrapf(err, "Error adding signal match")
+	}
+	events := make(chan error, 1) // the signals are merged into one
+	go func() {
+		// FIXME: ask packagekit for info on what packages changed
+		for range ch { // until the bus closes
+			select {
+			case events <- nil:
+			default: // an event is pending already
+			}
+		}
+	}()
+	return events, nil
+}
+
+// Close closes the dbus connection.
+func (obj *pkgKitBackend) Close() error {
+	return obj.bus.Close()
+}
@@ -0,0 +1,338 @@
+// Mgmt
+// Copyright (C) 2013-2016+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package resources
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	context "golang.org/x/net/context"
+)
+
+func init() {
+	pkgBackends["fake"] = func(obj *PkgRes) (pkgBackend, error) {
+		return &pkgFakeBackend{}, nil
+	}
+}
+
+// pkgFakePackage is a package of the fake backend.
+type pkgFakePackage struct {
+	versions  []string // the available versions, the newest is last
+	installed string   // the installed version, if any
+	held      bool
+	broken    bool // can't be installed
+	files     []string
+}
+
+// pkgFakePackages are the packages of the fake backend.
+var pkgFakePackages = map[string]*pkgFakePackage{}
+
+// pkgFakeBackend is a pkg backend which keeps its packages in memory. Like the
+// real package managers, it refuses to change held packages.
+type pkgFakeBackend struct{}
+
+func (obj *pkgFakeBackend) Query(packages map[string]string) (map[string]*pkgInfo, error) {
+	result := make(map[string]*pkgInfo)
+	for name := range packages {
+		p, exists := pkgFakePackages[name]
+		if !exists {
+			result[name] = &pkgInfo{}
+			continue
+		}
+		result[name] = &pkgInfo{
+			Found:     true,
+			Installed: p.installed != "",
+			Version:   p.installed,
+			Newest:    p.installed == p.versions[len(p.versions)-1],
+			Held:      p.held,
+		}
+	}
+	return result, nil
+}
+
+func (obj *pkgFakeBackend) Apply(packages map[string]string) error {
+	for name, state := range packages {
+		p := pkgFakePackages[name]
+		if p.held {
+			return fmt.Errorf("package %s is held", name)
+		}
+		if p.broken {
+			return fmt.Errorf("package %s is broken", name)
+		}
+		switch state {
+		case "uninstalled":
+			p.installed = ""
+		case "installed":
+			if p.installed == "" {
+				p.installed = p.versions[len(p.versions)-1]
+			}
+		case "newest":
+			p.installed = p.versions[len(p.versions)-1]
+		default:
+			p.installed = state
+		}
+	}
+	return nil
+}
+
+func (obj *pkgFakeBackend) Hold(packages []string, hold bool) error {
+	for _, name := range packages {
+		pkgFakePackages[name].held = hold
+	}
+	return nil
+}
+
+func (obj *pkgFakeBackend) Files(name string) ([]string, error) {
+	return pkgFakePackages[name].files, nil
+}
+
+func (obj *pkgFakeBackend) Watch() (<-chan error, error) {
+	return make(chan error), nil
+}
+
+func (obj *pkgFakeBackend) Close() error {
+	return nil
+}
+
+// newPkgFake returns a pkg resource which uses the fake backend.
+func newPkgFake(t *testing.T, name, state string, hold bool) *PkgRes {
+	obj := &PkgRes{
+		BaseRes: BaseRes{
+			Name:       name,
+			MetaParams: DefaultMetaParams,
+		},
+		State:   state,
+		Backend: "fake",
+		Hold:    hold,
+	}
+	if err := obj.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	if err := obj.Init(); err != nil {
+		t.Fatalf("Init failed: %v", err)
+	}
+	return obj
+}
+
+func TestPkgRes1(t *testing.T) {
+	pkgFakePackages = map[string]*pkgFakePackage{
+		"cowsay": {
+			versions: []string{"3.03-1", "3.04-2"},
+			files:    []string{"/usr/bin/cowsay", "/usr/lib/systemd/system/cowsay.service"},
+		},
+	}
+	cowsay := pkgFakePackages["cowsay"]
+
+	obj := newPkgFake(t, "cowsay", "3.03-1", true)
+	if svc := ReturnSvcInFileList(obj.fileList); !reflect.DeepEqual(svc, []string{"cowsay"}) {
+		t.Errorf("Wrong services: %v", svc)
+	}
+	if checkOK, err := obj.CheckApply(false); err != nil || checkOK {
+		t.Fatalf("Noop CheckApply returned: %v, %v", checkOK, err)
+	}
+	if n := len(obj.Changes()); n != 2 { // install and hold
+		t.Errorf("Expected 2 changes, got: %d", n)
+	}
+	checkApply(t, obj)
+	if cowsay.installed != "3.03-1" || !cowsay.held {
+		t.Errorf("Wrong package: %+v", cowsay)
+	}
+
+	// the held package is released to be changed, and then held again
+	obj = newPkgFake(t, "cowsay", "3.04-2", true)
+	checkApply(t, obj)
+	if cowsay.installed != "3.04-2" || !cowsay.held {
+		t.Errorf("Wrong package: %+v", cowsay)
+	}
+
+	// without hold, the holds are left alone
+	obj = newPkgFake(t, "cowsay", "installed", false)
+	if checkOK, err := obj.CheckApply(true); err != nil || !checkOK {
+		t.Fatalf("CheckApply returned: %v, %v", checkOK, err)
+	}
+	if !cowsay.held {
+		t.Errorf("The hold was released: %+v", cowsay)
+	}
+	obj = newPkgFake(t, "cowsay", "uninstalled", false)
+	if _, err := obj.CheckApply(true); err == nil {
+		t.Errorf("CheckApply should fail for a package which is held")
+	}
+
+	cowsay.held = false
+	checkApply(t, obj)
+	if cowsay.installed != "" {
+		t.Errorf("Wrong package: %+v", cowsay)
+	}
+
+	// a failed upgrade keeps the hold
+	cowsay.installed, cowsay.held, cowsay.broken = "3.03-1", true, true
+	obj = newPkgFake(t, "cowsay", "3.04-2", true)
+	if _, err := obj.CheckApply(true); err == nil {
+		t.Errorf("CheckApply should fail for a broken package")
+	}
+	if cowsay.installed != "3.03-1" || !cowsay.held {
+		t.Errorf("Wrong package: %+v", cowsay)
+	}
+	cowsay.broken = false
+	cowsay.installed = ""
+
+	missing := &PkgRes{BaseRes: BaseRes{Name: "missing"}, State: "installed", Backend: "fake"}
+	if err := missing.Init(); err == nil {
+		t.Errorf("Init should fail for a missing package")
+	}
+}
+
+func TestPkgResGroup1(t *testing.T) {
+	pkgFakePackages = map[string]*pkgFakePackage{
+		"vim":  {versions: []string{"8.0-1"}, installed: "8.0-1"},
+		"tmux": {versions: []string{"2.2-1", "2.3-1"}},
+	}
+	vim := newPkgFake(t, "vim", "installed", true)
+	tmux := newPkgFake(t, "tmux", "installed", true)
+	if !vim.GroupCmp(tmux) {
+		t.Fatalf("The packages should group")
+	}
+	if other := newPkgFake(t, "tmux", "installed", false); vim.GroupCmp(other) {
+		t.Errorf("The packages shouldn't group with different holds")
+	}
+	vim.SetGroup([]Res{tmux})
+	checkApply(t, vim)
+	for name, p := range pkgFakePackages {
+		if p.installed == "" || !p.held {
+			t.Errorf("Wrong package %s: %+v", name, p)
+		}
+	}
+}
+
+func TestPkgResValidate1(t *testing.T) {
+	for _, obj := range []*PkgRes{
+		{State: ""},
+		{State: "installed", Backend: "yum"},
+		{State: "uninstalled", Hold: true},
+		{State: "newest", Hold: true},
+	} {
+		obj.MetaParams = DefaultMetaParams
+		if err := obj.Validate(); err == nil {
+			t.Errorf("Validate should have failed: %+v", obj)
+		}
+	}
+}
+
+func TestPkgParse1(t *testing.T) {
+	installed, held := pkgAptParseStatus("bash install ok installed 4.4-5\n" +
+		"vim:amd64 hold ok installed 2:8.0-1\n" +
+		"old deinstall ok config-files 1.0-1\n")
+	if !reflect.DeepEqual(installed, map[string]string{"bash": "4.4-5", "vim": "2:8.0-1"}) {
+		t.Errorf("Wrong installed packages: %v", installed)
+	}
+	if !reflect.DeepEqual(held, []string{"vim"}) {
+		t.Errorf("Wrong held packages: %v", held)
+	}
+
+	candidates := pkgAptParsePolicy("bash:\n  Installed: 4.4-5\n  Candidate: 4.4-6\n  Version table:\n" +
+		" *** 4.4-5 500\n        500 http://deb.debian.org/debian stretch/main amd64 Packages\n" +
+		"gone:\n  Installed: (none)\n  Candidate: (none)\n  Version table:\n")
+	if !reflect.DeepEqual(candidates, map[string]string{"bash": "4.4-6"}) {
+		t.Errorf("Wrong candidates: %v", candidates)
+	}
+
+	locks := pkgDnfParseLocks("# Added lock on Mon Jan  1 2018\nvim-enhanced-2:8.0.1257-1.fc27.*\n!kernel-0:4.14.0-1.fc27.*\n")
+	if !reflect.DeepEqual(locks, []string{"vim-enhanced"}) {
+		t.Errorf("Wrong locks: %v", locks)
+	}
+
+	versions := pkgParseVersions("bash 4.4.12-7.fc27\npackage foo is not installed\n")
+	if !reflect.DeepEqual(versions, map[string]string{"bash": "4.4.12-7.fc27"}) {
+		t.Errorf("Wrong versions: %v", versions)
+	}
+}
+
+func TestPkgCmd1(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := pkgCmd(ctx, "sleep", "10"); err == nil {
+		t.Errorf("The command wasn't cancelled")
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("The command wasn't killed on time: %v", d)
+	}
+	if out, err := pkgCmd(context.Background(), "echo", "hello"); err != nil || out != "hello\n" {
+		t.Errorf("Wrong output: %q, %v", out, err)
+	}
+}
+
+// TestPkgDnfHeld1 runs a dnf without the versionlock plugin, and checks that
+// nothing is held, and that dnf isn't even run if hold isn't set.
+func TestPkgDnfHeld1(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mgmt-pkg-")
+	if err != nil {
+		t.Fatalf("Can't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	calls := path.Join(dir, "calls")
+	script := "#!/bin/sh\n" +
+		"echo \"$@\" >> " + calls + "\n" +
+		"case \"$*\" in\n" +
+		"*versionlock*) echo 'No such command: versionlock.' >&2; exit 1;;\n" +
+		"*repoquery*) echo 'cowsay 3.04-2';;\n" +
+		"esac\n"
+	if err := ioutil.WriteFile(path.Join(dir, "dnf"), []byte(script), 0755); err != nil {
+		t.Fatalf("Can't write dnf: %v", err)
+	}
+	old := os.Getenv("PATH")
+	defer os.Setenv("PATH", old)
+	os.Setenv("PATH", dir+":"+old)
+
+	for _, hold := range []bool{false, true} {
+		os.Remove(calls)
+		backend := &pkgDnfBackend{res: &PkgRes{State: "installed", Hold: hold}}
+		result, err := backend.Query(map[string]string{"cowsay": "installed"})
+		if err != nil {
+			t.Fatalf("Query failed: %v", err)
+		}
+		if info := result["cowsay"]; !info.Found || info.Held {
+			t.Errorf("Wrong package: %+v", info)
+		}
+		data, _ := ioutil.ReadFile(calls)
+		if queried := strings.Contains(string(data), "versionlock"); queried != hold {
+			t.Errorf("Holds queried: %t, with hold: %t", queried, hold)
+		}
+		if err := backend.Hold([]string{"cowsay"}, true); err == nil {
+			t.Errorf("Hold should fail without the plugin")
+		}
+	}
+}
+
+// TestPkgCmdEnv1 checks that the output of the package managers isn't
+// translated, even if the env of mgmt asks for it.
+func TestPkgCmdEnv1(t *testing.T) {
+	old := os.Getenv("LC_ALL")
+	defer os.Setenv("LC_ALL", old)
+	os.Setenv("LC_ALL", "fr_FR.UTF-8")
+	out, err := pkgCmd(context.Background(), "sh", "-c", "env | grep ^LC_ALL=")
+	if err != nil || out != "LC_ALL=C\n" {
+		t.Errorf("Wrong env: %q, %v", out, err)
+	}
+}
@@ -0,0 +1,63 @@
+// Mgmt
+// Copyright (C) 2013-2016+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package resources
+
+import (
+	"fmt"
+)
+
+// Change describes a single difference between the current state and the
+// desired state of a resource, as found by CheckApply. Resources can report
+// these so that a noop run can tell the user exactly *what* would change.
+type Change struct {
+	Property string `json:"property"`       // which part of the resource, eg: "mode"
+	Old      string `json:"old,omitempty"`  // current value, if it is known
+	New      string `json:"new,omitempty"`  // desired value, if it is known
+	Diff     string `json:"diff,omitempty"` // unified diff, for content changes
+}
+
+// String returns a short human readable description of the change.
+func (obj *Change) String() string {
+	switch {
+	case obj.Old != "" && obj.New != "":
+		return fmt.Sprintf("%s: %s -> %s", obj.Property, obj.Old, obj.New)
+	case obj.New != "":
+		return fmt.Sprintf("%s: %s", obj.Property, obj.New)
+	case obj.Old != "":
+		return fmt.Sprintf("%s: %s -> (none)", obj.Property, obj.Old)
+	}
+	return obj.Property
+}
+
+// AddChange records a change that CheckApply found. It should only be called
+// from within CheckApply. Resources which don't report any changes will still
+// show up in the noop report, but without any details.
+func (obj *BaseRes) AddChange(change *Change) {
+	obj.changes = append(obj.changes, change)
+}
+
+// Changes returns the list of changes found by the last CheckApply run.
+func (obj *BaseRes) Changes() []*Change {
+	return obj.changes
+}
+
+// ResetChanges clears the list of changes. It is called by the engine before
+// each CheckApply run.
+func (obj *BaseRes) ResetChanges() {
+	obj.changes = nil
+}
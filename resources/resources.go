@@ -22,20 +22,26 @@ import (
 	"bytes"
 	"encoding/base64"
 	"encoding/gob"
+	"encoding/json"
 	"fmt"
 	"log"
 	"math"
 	"os"
 	"path"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	// TODO: should each resource be a sub-package?
 	"github.com/purpleidea/mgmt/converger"
 	"github.com/purpleidea/mgmt/event"
+	"github.com/purpleidea/mgmt/journal"
 	"github.com/purpleidea/mgmt/prometheus"
+	"github.com/purpleidea/mgmt/util"
 
 	errwrap "github.com/pkg/errors"
+	context "golang.org/x/net/context"
 	"golang.org/x/time/rate"
 )
 
@@ -78,6 +84,7 @@ type Data struct {
 	//Noop     bool
 	Converger  converger.Converger
 	Prometheus *prometheus.Prometheus
+	Journal    *journal.Journal
 	Prefix     string // the prefix to be used for the pgraph namespace
 	Debug      bool
 	// NOTE: we can add more fields here if needed for the resources.
@@ -100,12 +107,110 @@ type BaseUID struct {
 	reversed *bool // piggyback edge information here
 }
 
+// The Reversible interface is implemented by the resources which know how to
+// undo their effects. It is used by the reverse metaparam. The Reversed method
+// returns a new resource, with the same name, which does the inverse of this
+// one. It returns nil if there is nothing to undo.
+type Reversible interface {
+	Reversed() (Res, error)
+}
+
 // The AutoEdge interface is used to implement the autoedges feature.
 type AutoEdge interface {
 	Next() []ResUID   // call to get list of edges to add
 	Test([]bool) bool // call until false
 }
 
+// Conflicter is the interface of the resources which can conflict with other
+// resources of the same graph, because they manage the same thing differently.
+type Conflicter interface {
+	Conflicts(Res) error // returns an error if the resources conflict
+}
+
+// BatchAutoEdges is the auto edge generator of the resources which return all
+// of their automatic edges at once.
+type BatchAutoEdges struct {
+	data []ResUID
+	done bool
+}
+
+// Next returns the next automatic edges. They are all returned at once.
+func (obj *BatchAutoEdges) Next() []ResUID {
+	if obj.done || len(obj.data) == 0 {
+		return nil
+	}
+	return obj.data
+}
+
+// Test gets results of the earlier Next() call, & returns if we should continue!
+func (obj *BatchAutoEdges) Test(input []bool) bool {
+	obj.done = true // there is only one batch
+	return false
+}
+
+// parentDirAutoEdges is the auto edge generator of the resources which use
+// some paths. The file resource which manages each path, or else the one which
+// manages its nearest parent dir, happens before us.
+type parentDirAutoEdges struct {
+	data [][]ResUID // the path and then its parent dirs, for each path
+}
+
+// newParentDirAutoEdges returns the auto edge generator of the paths of res.
+func newParentDirAutoEdges(res Res, paths []string) *parentDirAutoEdges {
+	var data [][]ResUID
+	for _, p := range paths {
+		var uids []ResUID
+		for _, x := range util.PathSplitFullReversed(p) {
+			var reversed = true // the files happen before us
+			uids = append(uids, &FileUID{
+				BaseUID: BaseUID{
+					name:     res.GetName(),
+					kind:     res.Kind(),
+					reversed: &reversed,
+				},
+				path: x,
+			})
+		}
+		data = append(data, uids)
+	}
+	return &parentDirAutoEdges{
+		data: data,
+	}
+}
+
+// Next returns the next automatic edges. There is one for each of the paths
+// which hasn't found its match yet.
+func (obj *parentDirAutoEdges) Next() []ResUID {
+	var result []ResUID
+	for _, uids := range obj.data {
+		result = append(result, uids[0])
+	}
+	return result
+}
+
+// Test gets results of the earlier Next() call, & returns if we should continue!
+func (obj *parentDirAutoEdges) Test(input []bool) bool {
+	if len(input) != len(obj.data) { // in case we get given bad data
+		log.Fatal("Expecting a value for each path!")
+	}
+	var data [][]ResUID
+	for i, uids := range obj.data {
+		if !input[i] && len(uids) > 1 { // try the parent dir next
+			data = append(data, uids[1:])
+		}
+	}
+	obj.data = data
+	return len(data) > 0
+}
+
+// The backoff strategies which can be used in the backoff metaparam. An empty
+// value is the same as the fixed strategy.
+const (
+	BackoffFixed       = "fixed"       // always wait for the delay
+	BackoffLinear      = "linear"      // wait for the delay times the attempt
+	BackoffExponential = "exponential" // double the delay on each attempt
+)
+
 // MetaParams is a struct will all params that apply to every resource.
 type MetaParams struct {
 	AutoEdge  bool `yaml:"autoedge"`  // metaparam, should we generate auto edges?
@@ -119,6 +224,38 @@ type MetaParams struct {
 	Poll  uint32     `yaml:"poll"`  // metaparam, number of seconds between poll intervals, 0 to watch
 	Limit rate.Limit `yaml:"limit"` // metaparam, number of events per second to allow through
 	Burst int        `yaml:"burst"` // metaparam, number of events to allow in a burst
+	// NOTE: the backoff strategy grows the delay between successive retries.
+	Backoff  string `yaml:"backoff"`  // metaparam, retry delay strategy: fixed, linear or exponential
+	MaxDelay uint64 `yaml:"maxdelay"` // metaparam, maximum number of milliseconds between retries, 0 for no cap
+	Jitter   bool   `yaml:"jitter"`   // metaparam, randomize each retry delay between half and all of its value
+	// NOTE: the parallel value is shared by every resource in the same pool.
+	Parallel uint16 `yaml:"parallel"` // metaparam, max number of simultaneous CheckApply runs in the pool, 0 for unlimited
+	Pool     string `yaml:"pool"`     // metaparam, name of the parallel pool to use, defaults to the resource kind
+	Timeout  uint64 `yaml:"timeout"`  // metaparam, number of seconds to allow CheckApply and Watch startup to take, 0 for no timeout
+	Reverse  bool   `yaml:"reverse"`  // metaparam, undo the effects of the resource when it's removed from the graph
+	// NOTE: a semaphore is shared by every resource that uses the same name.
+	Sema []string `yaml:"sema"` // metaparam, list of semaphores to hold during CheckApply, in name[:count] format
+	// NOTE: outside of the windows, CheckApply only runs in noop mode.
+	Schedule []string `yaml:"schedule"` // metaparam, list of calendar windows during which changes are allowed, empty for always
+}
+
+// SemaSep is the separator between the name and the count of a semaphore.
+const SemaSep = ":"
+
+// ParseSema parses a semaphore from the sema metaparam, which is in the format
+// name[:count]. The count defaults to one, which makes it a simple lock.
+func ParseSema(id string) (name string, count int, err error) {
+	name, count = id, 1
+	if i := strings.LastIndex(id, SemaSep); i >= 0 {
+		name = id[:i]
+		if count, err = strconv.Atoi(id[i+len(SemaSep):]); err != nil || count < 1 {
+			return "", 0, fmt.Errorf("Invalid semaphore count: %s", id)
+		}
+	}
+	if name == "" {
+		return "", 0, fmt.Errorf("Invalid semaphore name: %s", id)
+	}
+	return name, count, nil
 }
 
 // UnmarshalYAML is the custom unmarshal handler for the MetaParams struct. It
@@ -135,16 +272,73 @@ func (obj *MetaParams) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	return nil
 }
 
+// limitInf is the json representation of an infinite rate limit.
+const limitInf = "Inf"
+
+// MarshalJSON is the custom json marshal handler for the MetaParams struct. The
+// rate limit is stored as a string, since json can't represent an infinity.
+func (obj *MetaParams) MarshalJSON() ([]byte, error) {
+	type rawMetaParams MetaParams // indirection to avoid infinite recursion
+	limit := strconv.FormatFloat(float64(obj.Limit), 'g', -1, 64)
+	if obj.Limit == rate.Inf || math.IsInf(float64(obj.Limit), 1) {
+		limit = limitInf
+	}
+	return json.Marshal(&struct {
+		*rawMetaParams
+		Limit string
+	}{
+		rawMetaParams: (*rawMetaParams)(obj),
+		Limit:         limit,
+	})
+}
+
+// UnmarshalJSON is the custom json unmarshal handler for the MetaParams struct.
+// The missing values are set to their defaults.
+func (obj *MetaParams) UnmarshalJSON(data []byte) error {
+	type rawMetaParams MetaParams           // indirection to avoid infinite recursion
+	raw := rawMetaParams(DefaultMetaParams) // convert; the defaults go here
+	aux := &struct {
+		*rawMetaParams
+		Limit *string
+	}{
+		rawMetaParams: &raw,
+	}
+	if err := json.Unmarshal(data, aux); err != nil {
+		return err
+	}
+	if aux.Limit != nil && *aux.Limit == limitInf {
+		raw.Limit = rate.Inf
+	} else if aux.Limit != nil {
+		limit, err := strconv.ParseFloat(*aux.Limit, 64)
+		if err != nil {
+			return errwrap.Wrapf(err, "invalid limit")
+		}
+		raw.Limit = rate.Limit(limit)
+	}
+
+	*obj = MetaParams(raw) // restore from indirection with type conversion!
+	return nil
+}
+
 // DefaultMetaParams are the defaults to be used for undefined metaparams.
 var DefaultMetaParams = MetaParams{
 	AutoEdge:  true,
 	AutoGroup: true,
 	Noop:      false,
-	Retry:     0,        // TODO: is this a good default?
-	Delay:     0,        // TODO: is this a good default?
-	Poll:      0,        // defaults to watching for events
-	Limit:     rate.Inf, // defaults to no limit
-	Burst:     0,        // no burst needed on an infinite rate // TODO: is this a good default?
+	Retry:     0,            // TODO: is this a good default?
+	Delay:     0,            // TODO: is this a good default?
+	Poll:      0,            // defaults to watching for events
+	Limit:     rate.Inf,     // defaults to no limit
+	Burst:     0,            // no burst needed on an infinite rate // TODO: is this a good default?
+	Backoff:   BackoffFixed, // defaults to the same delay between retries
+	MaxDelay:  0,            // defaults to no cap
+	Jitter:    false,        // defaults to exact delays
+	Parallel:  0,            // defaults to no limit
+	Pool:      "",           // defaults to a pool per resource kind
+	Timeout:   0,            // defaults to no timeout
+	Reverse:   false,        // defaults to leaving things as they are
+	Sema:      []string{},   // defaults to no semaphores
+	Schedule:  []string{},   // defaults to changes being allowed at any time
 }
 
 // The Base interface is everything that is common to all resources.
@@ -159,6 +353,8 @@ type Base interface {
 	AssociateData(*Data)
 	IsWorking() bool
 	SetWorking(bool)
+	IsRunning() bool
+	SetRunning(bool)
 	Converger() converger.Converger
 	RegisterConverger()
 	UnregisterConverger()
@@ -171,6 +367,11 @@ type Base interface {
 	Refresh() bool                         // is there a pending refresh to run?
 	SetRefresh(bool)                       // set the refresh state of this resource
 	SendRecv(Res) (map[string]bool, error) // send->recv data passing function
+	GetRecv() map[string]*Send             // the keys this resource receives on
+	SetRecv(map[string]*Send)              // set the keys to receive on
+	AddChange(*Change)                     // record a change found by CheckApply
+	Changes() []*Change                    // changes found by the last CheckApply
+	ResetChanges()                         // clear the list of changes
 	IsStateOK() bool
 	StateOK(b bool)
 	GroupCmp(Res) bool  // TODO: is there a better name for this?
@@ -185,6 +386,9 @@ type Base interface {
 	Starter(bool)
 	Poll(chan *event.Event) error // poll alternative to watching :(
 	Prometheus() *prometheus.Prometheus
+	GetJournal() *journal.Journal
+	Context() context.Context // cancelled when CheckApply should give up
+	SetContext(context.Context)
 }
 
 // Res is the minimum interface you need to implement to define a new resource.
@@ -207,7 +411,7 @@ type Res interface {
 type BaseRes struct {
 	Name       string
 	MetaParams MetaParams       // struct of all the metaparams
-	Recv       map[string]*Send // mapping of key to receive on from value
+	Recv       map[string]*Send `json:"-"` // mapping of key to receive on from value
 
 	kind       string
 	mutex      *sync.Mutex // locks around sending and closing of events channel
@@ -215,17 +419,21 @@ type BaseRes struct {
 	converger  converger.Converger // converged tracking
 	cuid       converger.ConvergerUID
 	prometheus *prometheus.Prometheus
+	journal    *journal.Journal
 	prefix     string // base prefix for this resource
 	debug      bool
 	state      ResState
-	working    bool          // is the Worker() loop running ?
-	started    chan struct{} // closed when worker is started/running
-	isStarted  bool          // did the started chan already close?
-	starter    bool          // does this have indegree == 0 ? XXX: usually?
-	isStateOK  bool          // whether the state is okay based on events or not
-	isGrouped  bool          // am i contained within a group?
-	grouped    []Res         // list of any grouped resources
-	refresh    bool          // does this resource have a refresh to run?
+	working    bool            // is the Worker() loop running ?
+	running    bool            // did the current Watch get to Running() ?
+	started    chan struct{}   // closed when worker is started/running
+	isStarted  bool            // did the started chan already close?
+	starter    bool            // does this have indegree == 0 ? XXX: usually?
+	isStateOK  bool            // whether the state is okay based on events or not
+	isGrouped  bool            // am i contained within a group?
+	grouped    []Res           // list of any grouped resources
+	refresh    bool            // does this resource have a refresh to run?
+	changes    []*Change       // changes found by the last CheckApply run
+	ctx        context.Context // context for the current CheckApply run
 	//refreshState StatefulBool // TODO: future stateful bool
 }
 
@@ -299,6 +507,25 @@ func (obj *BaseRes) Validate() error {
 	if obj.Meta().Burst == 0 && !isInf { // blocked
 		return fmt.Errorf("Permanently limited (rate != Inf, burst: 0)")
 	}
+	switch obj.Meta().Backoff {
+	case "", BackoffFixed, BackoffLinear, BackoffExponential:
+	default:
+		return fmt.Errorf("Unknown backoff strategy: %s", obj.Meta().Backoff)
+	}
+	for _, id := range obj.Meta().Sema {
+		if _, _, err := ParseSema(id); err != nil {
+			return err
+		}
+	}
+	for _, window := range obj.Meta().Schedule {
+		c, err := ParseSchedule(window)
+		if err != nil {
+			return err
+		}
+		if c.Next(time.Now()).IsZero() {
+			return fmt.Errorf("Schedule window never opens: %s", window)
+		}
+	}
 	return nil
 }
 
@@ -371,6 +598,7 @@ func (obj *BaseRes) Events() chan *event.Event {
 func (obj *BaseRes) AssociateData(data *Data) {
 	obj.converger = data.Converger
 	obj.prometheus = data.Prometheus
+	obj.journal = data.Journal
 	obj.prefix = data.Prefix
 	obj.debug = data.Debug
 }
@@ -389,6 +617,20 @@ func (obj *BaseRes) SetWorking(b bool) {
 	obj.working = b
 }
 
+// IsRunning tells us if the current Watch() got to call Running().
+func (obj *BaseRes) IsRunning() bool {
+	obj.mutex.Lock()
+	defer obj.mutex.Unlock()
+	return obj.running
+}
+
+// SetRunning tracks the state of if the current Watch() has started running.
+func (obj *BaseRes) SetRunning(b bool) {
+	obj.mutex.Lock()
+	defer obj.mutex.Unlock()
+	obj.running = b
+}
+
 // Converger returns the converger object used by the system. It can be used to
 // register new convergers if needed.
 func (obj *BaseRes) Converger() converger.Converger {
@@ -499,6 +741,15 @@ func (obj *BaseRes) Compare(res Res) bool {
 	if obj.Meta().Delay != res.Meta().Delay {
 		return false
 	}
+	if obj.Meta().Backoff != res.Meta().Backoff {
+		return false
+	}
+	if obj.Meta().MaxDelay != res.Meta().MaxDelay {
+		return false
+	}
+	if obj.Meta().Jitter != res.Meta().Jitter {
+		return false
+	}
 	if obj.Meta().Poll != res.Meta().Poll {
 		return false
 	}
@@ -508,6 +759,24 @@ func (obj *BaseRes) Compare(res Res) bool {
 	if obj.Meta().Burst != res.Meta().Burst {
 		return false
 	}
+	if obj.Meta().Parallel != res.Meta().Parallel {
+		return false
+	}
+	if obj.Meta().Pool != res.Meta().Pool {
+		return false
+	}
+	if obj.Meta().Timeout != res.Meta().Timeout {
+		return false
+	}
+	if obj.Meta().Reverse != res.Meta().Reverse {
+		return false
+	}
+	if !util.StrSetEq(obj.Meta().Sema, res.Meta().Sema) {
+		return false
+	}
+	if !util.StrSetEq(obj.Meta().Schedule, res.Meta().Schedule) {
+		return false
+	}
 	return true
 }
 
@@ -589,6 +858,27 @@ func (obj *BaseRes) Prometheus() *prometheus.Prometheus {
 	return obj.prometheus
 }
 
+// GetJournal returns the engine journal, or nil if it is disabled.
+func (obj *BaseRes) GetJournal() *journal.Journal {
+	return obj.journal
+}
+
+// Context returns the context of the running CheckApply. It is cancelled when
+// the timeout metaparam expires, and long running operations should watch its
+// Done channel so that they can abort cleanly. It is never nil.
+func (obj *BaseRes) Context() context.Context {
+	if obj.ctx == nil {
+		return context.Background()
+	}
+	return obj.ctx
+}
+
+// SetContext sets the context for the next CheckApply run. It should only be
+// called by the mgmt engine.
+func (obj *BaseRes) SetContext(ctx context.Context) {
+	obj.ctx = ctx
+}
+
 // ResToB64 encodes a resource to a base64 encoded string (after serialization)
 func ResToB64(res Res) (string, error) {
 	b := bytes.Buffer{}
@@ -113,6 +113,7 @@ func (obj *BaseRes) Running(processChan chan *event.Event) error {
 		obj.isStarted = true
 		close(obj.started) // send started signal
 	}
+	obj.SetRunning(true) // so that the retries of Watch start over
 
 	var err error
 	if obj.starter { // vertices of indegree == 0 should send initial pokes
@@ -126,9 +127,24 @@ type Send struct {
 	Res Res    // a handle to the resource which is sending a value
 	Key string // the key in the resource that we're sending
 
+	// Convert is the optional conversion to apply to the sent value, so
+	// that it can be received by a key of a different type. See Convert.
+	Convert string
+
 	Changed bool // set to true if this key was updated, read only!
 }
 
+// GetRecv returns the map of keys that this resource receives on.
+func (obj *BaseRes) GetRecv() map[string]*Send {
+	return obj.Recv
+}
+
+// SetRecv sets the map of keys that this resource receives on. The keys are
+// the names of the receiving fields, and each value points to the sender.
+func (obj *BaseRes) SetRecv(recv map[string]*Send) {
+	obj.Recv = recv
+}
+
 // SendRecv pulls in the sent values into the receive slots. It is called by the
 // receiver and must be given as input the full resource struct to receive on.
 func (obj *BaseRes) SendRecv(res Res) (map[string]bool, error) {
@@ -158,6 +174,17 @@ func (obj *BaseRes) SendRecv(res Res) (map[string]bool, error) {
 			log.Printf("Recv(%s) has %v: %v", type2, kind2, value2)
 		}
 
+		// coerce the sent value into the type of the receiving key
+		if v.Convert != "" && value1.IsValid() && value2.IsValid() {
+			value, e := Convert(v.Convert, value1, value2.Type())
+			if e != nil {
+				e := errwrap.Wrapf(e, "Conversion failed between %s[%s] and %s[%s]", v.Res.Kind(), v.Res.GetName(), obj.Kind(), obj.GetName())
+				err = multierr.Append(err, e) // list of errors
+				continue
+			}
+			value1, kind1 = value, value.Kind()
+		}
+
 		// i think we probably want the same kind, at least for now...
 		if kind1 != kind2 {
 			e := fmt.Errorf("Kind mismatch between %s[%s]: %s and %s[%s]: %s", v.Res.Kind(), v.Res.GetName(), kind1, obj.Kind(), obj.GetName(), kind2)
@@ -166,7 +193,7 @@ func (obj *BaseRes) SendRecv(res Res) (map[string]bool, error) {
 		}
 
 		// if the types don't match, we can't use send->recv
-		// TODO: do we want to relax this for string -> *string ?
+		// NOTE: a Convert can be used to relax this, eg: string -> *string
 		if e := TypeCmp(value1, value2); e != nil {
 			e := errwrap.Wrapf(e, "Type mismatch between %s[%s] and %s[%s]", v.Res.Kind(), v.Res.GetName(), obj.Kind(), obj.GetName())
 			err = multierr.Append(err, e) // list of errors
@@ -199,6 +226,57 @@ func (obj *BaseRes) SendRecv(res Res) (map[string]bool, error) {
 	return updated, err
 }
 
+// CheckRecv verifies statically that the key of the receiving resource can get
+// its value from the sender. Both fields must exist and be exported, the one of
+// the receiver must be settable, and their types must match, unless the sender
+// asks for a conversion that can turn one type into the other. This runs before
+// the graph starts, so that we don't discover a broken mapping at runtime.
+func CheckRecv(res Res, key string, send *Send) error {
+	if send == nil || send.Res == nil {
+		return fmt.Errorf("%s[%s].%s: Missing sender", res.Kind(), res.GetName(), key)
+	}
+	str := fmt.Sprintf("%s[%s].%s -> %s[%s].%s", send.Res.Kind(), send.Res.GetName(), send.Key, res.Kind(), res.GetName(), key)
+
+	// send
+	obj1 := reflect.Indirect(reflect.ValueOf(send.Res))
+	field1, exists := obj1.Type().FieldByName(send.Key)
+	if !exists {
+		return fmt.Errorf("%s: Sender has no field named %s", str, send.Key)
+	}
+	if field1.PkgPath != "" {
+		return fmt.Errorf("%s: Sender field %s is not exported", str, send.Key)
+	}
+	value1 := obj1.FieldByName(send.Key)
+
+	// recv
+	obj2 := reflect.Indirect(reflect.ValueOf(res))
+	field2, exists := obj2.Type().FieldByName(key)
+	if !exists {
+		return fmt.Errorf("%s: Receiver has no field named %s", str, key)
+	}
+	if field2.PkgPath != "" {
+		return fmt.Errorf("%s: Receiver field %s is not exported", str, key)
+	}
+	value2 := obj2.FieldByName(key)
+	if !value2.CanSet() {
+		return fmt.Errorf("%s: Receiver field %s can't be set", str, key)
+	}
+
+	if send.Convert != "" {
+		if err := ConvertCheck(send.Convert, field1.Type, field2.Type); err != nil {
+			return errwrap.Wrapf(err, "%s", str)
+		}
+		return nil
+	}
+	if kind1, kind2 := value1.Kind(), value2.Kind(); kind1 != kind2 {
+		return fmt.Errorf("%s: Kind mismatch: %s != %s", str, kind1, kind2)
+	}
+	if err := TypeCmp(value1, value2); err != nil {
+		return errwrap.Wrapf(err, "%s", str)
+	}
+	return nil
+}
+
 // TypeCmp compares two reflect values to see if they are the same Kind. It can
 // look into a ptr Kind to see if the underlying pair of ptr's can TypeCmp too!
 func TypeCmp(a, b reflect.Value) error {
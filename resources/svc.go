@@ -23,6 +23,11 @@ import (
 	"encoding/gob"
 	"fmt"
 	"log"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"strings"
 
 	"github.com/purpleidea/mgmt/event"
 	"github.com/purpleidea/mgmt/util"
@@ -38,11 +43,18 @@ func init() {
 	gob.Register(&SvcRes{})
 }
 
+// svcUnitDir is where the svc resource writes the unit files of the system.
+var svcUnitDir = "/etc/systemd/system"
+
 // SvcRes is a service resource for systemd units.
 type SvcRes struct {
-	BaseRes `yaml:",inline"`
-	State   string `yaml:"state"`   // state: running, stopped, undefined
-	Startup string `yaml:"startup"` // enabled, disabled, undefined
+	BaseRes   `yaml:",inline"`
+	State     string            `yaml:"state"`     // state: running, stopped, undefined
+	Startup   string            `yaml:"startup"`   // enabled, disabled, masked, undefined
+	User      bool              `yaml:"user"`      // a unit of the user session manager
+	Content   string            `yaml:"content"`   // the unit file, if we manage it
+	DropIns   map[string]string `yaml:"dropins"`   // the drop-in snippets, by name
+	OnRefresh string            `yaml:"onrefresh"` // reload (default), restart or reload-or-restart
 }
 
 // NewSvcRes is a constructor for this resource. It also calls Init() for you.
@@ -67,8 +79,21 @@ func (obj *SvcRes) Validate() error {
 	if obj.State != "running" && obj.State != "stopped" && obj.State != "" {
 		return fmt.Errorf("State must be either `running` or `stopped` or undefined.")
 	}
-	if obj.Startup != "enabled" && obj.Startup != "disabled" && obj.Startup != "" {
-		return fmt.Errorf("Startup must be either `enabled` or `disabled` or undefined.")
+	if obj.Startup != "enabled" && obj.Startup != "disabled" && obj.Startup != "masked" && obj.Startup != "" {
+		return fmt.Errorf("Startup must be either `enabled` or `disabled` or `masked` or undefined.")
+	}
+	if obj.Startup == "masked" && (obj.State == "running" || obj.Content != "") {
+		return fmt.Errorf("A masked unit can't be running nor have content.")
+	}
+	for name := range obj.DropIns {
+		if name == "" || strings.ContainsAny(name, "/") {
+			return fmt.Errorf("Invalid drop-in name: %q", name)
+		}
+	}
+	switch obj.OnRefresh {
+	case "", "reload", "restart", "reload-or-restart":
+	default:
+		return fmt.Errorf("OnRefresh must be either `reload`, `restart` or `reload-or-restart`.")
 	}
 	return obj.BaseRes.Validate()
 }
@@ -79,21 +104,125 @@ func (obj *SvcRes) Init() error {
 	return obj.BaseRes.Init() // call base init, b/c we're overriding
 }
 
-// Watch is the primary listener for this resource and it outputs events.
+// unit returns the name of the systemd unit. The name of the resource is the
+// name of a service, unless it has the suffix of another type of unit.
+func (obj *SvcRes) unit() string {
+	for _, x := range svcUnitTypes {
+		if strings.HasSuffix(obj.Name, "."+x) {
+			return obj.Name
+		}
+	}
+	return fmt.Sprintf("%s.service", obj.Name) // systemd name
+}
+
+// svcUnitTypes are the suffixes of the unit names that the svc resource uses.
+var svcUnitTypes = []string{"service", "socket", "timer", "path", "target"}
+
+// svcStartup returns whether the unit with this UnitFileState starts on boot,
+// and whether it's masked.
+func svcStartup(unitFileState string) (enabled, masked bool) {
+	enabled = util.StrInList(unitFileState, svcEnabledStates)
+	masked = unitFileState == "masked" || unitFileState == "masked-runtime"
+	return enabled, masked
+}
+
+// svcEnabledStates are the UnitFileState values of the units which start on
+// boot. The static, generated and indirect units can't be enabled any more than
+// they are, and an alias is enabled with the unit that it points to.
+var svcEnabledStates = []string{"enabled", "enabled-runtime", "static", "alias", "indirect", "generated"}
+
+// unitDir returns the dir where we write the unit file and the drop-ins. For a
+// user unit, this is in the config dir of the user that we run as.
+func (obj *SvcRes) unitDir() (string, error) {
+	if !obj.User {
+		return svcUnitDir, nil
+	}
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+		return path.Join(dir, "systemd/user"), nil
+	}
+	usr, err := user.Current()
+	if err != nil {
+		return "", errwrap.Wrapf(err, "can't find the home directory")
+	}
+	return path.Join(usr.HomeDir, ".config/systemd/user"), nil
+}
+
+// files returns the content of the unit file and of the drop-ins, by path. The
+// content is empty for the drop-ins that we wrote earlier, which aren't listed
+// anymore. The unit file is only managed if we have its content.
+func (obj *SvcRes) files() (map[string]string, error) {
+	dir, err := obj.unitDir()
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]string)
+	if obj.Content != "" {
+		result[path.Join(dir, obj.unit())] = unitHeader + strings.TrimSuffix(obj.Content, "\n") + "\n"
+	}
+	dropins := path.Join(dir, obj.unit()+".d")
+	matches, err := filepath.Glob(path.Join(dropins, "*.conf"))
+	if err != nil {
+		return nil, errwrap.Wrapf(err, "can't list %s", dropins)
+	}
+	for _, p := range matches {
+		result[p] = "" // only removed if it's ours
+	}
+	for name, content := range obj.DropIns {
+		result[path.Join(dropins, name+".conf")] = unitHeader + strings.TrimSuffix(content, "\n") + "\n"
+	}
+	return result, nil
+}
+
+// connect returns a connection to the systemd instance which runs the unit.
+func (obj *SvcRes) connect() (*systemd.Conn, error) {
+	if obj.User {
+		return systemd.NewUserConnection()
+	}
+	return systemd.NewSystemdConnection() // needs root access
+}
+
+// Watch is the primary listener for this resource and it outputs events. It
+// watches the unit, and the unit file and the drop-ins if we manage them, so
+// that edits get reverted.
 func (obj *SvcRes) Watch(processChan chan *event.Event) error {
-	// obj.Name: svc name
+	files := []string{}
+	if obj.Content != "" || len(obj.DropIns) > 0 {
+		dir, err := obj.unitDir()
+		if err != nil {
+			return err
+		}
+		files = append(files, path.Join(dir, obj.unit()), path.Join(dir, obj.unit()+".d/"))
+	}
+	return watchUnit(obj, processChan, obj.User, obj.unit(), files...)
+}
+
+// watchUnit watches the state of the systemd unit, and the files, if any. It
+// is the Watch of the resources which manage a unit. The unit is one of the
+// user session manager if user is true.
+func watchUnit(obj Res, processChan chan *event.Event, user bool, svc string, files ...string) error {
 	if !systemdUtil.IsRunningSystemd() {
 		return fmt.Errorf("Systemd is not running.")
 	}
 
-	conn, err := systemd.NewSystemdConnection() // needs root access
+	var conn *systemd.Conn
+	var bus *dbus.Conn
+	var err error
+	if user {
+		conn, err = systemd.NewUserConnection()
+	} else {
+		conn, err = systemd.NewSystemdConnection() // needs root access
+	}
 	if err != nil {
 		return errwrap.Wrapf(err, "Failed to connect to systemd")
 	}
 	defer conn.Close()
 
 	// if we share the bus with others, we will get each others messages!!
-	bus, err := util.SystemBusPrivateUsable() // don't share the bus connection!
+	if user {
+		bus, err = util.SessionBusPrivateUsable() // don't share the bus connection!
+	} else {
+		bus, err = util.SystemBusPrivateUsable() // don't share the bus connection!
+	}
 	if err != nil {
 		return errwrap.Wrapf(err, "Failed to connect to bus")
 	}
@@ -104,13 +233,19 @@ func (obj *SvcRes) Watch(processChan chan *event.Event) error {
 	buschan := make(chan *dbus.Signal, 10)
 	bus.Signal(buschan)
 
+	// the files, such as the unit files which the resource manages
+	watcher, err := newMultiWatcher(files...)
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
 	// notify engine that we're running
 	if err := obj.Running(processChan); err != nil {
 		return err // bubble up a NACK...
 	}
 
-	var svc = fmt.Sprintf("%s.service", obj.Name) // systemd name
-	var send = false                              // send event?
+	var send = false // send event?
 	var exit *error
 	var invalid = false              // does the svc exist or not?
 	var previous bool                // previous invalid value
@@ -157,6 +292,13 @@ func (obj *SvcRes) Watch(processChan chan *event.Event) error {
 				// loop so that we can see the changed invalid signal
 				log.Printf("Svc[%s]->DaemonReload()", svc)
 
+			case err := <-watcher.Events():
+				if err != nil {
+					return errwrap.Wrapf(err, "Unknown %s[%s] watcher error", obj.Kind(), obj.GetName())
+				}
+				send = true
+				obj.StateOK(false) // dirty
+
 			case event := <-obj.Events():
 				if exit, send = obj.ReadEvent(event); exit != nil {
 					return *exit // exit
@@ -184,8 +326,8 @@ func (obj *SvcRes) Watch(processChan chan *event.Event) error {
 						log.Printf("Svc[%s]->Stopped", svc)
 					case "reloading":
 						log.Printf("Svc[%s]->Reloading", svc)
-					default:
-						log.Fatalf("Unknown svc state: %s", event[svc].ActiveState)
+					default: // such as failed, or activating
+						log.Printf("Svc[%s]->%s", svc, event[svc].ActiveState)
 					}
 				} else {
 					// svc stopped (and ActiveState is nil...)
@@ -197,6 +339,13 @@ func (obj *SvcRes) Watch(processChan chan *event.Event) error {
 			case err := <-subErrors:
 				return errwrap.Wrapf(err, "Unknown %s[%s] error", obj.Kind(), obj.GetName())
 
+			case err := <-watcher.Events():
+				if err != nil {
+					return errwrap.Wrapf(err, "Unknown %s[%s] watcher error", obj.Kind(), obj.GetName())
+				}
+				send = true
+				obj.StateOK(false) // dirty
+
 			case event := <-obj.Events():
 				if exit, send = obj.ReadEvent(event); exit != nil {
 					return *exit // exit
@@ -218,13 +367,43 @@ func (obj *SvcRes) CheckApply(apply bool) (checkOK bool, err error) {
 		return false, fmt.Errorf("Systemd is not running.")
 	}
 
-	conn, err := systemd.NewSystemdConnection() // needs root access
+	conn, err := obj.connect()
 	if err != nil {
 		return false, errwrap.Wrapf(err, "Failed to connect to systemd")
 	}
 	defer conn.Close()
 
-	var svc = fmt.Sprintf("%s.service", obj.Name) // systemd name
+	var svc = obj.unit() // systemd name
+
+	// the unit file and the drop-ins come first, since they define the unit
+	files, err := obj.files()
+	if err != nil {
+		return false, err
+	}
+	changed, err := unitFilesChanged(files) // the files which aren't right
+	if err != nil {
+		return false, err
+	}
+	if len(changed) > 0 {
+		if !apply {
+			unitFileChanges(obj, files, changed)
+			// a missing unit can't be checked until its file is written
+			if obj.Content != "" {
+				dir, _ := obj.unitDir() // it worked for the files
+				if _, err := os.Stat(path.Join(dir, svc)); os.IsNotExist(err) {
+					return false, nil
+				}
+			}
+		} else {
+			log.Printf("%s[%s]: Writing unit files", obj.Kind(), obj.GetName())
+			if err := writeUnitFiles(files, changed); err != nil {
+				return false, err
+			}
+			if err := conn.Reload(); err != nil { // load the changed units
+				return false, errwrap.Wrapf(err, "Failed to reload systemd")
+			}
+		}
+	}
 
 	loadstate, err := conn.GetUnitProperty(svc, "LoadState")
 	if err != nil {
@@ -237,46 +416,94 @@ func (obj *SvcRes) CheckApply(apply bool) (checkOK bool, err error) {
 		return false, errwrap.Wrapf(err, "Failed to find svc: %s", svc)
 	}
 
-	// XXX: check svc "enabled at boot" or not status...
-
 	//conn.GetUnitProperties(svc)
 	activestate, err := conn.GetUnitProperty(svc, "ActiveState")
 	if err != nil {
 		return false, errwrap.Wrapf(err, "Failed to get active state")
 	}
+	unitfilestate, err := conn.GetUnitProperty(svc, "UnitFileState")
+	if err != nil {
+		return false, errwrap.Wrapf(err, "Failed to get unit file state")
+	}
 
 	var running = (activestate.Value == dbus.MakeVariant("active"))
+	var unitFileState, _ = unitfilestate.Value.Value().(string)
+	var enabled, masked = svcStartup(unitFileState)
 	var stateOK = ((obj.State == "") || (obj.State == "running" && running) || (obj.State == "stopped" && !running))
-	var startupOK = true        // XXX: DETECT AND SET
+	var startupOK = ((obj.Startup == "") || (obj.Startup == "enabled" && enabled) || (obj.Startup == "disabled" && !enabled) || (obj.Startup == "masked" && masked))
 	var refresh = obj.Refresh() // do we have a pending reload to apply?
+	// the changed files of a running unit are applied with a restart
+	var filesChanged = len(changed) > 0 && running && (obj.State == "" || obj.State == "running")
+	if filesChanged {
+		refresh = true
+	}
+	var action = obj.refreshAction(filesChanged)
 
-	if stateOK && startupOK && !refresh {
+	if stateOK && startupOK && !refresh && len(changed) == 0 {
 		return true, nil // we are in the correct state
 	}
 
 	// state is not okay, no work done, exit, but without error
 	if !apply {
+		if !stateOK {
+			var current = "stopped"
+			if running {
+				current = "running"
+			}
+			obj.AddChange(&Change{Property: "state", Old: current, New: obj.State})
+		}
+		if !startupOK {
+			var current = "disabled"
+			if enabled {
+				current = "enabled"
+			} else if masked {
+				current = "masked"
+			}
+			obj.AddChange(&Change{Property: "startup", Old: current, New: obj.Startup})
+		}
+		// the engine reports a pending refresh itself, since it doesn't
+		// run CheckApply for it under noop, so only the restart that the
+		// changed files need is reported here
+		if filesChanged {
+			obj.AddChange(&Change{Property: "refresh", New: action})
+		}
 		return false, nil
 	}
 
 	// apply portion
 	log.Printf("%s[%s]: Apply", obj.Kind(), obj.GetName())
-	var files = []string{svc} // the svc represented in a list
-	if obj.Startup == "enabled" {
-		_, _, err = conn.EnableUnitFiles(files, false, true)
+	var units = []string{svc} // the svc represented in a list
+	if masked && obj.Startup == "enabled" && !startupOK {
+		if _, err := conn.UnmaskUnitFiles(units, false); err != nil {
+			return false, errwrap.Wrapf(err, "Unable to unmask unit")
+		}
+	}
+	if obj.Startup == "enabled" && !startupOK {
+		_, _, err = conn.EnableUnitFiles(units, false, true)
+
+	} else if obj.Startup == "disabled" && !startupOK {
+		_, err = conn.DisableUnitFiles(units, false)
 
-	} else if obj.Startup == "disabled" {
-		_, err = conn.DisableUnitFiles(files, false)
+	} else if obj.Startup == "masked" && !startupOK {
+		_, err = conn.MaskUnitFiles(units, false, false)
 	}
 
 	if err != nil {
 		return false, errwrap.Wrapf(err, "Unable to change startup status")
 	}
 
+	if !startupOK { // like systemctl does after changing the symlinks
+		if err := conn.Reload(); err != nil {
+			return false, errwrap.Wrapf(err, "Failed to reload systemd")
+		}
+	}
+
 	// XXX: do we need to use a buffered channel here?
 	result := make(chan string, 1) // catch result information
 
-	if obj.State == "running" {
+	if stateOK {
+		// nothing to start or to stop
+	} else if obj.State == "running" {
 		_, err = conn.StartUnit(svc, "fail", result)
 		if err != nil {
 			return false, errwrap.Wrapf(err, "Failed to start unit")
@@ -296,24 +523,58 @@ func (obj *SvcRes) CheckApply(apply bool) (checkOK bool, err error) {
 		refresh = false // we did a stop, so a reload is not needed
 	}
 
-	status := <-result
-	if &status == nil {
-		return false, fmt.Errorf("Systemd service action result is nil")
-	}
-	if status != "done" {
-		return false, fmt.Errorf("Unknown systemd return string: %v", status)
+	if !stateOK {
+		status := <-result
+		if &status == nil {
+			return false, fmt.Errorf("Systemd service action result is nil")
+		}
+		if status != "done" {
+			return false, fmt.Errorf("Unknown systemd return string: %v", status)
+		}
 	}
 
-	if refresh { // we need to reload the service
-		// XXX: run a svc reload here!
-		log.Printf("%s[%s]: Reloading...", obj.Kind(), obj.GetName())
-	}
+	if refresh && !running { // there is nothing to reload
+		log.Printf("%s[%s]: Skipping reload, since it's not running", obj.Kind(), obj.GetName())
 
-	// XXX: also set enabled on boot
+	} else if refresh { // we need to reload the service
+		log.Printf("%s[%s]: Refreshing with %s...", obj.Kind(), obj.GetName(), action)
+		switch action {
+		case "restart":
+			_, err = conn.RestartUnit(svc, "fail", result)
+		case "reload-or-restart":
+			_, err = conn.ReloadOrRestartUnit(svc, "fail", result)
+		default:
+			_, err = conn.ReloadUnit(svc, "fail", result)
+		}
+		if err != nil {
+			return false, errwrap.Wrapf(err, "Failed to %s unit", action)
+		}
+		if status := <-result; status != "done" {
+			return false, fmt.Errorf("Unknown systemd return string: %v", status)
+		}
+	}
 
 	return false, nil // success
 }
 
+// onRefresh returns what happens to a running unit when it gets a refresh.
+func (obj *SvcRes) onRefresh() string {
+	if obj.OnRefresh == "" {
+		return "reload"
+	}
+	return obj.OnRefresh
+}
+
+// refreshAction returns what happens to the running unit when it's refreshed.
+// A reload doesn't pick up the changes to the unit file or to the drop-ins, so
+// the unit is restarted when they changed, whatever the onrefresh action is.
+func (obj *SvcRes) refreshAction(filesChanged bool) string {
+	if filesChanged {
+		return "restart"
+	}
+	return obj.onRefresh()
+}
+
 // SvcUID is the UID struct for SvcRes.
 type SvcUID struct {
 	// NOTE: there is also a name variable in the BaseUID struct, this is
@@ -376,8 +637,17 @@ func (obj *SvcResAutoEdges) Test(input []bool) bool {
 func (obj *SvcRes) AutoEdges() AutoEdge {
 	var data []ResUID
 	svcFiles := []string{
-		fmt.Sprintf("/etc/systemd/system/%s.service", obj.Name),     // takes precedence
-		fmt.Sprintf("/usr/lib/systemd/system/%s.service", obj.Name), // pkg default
+		fmt.Sprintf("/etc/systemd/system/%s", obj.unit()),     // takes precedence
+		fmt.Sprintf("/usr/lib/systemd/system/%s", obj.unit()), // pkg default
+	}
+	if obj.User {
+		svcFiles = []string{
+			fmt.Sprintf("/etc/systemd/user/%s", obj.unit()),     // takes precedence
+			fmt.Sprintf("/usr/lib/systemd/user/%s", obj.unit()), // pkg default
+		}
+		if dir, err := obj.unitDir(); err == nil { // the user's own
+			svcFiles = append([]string{path.Join(dir, obj.unit())}, svcFiles...)
+		}
 	}
 	for _, x := range svcFiles {
 		var reversed = true
@@ -402,7 +672,7 @@ func (obj *SvcRes) AutoEdges() AutoEdge {
 func (obj *SvcRes) UIDs() []ResUID {
 	x := &SvcUID{
 		BaseUID: BaseUID{name: obj.GetName(), kind: obj.Kind()},
-		name:    obj.Name, // svc name
+		name:    strings.TrimSuffix(obj.unit(), ".service"), // svc name
 	}
 	return []ResUID{x}
 }
@@ -437,12 +707,48 @@ func (obj *SvcRes) Compare(res Res) bool {
 		if obj.Startup != res.Startup {
 			return false
 		}
+		if obj.User != res.User {
+			return false
+		}
+		if obj.Content != res.Content {
+			return false
+		}
+		if !util.StrMapEq(obj.DropIns, res.DropIns) {
+			return false
+		}
+		if obj.onRefresh() != res.onRefresh() {
+			return false
+		}
 	default:
 		return false
 	}
 	return true
 }
 
+// Reversed returns a resource which stops the service if this one has it
+// running, and which disables it if this one has it enabled. The state from
+// before this resource isn't known, so this happens even if the service was
+// already running or enabled.
+func (obj *SvcRes) Reversed() (Res, error) {
+	res := &SvcRes{
+		BaseRes: BaseRes{
+			Name:       obj.Name,
+			MetaParams: DefaultMetaParams,
+		},
+		User: obj.User,
+	}
+	if obj.State == "running" {
+		res.State = "stopped"
+	}
+	if obj.Startup == "enabled" {
+		res.Startup = "disabled"
+	}
+	if res.State == "" && res.Startup == "" {
+		return nil, nil // nothing to undo
+	}
+	return res, nil
+}
+
 // UnmarshalYAML is the custom unmarshal handler for this struct.
 // It is primarily useful for setting the defaults.
 func (obj *SvcRes) UnmarshalYAML(unmarshal func(interface{}) error) error {
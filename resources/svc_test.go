@@ -0,0 +1,167 @@
+// Mgmt
+// Copyright (C) 2013-2016+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package resources
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestSvcFiles1(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mgmt-svc-")
+	if err != nil {
+		t.Fatalf("Can't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	old := svcUnitDir
+	svcUnitDir = dir
+	defer func() { svcUnitDir = old }()
+
+	// a drop-in which we wrote earlier, and one which isn't ours
+	dropins := path.Join(dir, "web.service.d")
+	if err := os.MkdirAll(dropins, 0755); err != nil {
+		t.Fatalf("Can't create %s: %v", dropins, err)
+	}
+	for name, content := range map[string]string{"old.conf": unitHeader, "local.conf": "[Service]\n"} {
+		if err := ioutil.WriteFile(path.Join(dropins, name), []byte(content), 0644); err != nil {
+			t.Fatalf("Can't write %s: %v", name, err)
+		}
+	}
+
+	obj, _ := NewSvcRes("web", "running", "enabled")
+	obj.Content = "[Service]\nExecStart=/usr/bin/web"
+	obj.DropIns = map[string]string{"limits": "[Service]\nLimitNOFILE=4096\n"}
+	if err := obj.Validate(); err != nil {
+		t.Fatalf("Validate failed: %v", err)
+	}
+	files, err := obj.files()
+	if err != nil {
+		t.Fatalf("Files failed: %v", err)
+	}
+	if s := files[path.Join(dir, "web.service")]; s != unitHeader+"[Service]\nExecStart=/usr/bin/web\n" {
+		t.Errorf("Wrong unit file:\n%s", s)
+	}
+	if s := files[path.Join(dropins, "limits.conf")]; s != unitHeader+"[Service]\nLimitNOFILE=4096\n" {
+		t.Errorf("Wrong drop-in:\n%s", s)
+	}
+	if s, exists := files[path.Join(dropins, "old.conf")]; !exists || s != "" {
+		t.Errorf("Our old drop-in should be removed: %q", s)
+	}
+
+	// without content, the drop-ins of the unit are still managed
+	other, _ := NewSvcRes("web", "running", "enabled")
+	other.DropIns = map[string]string{"local": "[Service]\nNice=10\n"}
+	if files, err := other.files(); err != nil || len(files) != 2 || files[path.Join(dropins, "local.conf")] != unitHeader+"[Service]\nNice=10\n" {
+		t.Errorf("Wrong files: %v, %v", files, err)
+	}
+	other.DropIns = nil
+	if files, err := other.files(); err != nil || len(files) != 2 || files[path.Join(dropins, "old.conf")] != "" {
+		t.Errorf("Wrong files: %v, %v", files, err)
+	}
+
+	changed, err := unitFilesChanged(files)
+	if err != nil {
+		t.Fatalf("Can't check the files: %v", err)
+	}
+	if err := writeUnitFiles(files, changed); err != nil {
+		t.Fatalf("Can't write the files: %v", err)
+	}
+	if _, err := os.Stat(path.Join(dropins, "old.conf")); !os.IsNotExist(err) {
+		t.Errorf("Our old drop-in wasn't removed: %v", err)
+	}
+	if _, err := os.Stat(path.Join(dropins, "local.conf")); err != nil {
+		t.Errorf("The local drop-in was removed: %v", err)
+	}
+	if changed, err := unitFilesChanged(files); err != nil || len(changed) != 0 {
+		t.Errorf("Files still changed: %v, %v", changed, err)
+	}
+}
+
+func TestSvcUser1(t *testing.T) {
+	old := os.Getenv("XDG_CONFIG_HOME")
+	defer os.Setenv("XDG_CONFIG_HOME", old)
+	os.Setenv("XDG_CONFIG_HOME", "/home/james/.config")
+
+	obj, _ := NewSvcRes("backup.timer", "running", "")
+	obj.User = true
+	if dir, err := obj.unitDir(); err != nil || dir != "/home/james/.config/systemd/user" {
+		t.Errorf("Wrong user unit dir: %s, %v", dir, err)
+	}
+	if files, err := obj.files(); err != nil || len(files) != 0 {
+		t.Errorf("Unmanaged files: %v, %v", files, err)
+	}
+
+	for _, f := range []func(*SvcRes){
+		func(obj *SvcRes) { obj.State = "paused" },
+		func(obj *SvcRes) { obj.Startup = "static" },
+		func(obj *SvcRes) { obj.Startup = "masked" },
+		func(obj *SvcRes) { obj.State = "stopped"; obj.Startup = "masked"; obj.Content = "[Service]\n" },
+		func(obj *SvcRes) { obj.DropIns = map[string]string{"": ""} },
+		func(obj *SvcRes) { obj.OnRefresh = "kill" },
+		func(obj *SvcRes) { obj.DropIns = map[string]string{"../x": ""} },
+	} {
+		obj, _ := NewSvcRes("web", "running", "")
+		f(obj)
+		if err := obj.Validate(); err == nil {
+			t.Errorf("Validate should fail: %+v", obj)
+		}
+	}
+}
+
+func TestSvcRefreshAction1(t *testing.T) {
+	for _, x := range []struct {
+		onRefresh    string
+		filesChanged bool
+		action       string
+	}{
+		{"", false, "reload"},
+		{"reload-or-restart", false, "reload-or-restart"},
+		{"", true, "restart"},
+		{"reload", true, "restart"},
+		{"reload-or-restart", true, "restart"},
+	} {
+		obj := &SvcRes{OnRefresh: x.onRefresh}
+		if action := obj.refreshAction(x.filesChanged); action != x.action {
+			t.Errorf("Action for %q with changed files %t: %s, expected: %s", x.onRefresh, x.filesChanged, action, x.action)
+		}
+	}
+}
+
+func TestSvcStartup1(t *testing.T) {
+	for _, x := range []struct {
+		unitFileState   string
+		enabled, masked bool
+	}{
+		{"enabled", true, false},
+		{"enabled-runtime", true, false},
+		{"static", true, false},
+		{"alias", true, false},
+		{"indirect", true, false},
+		{"generated", true, false},
+		{"disabled", false, false},
+		{"masked", false, true},
+		{"masked-runtime", false, true},
+		{"", false, false},
+	} {
+		if enabled, masked := svcStartup(x.unitFileState); enabled != x.enabled || masked != x.masked {
+			t.Errorf("Startup of %q: enabled: %t, masked: %t", x.unitFileState, enabled, masked)
+		}
+	}
+}
@@ -21,6 +21,9 @@ import (
 	"encoding/gob"
 	"fmt"
 	"log"
+	"math"
+	"math/rand"
+	"sync"
 	"time"
 
 	"github.com/purpleidea/mgmt/event"
@@ -31,12 +34,29 @@ func init() {
 	gob.Register(&TimerRes{})
 }
 
-// TimerRes is a timer resource for time based events.
+// TimerRes is a timer resource for time based events. The interval between
+// the ticks is fixed, it grows linearly or exponentially, or the ticks follow a
+// calendar expression. A refresh restarts the schedule.
 type TimerRes struct {
-	BaseRes  `yaml:",inline"`
-	Interval uint32 `yaml:"interval"` // Interval : Interval between runs
+	BaseRes   `yaml:",inline"`
+	Interval  uint32  `yaml:"interval"`  // Interval : Interval between runs
+	Algorithm string  `yaml:"algorithm"` // fixed (the default), linear, exponential or calendar
+	Increment uint32  `yaml:"increment"` // linear: seconds added to each next interval
+	Factor    float64 `yaml:"factor"`    // exponential: multiplier of each next interval
+	Max       uint32  `yaml:"max"`       // the longest interval in seconds, zero for none
+	Calendar  string  `yaml:"calendar"`  // calendar: an expression such as */15 * * * *
+	Timezone  string  `yaml:"timezone"`  // calendar: such as UTC, the local time by default
+	Jitter    uint32  `yaml:"jitter"`    // delay each tick randomly by up to this many seconds
+	Align     bool    `yaml:"align"`     // tick at the multiples of the interval since the epoch
 
-	ticker *time.Ticker
+	Next string `yaml:"-"` // the time of the next tick, in RFC 3339, for send/recv
+
+	calendar *Calendar
+	random   *rand.Rand
+	reset    chan struct{} // restarts the schedule
+	mutex    *sync.Mutex   // guards next and tick
+	next     time.Time
+	tick     bool // a tick happened since the last CheckApply
 }
 
 // TimerUID is the UID struct for TimerRes.
@@ -58,30 +78,129 @@ func NewTimerRes(name string, interval uint32) (*TimerRes, error) {
 
 // Default returns some sensible defaults for this resource.
 func (obj *TimerRes) Default() Res {
-	return &TimerRes{}
+	return &TimerRes{
+		Algorithm: "fixed",
+		Factor:    2,
+	}
 }
 
 // Validate the params that are passed to TimerRes.
 func (obj *TimerRes) Validate() error {
+	switch obj.Algorithm {
+	case "", "fixed", "linear":
+	case "exponential":
+		if obj.Factor < 1 {
+			return fmt.Errorf("The factor must be at least 1.")
+		}
+		if obj.Max == 0 {
+			return fmt.Errorf("The exponential algorithm needs a max.")
+		}
+	case "calendar":
+		if _, err := obj.parseCalendar(); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("Unknown algorithm: %s", obj.Algorithm)
+	}
+	if obj.Algorithm != "calendar" && obj.Interval == 0 {
+		return fmt.Errorf("The interval must be positive.")
+	}
+	if obj.Max > 0 && obj.Max < obj.Interval {
+		return fmt.Errorf("The max must be at least the interval.")
+	}
 	return obj.BaseRes.Validate()
 }
 
 // Init runs some startup code for this resource.
 func (obj *TimerRes) Init() error {
+	if obj.Algorithm == "calendar" {
+		calendar, err := obj.parseCalendar()
+		if err != nil {
+			return err
+		}
+		obj.calendar = calendar
+	}
+	// each host picks its own jitter, which spreads the ticks of a cluster
+	obj.random = rand.New(rand.NewSource(time.Now().UnixNano()))
+	obj.reset = make(chan struct{}, 1)
+	obj.mutex = &sync.Mutex{}
 	obj.BaseRes.kind = "Timer"
 	return obj.BaseRes.Init() // call base init, b/c we're overrriding
 }
 
-// newTicker creates a new ticker
-func (obj *TimerRes) newTicker() *time.Ticker {
-	return time.NewTicker(time.Duration(obj.Interval) * time.Second)
+// parseCalendar parses the calendar expression in the timezone.
+func (obj *TimerRes) parseCalendar() (*Calendar, error) {
+	location := time.Local
+	if obj.Timezone != "" {
+		var err error
+		if location, err = time.LoadLocation(obj.Timezone); err != nil {
+			return nil, fmt.Errorf("Unknown timezone: %s", obj.Timezone)
+		}
+	}
+	return ParseCalendar(obj.Calendar, location)
+}
+
+// interval returns the interval before the tick which follows the n previous
+// ticks, without the jitter.
+func (obj *TimerRes) interval(n int) time.Duration {
+	seconds := float64(obj.Interval)
+	switch obj.Algorithm {
+	case "linear":
+		seconds += float64(n) * float64(obj.Increment)
+	case "exponential":
+		seconds *= math.Pow(obj.Factor, float64(n))
+	}
+	if obj.Max > 0 && seconds > float64(obj.Max) {
+		seconds = float64(obj.Max)
+	}
+	if seconds > math.MaxInt32 { // a growing linear interval without a max
+		seconds = math.MaxInt32
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// schedule returns the time of the tick which follows the n previous ticks.
+func (obj *TimerRes) schedule(now time.Time, n int) time.Time {
+	var t time.Time
+	if obj.calendar != nil {
+		if t = obj.calendar.Next(now); t.IsZero() {
+			return t // never
+		}
+	} else if d := obj.interval(n); obj.Align {
+		epoch := time.Unix(0, 0)
+		t = epoch.Add((now.Sub(epoch)/d + 1) * d)
+	} else {
+		t = now.Add(d)
+	}
+	if obj.Jitter > 0 {
+		t = t.Add(time.Duration(obj.random.Int63n(int64(obj.Jitter) * int64(time.Second))))
+	}
+	return t
 }
 
 // Watch is the primary listener for this resource and it outputs events.
 func (obj *TimerRes) Watch(processChan chan *event.Event) error {
-	// create a time.Ticker for the given interval
-	obj.ticker = obj.newTicker()
-	defer obj.ticker.Stop()
+	var count = 0 // the number of ticks so far
+	timer := time.NewTimer(time.Duration(math.MaxInt64))
+	defer timer.Stop()
+	schedule := func() { // starts the timer for the next tick
+		next := obj.schedule(time.Now(), count)
+		obj.mutex.Lock()
+		obj.next = next
+		obj.mutex.Unlock()
+		if !timer.Stop() {
+			select {
+			case <-timer.C: // drain a tick that we replace
+			default:
+			}
+		}
+		if next.IsZero() {
+			log.Printf("%s[%s]: no next tick", obj.Kind(), obj.GetName())
+			return
+		}
+		timer.Reset(next.Sub(time.Now()))
+	}
+	schedule()
 
 	// notify engine that we're running
 	if err := obj.Running(processChan); err != nil {
@@ -92,9 +211,19 @@ func (obj *TimerRes) Watch(processChan chan *event.Event) error {
 
 	for {
 		select {
-		case <-obj.ticker.C: // received the timer event
+		case <-timer.C: // received the timer event
 			send = true
 			log.Printf("%s[%s]: received tick", obj.Kind(), obj.GetName())
+			count++
+			schedule()
+			obj.mutex.Lock()
+			obj.tick = true
+			obj.mutex.Unlock()
+			obj.StateOK(false) // dirty
+
+		case <-obj.reset:
+			count = 0
+			schedule()
 
 		case event := <-obj.Events():
 			if exit, _ := obj.ReadEvent(event); exit != nil {
@@ -109,19 +238,38 @@ func (obj *TimerRes) Watch(processChan chan *event.Event) error {
 	}
 }
 
-// CheckApply method for Timer resource. Triggers a timer reset on notify.
+// CheckApply method for Timer resource. A tick is a change, so that it notifies
+// the resources on the notifying edges. Triggers a timer reset on notify.
 func (obj *TimerRes) CheckApply(apply bool) (bool, error) {
+	obj.mutex.Lock()
+	defer obj.mutex.Unlock()
+	if !obj.next.IsZero() {
+		obj.Next = obj.next.Format(time.RFC3339) // for send/recv
+	}
+
 	// because there are no checks to run, this resource has a less
 	// traditional pattern than what is seen in most resources...
-	if !obj.Refresh() { // this works for apply || !apply
-		return true, nil // state is always okay if no refresh to do
-	} else if !apply { // we had a refresh to do
+	var refresh = obj.Refresh()
+	if !obj.tick && !refresh { // this works for apply || !apply
+		return true, nil // state is always okay if no tick or refresh
+	} else if !apply { // we had a tick or a refresh to do
+		if obj.tick {
+			obj.AddChange(&Change{Property: "tick", New: "pending"})
+		}
+		if refresh {
+			obj.AddChange(&Change{Property: "refresh", New: "reset"})
+		}
 		return false, nil // therefore state is wrong
 	}
+	obj.tick = false
 
 	// reset the timer since apply && refresh
-	obj.ticker.Stop()
-	obj.ticker = obj.newTicker()
+	if refresh {
+		select {
+		case obj.reset <- struct{}{}:
+		default: // a reset is already pending
+		}
+	}
 	return false, nil
 }
 
@@ -157,6 +305,18 @@ func (obj *TimerRes) Compare(res Res) bool {
 		if obj.Interval != res.Interval {
 			return false
 		}
+		if obj.Algorithm != res.Algorithm {
+			return false
+		}
+		if obj.Increment != res.Increment || obj.Factor != res.Factor || obj.Max != res.Max {
+			return false
+		}
+		if obj.Calendar != res.Calendar || obj.Timezone != res.Timezone {
+			return false
+		}
+		if obj.Jitter != res.Jitter || obj.Align != res.Align {
+			return false
+		}
 	default:
 		return false
 	}
@@ -0,0 +1,103 @@
+// Mgmt
+// Copyright (C) 2013-2016+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package resources
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCalendar1(t *testing.T) {
+	// a wednesday
+	now := time.Date(2017, time.March, 1, 10, 7, 30, 0, time.UTC)
+	tests := []struct {
+		expr string
+		next string
+	}{
+		{"* * * * *", "2017-03-01T10:08:00Z"},
+		{"*/15 * * * *", "2017-03-01T10:15:00Z"},
+		{"5,50 9-17 * * *", "2017-03-01T10:50:00Z"},
+		{"@daily", "2017-03-02T00:00:00Z"},
+		{"0 22 * * mon-fri", "2017-03-01T22:00:00Z"},
+		{"0 0 * * 7", "2017-03-05T00:00:00Z"}, // sunday
+		{"0 0 1 jan *", "2018-01-01T00:00:00Z"},
+		{"0 0 13 * fri", "2017-03-03T00:00:00Z"}, // either of the days
+		{"0 12 29 2 *", "2020-02-29T12:00:00Z"},
+	}
+	for _, x := range tests {
+		c, err := ParseCalendar(x.expr, time.UTC)
+		if err != nil {
+			t.Errorf("ParseCalendar(%q) failed: %v", x.expr, err)
+			continue
+		}
+		if next := c.Next(now).Format(time.RFC3339); next != x.next {
+			t.Errorf("Next(%q) = %s, expected: %s", x.expr, next, x.next)
+		}
+	}
+
+	c, _ := ParseCalendar("0 0 30 2 *", time.UTC)
+	if next := c.Next(now); !next.IsZero() {
+		t.Errorf("Next of an impossible date = %v", next)
+	}
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* * 0 * *", "5-1 * * * *", "*/0 * * * *", "* * * foo *"} {
+		if _, err := ParseCalendar(expr, time.UTC); err == nil {
+			t.Errorf("ParseCalendar(%q) should have failed", expr)
+		}
+	}
+}
+
+func TestTimerSchedule1(t *testing.T) {
+	now := time.Date(2017, time.March, 1, 10, 7, 30, 0, time.UTC)
+	tests := []struct {
+		timer *TimerRes
+		n     int
+		next  string
+	}{
+		{&TimerRes{Interval: 60}, 5, "2017-03-01T10:08:30Z"},
+		{&TimerRes{Interval: 60, Align: true}, 0, "2017-03-01T10:08:00Z"},
+		{&TimerRes{Interval: 60, Algorithm: "linear", Increment: 30}, 2, "2017-03-01T10:09:30Z"},
+		{&TimerRes{Interval: 60, Algorithm: "linear", Increment: 30, Max: 90}, 2, "2017-03-01T10:09:00Z"},
+		{&TimerRes{Interval: 10, Algorithm: "exponential", Factor: 2, Max: 3600}, 3, "2017-03-01T10:08:50Z"},
+		{&TimerRes{Interval: 10, Algorithm: "exponential", Factor: 2, Max: 3600}, 100, "2017-03-01T11:07:30Z"},
+		{&TimerRes{Algorithm: "calendar", Calendar: "0 * * * *", Timezone: "UTC"}, 0, "2017-03-01T11:00:00Z"},
+	}
+	for i, x := range tests {
+		x.timer.MetaParams = DefaultMetaParams
+		if err := x.timer.Validate(); err != nil {
+			t.Errorf("Test %d: Validate failed: %v", i, err)
+			continue
+		}
+		x.timer.Init()
+		if next := x.timer.schedule(now, x.n).UTC().Format(time.RFC3339); next != x.next {
+			t.Errorf("Test %d: schedule = %s, expected: %s", i, next, x.next)
+		}
+	}
+
+	timer := &TimerRes{Interval: 60, Jitter: 30}
+	timer.Init()
+	for i := 0; i < 10; i++ {
+		if d := timer.schedule(now, 0).Sub(now); d < time.Minute || d >= 90*time.Second {
+			t.Errorf("The jitter is out of range: %v", d)
+		}
+	}
+	timer = &TimerRes{Interval: 10, Algorithm: "exponential", Factor: 2}
+	timer.MetaParams = DefaultMetaParams
+	if err := timer.Validate(); err == nil {
+		t.Errorf("An exponential timer without a max was allowed")
+	}
+}
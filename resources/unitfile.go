@@ -0,0 +1,84 @@
+// Mgmt
+// Copyright (C) 2013-2016+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package resources
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	errwrap "github.com/pkg/errors"
+)
+
+// unitHeader starts the unit files that we generate. We never remove the files
+// which don't start with it, since they aren't ours.
+const unitHeader = "# This file is managed by mgmt. Do not edit.\n"
+
+// unitFilesChanged returns the sorted paths of the files which don't have the
+// content that they should. The content is empty for the files which must be
+// absent, and the files which aren't ours are left alone.
+func unitFilesChanged(files map[string]string) ([]string, error) {
+	changed := []string{}
+	for p, content := range files {
+		data, err := ioutil.ReadFile(p)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, errwrap.Wrapf(err, "can't read %s", p)
+		}
+		if err == nil && content == "" && !strings.HasPrefix(string(data), unitHeader) {
+			continue // not one of ours, such as a unit that we activate
+		}
+		if (err == nil) != (content != "") || string(data) != content {
+			changed = append(changed, p)
+		}
+	}
+	sort.Strings(changed)
+	return changed, nil
+}
+
+// writeUnitFiles writes or removes the changed files, and creates the dirs of
+// the ones which are written if needed.
+func writeUnitFiles(files map[string]string, changed []string) error {
+	for _, p := range changed {
+		if files[p] == "" {
+			if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+				return errwrap.Wrapf(err, "can't remove %s", p)
+			}
+			continue
+		}
+		if err := os.MkdirAll(path.Dir(p), 0755); err != nil {
+			return errwrap.Wrapf(err, "can't create %s", path.Dir(p))
+		}
+		if err := ioutil.WriteFile(p, []byte(files[p]), 0644); err != nil {
+			return errwrap.Wrapf(err, "can't write %s", p)
+		}
+	}
+	return nil
+}
+
+// unitFileChanges adds the changed files to the noop report of the resource.
+func unitFileChanges(obj Res, files map[string]string, changed []string) {
+	for _, p := range changed {
+		var action = "update"
+		if files[p] == "" {
+			action = "remove"
+		}
+		obj.AddChange(&Change{Property: path.Base(p), New: action})
+	}
+}
@@ -0,0 +1,56 @@
+// Mgmt
+// Copyright (C) 2013-2016+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package resources
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestUnitFiles1(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mgmt-unit-")
+	if err != nil {
+		t.Fatalf("Can't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	ours, theirs := path.Join(dir, "ours.network"), path.Join(dir, "theirs.network")
+	dropin := path.Join(dir, "ours.network.d", "x.conf")
+	if err := ioutil.WriteFile(ours, []byte(unitHeader+"old\n"), 0644); err != nil {
+		t.Fatalf("Can't write %s: %v", ours, err)
+	}
+	if err := ioutil.WriteFile(theirs, []byte("theirs\n"), 0644); err != nil {
+		t.Fatalf("Can't write %s: %v", theirs, err)
+	}
+
+	files := map[string]string{dropin: unitHeader + "new\n", ours: "", theirs: ""}
+	changed, err := unitFilesChanged(files)
+	if err != nil || len(changed) != 2 || changed[0] != ours || changed[1] != dropin {
+		t.Fatalf("Wrong changed files: %v, %v", changed, err)
+	}
+	if err := writeUnitFiles(files, changed); err != nil {
+		t.Fatalf("Can't write the files: %v", err)
+	}
+	if changed, err := unitFilesChanged(files); err != nil || len(changed) != 0 {
+		t.Errorf("Files still changed: %v, %v", changed, err)
+	}
+	if _, err := os.Stat(theirs); err != nil {
+		t.Errorf("A file which isn't ours was removed: %v", err)
+	}
+}
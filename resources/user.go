@@ -0,0 +1,458 @@
+// Mgmt
+// Copyright (C) 2013-2016+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package resources
+
+import (
+	"encoding/gob"
+	"fmt"
+	"log"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/purpleidea/mgmt/event"
+	"github.com/purpleidea/mgmt/util"
+)
+
+func init() {
+	RegisterResource("user", func() Res { return &UserRes{} })
+	gob.Register(&UserRes{})
+}
+
+// The fields of an entry in /etc/passwd and in /etc/shadow.
+const (
+	passwdUID     = 2
+	passwdGID     = 3
+	passwdComment = 4
+	passwdHomeDir = 5
+	passwdShell   = 6
+	passwdFields  = 7
+
+	shadowPassword = 1
+	shadowFields   = 9
+)
+
+// UserRes is a user resource. It manages the entry of the user in /etc/passwd
+// and in /etc/shadow, and its membership of groups in /etc/group. The name of
+// the resource is the name of the user. The empty params are left as they are,
+// or they get a default when the user is created.
+type UserRes struct {
+	BaseRes `yaml:",inline"`
+	State   string   `yaml:"state"`   // state: exists, absent
+	UID     *uint32  `yaml:"uid"`     // nil picks a free uid on creation
+	Group   string   `yaml:"group"`   // the primary group name or gid
+	Groups  []string `yaml:"groups"`  // the supplementary groups to add the user to
+	HomeDir string   `yaml:"homedir"` // the home dir, which isn't created
+	Shell   string   `yaml:"shell"`   // the login shell
+	Comment string   `yaml:"comment"` // the gecos field
+
+	// HashedPassword is the crypt(3) hash of the password, which goes in
+	// /etc/shadow. If it's empty, new users get a locked password. It's a
+	// secret, so it's left out of the json of the graph.
+	HashedPassword string `yaml:"hashedpassword" json:"-"`
+}
+
+// NewUserRes is a constructor for this resource. It also calls Init() for you.
+func NewUserRes(name, state, group string) (*UserRes, error) {
+	obj := &UserRes{
+		BaseRes: BaseRes{
+			Name: name,
+		},
+		State: state,
+		Group: group,
+	}
+	return obj, obj.Init()
+}
+
+// Default returns some sensible defaults for this resource.
+func (obj *UserRes) Default() Res {
+	return &UserRes{
+		State: "exists",
+	}
+}
+
+// Validate if the params passed in are valid data.
+func (obj *UserRes) Validate() error {
+	if obj.State != "exists" && obj.State != "absent" {
+		return fmt.Errorf("State must be exists or absent.")
+	}
+	if err := validateUserDBName(obj.GetName()); err != nil {
+		return err
+	}
+	for _, x := range append([]string{obj.Group}, obj.Groups...) {
+		if strings.ContainsAny(x, ":,\n") {
+			return fmt.Errorf("Invalid group name: %s", x)
+		}
+	}
+	for _, x := range []string{obj.HomeDir, obj.Shell, obj.Comment, obj.HashedPassword} {
+		if strings.ContainsAny(x, ":\n") {
+			return fmt.Errorf("Params can't contain a colon or a newline.")
+		}
+	}
+	if obj.HomeDir != "" && !path.IsAbs(obj.HomeDir) {
+		return fmt.Errorf("HomeDir must be an absolute path.")
+	}
+	return obj.BaseRes.Validate()
+}
+
+// validateUserDBName checks that the name can be stored in the databases.
+func validateUserDBName(name string) error {
+	if name == "" || strings.ContainsAny(name, ":,\n ") || strings.HasPrefix(name, "-") || strings.HasPrefix(name, "+") {
+		return fmt.Errorf("Invalid name: %s", name)
+	}
+	if _, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return fmt.Errorf("The name can't be a number: %s", name)
+	}
+	return nil
+}
+
+// Init runs some startup code for this resource.
+func (obj *UserRes) Init() error {
+	obj.BaseRes.kind = "User"
+	return obj.BaseRes.Init() // call base init, b/c we're overriding
+}
+
+// Watch is the primary listener for this resource and it outputs events.
+func (obj *UserRes) Watch(processChan chan *event.Event) error {
+	return watchUserDB(obj, processChan)
+}
+
+// CheckApply checks the resource state and applies the resource if the bool
+// input is true. It returns error info and if the state check passed or not.
+func (obj *UserRes) CheckApply(apply bool) (checkOK bool, err error) {
+	if apply { // hold the lock from the read to the write
+		unlock, err := lockUserDB()
+		if err != nil {
+			return false, err
+		}
+		defer unlock()
+	}
+	dbs, err := readUserDBs()
+	if err != nil {
+		return false, err
+	}
+	changed, err := obj.change(dbs)
+	if err != nil {
+		return false, err
+	}
+	if len(changed) == 0 {
+		return true, nil
+	}
+	if !apply {
+		dbs.report(obj)
+		return false, nil
+	}
+	log.Printf("%s[%s]: Apply", obj.Kind(), obj.GetName())
+	return false, dbs.write(changed)
+}
+
+// change makes the changes to the databases, in memory, and returns the set of
+// databases that changed.
+func (obj *UserRes) change(dbs *userDBs) (map[*userDB]bool, error) {
+	name := obj.GetName()
+	changed := make(map[*userDB]bool)
+
+	if obj.State == "absent" {
+		changed[dbs.passwd] = dbs.passwd.remove(name)
+		changed[dbs.shadow] = dbs.shadow.remove(name)
+		for _, fields := range dbs.group.entries() {
+			if dbs.group.setMember(fields[0], name, groupMembers, false) {
+				changed[dbs.group] = true
+			}
+			if dbs.gshadow.setMember(fields[0], name, gshadowMembers, false) {
+				changed[dbs.gshadow] = true
+			}
+		}
+		return onlyChanged(changed), nil
+	}
+
+	fields := dbs.passwd.get(name, passwdFields)
+	if fields == nil { // create the user
+		fields = []string{name, "x", "", "", "", path.Join("/home", name), "/bin/sh"}
+		id, err := dbs.passwd.nextID(passwdUID)
+		if err != nil {
+			return nil, err
+		}
+		fields[passwdUID] = strconv.FormatUint(uint64(id), 10)
+	}
+	if obj.UID != nil {
+		uid := strconv.FormatUint(uint64(*obj.UID), 10)
+		if owner, used := dbs.passwd.owner(*obj.UID, passwdUID); used && owner != name {
+			return nil, fmt.Errorf("The uid %s is already used by %s", uid, owner)
+		}
+		fields[passwdUID] = uid
+	}
+	if fields[passwdGID] == "" && obj.Group == "" { // use the group with the same name
+		gid, _, exists := dbs.group.lookupID(name, groupGID)
+		if !exists {
+			var err error
+			if gid, err = createUserGroup(dbs, changed, name, fields[passwdUID]); err != nil {
+				return nil, err
+			}
+		}
+		fields[passwdGID] = strconv.FormatUint(uint64(gid), 10)
+	}
+	if obj.Group != "" {
+		gid, _, exists := dbs.group.lookupID(obj.Group, groupGID)
+		if !exists {
+			return nil, fmt.Errorf("The group %s doesn't exist", obj.Group)
+		}
+		fields[passwdGID] = strconv.FormatUint(uint64(gid), 10)
+	}
+	for field, value := range map[int]string{
+		passwdComment: obj.Comment,
+		passwdHomeDir: obj.HomeDir,
+		passwdShell:   obj.Shell,
+	} {
+		if value != "" {
+			fields[field] = value
+		}
+	}
+	changed[dbs.passwd] = dbs.passwd.set(fields)
+
+	if dbs.shadow.exists {
+		shadow := dbs.shadow.get(name, shadowFields)
+		if shadow == nil { // the password is locked, and never expires
+			days := strconv.FormatInt(time.Now().Unix()/(24*60*60), 10)
+			shadow = []string{name, "!", days, "0", "99999", "7", "", "", ""}
+		}
+		if obj.HashedPassword != "" {
+			shadow[shadowPassword] = obj.HashedPassword
+		}
+		changed[dbs.shadow] = dbs.shadow.set(shadow)
+	}
+
+	// the user is added to its groups, but the other groups are left alone,
+	// since their members might be managed by the group resources
+	for _, x := range obj.Groups {
+		_, group, exists := dbs.group.lookupID(x, groupGID)
+		if !exists {
+			return nil, fmt.Errorf("The group %s doesn't exist", x)
+		}
+		if dbs.group.setMember(group, name, groupMembers, true) {
+			changed[dbs.group] = true
+		}
+		if dbs.gshadow.setMember(group, name, gshadowMembers, true) {
+			changed[dbs.gshadow] = true
+		}
+	}
+	return onlyChanged(changed), nil
+}
+
+// createUserGroup adds the group which has the same name as the user, which is
+// its primary group. Like with useradd, its gid is the uid, unless it's taken.
+func createUserGroup(dbs *userDBs, changed map[*userDB]bool, name, uid string) (uint32, error) {
+	id, err := strconv.ParseUint(uid, 10, 32)
+	if err != nil {
+		return 0, err
+	}
+	gid := uint32(id)
+	if _, used := dbs.group.owner(gid, groupGID); used {
+		if gid, err = dbs.group.nextID(groupGID); err != nil {
+			return 0, err
+		}
+	}
+	changed[dbs.group] = dbs.group.set([]string{name, "x", strconv.FormatUint(uint64(gid), 10), ""})
+	if dbs.gshadow.exists {
+		changed[dbs.gshadow] = dbs.gshadow.set([]string{name, "!", "", ""})
+	}
+	return gid, nil
+}
+
+// Conflicts returns an error if the group resource manages the members of one
+// of the groups of the user, and it doesn't list the user, or if it lists the
+// user which is absent, since the two resources would keep undoing each other.
+func (obj *UserRes) Conflicts(r Res) error {
+	res, ok := r.(*GroupRes)
+	if !ok || res.State != "exists" || res.Members == nil {
+		return nil
+	}
+	name := obj.GetName()
+	member := util.StrInList(name, res.Members)
+	if obj.State == "absent" && member {
+		return fmt.Errorf("The user %s is absent, but the group %s lists it", name, res.GetName())
+	}
+	if obj.State == "absent" || member {
+		return nil
+	}
+	for _, x := range obj.Groups {
+		if res.UIDs()[0].IFF(newGroupUID("", "", x, nil)) {
+			return fmt.Errorf("The user %s is in the group %s, but the group doesn't list it", name, res.GetName())
+		}
+	}
+	return nil
+}
+
+// onlyChanged returns the databases that changed, without the others.
+func onlyChanged(changed map[*userDB]bool) map[*userDB]bool {
+	result := make(map[*userDB]bool)
+	for db, b := range changed {
+		if b {
+			result[db] = true
+		}
+	}
+	return result
+}
+
+// UserUID is the UID struct for UserRes.
+type UserUID struct {
+	BaseUID
+	name string
+	uid  *uint32
+}
+
+// IFF aka if and only if they are equivalent, return true. If not, false. The
+// users match if they have the same name, or if both have the same uid.
+func (obj *UserUID) IFF(uid ResUID) bool {
+	res, ok := uid.(*UserUID)
+	if !ok {
+		return false
+	}
+	if obj.name != "" && obj.name == res.name {
+		return true
+	}
+	return obj.uid != nil && res.uid != nil && *obj.uid == *res.uid
+}
+
+// AutoEdges returns the AutoEdge interface. The groups of the user are created
+// before it.
+func (obj *UserRes) AutoEdges() AutoEdge {
+	if obj.State == "absent" {
+		return nil // the groups can go away before or after us
+	}
+	group := obj.Group
+	if group == "" {
+		group = obj.GetName() // the default primary group
+	}
+	var data []ResUID
+	for _, x := range append([]string{group}, obj.Groups...) {
+		var reversed = true // the group happens before us
+		data = append(data, newGroupUID(obj.GetName(), obj.Kind(), x, &reversed))
+	}
+	return &BatchAutoEdges{
+		data: data,
+	}
+}
+
+// newUserUID returns the UID which matches the user resource for the user name
+// or uid, such as the owner of a file.
+func newUserUID(name, kind, user string, reversed *bool) *UserUID {
+	x := &UserUID{
+		BaseUID: BaseUID{
+			name:     name,
+			kind:     kind,
+			reversed: reversed,
+		},
+	}
+	if id, err := strconv.ParseUint(user, 10, 32); err == nil {
+		uid := uint32(id)
+		x.uid = &uid
+	} else {
+		x.name = user
+	}
+	return x
+}
+
+// UIDs includes all params to make a unique identification of this object.
+// Most resources only return one, although some resources can return multiple.
+func (obj *UserRes) UIDs() []ResUID {
+	x := &UserUID{
+		BaseUID: BaseUID{name: obj.GetName(), kind: obj.Kind()},
+		name:    obj.GetName(),
+		uid:     obj.UID,
+	}
+	return []ResUID{x}
+}
+
+// GroupCmp returns whether two resources can be grouped together or not.
+func (obj *UserRes) GroupCmp(r Res) bool {
+	_, ok := r.(*UserRes)
+	if !ok {
+		return false
+	}
+	return false // TODO: this could save some reads and writes
+}
+
+// Compare two resources and return if they are equivalent.
+func (obj *UserRes) Compare(res Res) bool {
+	switch res.(type) {
+	case *UserRes:
+		res := res.(*UserRes)
+		if !obj.BaseRes.Compare(res) { // call base Compare
+			return false
+		}
+
+		if obj.Name != res.Name {
+			return false
+		}
+		if obj.State != res.State {
+			return false
+		}
+		if (obj.UID == nil) != (res.UID == nil) {
+			return false
+		}
+		if obj.UID != nil && *obj.UID != *res.UID {
+			return false
+		}
+		if obj.Group != res.Group {
+			return false
+		}
+		if (obj.Groups == nil) != (res.Groups == nil) {
+			return false
+		}
+		if !util.StrSetEq(obj.Groups, res.Groups) {
+			return false
+		}
+		if obj.HomeDir != res.HomeDir {
+			return false
+		}
+		if obj.Shell != res.Shell {
+			return false
+		}
+		if obj.Comment != res.Comment {
+			return false
+		}
+		if obj.HashedPassword != res.HashedPassword {
+			return false
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// UnmarshalYAML is the custom unmarshal handler for this struct.
+// It is primarily useful for setting the defaults.
+func (obj *UserRes) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type rawRes UserRes // indirection to avoid infinite recursion
+
+	def := obj.Default()      // get the default
+	res, ok := def.(*UserRes) // put in the right format
+	if !ok {
+		return fmt.Errorf("could not convert to UserRes")
+	}
+	raw := rawRes(*res) // convert; the defaults go here
+
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+
+	*obj = UserRes(raw) // restore from indirection with type conversion!
+	return nil
+}
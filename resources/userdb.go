@@ -0,0 +1,378 @@
+// Mgmt
+// Copyright (C) 2013-2016+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package resources
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/purpleidea/mgmt/event"
+
+	errwrap "github.com/pkg/errors"
+)
+
+// These are the local user and group databases which the user and the group
+// resources manage. The shadow ones are optional, and are skipped if missing.
+var (
+	userDBPasswd  = "/etc/passwd"
+	userDBShadow  = "/etc/shadow"
+	userDBGroup   = "/etc/group"
+	userDBGshadow = "/etc/gshadow"
+	userDBLock    = "/etc/.pwd.lock" // the same lock as lckpwdf(3) uses
+)
+
+// The ids which are picked for new users and groups are at least this big.
+const (
+	userDBMinID = 1000
+	userDBMaxID = 60000
+)
+
+// userDB is one of the colon separated databases, such as /etc/passwd. The
+// lines which aren't entries, such as comments, are kept as they are.
+type userDB struct {
+	path   string
+	exists bool
+	lines  []string
+	mode   os.FileMode
+	uid    int
+	gid    int
+
+	changes []*Change // what changed, for the noop report
+}
+
+// readUserDB reads the database. If it's missing, it is empty and not exists.
+func readUserDB(p string) (*userDB, error) {
+	db := &userDB{path: p, mode: 0644}
+	fi, err := os.Stat(p)
+	if os.IsNotExist(err) {
+		return db, nil
+	} else if err != nil {
+		return nil, errwrap.Wrapf(err, "can't stat %s", p)
+	}
+	db.exists = true
+	db.mode = fi.Mode()
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		db.uid, db.gid = int(st.Uid), int(st.Gid)
+	}
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, errwrap.Wrapf(err, "can't read %s", p)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line != "" {
+			db.lines = append(db.lines, line)
+		}
+	}
+	return db, nil
+}
+
+// isEntry returns true if the line is an entry, and not a comment for example.
+func isEntry(line string) bool {
+	return line != "" && !strings.HasPrefix(line, "#") && !strings.HasPrefix(line, "+") && !strings.HasPrefix(line, "-")
+}
+
+// find returns the index of the line for the named entry, or -1 if it's absent.
+func (obj *userDB) find(name string) int {
+	for i, line := range obj.lines {
+		if isEntry(line) && strings.SplitN(line, ":", 2)[0] == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// get returns the fields of the named entry, padded to at least n of them, or
+// nil if the entry is absent.
+func (obj *userDB) get(name string, n int) []string {
+	i := obj.find(name)
+	if i < 0 {
+		return nil
+	}
+	fields := strings.Split(obj.lines[i], ":")
+	for len(fields) < n {
+		fields = append(fields, "")
+	}
+	return fields
+}
+
+// entries returns the fields of every entry in the database.
+func (obj *userDB) entries() [][]string {
+	result := [][]string{}
+	for _, line := range obj.lines {
+		if isEntry(line) {
+			result = append(result, strings.Split(line, ":"))
+		}
+	}
+	return result
+}
+
+// set adds or replaces the entry which is named by the first field. It returns
+// true if this changed the database.
+func (obj *userDB) set(fields []string) bool {
+	line := strings.Join(fields, ":")
+	i := obj.find(fields[0])
+	if i < 0 {
+		obj.lines = append(obj.lines, line)
+		obj.change("", line)
+		return true
+	}
+	if obj.lines[i] == line {
+		return false
+	}
+	obj.change(obj.lines[i], line)
+	obj.lines[i] = line
+	return true
+}
+
+// remove removes the named entry. It returns true if this changed the database.
+func (obj *userDB) remove(name string) bool {
+	i := obj.find(name)
+	if i < 0 {
+		return false
+	}
+	obj.change(obj.lines[i], "")
+	obj.lines = append(obj.lines[:i], obj.lines[i+1:]...)
+	return true
+}
+
+// change records a changed line. The lines of the shadow databases aren't
+// shown, since they contain the password hashes.
+func (obj *userDB) change(before, after string) {
+	name := path.Base(obj.path)
+	if strings.HasSuffix(name, "shadow") {
+		before, after = "", ""
+	}
+	obj.changes = append(obj.changes, &Change{Property: name, Old: before, New: after})
+}
+
+// lookupID returns the id in the field of the entry which has the name or id,
+// and the name of that entry. The bool is false if there is no such entry.
+func (obj *userDB) lookupID(nameOrID string, field int) (uint32, string, bool) {
+	for _, fields := range obj.entries() {
+		if len(fields) <= field {
+			continue
+		}
+		id, err := strconv.ParseUint(fields[field], 10, 32)
+		if err != nil {
+			continue
+		}
+		if fields[0] == nameOrID || fields[field] == nameOrID {
+			return uint32(id), fields[0], true
+		}
+	}
+	return 0, "", false
+}
+
+// owner returns the name of the entry which uses the id in the field, if any.
+func (obj *userDB) owner(id uint32, field int) (string, bool) {
+	for _, fields := range obj.entries() {
+		if len(fields) > field && fields[field] == strconv.FormatUint(uint64(id), 10) {
+			return fields[0], true
+		}
+	}
+	return "", false
+}
+
+// nextID returns the smallest id which isn't used yet in the field.
+func (obj *userDB) nextID(field int) (uint32, error) {
+	for id := uint32(userDBMinID); id <= userDBMaxID; id++ {
+		if _, used := obj.owner(id, field); !used {
+			return id, nil
+		}
+	}
+	return 0, fmt.Errorf("No free id left in %s", obj.path)
+}
+
+// write replaces the database atomically, and keeps its mode and its owner.
+func (obj *userDB) write() error {
+	tmp := obj.path + "+" // the same name that the shadow utils use
+	data := strings.Join(obj.lines, "\n") + "\n"
+	if err := ioutil.WriteFile(tmp, []byte(data), obj.mode); err != nil {
+		return errwrap.Wrapf(err, "can't write %s", tmp)
+	}
+	if err := os.Chmod(tmp, obj.mode); err != nil { // in case of a umask
+		os.Remove(tmp)
+		return errwrap.Wrapf(err, "can't chmod %s", tmp)
+	}
+	if obj.exists {
+		if err := os.Chown(tmp, obj.uid, obj.gid); err != nil {
+			os.Remove(tmp)
+			return errwrap.Wrapf(err, "can't chown %s", tmp)
+		}
+	}
+	if err := os.Rename(tmp, obj.path); err != nil {
+		os.Remove(tmp)
+		return errwrap.Wrapf(err, "can't replace %s", obj.path)
+	}
+	obj.exists = true
+	return nil
+}
+
+// setMember adds the user to the member list in the field of the entry, or it
+// removes it from there. It returns true if this changed the database.
+func (obj *userDB) setMember(group, user string, field int, member bool) bool {
+	fields := obj.get(group, field+1)
+	if fields == nil {
+		return false
+	}
+	members := []string{}
+	found := false
+	for _, x := range strings.Split(fields[field], ",") {
+		if x == "" {
+			continue
+		}
+		if x == user {
+			found = true
+			if !member {
+				continue // remove it
+			}
+		}
+		members = append(members, x)
+	}
+	if found == member {
+		return false // nothing to do
+	}
+	if member {
+		members = append(members, user)
+	}
+	fields[field] = strings.Join(members, ",")
+	return obj.set(fields)
+}
+
+// userDBMutex serializes the changes that the resources of this process make.
+var userDBMutex = &sync.Mutex{}
+
+// lockUserDB takes the lock which guards the databases against other writers,
+// such as useradd, and returns the function which releases it.
+func lockUserDB() (func(), error) {
+	userDBMutex.Lock()
+	f, err := os.OpenFile(userDBLock, os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		userDBMutex.Unlock()
+		return nil, errwrap.Wrapf(err, "can't open %s", userDBLock)
+	}
+	lock := &syscall.Flock_t{Type: syscall.F_WRLCK} // the whole file
+	if err := syscall.FcntlFlock(f.Fd(), syscall.F_SETLKW, lock); err != nil {
+		f.Close()
+		userDBMutex.Unlock()
+		return nil, errwrap.Wrapf(err, "can't lock %s", userDBLock)
+	}
+	return func() {
+		f.Close() // this releases the lock
+		userDBMutex.Unlock()
+	}, nil
+}
+
+// userDBs is the set of databases that a CheckApply works on.
+type userDBs struct {
+	passwd  *userDB
+	shadow  *userDB
+	group   *userDB
+	gshadow *userDB
+}
+
+// readUserDBs reads all of the databases.
+func readUserDBs() (*userDBs, error) {
+	dbs := &userDBs{}
+	for _, x := range []struct {
+		db   **userDB
+		path string
+	}{
+		{&dbs.passwd, userDBPasswd},
+		{&dbs.shadow, userDBShadow},
+		{&dbs.group, userDBGroup},
+		{&dbs.gshadow, userDBGshadow},
+	} {
+		db, err := readUserDB(x.path)
+		if err != nil {
+			return nil, err
+		}
+		*x.db = db
+	}
+	if !dbs.passwd.exists || !dbs.group.exists {
+		return nil, fmt.Errorf("The %s and %s databases must exist", userDBPasswd, userDBGroup)
+	}
+	return dbs, nil
+}
+
+// report adds the changes to the databases to the noop report of the resource.
+func (obj *userDBs) report(res Res) {
+	for _, db := range []*userDB{obj.passwd, obj.shadow, obj.group, obj.gshadow} {
+		for _, change := range db.changes {
+			res.AddChange(change)
+		}
+	}
+}
+
+// write writes the databases which changed, in the order that useradd uses.
+func (obj *userDBs) write(changed map[*userDB]bool) error {
+	for _, db := range []*userDB{obj.passwd, obj.shadow, obj.group, obj.gshadow} {
+		if !changed[db] {
+			continue
+		}
+		if err := db.write(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// watchUserDB is the Watch of the user and group resources. It sends an event
+// whenever one of the databases changes, so that external edits get reverted.
+func watchUserDB(obj Res, processChan chan *event.Event) error {
+	watcher, err := newMultiWatcher(userDBPasswd, userDBShadow, userDBGroup, userDBGshadow)
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	// notify engine that we're running
+	if err := obj.Running(processChan); err != nil {
+		return err // bubble up a NACK...
+	}
+
+	var send = false // send event?
+	var exit *error
+	for {
+		select {
+		case err := <-watcher.Events():
+			if err != nil {
+				return errwrap.Wrapf(err, "Unknown %s[%s] watcher error", obj.Kind(), obj.GetName())
+			}
+			send = true
+			obj.StateOK(false) // dirty
+
+		case event := <-obj.Events():
+			if exit, send = obj.ReadEvent(event); exit != nil {
+				return *exit // exit
+			}
+		}
+
+		// do all our event sending all together to avoid duplicate msgs
+		if send {
+			send = false
+			obj.Event(processChan)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+// Mgmt
+// Copyright (C) 2013-2016+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package resources
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+// userDBTest points the databases to a temporary dir for the test.
+func userDBTest(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "mgmt-userdb-")
+	if err != nil {
+		t.Fatalf("Can't create temp dir: %v", err)
+	}
+	old := []string{userDBPasswd, userDBShadow, userDBGroup, userDBGshadow, userDBLock}
+	userDBPasswd = path.Join(dir, "passwd")
+	userDBShadow = path.Join(dir, "shadow")
+	userDBGroup = path.Join(dir, "group")
+	userDBGshadow = path.Join(dir, "gshadow") // left missing
+	userDBLock = path.Join(dir, ".pwd.lock")
+
+	files := map[string]string{
+		userDBPasswd: "# comment\nroot:x:0:0:root:/root:/bin/bash\nalice:x:1000:1000::/home/alice:/bin/sh\n",
+		userDBShadow: "root:*:17000:0:99999:7:::\nalice:!:17000:0:99999:7:::\n",
+		userDBGroup:  "root:x:0:\nalice:x:1000:\nwheel:x:10:alice\n",
+	}
+	for p, data := range files {
+		if err := ioutil.WriteFile(p, []byte(data), 0600); err != nil {
+			t.Fatalf("Can't write %s: %v", p, err)
+		}
+	}
+	return func() {
+		userDBPasswd, userDBShadow, userDBGroup, userDBGshadow, userDBLock = old[0], old[1], old[2], old[3], old[4]
+		os.RemoveAll(dir)
+	}
+}
+
+// userDBRead returns the content of the database, or fails the test.
+func userDBRead(t *testing.T, p string) string {
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		t.Fatalf("Can't read %s: %v", p, err)
+	}
+	return string(data)
+}
+
+// checkApply runs CheckApply twice, and checks that only the first one changed
+// something.
+func checkApply(t *testing.T, res Res) {
+	if checkOK, err := res.CheckApply(true); err != nil || checkOK {
+		t.Fatalf("%s[%s]: First CheckApply returned: %v, %v", res.Kind(), res.GetName(), checkOK, err)
+	}
+	if checkOK, err := res.CheckApply(true); err != nil || !checkOK {
+		t.Fatalf("%s[%s]: Second CheckApply returned: %v, %v", res.Kind(), res.GetName(), checkOK, err)
+	}
+}
+
+func TestUserGroupRes1(t *testing.T) {
+	defer userDBTest(t)()
+
+	group, _ := NewGroupRes("devs", "exists")
+	checkApply(t, group)
+	if s := userDBRead(t, userDBGroup); !strings.Contains(s, "\ndevs:x:1001:\n") {
+		t.Errorf("Group wasn't added:\n%s", s)
+	}
+
+	user, _ := NewUserRes("bob", "exists", "devs")
+	user.Groups = []string{"wheel", "10"} // the same group twice
+	user.Shell = "/bin/bash"
+	checkApply(t, user)
+	if s := userDBRead(t, userDBPasswd); !strings.HasPrefix(s, "# comment\n") || !strings.Contains(s, "\nbob:x:1001:1001::/home/bob:/bin/bash\n") {
+		t.Errorf("User wasn't added:\n%s", s)
+	}
+	if s := userDBRead(t, userDBShadow); !strings.Contains(s, "\nbob:!:") {
+		t.Errorf("Shadow entry wasn't added:\n%s", s)
+	}
+	if s := userDBRead(t, userDBGroup); !strings.Contains(s, "\nwheel:x:10:alice,bob\n") {
+		t.Errorf("User wasn't added to the group:\n%s", s)
+	}
+	if _, err := os.Stat(userDBGshadow); !os.IsNotExist(err) {
+		t.Errorf("The missing gshadow was created")
+	}
+
+	user, _ = NewUserRes("bob", "absent", "")
+	checkApply(t, user)
+	if s := userDBRead(t, userDBPasswd); strings.Contains(s, "bob") {
+		t.Errorf("User wasn't removed:\n%s", s)
+	}
+	if s := userDBRead(t, userDBGroup); !strings.Contains(s, "\nwheel:x:10:alice\n") {
+		t.Errorf("User wasn't removed from the group:\n%s", s)
+	}
+}
+
+func TestUserGroupRes2(t *testing.T) {
+	defer userDBTest(t)()
+
+	uid := uint32(0)
+	user, _ := NewUserRes("eve", "exists", "root")
+	user.UID = &uid
+	if _, err := user.CheckApply(true); err == nil {
+		t.Errorf("Duplicate uid was allowed")
+	}
+
+	user, _ = NewUserRes("eve", "exists", "nope")
+	if _, err := user.CheckApply(true); err == nil {
+		t.Errorf("Missing group was allowed")
+	}
+
+	user, _ = NewUserRes("alice", "exists", "")
+	user.Comment = "Alice"
+	if checkOK, err := user.CheckApply(false); err != nil || checkOK {
+		t.Errorf("Noop CheckApply returned: %v, %v", checkOK, err)
+	}
+	if s := userDBRead(t, userDBPasswd); strings.Contains(s, "Alice") {
+		t.Errorf("Noop CheckApply changed the user:\n%s", s)
+	}
+}
+
+func TestUserGroupRes3(t *testing.T) {
+	defer userDBTest(t)()
+
+	// the primary group named like the user is created along with it
+	user, _ := NewUserRes("carol", "exists", "")
+	checkApply(t, user)
+	if s := userDBRead(t, userDBPasswd); !strings.Contains(s, "\ncarol:x:1001:1001:") {
+		t.Errorf("User wasn't added:\n%s", s)
+	}
+	if s := userDBRead(t, userDBGroup); !strings.Contains(s, "\ncarol:x:1001:\n") {
+		t.Errorf("The group of the user wasn't added:\n%s", s)
+	}
+
+	// the user is added to its groups, and the others are left alone
+	user, _ = NewUserRes("alice", "exists", "")
+	user.Groups = []string{"carol"}
+	checkApply(t, user)
+	if s := userDBRead(t, userDBGroup); !strings.Contains(s, "\nwheel:x:10:alice\n") || !strings.Contains(s, "\ncarol:x:1001:alice\n") {
+		t.Errorf("Wrong groups:\n%s", s)
+	}
+}
+
+func TestUserGroupConflicts1(t *testing.T) {
+	newGroup := func(name string, members []string) *GroupRes {
+		group, _ := NewGroupRes(name, "exists")
+		group.Members = members
+		return group
+	}
+	gid := uint32(10)
+	wheel := newGroup("wheel", []string{"alice"})
+	wheel.GID = &gid
+	for _, x := range []struct {
+		user     *UserRes
+		group    *GroupRes
+		conflict bool
+	}{
+		{&UserRes{State: "exists", Groups: []string{"wheel"}}, wheel, true},
+		{&UserRes{State: "exists", Groups: []string{"10"}}, wheel, true},
+		{&UserRes{State: "exists", Groups: []string{"wheel"}}, newGroup("wheel", nil), false},
+		{&UserRes{State: "exists", Groups: []string{"wheel"}}, newGroup("wheel", []string{"bob"}), false},
+		{&UserRes{State: "exists", Groups: []string{"devs"}}, wheel, false},
+		{&UserRes{State: "absent"}, newGroup("devs", []string{"bob"}), true},
+		{&UserRes{State: "absent"}, wheel, false},
+	} {
+		x.user.SetName("bob")
+		if err := x.user.Conflicts(x.group); (err != nil) != x.conflict {
+			t.Errorf("User %+v with group %+v: conflict: %t, error: %v", x.user, x.group, x.conflict, err)
+		}
+	}
+}
+
+func TestUserGroupAutoEdges1(t *testing.T) {
+	group, _ := NewGroupRes("devs", "exists")
+	group.Members = []string{"bob", "1005"}
+	bob, _ := NewUserRes("bob", "exists", "")
+	uid := uint32(1005)
+	eve, _ := NewUserRes("eve", "exists", "")
+	eve.UID = &uid
+	uids := group.AutoEdges().Next()
+	if len(uids) != 2 {
+		t.Fatalf("Expected 2 autoedges, got: %d", len(uids))
+	}
+	for i, user := range []*UserRes{bob, eve} {
+		if !uids[i].IFF(user.UIDs()[0]) || uids[i].Reversed() {
+			t.Errorf("The user %s should come after the group", user.GetName())
+		}
+	}
+}
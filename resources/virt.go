@@ -20,12 +20,14 @@ package resources
 
 import (
 	"encoding/gob"
+	"encoding/xml"
 	"fmt"
 	"log"
 	"math/rand"
 	"net/url"
 	"os/user"
 	"path"
+	"reflect"
 	"strings"
 	"time"
 
@@ -49,12 +51,13 @@ type virtURISchemeType int
 const (
 	defaultURI virtURISchemeType = iota
 	lxcURI
+	testURI // the test driver of libvirt, eg: test:///default
 )
 
 // VirtAuth is used to pass credentials to libvirt.
 type VirtAuth struct {
 	Username string `yaml:"username"`
-	Password string `yaml:"password"`
+	Password string `yaml:"password" json:"-"` // secret, left out of the json
 }
 
 // VirtRes is a libvirt resource. A transient virt resource, which has its state
@@ -73,6 +76,8 @@ type VirtRes struct {
 	CDRom      []cdRomDevice      `yaml:"cdrom"`
 	Network    []networkDevice    `yaml:"network"`
 	Filesystem []filesystemDevice `yaml:"filesystem"`
+	Snapshot   []virtSnapshot     `yaml:"snapshot"` // named snapshots
+	Revert     string             `yaml:"revert"`   // the snapshot to keep current
 	Auth       *VirtAuth          `yaml:"auth"`
 
 	conn      *libvirt.Connect
@@ -117,6 +122,8 @@ func (obj *VirtRes) Init() error {
 	switch u.Scheme {
 	case "lxc":
 		obj.uriScheme = lxcURI
+	case "test":
+		obj.uriScheme = testURI
 	}
 
 	obj.absent = (obj.Transient && obj.State == "shutoff") // machine shouldn't exist
@@ -127,6 +134,38 @@ func (obj *VirtRes) Init() error {
 
 // Validate if the params passed in are valid data.
 func (obj *VirtRes) Validate() error {
+	for _, disk := range obj.Disk {
+		if disk.Size == 0 && disk.Backing == "" {
+			continue // the image isn't created by us
+		}
+		if disk.Type != "qcow2" && disk.Type != "raw" {
+			return fmt.Errorf("Can't create a disk image of type: %s", disk.Type)
+		}
+		if disk.Backing != "" && disk.Type != "qcow2" {
+			return fmt.Errorf("Only a qcow2 disk image can have a backing file.")
+		}
+	}
+	names := make(map[string]string)
+	for _, snapshot := range obj.Snapshot {
+		if snapshot.Name == "" {
+			return fmt.Errorf("A snapshot must have a name.")
+		}
+		if _, exists := names[snapshot.Name]; exists {
+			return fmt.Errorf("Duplicate snapshot: %s", snapshot.Name)
+		}
+		switch snapshot.State {
+		case "", "exists", "absent":
+		default:
+			return fmt.Errorf("Invalid snapshot state: %s", snapshot.State)
+		}
+		names[snapshot.Name] = snapshot.State
+	}
+	if obj.Transient && len(obj.Snapshot) > 0 {
+		return fmt.Errorf("A transient domain can't have snapshots.")
+	}
+	if state, exists := names[obj.Revert]; obj.Revert != "" && (!exists || state == "absent") {
+		return fmt.Errorf("Can't revert to a missing snapshot: %s", obj.Revert)
+	}
 	return obj.BaseRes.Validate()
 }
 
@@ -374,6 +413,18 @@ func (obj *VirtRes) CheckApply(apply bool) (bool, error) {
 
 	var checkOK = true
 
+	// the disk images must exist before the domain uses them
+	if !obj.absent {
+		if c, err := obj.imageCheckApply(apply); err != nil {
+			return false, errwrap.Wrapf(err, "imageCheckApply failed")
+		} else if !c {
+			if !apply {
+				return false, nil
+			}
+			checkOK = false
+		}
+	}
+
 	dom, err := obj.conn.LookupDomainByName(obj.GetName())
 	if err == nil {
 		// pass
@@ -440,6 +491,24 @@ func (obj *VirtRes) CheckApply(apply bool) (bool, error) {
 		checkOK = false
 	}
 
+	// snapshots, before the state, since a revert changes it
+	if len(obj.Snapshot) > 0 {
+		if c, err := obj.snapshotCheckApply(apply, dom); err != nil {
+			return false, errwrap.Wrapf(err, "snapshotCheckApply failed")
+		} else if !c {
+			if !apply {
+				return false, nil
+			}
+			checkOK = false
+			if domInfo, err = dom.GetInfo(); err != nil {
+				return false, errwrap.Wrapf(err, "domain.GetInfo failed")
+			}
+			if isActive, err = dom.IsActive(); err != nil {
+				return false, errwrap.Wrapf(err, "domain.IsActive failed")
+			}
+		}
+	}
+
 	// check for valid state
 	switch obj.State {
 	case "running":
@@ -503,11 +572,6 @@ func (obj *VirtRes) CheckApply(apply bool) (bool, error) {
 		log.Printf("%s[%s]: Domain destroyed", obj.Kind(), obj.GetName())
 	}
 
-	if !apply {
-		return false, nil
-	}
-	// remaining apply portion
-
 	// mem & cpu checks...
 	if !obj.absent {
 		if c, err := obj.attrCheckApply(apply); err != nil {
@@ -517,14 +581,304 @@ func (obj *VirtRes) CheckApply(apply bool) (bool, error) {
 		}
 	}
 
+	// hot-plug of the disks and the network interfaces
+	if !obj.absent {
+		if c, err := obj.deviceCheckApply(apply, dom); err != nil {
+			return false, errwrap.Wrapf(err, "deviceCheckApply failed")
+		} else if !c {
+			checkOK = false
+		}
+	}
+
 	return checkOK, nil // w00t
 }
 
+// imageCheckApply creates the images of the disks which have a size or a
+// backing file, in their storage pool, if they don't exist yet. An image which
+// exists already isn't resized.
+func (obj *VirtRes) imageCheckApply(apply bool) (bool, error) {
+	var checkOK = true
+	for _, disk := range obj.Disk {
+		if disk.Size == 0 && disk.Backing == "" {
+			continue
+		}
+		c, err := obj.imageCreate(apply, disk)
+		if err != nil {
+			return false, err
+		}
+		if !c {
+			checkOK = false
+			if !apply {
+				return false, nil
+			}
+		}
+	}
+	return checkOK, nil
+}
+
+// imageCreate creates the image of the disk, as a volume of its storage pool.
+func (obj *VirtRes) imageCreate(apply bool, disk diskDevice) (bool, error) {
+	source, err := expandHome(disk.Source)
+	if err != nil {
+		return false, err
+	}
+	pool, err := obj.conn.LookupStoragePoolByName(disk.pool())
+	if err != nil {
+		return false, errwrap.Wrapf(err, "conn.LookupStoragePoolByName failed")
+	}
+	defer pool.Free()
+	if err := pool.Refresh(0); err != nil { // find the images made elsewhere
+		return false, errwrap.Wrapf(err, "pool.Refresh failed")
+	}
+
+	vol, err := pool.LookupStorageVolByName(path.Base(source))
+	if virErr, ok := err.(libvirt.Error); ok && virErr.Code == libvirt.ERR_NO_STORAGE_VOL {
+		if !apply {
+			return false, nil
+		}
+		vol, err = pool.StorageVolCreateXML(disk.GetVolumeXML(source), 0)
+		if err != nil {
+			return false, errwrap.Wrapf(err, "pool.StorageVolCreateXML failed")
+		}
+		log.Printf("%s[%s]: Image %s created", obj.Kind(), obj.GetName(), source)
+		defer vol.Free()
+		return false, obj.imagePath(vol, source)
+	} else if err != nil {
+		return false, errwrap.Wrapf(err, "pool.LookupStorageVolByName failed")
+	}
+	defer vol.Free()
+	return true, obj.imagePath(vol, source)
+}
+
+// imagePath errors if the volume isn't the source of the disk, which happens if
+// the source isn't in the directory of the storage pool.
+func (obj *VirtRes) imagePath(vol *libvirt.StorageVol, source string) error {
+	p, err := vol.GetPath()
+	if err != nil {
+		return errwrap.Wrapf(err, "vol.GetPath failed")
+	}
+	if p != source {
+		return fmt.Errorf("The image %s of the storage pool isn't %s", p, source)
+	}
+	return nil
+}
+
+// snapshotCheckApply creates and deletes the named snapshots, and reverts the
+// domain to the revert snapshot if it isn't the current one.
+func (obj *VirtRes) snapshotCheckApply(apply bool, dom *libvirt.Domain) (bool, error) {
+	var checkOK = true
+	for _, snapshot := range obj.Snapshot {
+		snap, err := dom.SnapshotLookupByName(snapshot.Name, 0)
+		var exists = err == nil
+		if virErr, ok := err.(libvirt.Error); err != nil && (!ok || virErr.Code != libvirt.ERR_NO_DOMAIN_SNAPSHOT) {
+			return false, errwrap.Wrapf(err, "domain.SnapshotLookupByName failed")
+		}
+		if exists == (snapshot.State != "absent") {
+			if exists {
+				snap.Free()
+			}
+			continue
+		}
+		checkOK = false
+		if !apply {
+			if exists {
+				snap.Free()
+			}
+			return false, nil
+		}
+		if exists {
+			err := snap.Delete(0)
+			snap.Free()
+			if err != nil {
+				return false, errwrap.Wrapf(err, "snapshot.Delete failed")
+			}
+			log.Printf("%s[%s]: Snapshot %s deleted", obj.Kind(), obj.GetName(), snapshot.Name)
+			continue
+		}
+		snap, err = dom.CreateSnapshotXML(snapshot.GetXML(), 0)
+		if err != nil {
+			return false, errwrap.Wrapf(err, "domain.CreateSnapshotXML failed")
+		}
+		snap.Free()
+		log.Printf("%s[%s]: Snapshot %s created", obj.Kind(), obj.GetName(), snapshot.Name)
+	}
+
+	if obj.Revert == "" {
+		return checkOK, nil
+	}
+	snap, err := dom.SnapshotLookupByName(obj.Revert, 0)
+	if err != nil {
+		return false, errwrap.Wrapf(err, "domain.SnapshotLookupByName failed")
+	}
+	defer snap.Free()
+	current, err := snap.IsCurrent(0)
+	if err != nil {
+		return false, errwrap.Wrapf(err, "snapshot.IsCurrent failed")
+	}
+	if current {
+		return checkOK, nil
+	}
+	if !apply {
+		return false, nil
+	}
+	var flags libvirt.DomainSnapshotRevertFlags // keep the snapshot's state
+	switch obj.State {
+	case "running":
+		flags = libvirt.DOMAIN_SNAPSHOT_REVERT_RUNNING
+	case "paused":
+		flags = libvirt.DOMAIN_SNAPSHOT_REVERT_PAUSED
+	}
+	if err := snap.RevertToSnapshot(flags); err != nil {
+		return false, errwrap.Wrapf(err, "snapshot.RevertToSnapshot failed")
+	}
+	log.Printf("%s[%s]: Reverted to snapshot %s", obj.Kind(), obj.GetName(), obj.Revert)
+	return false, nil
+}
+
+// deviceCheckApply attaches the missing disks and network interfaces to the
+// domain, and detaches the ones which aren't wanted anymore. A running domain
+// is changed live, and a persistent one has its config changed too.
+func (obj *VirtRes) deviceCheckApply(apply bool, dom *libvirt.Domain) (bool, error) {
+	domXML, err := dom.GetXMLDesc(0)
+	if err != nil {
+		return false, errwrap.Wrapf(err, "domain.GetXMLDesc failed")
+	}
+	attach, detach, err := virtDeviceDiff(domXML, obj.Disk, obj.Network)
+	if err != nil {
+		return false, err
+	}
+	if len(attach) == 0 && len(detach) == 0 {
+		return true, nil
+	}
+	if !apply {
+		return false, nil
+	}
+
+	isPersistent, err := dom.IsPersistent()
+	if err != nil {
+		return false, errwrap.Wrapf(err, "domain.IsPersistent failed")
+	}
+	isActive, err := dom.IsActive()
+	if err != nil {
+		return false, errwrap.Wrapf(err, "domain.IsActive failed")
+	}
+	var flags libvirt.DomainDeviceModifyFlags
+	if isActive {
+		flags |= libvirt.DOMAIN_DEVICE_MODIFY_LIVE
+	}
+	if isPersistent {
+		flags |= libvirt.DOMAIN_DEVICE_MODIFY_CONFIG
+	}
+
+	for _, x := range detach {
+		if err := dom.DetachDeviceFlags(x, flags); err != nil {
+			return false, errwrap.Wrapf(err, "domain.DetachDeviceFlags failed")
+		}
+		log.Printf("%s[%s]: Device detached: %s", obj.Kind(), obj.GetName(), x)
+	}
+	for _, x := range attach {
+		if err := dom.AttachDeviceFlags(x, flags); err != nil {
+			return false, errwrap.Wrapf(err, "domain.AttachDeviceFlags failed")
+		}
+		log.Printf("%s[%s]: Device attached: %s", obj.Kind(), obj.GetName(), x)
+	}
+	return false, nil
+}
+
+// virtDomainXML is the part of the domain xml which describes the devices that
+// can be hot-plugged.
+type virtDomainXML struct {
+	Disks []struct {
+		Device string `xml:"device,attr"`
+		Source struct {
+			File string `xml:"file,attr"`
+		} `xml:"source"`
+		Target struct {
+			Dev string `xml:"dev,attr"`
+		} `xml:"target"`
+	} `xml:"devices>disk"`
+	Interfaces []struct {
+		Type string `xml:"type,attr"`
+		MAC  struct {
+			Address string `xml:"address,attr"`
+		} `xml:"mac"`
+		Source struct {
+			Network string `xml:"network,attr"`
+		} `xml:"source"`
+	} `xml:"devices>interface"`
+}
+
+// virtDeviceDiff compares the disks and the network interfaces of the domain
+// xml with the wanted ones. It returns the xml of the devices to attach, and of
+// the ones to detach. The disks are matched by their source, and the network
+// interfaces by their network, and by their mac address if it's set.
+func virtDeviceDiff(domXML string, disks []diskDevice, networks []networkDevice) ([]string, []string, error) {
+	var domain virtDomainXML
+	if err := xml.Unmarshal([]byte(domXML), &domain); err != nil {
+		return nil, nil, errwrap.Wrapf(err, "can't parse the domain xml")
+	}
+	var attach, detach []string
+
+	used := make(map[string]bool) // the disk targets
+	found := make(map[int]bool)   // the existing disks which are wanted
+	for _, x := range domain.Disks {
+		used[x.Target.Dev] = true
+	}
+	for _, disk := range disks {
+		source, _ := expandHome(disk.Source)
+		var exists bool
+		for i, x := range domain.Disks {
+			if x.Device == "disk" && !found[i] && x.Source.File == source {
+				found[i], exists = true, true
+				break
+			}
+		}
+		if exists {
+			continue
+		}
+		idx := 0
+		for ; used[fmt.Sprintf("vd%c", 'a'+idx)]; idx++ {
+		}
+		if idx >= 26 {
+			return nil, nil, fmt.Errorf("No free disk target left")
+		}
+		used[fmt.Sprintf("vd%c", 'a'+idx)] = true
+		attach = append(attach, disk.GetXML(idx))
+	}
+	for i, x := range domain.Disks {
+		if x.Device == "disk" && !found[i] {
+			detach = append(detach, fmt.Sprintf("<disk type='file' device='disk'><source file='%s'/><target dev='%s'/></disk>", x.Source.File, x.Target.Dev))
+		}
+	}
+
+	found = make(map[int]bool) // the existing interfaces which are wanted
+	for _, network := range networks {
+		var exists bool
+		for i, x := range domain.Interfaces {
+			if x.Type == "network" && !found[i] && x.Source.Network == network.Name && (network.MAC == "" || strings.EqualFold(x.MAC.Address, network.MAC)) {
+				found[i], exists = true, true
+				break
+			}
+		}
+		if !exists {
+			attach = append(attach, network.GetXML(0))
+		}
+	}
+	for i, x := range domain.Interfaces {
+		if x.Type == "network" && !found[i] {
+			detach = append(detach, fmt.Sprintf("<interface type='network'><mac address='%s'/><source network='%s'/></interface>", x.MAC.Address, x.Source.Network))
+		}
+	}
+	return attach, detach, nil
+}
+
 // Return the correct domain type based on the uri
 func (obj VirtRes) getDomainType() string {
 	switch obj.uriScheme {
 	case lxcURI:
 		return "<domain type='lxc'>"
+	case testURI:
+		return "<domain type='test'>"
 	default:
 		return "<domain type='kvm'>"
 	}
@@ -605,8 +959,11 @@ type virtDevice interface {
 }
 
 type diskDevice struct {
-	Source string `yaml:"source"`
-	Type   string `yaml:"type"`
+	Source  string `yaml:"source"`
+	Type    string `yaml:"type"`
+	Size    uint64 `yaml:"size"`    // in bytes, to create the image if it's missing
+	Backing string `yaml:"backing"` // the backing file of a created qcow2 image
+	Pool    string `yaml:"pool"`    // the storage pool of a created image
 }
 
 type cdRomDevice struct {
@@ -626,6 +983,11 @@ type filesystemDevice struct {
 	ReadOnly bool   `yaml:"read_only"`
 }
 
+type virtSnapshot struct {
+	Name  string `yaml:"name"`
+	State string `yaml:"state"` // exists (the default) or absent
+}
+
 func (d *diskDevice) GetXML(idx int) string {
 	source, _ := expandHome(d.Source) // TODO: should we handle errors?
 	var b string
@@ -637,6 +999,31 @@ func (d *diskDevice) GetXML(idx int) string {
 	return b
 }
 
+// pool returns the name of the storage pool which holds the created image.
+func (d *diskDevice) pool() string {
+	if d.Pool == "" {
+		return "default"
+	}
+	return d.Pool
+}
+
+// GetVolumeXML returns the xml of the storage volume which creates the image.
+func (d *diskDevice) GetVolumeXML(source string) string {
+	var b string
+	b += "<volume>"
+	b += fmt.Sprintf("<name>%s</name>", path.Base(source))
+	if d.Size > 0 { // it's the size of the backing file otherwise
+		b += fmt.Sprintf("<capacity unit='bytes'>%d</capacity>", d.Size)
+	}
+	b += fmt.Sprintf("<target><format type='%s'/></target>", d.Type)
+	if d.Backing != "" {
+		backing, _ := expandHome(d.Backing) // TODO: should we handle errors?
+		b += fmt.Sprintf("<backingStore><path>%s</path></backingStore>", backing)
+	}
+	b += "</volume>"
+	return b
+}
+
 func (d *cdRomDevice) GetXML(idx int) string {
 	source, _ := expandHome(d.Source) // TODO: should we handle errors?
 	var b string
@@ -661,6 +1048,10 @@ func (d *networkDevice) GetXML(idx int) string {
 	return b
 }
 
+func (s *virtSnapshot) GetXML() string {
+	return fmt.Sprintf("<domainsnapshot><name>%s</name></domainsnapshot>", s.Name)
+}
+
 func (d *filesystemDevice) GetXML(idx int) string {
 	source, _ := expandHome(d.Source) // TODO: should we handle errors?
 	var b string
@@ -702,9 +1093,32 @@ func (obj *VirtRes) GroupCmp(r Res) bool {
 	return false // not possible atm
 }
 
-// AutoEdges returns the AutoEdge interface. In this case no autoedges are used.
+// AutoEdges returns the AutoEdge interface. The file resource which manages the
+// source of a disk, of a backing file, of a cdrom or of a filesystem, or else
+// the one which manages its nearest parent dir, happens before us.
 func (obj *VirtRes) AutoEdges() AutoEdge {
-	return nil
+	paths := []string{}
+	for _, x := range obj.Disk {
+		paths = append(paths, x.Source)
+		if x.Backing != "" {
+			paths = append(paths, x.Backing)
+		}
+	}
+	for _, x := range obj.CDRom {
+		paths = append(paths, x.Source)
+	}
+	for _, x := range obj.Filesystem {
+		paths = append(paths, strings.TrimSuffix(x.Source, "/")+"/") // a dir
+	}
+	abs := []string{}
+	for _, p := range paths {
+		p, err := expandHome(p)
+		if err != nil || !path.IsAbs(p) {
+			continue
+		}
+		abs = append(abs, p)
+	}
+	return newParentDirAutoEdges(obj, abs)
 }
 
 // Compare two resources and return if they are equivalent.
@@ -739,22 +1153,28 @@ func (obj *VirtRes) Compare(res Res) bool {
 		if obj.Memory != res.Memory {
 			return false
 		}
-		// TODO:
-		//if obj.Boot != res.Boot {
-		//	return false
-		//}
-		//if obj.Disk != res.Disk {
-		//	return false
-		//}
-		//if obj.CDRom != res.CDRom {
-		//	return false
-		//}
-		//if obj.Network != res.Network {
-		//	return false
-		//}
-		//if obj.Filesystem != res.Filesystem {
-		//	return false
-		//}
+		// the devices can be hot-plugged into the new version
+		if !reflect.DeepEqual(obj.Boot, res.Boot) {
+			return false
+		}
+		if !reflect.DeepEqual(obj.Disk, res.Disk) {
+			return false
+		}
+		if !reflect.DeepEqual(obj.CDRom, res.CDRom) {
+			return false
+		}
+		if !reflect.DeepEqual(obj.Network, res.Network) {
+			return false
+		}
+		if !reflect.DeepEqual(obj.Filesystem, res.Filesystem) {
+			return false
+		}
+		if !reflect.DeepEqual(obj.Snapshot, res.Snapshot) {
+			return false
+		}
+		if obj.Revert != res.Revert {
+			return false
+		}
 	default:
 		return false
 	}
@@ -0,0 +1,120 @@
+// Mgmt
+// Copyright (C) 2013-2016+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+// +build !novirt
+
+package resources
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/libvirt/libvirt-go"
+)
+
+func TestVirtDeviceDiff1(t *testing.T) {
+	domXML := `<domain type='kvm'><name>vm1</name><devices>
+<disk type='file' device='disk'><source file='/var/lib/images/a.qcow2'/><target dev='vda' bus='virtio'/></disk>
+<disk type='file' device='disk'><source file='/var/lib/images/b.qcow2'/><target dev='vdb' bus='virtio'/></disk>
+<disk type='file' device='cdrom'><source file='/var/lib/images/c.iso'/><target dev='hda' bus='ide'/></disk>
+<interface type='network'><mac address='52:54:00:aa:bb:cc'/><source network='default'/></interface>
+<interface type='network'><mac address='52:54:00:dd:ee:ff'/><source network='lab'/></interface>
+</devices></domain>`
+	disks := []diskDevice{
+		{Source: "/var/lib/images/b.qcow2", Type: "qcow2"},
+		{Source: "/var/lib/images/d.qcow2", Type: "qcow2"},
+	}
+	networks := []networkDevice{
+		{Name: "default"},
+		{Name: "lab", MAC: "52:54:00:12:34:56"},
+	}
+	attach, detach, err := virtDeviceDiff(domXML, disks, networks)
+	if err != nil {
+		t.Fatalf("virtDeviceDiff failed: %v", err)
+	}
+	if len(attach) != 2 || !strings.Contains(attach[0], "<source file='/var/lib/images/d.qcow2'/><target dev='vdc'") || !strings.Contains(attach[1], "<mac address='52:54:00:12:34:56'/><source network='lab'/>") {
+		t.Errorf("Wrong devices to attach: %v", attach)
+	}
+	if len(detach) != 2 || !strings.Contains(detach[0], "<target dev='vda'/>") || !strings.Contains(detach[1], "<mac address='52:54:00:dd:ee:ff'/>") {
+		t.Errorf("Wrong devices to detach: %v", detach)
+	}
+
+	if attach, detach, err := virtDeviceDiff(domXML, []diskDevice{disks[0], {Source: "/var/lib/images/a.qcow2"}}, networks[:1]); err != nil || len(attach) != 0 || len(detach) != 1 {
+		t.Errorf("Wrong device diff: %v, %v, %v", attach, detach, err)
+	}
+}
+
+func TestVirtValidate1(t *testing.T) {
+	disk := diskDevice{Source: "/var/lib/images/vm1.qcow2", Type: "qcow2", Size: 1 << 30, Backing: "/var/lib/images/base.qcow2"}
+	if s := disk.GetVolumeXML(disk.Source); s != "<volume><name>vm1.qcow2</name><capacity unit='bytes'>1073741824</capacity><target><format type='qcow2'/></target><backingStore><path>/var/lib/images/base.qcow2</path></backingStore></volume>" {
+		t.Errorf("Wrong volume xml: %s", s)
+	}
+
+	for _, f := range []func(*VirtRes){
+		func(obj *VirtRes) { obj.Disk = []diskDevice{{Source: "/vm.img", Type: "raw", Backing: "/base.img"}} },
+		func(obj *VirtRes) { obj.Disk = []diskDevice{{Source: "/vm.img", Size: 1024}} },
+		func(obj *VirtRes) { obj.Snapshot = []virtSnapshot{{State: "exists"}} },
+		func(obj *VirtRes) { obj.Snapshot = []virtSnapshot{{Name: "s1"}, {Name: "s1"}} },
+		func(obj *VirtRes) { obj.Snapshot = []virtSnapshot{{Name: "s1", State: "gone"}} },
+		func(obj *VirtRes) { obj.Snapshot = []virtSnapshot{{Name: "s1", State: "absent"}}; obj.Revert = "s1" },
+		func(obj *VirtRes) { obj.Revert = "s1" },
+		func(obj *VirtRes) { obj.Transient = true; obj.Snapshot = []virtSnapshot{{Name: "s1"}} },
+	} {
+		obj, _ := NewVirtRes("vm1", "test:///default", "shutoff", false, 1, 131072, "")
+		f(obj)
+		if err := obj.Validate(); err == nil {
+			t.Errorf("Validate should fail: %+v", obj)
+		}
+	}
+}
+
+func TestVirtRes1(t *testing.T) {
+	conn, err := libvirt.NewConnect("test:///default") // keeps its state
+	if err != nil {
+		t.Skipf("Can't connect to the test driver: %v", err)
+	}
+	defer conn.Close()
+
+	obj, _ := NewVirtRes("mgmt-test1", "test:///default", "running", false, 1, 131072, "")
+	obj.Disk = []diskDevice{{Source: "/default-pool/mgmt-test1.qcow2", Type: "qcow2", Size: 1 << 20, Pool: "default-pool"}}
+	obj.Snapshot = []virtSnapshot{{Name: "clean"}}
+	checkApply(t, obj)
+	if vol, err := conn.LookupStorageVolByPath("/default-pool/mgmt-test1.qcow2"); err != nil {
+		t.Errorf("Image wasn't created: %v", err)
+	} else {
+		vol.Free()
+	}
+
+	obj.Snapshot = []virtSnapshot{{Name: "clean"}, {Name: "later"}}
+	obj.Revert = "clean"
+	checkApply(t, obj)
+	dom, err := conn.LookupDomainByName("mgmt-test1")
+	if err != nil {
+		t.Fatalf("Domain is missing: %v", err)
+	}
+	defer dom.Free()
+	if snap, err := dom.SnapshotLookupByName("later", 0); err != nil {
+		t.Errorf("Snapshot wasn't created: %v", err)
+	} else {
+		snap.Free()
+	}
+
+	obj.Snapshot = []virtSnapshot{{Name: "clean"}, {Name: "later", State: "absent"}}
+	checkApply(t, obj)
+	if _, err := dom.SnapshotLookupByName("later", 0); err == nil {
+		t.Errorf("Snapshot wasn't deleted")
+	}
+}
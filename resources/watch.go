@@ -0,0 +1,88 @@
+// Mgmt
+// Copyright (C) 2013-2016+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package resources
+
+import (
+	"sync"
+
+	"github.com/purpleidea/mgmt/recwatch"
+
+	errwrap "github.com/pkg/errors"
+)
+
+// multiWatcher watches several paths with recwatch, and merges their events.
+// The resources only need to know that something changed, so the events which
+// come while one is pending are merged into it, but the errors are all kept.
+type multiWatcher struct {
+	watchers []*recwatch.RecWatcher
+	events   chan error
+	done     chan struct{}
+	wg       *sync.WaitGroup
+}
+
+// newMultiWatcher starts watching the paths. With no paths, it never sends an
+// event, so that it can be used in a select either way.
+func newMultiWatcher(paths ...string) (*multiWatcher, error) {
+	obj := &multiWatcher{
+		events: make(chan error, 1), // the events are merged into one
+		done:   make(chan struct{}),
+		wg:     &sync.WaitGroup{},
+	}
+	for _, p := range paths {
+		w, err := recwatch.NewRecWatcher(p, false)
+		if err != nil {
+			obj.Close()
+			return nil, errwrap.Wrapf(err, "can't watch %s", p)
+		}
+		obj.watchers = append(obj.watchers, w)
+		obj.wg.Add(1)
+		go func(w *recwatch.RecWatcher) {
+			defer obj.wg.Done()
+			for e := range w.Events() { // until the watcher closes
+				if e.Error != nil {
+					select {
+					case obj.events <- e.Error:
+					case <-obj.done: // drain
+					}
+					continue
+				}
+				select {
+				case obj.events <- nil:
+				default: // an event is pending already
+				}
+			}
+		}(w)
+	}
+	return obj, nil
+}
+
+// Events returns the channel of the merged events, which are nil, unless one of
+// the watchers failed.
+func (obj *multiWatcher) Events() <-chan error {
+	return obj.events
+}
+
+// Close stops the watchers.
+func (obj *multiWatcher) Close() error {
+	close(obj.done)
+	for _, w := range obj.watchers {
+		w.Close()
+	}
+	obj.wg.Wait()
+	return nil
+}
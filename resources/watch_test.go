@@ -0,0 +1,121 @@
+// Mgmt
+// Copyright (C) 2013-2016+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package resources
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/purpleidea/mgmt/converger"
+	"github.com/purpleidea/mgmt/event"
+)
+
+// testWatch runs the Watch of the resource until it's running. It returns the
+// channel of the events that Watch sends, and the function which stops it.
+func testWatch(t *testing.T, res Res) (<-chan struct{}, func()) {
+	res.AssociateData(&Data{Converger: converger.NewConverger(-1, nil)})
+	res.RegisterConverger()
+	res.SetWorking(true)
+
+	processChan := make(chan *event.Event)
+	events := make(chan struct{}, 1) // the events are merged into one
+	exited := make(chan error, 1)
+	go func() {
+		exited <- res.Watch(processChan)
+	}()
+	go func() {
+		for ev := range processChan {
+			ev.ACK()
+			select {
+			case events <- struct{}{}:
+			default: // an event is pending already
+			}
+		}
+	}()
+	select {
+	case <-res.Started():
+	case err := <-exited:
+		t.Fatalf("Watch failed: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Watch didn't start")
+	}
+
+	return events, func() {
+		if err := res.SendEvent(event.EventExit, nil); err != nil {
+			t.Errorf("Can't stop Watch: %v", err)
+		}
+		if err := <-exited; err != nil {
+			t.Errorf("Watch failed: %v", err)
+		}
+		close(processChan)
+		res.UnregisterConverger()
+	}
+}
+
+func TestMultiWatcher1(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mgmt-watch-")
+	if err != nil {
+		t.Fatalf("Can't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	paths := []string{path.Join(dir, "a"), path.Join(dir, "b")}
+	for _, p := range paths {
+		if err := ioutil.WriteFile(p, []byte("1\n"), 0644); err != nil {
+			t.Fatalf("Can't write %s: %v", p, err)
+		}
+	}
+
+	watcher, err := newMultiWatcher(paths...)
+	if err != nil {
+		t.Fatalf("Can't watch: %v", err)
+	}
+	defer watcher.Close()
+	time.Sleep(100 * time.Millisecond) // the watches are added asynchronously
+	for _, p := range paths {
+		if err := ioutil.WriteFile(p, []byte("2\n"), 0644); err != nil {
+			t.Fatalf("Can't write %s: %v", p, err)
+		}
+		select {
+		case err := <-watcher.Events():
+			if err != nil {
+				t.Fatalf("Watcher error: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("No event for %s", p)
+		}
+		time.Sleep(100 * time.Millisecond) // let the events of the write merge
+		select {
+		case <-watcher.Events():
+		default:
+		}
+	}
+
+	empty, err := newMultiWatcher()
+	if err != nil {
+		t.Fatalf("Can't watch nothing: %v", err)
+	}
+	select {
+	case <-empty.Events():
+		t.Errorf("Got an event without paths")
+	case <-time.After(100 * time.Millisecond):
+	}
+	empty.Close()
+}
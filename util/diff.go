@@ -0,0 +1,161 @@
+// Mgmt
+// Copyright (C) 2013-2016+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package util
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// DiffContext is the number of unchanged lines shown around each diff hunk.
+const DiffContext = 3
+
+// DiffMaxCells is the largest table (lines of a * lines of b) that we'll build
+// when computing a diff. Bigger inputs are refused to protect our memory usage.
+const DiffMaxCells = 4 * 1024 * 1024
+
+// diffLine is a single line in an edit script.
+type diffLine struct {
+	op   byte // one of ' ', '-' or '+'
+	text string
+	a, b int // line numbers (zero based) in a and in b
+}
+
+// splitLines splits a string into lines which keep their trailing newline.
+func splitLines(s string) []string {
+	if s == "" {
+		return []string{}
+	}
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// UnifiedDiff returns the unified diff which turns string a into string b. The
+// names are used in the header. If both strings are equal, this returns empty.
+// It uses a simple longest common subsequence table, so it errors if the input
+// is too large, rather than blowing up.
+func UnifiedDiff(a, b, nameA, nameB string) (string, error) {
+	if a == b {
+		return "", nil
+	}
+	la, lb := splitLines(a), splitLines(b)
+	n, m := len(la), len(lb)
+	if (n+1)*(m+1) > DiffMaxCells {
+		return "", fmt.Errorf("Input is too large to diff (%d x %d lines)", n, m)
+	}
+
+	// lcs[i][j] is the length of the lcs of la[i:] and lb[j:]
+	lcs := make([][]int, n+1)
+	for i := range lcs {
+		lcs[i] = make([]int, m+1)
+	}
+	for i := n - 1; i >= 0; i-- {
+		for j := m - 1; j >= 0; j-- {
+			if la[i] == lb[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	// walk the table to build the edit script
+	script := []diffLine{}
+	i, j := 0, 0
+	for i < n || j < m {
+		switch {
+		case i < n && j < m && la[i] == lb[j]:
+			script = append(script, diffLine{' ', la[i], i, j})
+			i++
+			j++
+		case j < m && (i == n || lcs[i][j+1] > lcs[i+1][j]):
+			script = append(script, diffLine{'+', lb[j], i, j})
+			j++
+		default:
+			script = append(script, diffLine{'-', la[i], i, j})
+			i++
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "--- %s\n+++ %s\n", nameA, nameB)
+	for start := 0; start < len(script); {
+		// find the next change
+		for start < len(script) && script[start].op == ' ' {
+			start++
+		}
+		if start == len(script) {
+			break
+		}
+		// extend the hunk while the changes are close enough together
+		end := start
+		for k := start; k < len(script); k++ {
+			if script[k].op != ' ' {
+				end = k + 1
+			} else if k-end >= 2*DiffContext {
+				break
+			}
+		}
+		lo := start - DiffContext
+		if lo < 0 {
+			lo = 0
+		}
+		hi := end + DiffContext
+		if hi > len(script) {
+			hi = len(script)
+		}
+		writeHunk(buf, script[lo:hi])
+		start = hi
+	}
+	return buf.String(), nil
+}
+
+// writeHunk writes a single hunk with its header into the buffer.
+func writeHunk(buf *bytes.Buffer, hunk []diffLine) {
+	var countA, countB int
+	for _, x := range hunk {
+		if x.op != '+' {
+			countA++
+		}
+		if x.op != '-' {
+			countB++
+		}
+	}
+	// an empty range is written as the line just before it
+	startA, startB := hunk[0].a, hunk[0].b
+	if countA > 0 {
+		startA++
+	}
+	if countB > 0 {
+		startB++
+	}
+	fmt.Fprintf(buf, "@@ -%d,%d +%d,%d @@\n", startA, countA, startB, countB)
+	for _, x := range hunk {
+		buf.WriteByte(x.op)
+		buf.WriteString(x.text)
+		if !strings.HasSuffix(x.text, "\n") {
+			buf.WriteString("\n\\ No newline at end of file\n")
+		}
+	}
+}
@@ -0,0 +1,54 @@
+// Mgmt
+// Copyright (C) 2013-2016+ James Shubin and the project contributors
+// Written by James Shubin <james@shubin.ca> and the project contributors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package util
+
+// Semaphore is a counting semaphore. It must be initialized before use.
+type Semaphore struct {
+	C chan struct{}
+}
+
+// NewSemaphore creates a new semaphore with the given number of resources.
+func NewSemaphore(size int) *Semaphore {
+	obj := &Semaphore{}
+	obj.Init(size)
+	return obj
+}
+
+// Init initializes the semaphore with the given number of resources.
+func (obj *Semaphore) Init(size int) {
+	obj.C = make(chan struct{}, size)
+}
+
+// Size returns the total number of resources this semaphore was built with.
+func (obj *Semaphore) Size() int {
+	return cap(obj.C)
+}
+
+// P acquires n resources. It blocks until they are all available.
+func (obj *Semaphore) P(n int) {
+	for i := 0; i < n; i++ {
+		obj.C <- struct{}{} // acquire one
+	}
+}
+
+// V releases n resources.
+func (obj *Semaphore) V(n int) {
+	for i := 0; i < n; i++ {
+		<-obj.C // release one
+	}
+}
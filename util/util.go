@@ -92,6 +92,35 @@ func StrListIntersection(list1 []string, list2 []string) []string {
 	return result
 }
 
+// StrSetEq returns true if the two lists contain the same elements, ignoring
+// their order and any duplicates.
+func StrSetEq(list1, list2 []string) bool {
+	a := StrRemoveDuplicatesInList(list1)
+	b := StrRemoveDuplicatesInList(list2)
+	if len(a) != len(b) {
+		return false
+	}
+	for _, x := range a {
+		if !StrInList(x, b) {
+			return false
+		}
+	}
+	return true
+}
+
+// StrMapEq returns true if the two maps contain the same keys and values.
+func StrMapEq(m1, m2 map[string]string) bool {
+	if len(m1) != len(m2) {
+		return false
+	}
+	for k, v := range m1 {
+		if x, exists := m2[k]; !exists || x != v {
+			return false
+		}
+	}
+	return true
+}
+
 // ReverseStringList reverses a list of strings.
 func ReverseStringList(in []string) []string {
 	var out []string // empty list
@@ -336,6 +365,23 @@ func FlattenListWithSplit(input []string, split []string) []string {
 	return out
 }
 
+// MergeEnv returns the environment, which is a list of key=value strings, with
+// the variables added to it. The keys which are already set are removed first,
+// since the old versions of golang pass the duplicates to the process, and the
+// first one is the one that it gets.
+func MergeEnv(env []string, vars map[string]string) []string {
+	result := []string{}
+	for _, x := range env {
+		if _, exists := vars[strings.SplitN(x, "=", 2)[0]]; !exists {
+			result = append(result, x)
+		}
+	}
+	for _, k := range StrMapKeys(vars) {
+		result = append(result, k+"="+vars[k])
+	}
+	return result
+}
+
 // TimeAfterOrBlock is aspecial version of time.After that blocks when given a
 // negative integer. When used in a case statement, the timer restarts on each
 // select call to it.
@@ -364,3 +410,21 @@ func SystemBusPrivateUsable() (conn *dbus.Conn, err error) {
 	}
 	return conn, nil // success
 }
+
+// SessionBusPrivateUsable makes using the private session bus usable, like the
+// private system bus.
+func SessionBusPrivateUsable() (conn *dbus.Conn, err error) {
+	conn, err = dbus.SessionBusPrivate()
+	if err != nil {
+		return nil, err
+	}
+	if err = conn.Auth(nil); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err = conn.Hello(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil // success
+}
@@ -791,3 +791,91 @@ func TestUtilFlattenListWithSplit1(t *testing.T) {
 		}
 	}
 }
+
+func TestUtilSemaphore1(t *testing.T) {
+	sema := NewSemaphore(2)
+	if s := sema.Size(); s != 2 {
+		t.Errorf("Semaphore size expected: %d; got: %d.", 2, s)
+	}
+	sema.P(2) // this must not block
+	if l := len(sema.C); l != 2 {
+		t.Errorf("Semaphore usage expected: %d; got: %d.", 2, l)
+	}
+	select {
+	case sema.C <- struct{}{}:
+		t.Errorf("Semaphore should be full!")
+	default:
+	}
+	sema.V(1)
+	sema.P(1) // a slot was freed, so this must not block either
+	sema.V(2)
+	if l := len(sema.C); l != 0 {
+		t.Errorf("Semaphore usage expected: %d; got: %d.", 0, l)
+	}
+}
+
+func TestUtilUnifiedDiff1(t *testing.T) {
+	if out, err := UnifiedDiff("a\nb\n", "a\nb\n", "old", "new"); err != nil || out != "" {
+		t.Errorf("UnifiedDiff expected no diff; got: %q, %v.", out, err)
+	}
+
+	{
+		a := "1\n2\n3\n4\n5\n6\n7\n8\n9\n"
+		b := "1\n2\n3\n4\nfive\n6\n7\n8\n9\n"
+		ex := "--- old\n+++ new\n@@ -2,7 +2,7 @@\n 2\n 3\n 4\n-5\n+five\n 6\n 7\n 8\n"
+		out, err := UnifiedDiff(a, b, "old", "new")
+		if err != nil || out != ex {
+			t.Errorf("UnifiedDiff expected: %q; got: %q, %v.", ex, out, err)
+		}
+	}
+
+	{
+		ex := "--- old\n+++ new\n@@ -0,0 +1,1 @@\n+hello\n\\ No newline at end of file\n"
+		out, err := UnifiedDiff("", "hello", "old", "new")
+		if err != nil || out != ex {
+			t.Errorf("UnifiedDiff expected: %q; got: %q, %v.", ex, out, err)
+		}
+	}
+}
+
+func TestUtilStrSetEq1(t *testing.T) {
+	if !StrSetEq([]string{"a", "b"}, []string{"b", "a", "b"}) {
+		t.Errorf("StrSetEq expected the lists to be equal.")
+	}
+	if !StrSetEq([]string{}, nil) {
+		t.Errorf("StrSetEq expected the empty lists to be equal.")
+	}
+	if StrSetEq([]string{"a", "b"}, []string{"a", "c"}) {
+		t.Errorf("StrSetEq expected the lists to differ.")
+	}
+	if StrSetEq([]string{"a"}, []string{"a", "b"}) {
+		t.Errorf("StrSetEq expected the lists to differ.")
+	}
+}
+
+func TestUtilStrMapEq1(t *testing.T) {
+	if !StrMapEq(map[string]string{"a": "1", "b": "2"}, map[string]string{"b": "2", "a": "1"}) {
+		t.Errorf("StrMapEq expected the maps to be equal.")
+	}
+	if !StrMapEq(map[string]string{}, nil) {
+		t.Errorf("StrMapEq expected the empty maps to be equal.")
+	}
+	if StrMapEq(map[string]string{"a": "1"}, map[string]string{"a": "2"}) {
+		t.Errorf("StrMapEq expected the maps to differ.")
+	}
+	if StrMapEq(map[string]string{"a": ""}, map[string]string{"b": ""}) {
+		t.Errorf("StrMapEq expected the maps to differ.")
+	}
+}
+
+func TestUtilMergeEnv1(t *testing.T) {
+	env := []string{"HOME=/root", "PATH=/bin", "LC_ALL=fr_FR.UTF-8", "EMPTY="}
+	vars := map[string]string{"PATH": "/usr/bin:/bin", "LC_ALL": "C", "NEW": "a=b"}
+	expected := []string{"HOME=/root", "EMPTY=", "LC_ALL=C", "NEW=a=b", "PATH=/usr/bin:/bin"}
+	if out := MergeEnv(env, vars); !reflect.DeepEqual(out, expected) {
+		t.Errorf("MergeEnv returned: %v, expected: %v", out, expected)
+	}
+	if out := MergeEnv(env, nil); !reflect.DeepEqual(out, env) {
+		t.Errorf("MergeEnv changed the env: %v", out)
+	}
+}